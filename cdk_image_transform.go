@@ -10,6 +10,7 @@ import (
 	lambdaevent "github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
 	s3n "github.com/aws/aws-cdk-go/awscdk/v2/awss3notifications"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssns"
 	awssnssub "github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
@@ -59,6 +60,21 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		PartitionKey:  &awsdynamodb.Attribute{Name: jsii.String("pk"), Type: awsdynamodb.AttributeType_STRING},
 		SortKey:       &awsdynamodb.Attribute{Name: jsii.String("sk"), Type: awsdynamodb.AttributeType_STRING},
 		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+		// expires the quota counters and the uploads of the jobs, the removed
+		// upload expiries are read from the stream by the expire jobs lambda
+		TimeToLiveAttribute: jsii.String("ExpiresAt"),
+		Stream:              awsdynamodb.StreamViewType_OLD_IMAGE,
+	})
+
+	// the keys signing the job tokens, see the README to rotate them
+	jobTokenKeyset := awssecretsmanager.NewSecret(stack, jsii.String("JobTokenKeyset"), &awssecretsmanager.SecretProps{
+		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+			SecretStringTemplate: jsii.String(`{"current":"k1"}`),
+			GenerateStringKey:    jsii.String("k1"),
+			PasswordLength:       jsii.Number(64),
+			ExcludePunctuation:   jsii.Bool(true),
+		},
 	})
 
 	bundlingOptions := &awslambdago.BundlingOptions{
@@ -69,13 +85,33 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 
 	// create the SQS queue
 	uploadQueue := awssqs.NewQueue(stack, jsii.String("BucketUploadQueue"), &awssqs.QueueProps{
+		// the claims of the jobs are leased for as long, see function/transformimage/idempotency.go
 		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number(300)),
+		// transient failures are retried with a backoff, see function/transformimage/retry.go
 		DeadLetterQueue: &awssqs.DeadLetterQueue{
-			MaxReceiveCount: jsii.Number(1),
+			MaxReceiveCount: jsii.Number(5),
 			Queue:           dlq,
 		},
 	})
 
+	// the lifecycle events of the jobs, other services subscribe with a filter policy on the type attribute
+	jobEventsTopic := awssns.NewTopic(stack, jsii.String("JobEventsTopic"), nil)
+
+	awscdk.NewCfnOutput(stack, jsii.String("JobEventsTopicArn"), &awscdk.CfnOutputProps{
+		Value: jobEventsTopic.TopicArn(),
+	})
+
+	// the completion webhooks, a delivery is attempted 8 times before it is dropped in the DLQ
+	notifyDLQ := awssqs.NewQueue(stack, jsii.String("NotifyQueueDLQ"), nil)
+
+	notifyQueue := awssqs.NewQueue(stack, jsii.String("NotifyQueue"), &awssqs.QueueProps{
+		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number(60)),
+		DeadLetterQueue: &awssqs.DeadLetterQueue{
+			MaxReceiveCount: jsii.Number(8),
+			Queue:           notifyDLQ,
+		},
+	})
+
 	// generate url lambda
 	generateUrlLambda := awslambdago.NewGoFunction(stack, jsii.String("GenerateUrlLambda"), &awslambdago.GoFunctionProps{
 		Architecture: lambda.Architecture_X86_64(),
@@ -85,21 +121,42 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		Timeout:      awscdk.Duration_Seconds(jsii.Number(10)),
 		Entry:        jsii.String("function/getpresigned"),
 		Environment: &map[string]*string{
-			"AUTH_TABLE_NAME":   authTable.TableName(),
-			"INPUT_BUCKET_NAME": inputBucket.BucketName(),
+			"AUTH_TABLE_NAME":      authTable.TableName(),
+			"INPUT_BUCKET_NAME":    inputBucket.BucketName(),
+			"PIPELINE_COST_BUDGET": jsii.String("400"), // megapixel steps
+			"JOB_TOKEN_SECRET_ARN": jobTokenKeyset.SecretArn(),
+			"UPLOAD_QUEUE_URL":     uploadQueue.QueueUrl(),
+			"JOB_EVENTS_TOPIC_ARN": jobEventsTopic.TopicArn(),
 		},
 	})
 
 	generateUrlLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
 		Actions: &[]*string{
 			jsii.String("s3:PutObject"),
+			jsii.String("s3:GetObject"),
 		},
 		Resources: &[]*string{
 			inputBucket.ArnForObjects(jsii.String("*")),
 		},
 	}))
 
-	authTable.GrantWriteData(generateUrlLambda)
+	// reprocessing heads the upload, which must answer 404 once it expired
+	generateUrlLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
+		Actions: &[]*string{
+			jsii.String("s3:ListBucket"),
+		},
+		Resources: &[]*string{
+			inputBucket.BucketArn(),
+		},
+	}))
+
+	// reprocessing enqueues the upload again
+	uploadQueue.GrantSendMessages(generateUrlLambda)
+	jobEventsTopic.GrantPublish(generateUrlLambda)
+
+	// reads the limits of the tenant and updates its quota counters
+	authTable.GrantReadWriteData(generateUrlLambda)
+	jobTokenKeyset.GrantRead(generateUrlLambda, nil)
 
 	// create image transform lambda
 	transformImageLambda := awslambdago.NewGoFunction(stack, jsii.String("TransformImageLambda"), &awslambdago.GoFunctionProps{
@@ -110,12 +167,22 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		Timeout:      awscdk.Duration_Seconds(jsii.Number(300)),
 		Entry:        jsii.String("function/transformimage"),
 		Environment: &map[string]*string{
-			"INPUT_BUCKET_NAME":  inputBucket.BucketName(),
-			"OUTPUT_BUCKET_NAME": outputBucket.BucketName(),
-			"AUTH_TABLE_NAME":    authTable.TableName(),
+			"INPUT_BUCKET_NAME":    inputBucket.BucketName(),
+			"OUTPUT_BUCKET_NAME":   outputBucket.BucketName(),
+			"AUTH_TABLE_NAME":      authTable.TableName(),
+			"OVERSIZE_POLICY":      jsii.String("downsample"), // or reject
+			"UPLOAD_QUEUE_URL":     uploadQueue.QueueUrl(),
+			"NOTIFY_QUEUE_URL":     notifyQueue.QueueUrl(),
+			"JOB_EVENTS_TOPIC_ARN": jobEventsTopic.TopicArn(),
 		},
 	})
 
+	notifyQueue.GrantSendMessages(transformImageLambda)
+	jobEventsTopic.GrantPublish(transformImageLambda)
+
+	// delays the retries of the failed messages
+	uploadQueue.Grant(transformImageLambda, jsii.String("sqs:ChangeMessageVisibility"))
+
 	transformImageLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
 		Actions: &[]*string{
 			jsii.String("s3:GetObject"),
@@ -127,6 +194,16 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		},
 	}))
 
+	// so that heading an output not written yet answers 404 rather than 403
+	transformImageLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
+		Actions: &[]*string{
+			jsii.String("s3:ListBucket"),
+		},
+		Resources: &[]*string{
+			outputBucket.BucketArn(),
+		},
+	}))
+
 	authTable.GrantReadWriteData(transformImageLambda)
 
 	accessObjectLambda := awslambdago.NewGoFunction(stack, jsii.String("AccessObjectLambda"), &awslambdago.GoFunctionProps{
@@ -151,7 +228,7 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		},
 	}))
 
-	authTable.GrantReadData(accessObjectLambda)
+	authTable.GrantReadWriteData(accessObjectLambda)
 
 	dlqLambda := awslambdago.NewGoFunction(stack, jsii.String("DLQLambda"), &awslambdago.GoFunctionProps{
 		Architecture: lambda.Architecture_X86_64(),
@@ -161,11 +238,16 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		Timeout:      awscdk.Duration_Seconds(jsii.Number(10)),
 		Entry:        jsii.String("function/dlq"),
 		Environment: &map[string]*string{
-			"INPUT_BUCKET_NAME": inputBucket.BucketName(),
-			"AUTH_TABLE_NAME":   authTable.TableName(),
+			"INPUT_BUCKET_NAME":    inputBucket.BucketName(),
+			"AUTH_TABLE_NAME":      authTable.TableName(),
+			"NOTIFY_QUEUE_URL":     notifyQueue.QueueUrl(),
+			"JOB_EVENTS_TOPIC_ARN": jobEventsTopic.TopicArn(),
 		},
 	})
 
+	notifyQueue.GrantSendMessages(dlqLambda)
+	jobEventsTopic.GrantPublish(dlqLambda)
+
 	dlqLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
 		Actions: &[]*string{
 			jsii.String("s3:GetObject"),
@@ -179,11 +261,67 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 	}))
 
 	dlqLambda.AddEventSource(awslambdaeventsources.NewSqsEventSource(dlq, &awslambdaeventsources.SqsEventSourceProps{
-		BatchSize: jsii.Number(10),
+		BatchSize:               jsii.Number(10),
+		ReportBatchItemFailures: jsii.Bool(true),
 	}))
 
 	authTable.GrantReadWriteData(dlqLambda)
 
+	notifierLambda := awslambdago.NewGoFunction(stack, jsii.String("NotifierLambda"), &awslambdago.GoFunctionProps{
+		Architecture: lambda.Architecture_X86_64(),
+		Runtime:      lambda.Runtime_PROVIDED_AL2(),
+		Bundling:     bundlingOptions,
+		MemorySize:   jsii.Number(128),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(60)),
+		Entry:        jsii.String("function/notifier"),
+		Environment: &map[string]*string{
+			"AUTH_TABLE_NAME":  authTable.TableName(),
+			"NOTIFY_QUEUE_URL": notifyQueue.QueueUrl(),
+		},
+	})
+
+	notifierLambda.AddEventSource(awslambdaeventsources.NewSqsEventSource(notifyQueue, &awslambdaeventsources.SqsEventSourceProps{
+		BatchSize:               jsii.Number(5),
+		ReportBatchItemFailures: jsii.Bool(true),
+	}))
+
+	// records the delivery attempts and delays the retries
+	authTable.GrantReadWriteData(notifierLambda)
+	notifyQueue.Grant(notifierLambda, jsii.String("sqs:ChangeMessageVisibility"))
+
+	expireJobsLambda := awslambdago.NewGoFunction(stack, jsii.String("ExpireJobsLambda"), &awslambdago.GoFunctionProps{
+		Architecture: lambda.Architecture_X86_64(),
+		Runtime:      lambda.Runtime_PROVIDED_AL2(),
+		Bundling:     bundlingOptions,
+		MemorySize:   jsii.Number(128),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(30)),
+		Entry:        jsii.String("function/expirejobs"),
+		Environment: &map[string]*string{
+			"AUTH_TABLE_NAME": authTable.TableName(),
+		},
+	})
+
+	// only the upload expiries removed by the time to live, see job.UploadExpirySk
+	expireJobsLambda.AddEventSource(awslambdaeventsources.NewDynamoEventSource(authTable, &awslambdaeventsources.DynamoEventSourceProps{
+		StartingPosition:        lambda.StartingPosition_TRIM_HORIZON,
+		BatchSize:               jsii.Number(25),
+		ReportBatchItemFailures: jsii.Bool(true),
+		RetryAttempts:           jsii.Number(10),
+		Filters: &[]*map[string]interface{}{
+			lambda.FilterCriteria_Filter(&map[string]interface{}{
+				"eventName": lambda.FilterRule_IsEqual(jsii.String("REMOVE")),
+				"dynamodb": map[string]interface{}{
+					"OldImage": map[string]interface{}{
+						"sk": map[string]interface{}{"S": lambda.FilterRule_IsEqual(jsii.String("upload-expiry"))},
+					},
+				},
+			}),
+		},
+	}))
+
+	// expires the jobs and refunds their quota
+	authTable.GrantReadWriteData(expireJobsLambda)
+
 	authorizeAccessLambda := awslambdago.NewGoFunction(stack, jsii.String("AuthorizeAccessLambda"), &awslambdago.GoFunctionProps{
 		Architecture: lambda.Architecture_X86_64(),
 		Runtime:      lambda.Runtime_PROVIDED_AL2(),
@@ -192,11 +330,83 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		Timeout:      awscdk.Duration_Seconds(jsii.Number(10)),
 		Entry:        jsii.String("function/authorizeaccess"),
 		Environment: &map[string]*string{
-			"AUTH_TABLE_NAME": authTable.TableName(),
+			"AUTH_TABLE_NAME":      authTable.TableName(),
+			"JOB_TOKEN_SECRET_ARN": jobTokenKeyset.SecretArn(),
 		},
 	})
 
 	authTable.GrantReadData(authorizeAccessLambda)
+	jobTokenKeyset.GrantRead(authorizeAccessLambda, nil)
+
+	listTransformsLambda := awslambdago.NewGoFunction(stack, jsii.String("ListTransformsLambda"), &awslambdago.GoFunctionProps{
+		Architecture: lambda.Architecture_X86_64(),
+		Runtime:      lambda.Runtime_PROVIDED_AL2(),
+		Bundling:     bundlingOptions,
+		MemorySize:   jsii.Number(128),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(10)),
+		Entry:        jsii.String("function/listtransforms"),
+	})
+
+	tenantLimitsLambda := awslambdago.NewGoFunction(stack, jsii.String("TenantLimitsLambda"), &awslambdago.GoFunctionProps{
+		Architecture: lambda.Architecture_X86_64(),
+		Runtime:      lambda.Runtime_PROVIDED_AL2(),
+		Bundling:     bundlingOptions,
+		MemorySize:   jsii.Number(128),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(10)),
+		Entry:        jsii.String("function/tenantlimits"),
+		Environment: &map[string]*string{
+			"AUTH_TABLE_NAME": authTable.TableName(),
+		},
+	})
+
+	authTable.GrantReadWriteData(tenantLimitsLambda)
+
+	transformOnDemandLambda := awslambdago.NewGoFunction(stack, jsii.String("TransformOnDemandLambda"), &awslambdago.GoFunctionProps{
+		Architecture: lambda.Architecture_X86_64(),
+		Runtime:      lambda.Runtime_PROVIDED_AL2(),
+		Bundling:     bundlingOptions,
+		MemorySize:   jsii.Number(1024),
+		Timeout:      awscdk.Duration_Seconds(jsii.Number(29)), // the api gateway integration timeout
+		Entry:        jsii.String("function/transformondemand"),
+		Environment: &map[string]*string{
+			"INPUT_BUCKET_NAME":    inputBucket.BucketName(),
+			"OUTPUT_BUCKET_NAME":   outputBucket.BucketName(),
+			"AUTH_TABLE_NAME":      authTable.TableName(),
+			"PIPELINE_COST_BUDGET": jsii.String("400"), // megapixel steps
+		},
+	})
+
+	transformOnDemandLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
+		Actions: &[]*string{
+			jsii.String("s3:GetObject"),
+		},
+		Resources: &[]*string{
+			inputBucket.ArnForObjects(jsii.String("*")),
+			outputBucket.ArnForObjects(jsii.String("*")),
+		},
+	}))
+
+	transformOnDemandLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
+		Actions: &[]*string{
+			jsii.String("s3:PutObject"),
+		},
+		Resources: &[]*string{
+			outputBucket.ArnForObjects(jsii.String("cache/*")),
+		},
+	}))
+
+	// without ListBucket a missing cache entry is reported as 403 instead of 404
+	transformOnDemandLambda.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
+		Actions: &[]*string{
+			jsii.String("s3:ListBucket"),
+		},
+		Resources: &[]*string{
+			inputBucket.BucketArn(),
+			outputBucket.BucketArn(),
+		},
+	}))
+
+	authTable.GrantReadData(transformOnDemandLambda)
 
 	sqsSubscription := awssnssub.NewSqsSubscription(uploadQueue, &awssnssub.SqsSubscriptionProps{
 		RawMessageDelivery: jsii.Bool(true),
@@ -215,14 +425,49 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		BatchSize:      jsii.Number(10),
 		Enabled:        jsii.Bool(true),
 		MaxConcurrency: jsii.Number(10),
+		// only the failed messages of a batch are retried
+		ReportBatchItemFailures: jsii.Bool(true),
 	})
 
 	transformImageLambda.AddEventSource(invokeEventSource)
 
+	// every route requires the API key of a tenant, the object routes also require a job token
+	apiKeyAuth := awsapigateway.NewRequestAuthorizer(stack, jsii.String("apikeyauthapi"), &awsapigateway.RequestAuthorizerProps{
+		Handler: authorizeAccessLambda,
+		IdentitySources: &[]*string{
+			awsapigateway.IdentitySource_Header(jsii.String("X-Api-Key")),
+		},
+	})
+
+	// the source ip is part of the cache key of the authorizers checking job
+	// tokens, an allow cached for a token bound to an ip isn't replayed from
+	// another address
 	auth := awsapigateway.NewRequestAuthorizer(stack, jsii.String("authapi"), &awsapigateway.RequestAuthorizerProps{
 		Handler: authorizeAccessLambda,
 		IdentitySources: &[]*string{
+			awsapigateway.IdentitySource_Header(jsii.String("X-Api-Key")),
+			awsapigateway.IdentitySource_Header(jsii.String("Authorization")),
 			awsapigateway.IdentitySource_QueryString(jsii.String("object-name")),
+			awsapigateway.IdentitySource_Context(jsii.String("identity.sourceIp")),
+		},
+	})
+
+	// path parameters can't be identity sources, the whole path is used instead
+	imgAuth := awsapigateway.NewRequestAuthorizer(stack, jsii.String("imgauthapi"), &awsapigateway.RequestAuthorizerProps{
+		Handler: authorizeAccessLambda,
+		IdentitySources: &[]*string{
+			awsapigateway.IdentitySource_Header(jsii.String("X-Api-Key")),
+			awsapigateway.IdentitySource_Header(jsii.String("Authorization")),
+			awsapigateway.IdentitySource_Context(jsii.String("path")),
+			awsapigateway.IdentitySource_Context(jsii.String("identity.sourceIp")),
+		},
+	})
+
+	// a separate cache, the policies of the admin routes depend on the tenant being an admin
+	adminAuth := awsapigateway.NewRequestAuthorizer(stack, jsii.String("adminauthapi"), &awsapigateway.RequestAuthorizerProps{
+		Handler: authorizeAccessLambda,
+		IdentitySources: &[]*string{
+			awsapigateway.IdentitySource_Header(jsii.String("X-Api-Key")),
 		},
 	})
 
@@ -238,6 +483,23 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		},
 	})
 
+	// the errors of API Gateway itself, such as the denials of the authorizers,
+	// use the error envelope of the lambdas, see package apierror
+	for id, responseType := range map[string]awsapigateway.ResponseType{
+		"Default4XX": awsapigateway.ResponseType_DEFAULT_4XX(),
+		"Default5XX": awsapigateway.ResponseType_DEFAULT_5XX(),
+	} {
+		api.AddGatewayResponse(jsii.String(id), &awsapigateway.GatewayResponseOptions{
+			Type: responseType,
+			ResponseHeaders: &map[string]*string{
+				"X-Request-Id": jsii.String("context.requestId"),
+			},
+			Templates: &map[string]*string{
+				"application/json": jsii.String(`{"errors":[{"message":$context.error.messageString}],"requestId":"$context.requestId"}`),
+			},
+		})
+	}
+
 	response := awsapigateway.MethodResponse{
 		StatusCode:     jsii.String("200"),
 		ResponseModels: &map[string]awsapigateway.IModel{"application/json": awsapigateway.Model_EMPTY_MODEL()},
@@ -247,7 +509,8 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 
 	generateUrlResource := api.Root().AddResource(jsii.String("generate-url"), nil)
 	postmethod := generateUrlResource.AddMethod(jsii.String("POST"), generateUrlIntegration, &awsapigateway.MethodOptions{
-		AuthorizationType: awsapigateway.AuthorizationType_NONE,
+		AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+		Authorizer:        apiKeyAuth,
 	})
 	postmethod.AddMethodResponse(&response)
 
@@ -259,6 +522,47 @@ func NewCdkImageTransformStack(scope constructs.Construct, id string, props *Cdk
 		Authorizer:        auth,
 	})
 	getmethod.AddMethodResponse(&response)
+
+	listTransformsIntegration := awsapigateway.NewLambdaIntegration(listTransformsLambda, nil)
+
+	listTransformsResource := api.Root().AddResource(jsii.String("transforms"), nil)
+	listmethod := listTransformsResource.AddMethod(jsii.String("GET"), listTransformsIntegration, &awsapigateway.MethodOptions{
+		AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+		Authorizer:        apiKeyAuth,
+	})
+	listmethod.AddMethodResponse(&response)
+
+	transformOnDemandIntegration := awsapigateway.NewLambdaIntegration(transformOnDemandLambda, nil)
+
+	imgResource := api.Root().AddResource(jsii.String("img"), nil).AddResource(jsii.String("{key}"), nil)
+	imgmethod := imgResource.AddMethod(jsii.String("GET"), transformOnDemandIntegration, &awsapigateway.MethodOptions{
+		AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+		Authorizer:        imgAuth,
+	})
+	imgmethod.AddMethodResponse(&awsapigateway.MethodResponse{
+		StatusCode: jsii.String("302"),
+	})
+
+	jobResource := api.Root().AddResource(jsii.String("jobs"), nil).AddResource(jsii.String("{id}"), nil)
+	reprocessResource := jobResource.AddResource(jsii.String("reprocess"), nil)
+	reprocessmethod := reprocessResource.AddMethod(jsii.String("POST"), generateUrlIntegration, &awsapigateway.MethodOptions{
+		AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+		Authorizer:        imgAuth,
+	})
+	reprocessmethod.AddMethodResponse(&awsapigateway.MethodResponse{
+		StatusCode: jsii.String("202"),
+	})
+
+	tenantLimitsIntegration := awsapigateway.NewLambdaIntegration(tenantLimitsLambda, nil)
+
+	limitsResource := api.Root().AddResource(jsii.String("admin"), nil).AddResource(jsii.String("tenants"), nil).AddResource(jsii.String("{tenantId}"), nil).AddResource(jsii.String("limits"), nil)
+	for _, method := range []string{"GET", "PUT"} {
+		limitsmethod := limitsResource.AddMethod(jsii.String(method), tenantLimitsIntegration, &awsapigateway.MethodOptions{
+			AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+			Authorizer:        adminAuth,
+		})
+		limitsmethod.AddMethodResponse(&response)
+	}
 	
 	return stack
 }
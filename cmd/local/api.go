@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// route is a method of a resource of the rest api, authorized by a request
+// authorizer with the given identity sources.
+type route struct {
+	method     string
+	resource   string
+	function   *function
+	authorizer *function
+	identity   []string // headers, or query strings prefixed with "?"
+}
+
+// api serves the routes of the rest api as its lambda proxy integrations do.
+// Authorizer results aren't cached.
+type api struct {
+	routes []route
+	stage  string
+}
+
+// matchResource returns the path parameters of the path if it matches the resource.
+func matchResource(resource, requestPath string) (map[string]string, bool) {
+
+	resourceParts := strings.Split(strings.Trim(resource, "/"), "/")
+	pathParts := strings.Split(strings.Trim(requestPath, "/"), "/")
+	if len(resourceParts) != len(pathParts) {
+		return nil, false
+	}
+	parameters := map[string]string{}
+	for i, part := range resourceParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			parameters[strings.Trim(part, "{}")] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return parameters, true
+}
+
+// matchArn matches an arn against a resource of a policy, which may contain
+// the wildcards * and ?.
+func matchArn(pattern, arn string) bool {
+
+	matched, err := path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(arn, "/", "\x00"))
+	return err == nil && matched
+}
+
+// allowed evaluates the policy of an authorizer, an explicit deny winning.
+func allowed(policy events.APIGatewayCustomAuthorizerPolicy, methodArn string) bool {
+
+	allow := false
+	for _, statement := range policy.Statement {
+		for _, resource := range statement.Resource {
+			if !matchArn(resource, methodArn) {
+				continue
+			}
+			if strings.EqualFold(statement.Effect, "Deny") {
+				return false
+			}
+			allow = allow || strings.EqualFold(statement.Effect, "Allow")
+		}
+	}
+	return allow
+}
+
+// writeGatewayError answers like the gateway responses of the stack, with the
+// error envelope of the lambdas.
+func writeGatewayError(w http.ResponseWriter, status int, message, requestId string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(apierror.RequestIdHeader, requestId)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apierror.Envelope{Errors: []transforms.ValidationError{{Message: message}}, RequestId: requestId})
+}
+
+func singleValues(values map[string][]string) map[string]string {
+
+	single := map[string]string{}
+	for name, value := range values {
+		single[name] = value[len(value)-1]
+	}
+	return single
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	requestId := randomId()
+	var r *route
+	var pathParameters map[string]string
+	for i := range a.routes {
+		if parameters, ok := matchResource(a.routes[i].resource, req.URL.Path); ok && a.routes[i].method == req.Method {
+			r, pathParameters = &a.routes[i], parameters
+			break
+		}
+	}
+	if r == nil {
+		// as API Gateway answers any unknown route
+		writeGatewayError(w, http.StatusForbidden, "Missing Authentication Token", requestId)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, err.Error(), requestId)
+		return
+	}
+
+	sourceIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	headers := singleValues(req.Header)
+	query := singleValues(req.URL.Query())
+	if len(query) == 0 {
+		query = nil
+	}
+	if len(pathParameters) == 0 {
+		pathParameters = nil
+	}
+	methodArn := fmt.Sprintf("arn:aws:execute-api:%s:%s:local/%s/%s%s", region, accountId, a.stage, req.Method, req.URL.Path)
+
+	// a missing identity source is rejected without calling the authorizer
+	for _, source := range r.identity {
+		if name, ok := strings.CutPrefix(source, "?"); ok && query[name] == "" || !ok && req.Header.Get(source) == "" {
+			writeGatewayError(w, http.StatusUnauthorized, "Unauthorized", requestId)
+			return
+		}
+	}
+
+	identity := events.APIGatewayRequestIdentity{SourceIP: sourceIP, UserAgent: req.UserAgent()}
+	payload, err := r.authorizer.invoke(req.Context(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type:                  "REQUEST",
+		MethodArn:             methodArn,
+		Resource:              r.resource,
+		Path:                  req.URL.Path,
+		HTTPMethod:            req.Method,
+		Headers:               headers,
+		MultiValueHeaders:     req.Header,
+		QueryStringParameters: query,
+		PathParameters:        pathParameters,
+		RequestContext: events.APIGatewayCustomAuthorizerRequestTypeRequestContext{
+			AccountID:    accountId,
+			ResourcePath: r.resource,
+			Stage:        a.stage,
+			RequestID:    requestId,
+			Identity:     events.APIGatewayCustomAuthorizerRequestTypeRequestIdentity{SourceIP: sourceIP},
+			HTTPMethod:   req.Method,
+			APIID:        "local",
+		},
+	}, 30*time.Second)
+	if err != nil {
+		fmt.Printf("[api] %s %s: authorizer failed: %v\n", req.Method, req.URL.Path, err)
+		if e, ok := err.(functionError); ok && e.Message == "Unauthorized" {
+			writeGatewayError(w, http.StatusUnauthorized, "Unauthorized", requestId)
+		} else {
+			writeGatewayError(w, http.StatusInternalServerError, "null", requestId)
+		}
+		return
+	}
+	var authorization events.APIGatewayCustomAuthorizerResponse
+	if err := json.Unmarshal(payload, &authorization); err != nil || !allowed(authorization.PolicyDocument, methodArn) {
+		writeGatewayError(w, http.StatusForbidden, "User is not authorized to access this resource with an explicit deny", requestId)
+		return
+	}
+	authorizer := map[string]interface{}{"principalId": authorization.PrincipalID}
+	for name, value := range authorization.Context {
+		authorizer[name] = value
+	}
+
+	payload, err = r.function.invoke(req.Context(), events.APIGatewayProxyRequest{
+		Resource:                        r.resource,
+		Path:                            req.URL.Path,
+		HTTPMethod:                      req.Method,
+		Headers:                         headers,
+		MultiValueHeaders:               req.Header,
+		QueryStringParameters:           query,
+		MultiValueQueryStringParameters: req.URL.Query(),
+		PathParameters:                  pathParameters,
+		Body:                            string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			AccountID:    accountId,
+			ResourcePath: r.resource,
+			Stage:        a.stage,
+			RequestID:    requestId,
+			Identity:     identity,
+			HTTPMethod:   req.Method,
+			APIID:        "local",
+			Authorizer:   authorizer,
+			Path:         "/" + a.stage + req.URL.Path,
+		},
+	}, 29*time.Second) // the integration timeout of API Gateway
+	var response events.APIGatewayProxyResponse
+	if err == nil {
+		err = json.Unmarshal(payload, &response)
+	}
+	if err != nil {
+		fmt.Printf("[api] %s %s: %s failed: %v\n", req.Method, req.URL.Path, r.function.name, err)
+		writeGatewayError(w, http.StatusBadGateway, "Internal server error", requestId)
+		return
+	}
+
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
+	fmt.Printf("[api] %s %s %d\n", req.Method, req.URL.Path, response.StatusCode)
+	w.WriteHeader(response.StatusCode)
+	if response.IsBase64Encoded {
+		decoded, _ := base64.StdEncoding.DecodeString(response.Body)
+		w.Write(decoded)
+		return
+	}
+	io.WriteString(w, response.Body)
+}
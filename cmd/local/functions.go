@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// function is a lambda built from function/<name> and run in the RPC mode of
+// aws-lambda-go, the mode of the go1.x runtime, one invocation at a time.
+type function struct {
+	name   string
+	binary string
+	env    map[string]string
+	memory int
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	client *rpc.Client
+}
+
+// buildFunctions builds the lambdas into dir.
+func buildFunctions(dir string, functions ...*function) error {
+
+	for _, f := range functions {
+		f.binary = filepath.Join(dir, f.name)
+		build := exec.Command("go", "build", "-o", f.binary, "./function/"+f.name)
+		build.Stdout, build.Stderr = os.Stdout, os.Stderr
+		if err := build.Run(); err != nil {
+			return fmt.Errorf("failed to build %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// freePort returns a port nothing listens on.
+func freePort() (string, error) {
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	return port, err
+}
+
+// prefixOutput copies the output of the function, a line at a time, prefixed
+// with its name.
+func (f *function) prefixOutput(r io.Reader) {
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fmt.Printf("[%s] %s\n", f.name, scanner.Text())
+	}
+}
+
+// start runs the function, it must be called with the lock held.
+func (f *function) start() error {
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(f.binary)
+	cmd.Env = append(os.Environ(),
+		"_LAMBDA_SERVER_PORT="+port,
+		"AWS_ENDPOINT_URL=http://"+awsAddr,
+		"AWS_REGION="+region,
+		"AWS_ACCESS_KEY_ID=local",
+		"AWS_SECRET_ACCESS_KEY=local",
+		"AWS_SESSION_TOKEN=",
+		"AWS_PROFILE=",
+		// the shared config of the machine mustn't point the lambdas at AWS
+		"AWS_CONFIG_FILE="+os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE="+os.DevNull,
+		"AWS_LAMBDA_FUNCTION_NAME="+f.name,
+		fmt.Sprintf("AWS_LAMBDA_FUNCTION_MEMORY_SIZE=%d", f.memory),
+	)
+	for name, value := range f.env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", f.name, err)
+	}
+	go f.prefixOutput(stdout)
+
+	// the function listens once its init is done
+	for wait := 0; ; wait++ {
+		client, err := rpc.Dial("tcp", "localhost:"+port)
+		if err == nil {
+			f.cmd, f.client = cmd, client
+			return nil
+		}
+		if wait == 100 {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("%s isn't listening on port %s: %v", f.name, port, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stop kills the function, it is started again by its next invocation.
+func (f *function) stop() {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kill()
+}
+
+func (f *function) kill() {
+
+	if f.cmd == nil {
+		return
+	}
+	f.client.Close()
+	f.cmd.Process.Kill()
+	f.cmd.Wait()
+	f.cmd, f.client = nil, nil
+}
+
+// functionError is the error returned by the handler of a function.
+type functionError struct {
+	*messages.InvokeResponse_Error
+}
+
+func (e functionError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+// invoke calls the function with the event and returns its response.
+func (f *function) invoke(ctx context.Context, event any, timeout time.Duration) ([]byte, error) {
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cmd == nil {
+		if err := f.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	request := messages.InvokeRequest{
+		Payload:            payload,
+		RequestId:          randomId(),
+		Deadline:           messages.InvokeRequest_Timestamp{Seconds: deadline.Unix(), Nanos: int64(deadline.Nanosecond())},
+		InvokedFunctionArn: "arn:aws:lambda:" + region + ":" + accountId + ":function:" + f.name,
+	}
+	var response messages.InvokeResponse
+	call := f.client.Go("Function.Invoke", request, &response, nil)
+	select {
+	case <-call.Done:
+	case <-time.After(time.Until(deadline)):
+		f.kill()
+		return nil, fmt.Errorf("%s timed out after %s", f.name, timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if call.Error != nil {
+		// the process died, it is restarted on the next invocation
+		f.kill()
+		return nil, fmt.Errorf("failed to invoke %s: %v", f.name, call.Error)
+	}
+	if response.Error != nil {
+		if response.Error.ShouldExit {
+			f.kill()
+		}
+		return nil, functionError{response.Error}
+	}
+	return response.Payload, nil
+}
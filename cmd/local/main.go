@@ -0,0 +1,267 @@
+// Command local runs the API and the upload pipeline on this machine, with
+// in-memory stand-ins for S3, DynamoDB, SQS, SNS and Secrets Manager, so that
+// whole upload-to-download flows run without deploying the stack.
+//
+//	go run ./cmd/local [-addr 127.0.0.1:8080] [-aws-addr 127.0.0.1:4566] [-retry-delay 5s]
+//
+// It must be run from the root of the repository. The lambdas are built from
+// function/<name> and run unchanged, their AWS clients pointed at the
+// stand-ins with AWS_ENDPOINT_URL. An upload to the input bucket is notified
+// to the upload topic, which delivers it to the upload queue raw, as the
+// stack does. An admin tenant is created on startup and its API key printed.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+const (
+	region    = "us-east-1"
+	accountId = "000000000000"
+
+	authTableName    = "AuthTable"
+	inputBucketName  = "input-bucket"
+	outputBucketName = "output-bucket"
+	jobTokenSecretId = "arn:aws:secretsmanager:" + region + ":" + accountId + ":secret:JobTokenKeyset"
+)
+
+// awsAddr is the address the stand-ins listen on.
+var awsAddr string
+
+// awsHandler routes the requests of the SDK to the stand-ins: the JSON APIs
+// by their target, SNS by its form and anything else to S3.
+type awsHandler struct {
+	dynamo  *fake.DynamoDB
+	objects *fake.S3
+	queues  *queueService
+	secrets secretStore
+}
+
+func (h *awsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	target := req.Header.Get("X-Amz-Target")
+	service, operation, _ := strings.Cut(target, ".")
+	switch {
+	case service == "DynamoDB_20120810":
+		h.dynamo.ServeHTTP(w, req)
+	case service == "AmazonSQS" || service == "secretsmanager":
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if service == "AmazonSQS" {
+			h.queues.serveSQS(w, operation, body)
+		} else {
+			h.secrets.serve(w, operation, body)
+		}
+	case req.Method == http.MethodPost && req.URL.Path == "/" && strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded"):
+		h.queues.serveSNS(w, req)
+	default:
+		h.objects.ServeHTTP(w, req)
+	}
+}
+
+func randomKey() string {
+
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// createTenant stores an admin tenant with an API key and a webhook secret.
+func createTenant(ctx context.Context) (tenantId, key, secret string, err error) {
+
+	dynamo := dynamodb.New(dynamodb.Options{
+		Region:       region,
+		BaseEndpoint: aws.String("http://" + awsAddr),
+		Credentials:  credentials.NewStaticCredentialsProvider("local", "local", ""),
+	})
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if tenantId, err = tenant.NewTenantId(); err != nil {
+		return "", "", "", err
+	}
+	if secret, err = tenant.NewWebhookSecret(); err != nil {
+		return "", "", "", err
+	}
+	err = tenant.Put(ctx, dynamo, authTableName, &tenant.Tenant{
+		Pk:            tenant.TenantPrefix + tenantId,
+		Sk:            job.MetadataSk,
+		TenantId:      tenantId,
+		Name:          "local",
+		Status:        tenant.StatusActive,
+		CreatedAt:     now,
+		Admin:         true,
+		WebhookSecret: secret,
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+	key, item, err := tenant.NewAPIKey(tenantId, now)
+	if err != nil {
+		return "", "", "", err
+	}
+	if err = tenant.Put(ctx, dynamo, authTableName, item); err != nil {
+		return "", "", "", err
+	}
+	return tenantId, key, secret, nil
+}
+
+func main() {
+
+	addr := flag.String("addr", "127.0.0.1:8080", "address of the api")
+	flag.StringVar(&awsAddr, "aws-addr", "127.0.0.1:4566", "address of the stand-ins of the AWS services, must be an IP address so that S3 is addressed path-style")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "longest delay before a failed message is received again")
+	flag.Parse()
+
+	if _, err := os.Stat("function"); err != nil {
+		fmt.Fprintln(os.Stderr, "local must be run from the root of the repository")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the queues and topics of the stack, with their visibility timeouts and
+	// max receive counts
+	queues := newQueueService(*retryDelay)
+	uploadDLQ := queues.addQueue("BucketUploadQueueDLQ", 30*time.Second, 0, nil)
+	uploadQueue := queues.addQueue("BucketUploadQueue", 300*time.Second, 5, uploadDLQ)
+	notifyDLQ := queues.addQueue("NotifyQueueDLQ", 30*time.Second, 0, nil)
+	notifyQueue := queues.addQueue("NotifyQueue", 60*time.Second, 8, notifyDLQ)
+	uploadTopic := queues.addTopic("UploadEventTopic", uploadQueue)
+	jobEventsTopic := queues.addTopic("JobEventsTopic")
+
+	objects := fake.NewS3(inputBucketName, outputBucketName)
+	objects.Notify = func(bucket, key string, o *fake.Object, sequencer string) {
+		if bucket != inputBucketName || !strings.HasPrefix(key, "image-") {
+			return
+		}
+		body, err := fake.S3Notification(region, bucket, key, o, sequencer)
+		if err != nil {
+			fmt.Printf("[s3] failed to notify the upload of %s: %v\n", key, err)
+			return
+		}
+		queues.publish(uploadTopic, string(body))
+	}
+
+	keyset, _ := json.Marshal(map[string]string{"current": "k1", "k1": randomKey()})
+	handler := &awsHandler{
+		dynamo:  fake.NewDynamoDB(authTableName),
+		objects: objects,
+		queues:  queues,
+		secrets: secretStore{jobTokenSecretId: string(keyset)},
+	}
+
+	// the environment of the lambdas, as the stack sets it
+	getpresigned := &function{name: "getpresigned", memory: 128, env: map[string]string{
+		"AUTH_TABLE_NAME":      authTableName,
+		"INPUT_BUCKET_NAME":    inputBucketName,
+		"PIPELINE_COST_BUDGET": "400",
+		"JOB_TOKEN_SECRET_ARN": jobTokenSecretId,
+		"UPLOAD_QUEUE_URL":     queues.queueURL(uploadQueue),
+		"JOB_EVENTS_TOPIC_ARN": jobEventsTopic.arn,
+	}}
+	transformimage := &function{name: "transformimage", memory: 256, env: map[string]string{
+		"INPUT_BUCKET_NAME":    inputBucketName,
+		"OUTPUT_BUCKET_NAME":   outputBucketName,
+		"AUTH_TABLE_NAME":      authTableName,
+		"OVERSIZE_POLICY":      "downsample",
+		"UPLOAD_QUEUE_URL":     queues.queueURL(uploadQueue),
+		"NOTIFY_QUEUE_URL":     queues.queueURL(notifyQueue),
+		"JOB_EVENTS_TOPIC_ARN": jobEventsTopic.arn,
+	}}
+	accessobject := &function{name: "accessobject", memory: 128, env: map[string]string{
+		"OUTPUT_BUCKET_NAME": outputBucketName,
+		"AUTH_TABLE_NAME":    authTableName,
+	}}
+	dlq := &function{name: "dlq", memory: 128, env: map[string]string{
+		"INPUT_BUCKET_NAME":    inputBucketName,
+		"AUTH_TABLE_NAME":      authTableName,
+		"NOTIFY_QUEUE_URL":     queues.queueURL(notifyQueue),
+		"JOB_EVENTS_TOPIC_ARN": jobEventsTopic.arn,
+	}}
+	notifier := &function{name: "notifier", memory: 128, env: map[string]string{
+		"AUTH_TABLE_NAME":  authTableName,
+		"NOTIFY_QUEUE_URL": queues.queueURL(notifyQueue),
+	}}
+	authorizeaccess := &function{name: "authorizeaccess", memory: 128, env: map[string]string{
+		"AUTH_TABLE_NAME":      authTableName,
+		"JOB_TOKEN_SECRET_ARN": jobTokenSecretId,
+	}}
+	functions := []*function{getpresigned, transformimage, accessobject, dlq, notifier, authorizeaccess}
+
+	dir, err := os.MkdirTemp("", "image-transform-local")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	if err := buildFunctions(dir, functions...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	defer func() {
+		for _, f := range functions {
+			f.stop()
+		}
+	}()
+
+	apiHandler := &api{stage: "prod", routes: []route{
+		{method: http.MethodPost, resource: "/generate-url", function: getpresigned, authorizer: authorizeaccess, identity: []string{tenant.APIKeyHeader}},
+		{method: http.MethodGet, resource: "/access-object", function: accessobject, authorizer: authorizeaccess, identity: []string{tenant.APIKeyHeader, "Authorization", "?object-name"}},
+		{method: http.MethodPost, resource: "/jobs/{id}/reprocess", function: getpresigned, authorizer: authorizeaccess, identity: []string{tenant.APIKeyHeader, "Authorization"}},
+	}}
+
+	servers := []*http.Server{{Addr: awsAddr, Handler: handler}, {Addr: *addr, Handler: apiHandler}}
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintln(os.Stderr, err)
+				stop()
+			}
+		}(server)
+	}
+
+	tenantId, key, secret, err := createTenant(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create the local tenant: %v\n", err)
+		stop()
+	} else {
+		fmt.Printf("api:            http://%s\n", *addr)
+		fmt.Printf("tenant:         %s\n", tenantId)
+		fmt.Printf("api key:        %s\n", key)
+		fmt.Printf("webhook secret: %s\n", secret)
+	}
+
+	go queues.poll(ctx, uploadQueue, 10, transformimage, true)
+	go queues.poll(ctx, uploadDLQ, 10, dlq, true)
+	go queues.poll(ctx, notifyQueue, 5, notifier, true)
+
+	<-ctx.Done()
+	for _, server := range servers {
+		server.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type message struct {
+	id            string
+	body          string
+	receiptHandle string
+	receiveCount  int
+	sentAt        time.Time
+	firstReceive  time.Time
+	visibleAt     time.Time
+}
+
+// queue is an SQS queue, redriving its messages to dlq once they have been
+// received maxReceive times.
+type queue struct {
+	name       string
+	visibility time.Duration
+	maxReceive int
+	dlq        *queue
+	messages   []*message
+}
+
+// queueService holds the queues and the topics, which only deliver to queues.
+type queueService struct {
+	mu     sync.Mutex
+	queues map[string]*queue
+	topics map[string]*topic
+
+	// retryDelay caps the visibility timeouts, so that retries don't take
+	// minutes locally
+	retryDelay time.Duration
+}
+
+// topic is an SNS topic delivering to its queues with raw message delivery.
+type topic struct {
+	name   string
+	arn    string
+	queues []*queue
+}
+
+func newQueueService(retryDelay time.Duration) *queueService {
+	return &queueService{queues: map[string]*queue{}, topics: map[string]*topic{}, retryDelay: retryDelay}
+}
+
+func randomId() string {
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	h := hex.EncodeToString(buf)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func (s *queueService) addQueue(name string, visibility time.Duration, maxReceive int, dlq *queue) *queue {
+
+	q := &queue{name: name, visibility: visibility, maxReceive: maxReceive, dlq: dlq}
+	s.queues[name] = q
+	return q
+}
+
+func (s *queueService) addTopic(name string, queues ...*queue) *topic {
+
+	t := &topic{name: name, arn: "arn:aws:sns:" + region + ":" + accountId + ":" + name, queues: queues}
+	s.topics[t.arn] = t
+	return t
+}
+
+func (s *queueService) queueURL(q *queue) string {
+	return "http://" + awsAddr + "/" + accountId + "/" + q.name
+}
+
+func queueArn(q *queue) string {
+	return "arn:aws:sqs:" + region + ":" + accountId + ":" + q.name
+}
+
+// send must be called with the lock held.
+func (s *queueService) send(q *queue, body string) *message {
+
+	now := time.Now()
+	m := &message{id: randomId(), body: body, sentAt: now, visibleAt: now}
+	q.messages = append(q.messages, m)
+	return m
+}
+
+func (s *queueService) publish(t *topic, body string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range t.queues {
+		s.send(q, body)
+	}
+}
+
+// receive returns up to max visible messages, hiding them for the visibility
+// timeout of the queue. Messages received too often are moved to the dlq.
+func (s *queueService) receive(q *queue, max int) []*message {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var received []*message
+	for i := 0; i < len(q.messages) && len(received) < max; i++ {
+		m := q.messages[i]
+		if m.visibleAt.After(now) {
+			continue
+		}
+		if q.dlq != nil && m.receiveCount >= q.maxReceive {
+			fmt.Printf("[sqs] moving %s from %s to %s after %d receives\n", m.id, q.name, q.dlq.name, m.receiveCount)
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			i--
+			m.receiveCount, m.visibleAt, m.firstReceive = 0, now, time.Time{}
+			q.dlq.messages = append(q.dlq.messages, m)
+			continue
+		}
+		m.receiveCount++
+		if m.firstReceive.IsZero() {
+			m.firstReceive = now
+		}
+		m.receiptHandle = randomId()
+		m.visibleAt = now.Add(q.visibility)
+		received = append(received, m)
+	}
+	return received
+}
+
+func (s *queueService) delete(q *queue, receiptHandle string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range q.messages {
+		if m.receiptHandle == receiptHandle {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+// release makes a message that failed visible again within the retry delay,
+// unless the function delayed it less than that.
+func (s *queueService) release(q *queue, receiptHandle string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range q.messages {
+		if m.receiptHandle == receiptHandle {
+			m.visibleAt = minTime(m.visibleAt, time.Now().Add(s.retryDelay))
+			return
+		}
+	}
+}
+
+func minTime(a, b time.Time) time.Time {
+
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func (s *queueService) sqsMessage(q *queue, m *message) events.SQSMessage {
+
+	sum := md5.Sum([]byte(m.body))
+	return events.SQSMessage{
+		MessageId:     m.id,
+		ReceiptHandle: m.receiptHandle,
+		Body:          m.body,
+		Md5OfBody:     hex.EncodeToString(sum[:]),
+		Attributes: map[string]string{
+			"ApproximateReceiveCount":          strconv.Itoa(m.receiveCount),
+			"SentTimestamp":                    strconv.FormatInt(m.sentAt.UnixMilli(), 10),
+			"ApproximateFirstReceiveTimestamp": strconv.FormatInt(m.firstReceive.UnixMilli(), 10),
+			"SenderId":                         accountId,
+		},
+		EventSource:    "aws:sqs",
+		EventSourceARN: queueArn(q),
+		AWSRegion:      region,
+	}
+}
+
+// poll invokes the function with the messages of the queue in batches, as an
+// SQS event source mapping. With reportFailures only the batch item failures
+// are retried, otherwise an error retries the whole batch.
+func (s *queueService) poll(ctx context.Context, q *queue, batchSize int, f *function, reportFailures bool) {
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		received := s.receive(q, batchSize)
+		if len(received) == 0 {
+			continue
+		}
+		event := events.SQSEvent{}
+		for _, m := range received {
+			event.Records = append(event.Records, s.sqsMessage(q, m))
+		}
+
+		failed := map[string]bool{}
+		payload, err := f.invoke(ctx, event, 15*time.Minute)
+		if err == nil && reportFailures {
+			var response events.SQSEventResponse
+			if err = json.Unmarshal(payload, &response); err == nil {
+				for _, failure := range response.BatchItemFailures {
+					failed[failure.ItemIdentifier] = true
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("[sqs] %s failed a batch of %s: %v\n", f.name, q.name, err)
+		}
+
+		for _, m := range event.Records {
+			if err != nil || failed[m.MessageId] {
+				s.release(q, m.ReceiptHandle)
+			} else {
+				s.delete(q, m.ReceiptHandle)
+			}
+		}
+	}
+}
+
+type sqsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// serveSQS answers the JSON protocol of the SQS API.
+func (s *queueService) serveSQS(w http.ResponseWriter, operation string, body []byte) {
+
+	var request struct {
+		QueueUrl          string
+		MessageBody       string
+		ReceiptHandle     string
+		VisibilityTimeout int
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	fail := func(code, message string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(sqsError{"com.amazonaws.sqs#" + code, message})
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		fail("InvalidParameterValue", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[path.Base(request.QueueUrl)]
+	if !ok {
+		fail("QueueDoesNotExist", "The specified queue does not exist.")
+		return
+	}
+
+	switch operation {
+	case "SendMessage":
+		m := s.send(q, request.MessageBody)
+		sum := md5.Sum([]byte(m.body))
+		json.NewEncoder(w).Encode(map[string]string{"MessageId": m.id, "MD5OfMessageBody": hex.EncodeToString(sum[:])})
+	case "ChangeMessageVisibility":
+		for _, m := range q.messages {
+			if m.receiptHandle == request.ReceiptHandle {
+				delay := min(time.Duration(request.VisibilityTimeout)*time.Second, s.retryDelay)
+				m.visibleAt = time.Now().Add(delay)
+				json.NewEncoder(w).Encode(struct{}{})
+				return
+			}
+		}
+		fail("ReceiptHandleIsInvalid", "The input receipt handle is invalid.")
+	case "DeleteMessage":
+		for i, m := range q.messages {
+			if m.receiptHandle == request.ReceiptHandle {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(struct{}{})
+	default:
+		fail("UnsupportedOperation", "unsupported operation "+operation)
+	}
+}
+
+type snsPublishResponse struct {
+	XMLName   xml.Name `xml:"PublishResponse"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	MessageId string   `xml:"PublishResult>MessageId"`
+	RequestId string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type snsErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestId string   `xml:"RequestId"`
+}
+
+// serveSNS answers the Publish action of the query protocol of the SNS API,
+// logging the message of topics that no queue subscribes to.
+func (s *queueService) serveSNS(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/xml")
+	req.ParseForm()
+	if req.PostForm.Get("Action") != "Publish" {
+		w.WriteHeader(http.StatusBadRequest)
+		xml.NewEncoder(w).Encode(snsErrorResponse{Type: "Sender", Code: "InvalidAction", Message: "unsupported action " + req.PostForm.Get("Action"), RequestId: randomId()})
+		return
+	}
+	t, ok := s.topics[req.PostForm.Get("TopicArn")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		xml.NewEncoder(w).Encode(snsErrorResponse{Type: "Sender", Code: "NotFound", Message: "Topic does not exist", RequestId: randomId()})
+		return
+	}
+
+	message := req.PostForm.Get("Message")
+	if len(t.queues) == 0 {
+		fmt.Printf("[sns] %s: %s\n", t.name, message)
+	}
+	s.publish(t, message)
+	xml.NewEncoder(w).Encode(snsPublishResponse{Xmlns: "http://sns.amazonaws.com/doc/2010-03-31/", MessageId: randomId(), RequestId: randomId()})
+}
+
+// secretStore answers GetSecretValue of the Secrets Manager API.
+type secretStore map[string]string
+
+func (s secretStore) serve(w http.ResponseWriter, operation string, body []byte) {
+
+	var request struct{ SecretId string }
+	json.Unmarshal(body, &request)
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	value, ok := s[request.SecretId]
+	if operation != "GetSecretValue" || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"ARN":          request.SecretId,
+		"Name":         path.Base(request.SecretId),
+		"SecretString": value,
+		"VersionId":    "local",
+		"CreatedDate":  float64(time.Now().Unix()),
+	})
+}
@@ -0,0 +1,122 @@
+// Command tenants manages the tenants and API keys stored in the auth table.
+//
+//	go run ./cmd/tenants -table <AuthTable> create-tenant -name acme [-admin]
+//	go run ./cmd/tenants -table <AuthTable> create-key -tenant t-0123456789abcdef
+//	go run ./cmd/tenants -table <AuthTable> disable-key -key 0123456789ab
+//	go run ./cmd/tenants -table <AuthTable> disable-tenant -tenant t-0123456789abcdef
+//	go run ./cmd/tenants -table <AuthTable> webhook-secret -tenant t-0123456789abcdef
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/tenant"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tenants -table <name> create-tenant -name <name> [-admin] | create-key -tenant <id> | disable-key -key <key id> | disable-tenant -tenant <id> | webhook-secret -tenant <id>")
+	os.Exit(2)
+}
+
+func main() {
+
+	table := flag.String("table", os.Getenv("AUTH_TABLE_NAME"), "name of the auth table")
+	flag.Parse()
+	if *table == "" || flag.NArg() == 0 {
+		usage()
+	}
+
+	awsConfig, err := awsclient.LoadConfig(context.TODO())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load aws config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo := awsclient.NewJobStore(awsConfig)
+
+	command := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	name := command.String("name", "", "name of the tenant")
+	tenantId := command.String("tenant", "", "id of the tenant")
+	admin := command.Bool("admin", false, "allow the tenant to manage the limits of every tenant")
+	keyId := command.String("key", "", "id of the api key, the part between the underscores")
+	command.Parse(flag.Args()[1:])
+
+	ctx := context.TODO()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	switch command.Name() {
+	case "create-tenant":
+		if *name == "" {
+			usage()
+		}
+		id, err := tenant.NewTenantId()
+		if err == nil {
+			err = tenant.Put(ctx, dynamo, *table, &tenant.Tenant{
+				Pk:        tenant.TenantPrefix + id,
+				Sk:        job.MetadataSk,
+				TenantId:  id,
+				Name:      *name,
+				Status:    tenant.StatusActive,
+				CreatedAt: now,
+				Admin:     *admin,
+			})
+		}
+		if err == nil {
+			fmt.Println(id)
+		}
+	case "create-key":
+		if *tenantId == "" {
+			usage()
+		}
+		var t *tenant.Tenant
+		t, err = tenant.Get(ctx, dynamo, *table, *tenantId)
+		if err == nil && t == nil {
+			err = fmt.Errorf("unknown tenant %s", *tenantId)
+		}
+		if err == nil {
+			var key string
+			var item *tenant.APIKey
+			key, item, err = tenant.NewAPIKey(*tenantId, now)
+			if err == nil {
+				err = tenant.Put(ctx, dynamo, *table, item)
+			}
+			if err == nil {
+				fmt.Println(key) // only shown once, the table only holds its hash
+			}
+		}
+	case "disable-key":
+		if *keyId == "" {
+			usage()
+		}
+		err = tenant.SetStatus(ctx, dynamo, *table, tenant.APIKeyPrefix+*keyId, tenant.StatusDisabled)
+	case "disable-tenant":
+		if *tenantId == "" {
+			usage()
+		}
+		err = tenant.SetStatus(ctx, dynamo, *table, tenant.TenantPrefix+*tenantId, tenant.StatusDisabled)
+	case "webhook-secret":
+		if *tenantId == "" {
+			usage()
+		}
+		var secret string
+		secret, err = tenant.NewWebhookSecret()
+		if err == nil {
+			err = tenant.SetWebhookSecret(ctx, dynamo, *table, *tenantId, secret)
+		}
+		if err == nil {
+			fmt.Println(secret) // replaces the previous secret
+		}
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
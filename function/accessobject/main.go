@@ -5,127 +5,209 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/webhook"
+
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 var authTableName = os.Getenv("AUTH_TABLE_NAME")
 var outputBucketName = os.Getenv("OUTPUT_BUCKET_NAME")
 
-var svc *s3.Client
-var dynamo *dynamodb.Client
+var presigner awsclient.Presigner
+var dynamo awsclient.JobStore
+
+func CreatePresignedURL(outputKey string) (string, error) {
 
-func InitConfig() (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO())
+	presignedURL, err := presigner.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(outputBucketName),
+		Key:    aws.String(outputKey),
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = downloadURLTTL
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create presigned url: %v", err)
+	}
+	return presignedURL.URL, nil
 }
 
-func InitDynamo(config aws.Config) *dynamodb.Client {
-	return dynamodb.NewFromConfig(config)
+// downloadURLTTL is the lifetime of the presigned download urls.
+const downloadURLTTL = 60 * time.Second
+
+type Pipeline struct {
+	Transforms []job.Transform        `json:"Transforms"`
+	Output     *imaging.OutputOptions `json:"Output,omitempty"`
 }
 
-func InitS3(config aws.Config) *s3.Client {
-	return s3.NewFromConfig(config)
+type RenditionStatus struct {
+	Name     string         `json:"Name"`
+	Pipeline Pipeline       `json:"Pipeline"`
+	Output   *job.ImageInfo `json:"Output,omitempty"`
 }
 
-func createKey(Pk, Sk string) (map[string]types.AttributeValue, error) {
-	pk, err := attributevalue.Marshal(Pk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal pk: %v", err)
-	}
-	sk, err := attributevalue.Marshal(Sk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal sk: %v", err)
-	}
-	return map[string]types.AttributeValue{"pk": pk, "sk": sk}, nil
+// JobStatus is the body of every /access-object response about an existing job.
+// The download url is only set once the job succeeded, for the requested
+// rendition when the job has renditions. Transitions records when the job last
+// entered each of the statuses it went through.
+type JobStatus struct {
+	Id                   string                `json:"Id"`
+	JobVersion           int                   `json:"JobVersion"`
+	Status               job.Status            `json:"Status"`
+	CreatedAt            string                `json:"CreatedAt,omitempty"`
+	UpdatedAt            string                `json:"UpdatedAt,omitempty"`
+	Transitions          map[job.Status]string `json:"Transitions,omitempty"`
+	Pipeline             Pipeline              `json:"Pipeline"`
+	Source               *job.ImageInfo        `json:"Source,omitempty"`
+	Output               *job.ImageInfo        `json:"Output,omitempty"`
+	Renditions           []RenditionStatus     `json:"Renditions,omitempty"`
+	Failure              *failure.Failure      `json:"Failure,omitempty"`
+	Deliveries           []webhook.Attempt     `json:"Deliveries,omitempty"`
+	DownloadURL          string                `json:"DownloadURL,omitempty"`
+	DownloadURLExpiresAt string                `json:"DownloadURLExpiresAt,omitempty"`
 }
 
-func CreatePresignedURL(uniqueID string) (string, error) {
+// renditionKey returns the output key of the named rendition of a job.
+func renditionKey(renditions []job.Rendition, rendition string) (string, error) {
 
-	presignClient := s3.NewPresignClient(svc)
-	presignedURL, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(outputBucketName),
-		Key:    aws.String(uniqueID),
-	}, func(opts *s3.PresignOptions) {
-		opts.Expires = time.Duration(60 * int64(time.Second))
-	})
+	names := make([]string, len(renditions))
+	for i, r := range renditions {
+		if r.Name == rendition {
+			return r.OutputKey, nil
+		}
+		names[i] = r.Name
+	}
+	if len(renditions) == 0 {
+		return "", fmt.Errorf("object has no renditions")
+	}
+	return "", fmt.Errorf("unknown rendition %q, available renditions: %s", rendition, strings.Join(names, ", "))
+}
 
-	if err != nil {
-		return "", fmt.Errorf("failed to create presigned url: %v", err)
+// NewJobStatus returns the status of a job without its download url.
+func NewJobStatus(item *job.Item) *JobStatus {
+
+	status := &JobStatus{
+		Id:          item.Pk,
+		JobVersion:  item.JobVersion,
+		Status:      item.Status,
+		CreatedAt:   item.CreatedAt,
+		UpdatedAt:   item.UpdatedAt,
+		Transitions: item.Transitions(),
+		Pipeline:    Pipeline{Transforms: item.Transforms, Output: item.Output},
+		Source:      item.SourceImage,
+		Output:      item.OutputImage,
+		Failure:     item.Failure,
+		Deliveries:  item.Deliveries,
 	}
-	return presignedURL.URL, nil
+	for _, rendition := range item.Renditions {
+		status.Renditions = append(status.Renditions, RenditionStatus{
+			Name:     rendition.Name,
+			Pipeline: Pipeline{Transforms: rendition.Transforms, Output: rendition.Output},
+			Output:   rendition.OutputImage,
+		})
+	}
+	return status
 }
 
-func CheckTableStatus(uniqueID string) (events.APIGatewayProxyResponse, error) {
+// CheckTableStatus answers the status of the job of uniqueID, of its current
+// version unless version names an earlier one.
+func CheckTableStatus(uniqueID, rendition, version, tenantId string) (events.APIGatewayProxyResponse, error) {
 
-	key, err := createKey(uniqueID, "metadata")
+	requested := 0
+	if version != "" {
+		var err error
+		if requested, err = strconv.Atoi(version); err != nil || requested < 1 {
+			return apierror.Respond(http.StatusBadRequest, fmt.Sprintf("invalid version %q", version))
+		}
+	}
+
+	item, err := job.Get(context.TODO(), dynamo, authTableName, job.MetadataKey(uniqueID))
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusInternalServerError,
 			},
-			fmt.Errorf("failed to create key: %s", err)
+			err
 	}
 
-	response, err := dynamo.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName:      aws.String(authTableName),
-		Key:            key,
-		ConsistentRead: aws.Bool(true),
-	})
+	// objects of other tenants are reported as missing
+	if item == nil || item.TenantId != tenantId {
+		return apierror.Respond(http.StatusNotFound, fmt.Sprintf("unknown object %s", uniqueID))
+	}
 
-	if err != nil {
-		return events.APIGatewayProxyResponse{
-				StatusCode: http.StatusInternalServerError,
-			},
-			fmt.Errorf("error while trying to get item: %s", err)
+	if requested != 0 && requested != item.JobVersion {
+		if item, err = job.Get(context.TODO(), dynamo, authTableName, job.Key(uniqueID, job.VersionSk(requested))); err != nil {
+			return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+				},
+				err
+		}
+		if item == nil {
+			return apierror.Respond(http.StatusNotFound, fmt.Sprintf("unknown version %d of %s", requested, uniqueID))
+		}
+	}
+
+	// reported expired until the expirejobs lambda stores it so
+	if item.UploadExpired(time.Now()) {
+		createdAt, _ := time.Parse(time.RFC3339, item.CreatedAt)
+		expiredAt := createdAt.Add(job.UploadTimeout).UTC().Format(time.RFC3339)
+		item.Status, item.ExpiredAt, item.UpdatedAt = job.StatusExpired, expiredAt, expiredAt
 	}
 
-	if response != nil {
-		if status, ok := response.Item["Status"]; ok {
-			if statusString, ok := status.(*types.AttributeValueMemberS); ok {
-
-				switch statusString.Value {
-				case "processing":
-					return events.APIGatewayProxyResponse{
-							StatusCode: http.StatusTooEarly,
-						},
-						nil
-				case "broken":
-					return events.APIGatewayProxyResponse{
-							StatusCode: http.StatusBadRequest,
-						},
-						fmt.Errorf("object is broken. need a better way to convey that")
-				case "processed":
-					presignedURL, err := CreatePresignedURL(uniqueID)
-					if err != nil {
-						return events.APIGatewayProxyResponse{
-								StatusCode: http.StatusInternalServerError,
-							},
-							fmt.Errorf("failed to create presigned url: %s", err)
-					}
-					return events.APIGatewayProxyResponse{
-							StatusCode: http.StatusOK,
-							Body:       presignedURL,
-						},
-						nil
-				default:
-					panic("should be unreachable")
-				}
+	status := NewJobStatus(item)
+
+	switch item.Status {
+	case job.StatusPendingUpload, job.StatusQueued, job.StatusProcessing,
+		job.StatusFailed, job.StatusExpired, job.StatusCancelled:
+		return apierror.JSON(http.StatusOK, status)
+	case job.StatusSucceeded:
+		outputKey := item.OutputKey
+		if len(item.Renditions) != 0 || rendition != "" {
+			// without a rendition the status lists the renditions to pick from
+			if rendition == "" {
+				return apierror.JSON(http.StatusOK, status)
 			}
+			outputKey, err = renditionKey(item.Renditions, rendition)
+			if err != nil {
+				return apierror.Respond(http.StatusBadRequest, err.Error())
+			}
+		}
+		expires := time.Now().Add(downloadURLTTL)
+		presignedURL, err := CreatePresignedURL(outputKey)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+				},
+				fmt.Errorf("failed to create presigned url: %s", err)
 		}
-		panic("table is missing status")
+		status.DownloadURL = presignedURL
+		status.DownloadURLExpiresAt = expires.UTC().Format(time.RFC3339)
+		return apierror.JSON(http.StatusOK, status)
+	default:
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("job %s has unknown status %q", item.Pk, item.Status)
 	}
-	panic("should be impossible to reach here. The authorizer already allowed this request so such object does did in fact exist in the table. but somehow it is now gone.. strange.")
 }
 
 func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return apierror.Handle(ctx, request, handleRequest)
+}
+
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
 	if request.HTTPMethod != "GET" {
 		return events.APIGatewayProxyResponse{
@@ -144,20 +226,18 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 
 	fmt.Printf("user is requesting access to: %s \n", objectName)
 
-	awsConfig, err := InitConfig()
-	if err != nil {
-		return events.APIGatewayProxyResponse{
-				StatusCode: http.StatusInternalServerError,
-			},
-			fmt.Errorf("failed to initialize AWS config: %v", err)
-	}
-
-	dynamo = InitDynamo(awsConfig)
-	svc = InitS3(awsConfig)
-	return CheckTableStatus(objectName)
+	return CheckTableStatus(objectName, request.QueryStringParameters["rendition"], request.QueryStringParameters["version"], tenant.FromContext(request.RequestContext.Authorizer))
 }
 
 func main() {
 
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to initialize AWS config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+	presigner = awsclient.NewPresigner(awsConfig)
+
 	lambda.Start(lambdaHandler)
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testTable  = "AuthTable"
+	testBucket = "output-bucket"
+	testObject = "image-1.png"
+)
+
+func setup(t *testing.T) (*fake.DynamoDB, *fake.S3) {
+
+	t.Helper()
+	authTableName, outputBucketName = testTable, testBucket
+	store, objects := fake.NewDynamoDB(testTable), fake.NewS3(testBucket)
+	dynamo, presigner = store, objects
+	return store, objects
+}
+
+func jobItem(status job.Status, fields map[string]any) map[string]any {
+
+	item := map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": status, "OutputKey": "image-1.jpg"}
+	for name, value := range fields {
+		item[name] = value
+	}
+	return item
+}
+
+func request(query map[string]string, tenantId string) events.APIGatewayProxyRequest {
+
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		QueryStringParameters: query,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{tenant.ContextKey: tenantId},
+		},
+	}
+}
+
+func status(t *testing.T, response events.APIGatewayProxyResponse, err error, want int) *JobStatus {
+
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != want {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, want, response.Body)
+	}
+	if want != http.StatusOK && !fake.IsErrorEnvelope(response, err, want) {
+		t.Fatalf("body = %s, want the error envelope", response.Body)
+	}
+	var status JobStatus
+	if want == http.StatusOK {
+		if err := json.Unmarshal([]byte(response.Body), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &status
+}
+
+func TestJobStatuses(t *testing.T) {
+
+	store, _ := setup(t)
+
+	for _, jobStatus := range job.Statuses {
+		if jobStatus == job.StatusSucceeded {
+			continue
+		}
+		store.Put(testTable, jobItem(jobStatus, map[string]any{"CreatedAt": time.Now().UTC().Format(time.RFC3339)}))
+		response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+		got := status(t, response, err, http.StatusOK)
+		if got.Status != jobStatus || got.DownloadURL != "" {
+			t.Errorf("status = %s, url = %q, want %s without a url", got.Status, got.DownloadURL, jobStatus)
+		}
+	}
+
+	// a status written by a newer version of the state machine
+	store.Put(testTable, jobItem("paused", nil))
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Errorf("unknown status: status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+}
+
+// TestExpiredUpload reports an overdue upload expired without storing it,
+// the expirejobs lambda does.
+func TestExpiredUpload(t *testing.T) {
+
+	store, _ := setup(t)
+	created := time.Now().Add(-job.UploadTimeout - time.Minute).UTC()
+	createdAt := created.Format(time.RFC3339)
+	store.Put(testTable, jobItem(job.StatusPendingUpload, map[string]any{"CreatedAt": createdAt}))
+	store.Errors = map[string]error{"UpdateItem": errors.New("GET wrote the job")}
+
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	got := status(t, response, err, http.StatusOK)
+	expiredAt := created.Add(job.UploadTimeout).Format(time.RFC3339)
+	if got.Status != job.StatusExpired || got.Transitions[job.StatusExpired] != expiredAt || got.Transitions[job.StatusPendingUpload] != createdAt {
+		t.Errorf("status = %s with transitions %v, want expired at %s after pending since %s", got.Status, got.Transitions, expiredAt, createdAt)
+	}
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != job.StatusPendingUpload || item.ExpiredAt != "" {
+		t.Errorf("stored status = %s expired at %q, want pending_upload", item.Status, item.ExpiredAt)
+	}
+}
+
+func TestSucceededJob(t *testing.T) {
+
+	store, _ := setup(t)
+	store.Put(testTable, jobItem(job.StatusSucceeded, map[string]any{"SucceededAt": "2024-05-01T10:00:00Z"}))
+
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	got := status(t, response, err, http.StatusOK)
+	if !strings.Contains(got.DownloadURL, "/"+testBucket+"/image-1.jpg?") || got.DownloadURLExpiresAt == "" {
+		t.Errorf("url = %q expiring %q, want a url of the output", got.DownloadURL, got.DownloadURLExpiresAt)
+	}
+	if got.JobVersion != 1 || got.Transitions[job.StatusSucceeded] != "2024-05-01T10:00:00Z" {
+		t.Errorf("version = %d with transitions %v, want 1 succeeded", got.JobVersion, got.Transitions)
+	}
+}
+
+// TestLegacyJob reads a job written before the schema was versioned, without
+// an OutputKey nor a JobVersion, and with a status of the legacy values.
+func TestLegacyJob(t *testing.T) {
+
+	store, _ := setup(t)
+	item := jobItem("processed", nil)
+	delete(item, "OutputKey")
+	store.Put(testTable, item)
+
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	got := status(t, response, err, http.StatusOK)
+	if !strings.Contains(got.DownloadURL, "/"+testBucket+"/"+testObject+"?") || got.JobVersion != 1 || got.Status != job.StatusSucceeded {
+		t.Errorf("url = %q of version %d %s, want the url of the upload key and version 1 succeeded", got.DownloadURL, got.JobVersion, got.Status)
+	}
+
+	// items of a newer schema can't be read by this version of the lambda
+	store.Put(testTable, jobItem(job.StatusSucceeded, map[string]any{"SchemaVersion": job.SchemaVersion + 1}))
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Errorf("newer schema: status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+}
+
+func TestRenditions(t *testing.T) {
+
+	store, _ := setup(t)
+	store.Put(testTable, jobItem(job.StatusSucceeded, map[string]any{"Renditions": []job.Rendition{
+		{Name: "thumb", OutputKey: "image-1/thumb.png"},
+		{Name: "large", OutputKey: "image-1/large.png"},
+	}}))
+
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	if got := status(t, response, err, http.StatusOK); got.DownloadURL != "" || len(got.Renditions) != 2 {
+		t.Errorf("url = %q with %d renditions, want the renditions without a url", got.DownloadURL, len(got.Renditions))
+	}
+
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject, "rendition": "thumb"}, "t-1"))
+	if got := status(t, response, err, http.StatusOK); !strings.Contains(got.DownloadURL, "image-1/thumb.png") {
+		t.Errorf("url = %q, want the url of the thumb", got.DownloadURL)
+	}
+
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject, "rendition": "small"}, "t-1"))
+	status(t, response, err, http.StatusBadRequest)
+}
+
+func TestVersions(t *testing.T) {
+
+	store, _ := setup(t)
+	store.Put(testTable, jobItem(job.StatusProcessing, map[string]any{"JobVersion": 2}))
+	store.Put(testTable, jobItem(job.StatusSucceeded, map[string]any{"sk": "version#1", "JobVersion": 1}))
+
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject, "version": "1"}, "t-1"))
+	if got := status(t, response, err, http.StatusOK); got.Status != job.StatusSucceeded || got.JobVersion != 1 {
+		t.Errorf("got version %d %s, want version 1 succeeded", got.JobVersion, got.Status)
+	}
+
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject, "version": "3"}, "t-1"))
+	status(t, response, err, http.StatusNotFound)
+
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject, "version": "first"}, "t-1"))
+	status(t, response, err, http.StatusBadRequest)
+}
+
+func TestMissingJobs(t *testing.T) {
+
+	store, _ := setup(t)
+	store.Put(testTable, jobItem(job.StatusSucceeded, nil))
+
+	// the jobs of other tenants are reported as missing
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-2"))
+	status(t, response, err, http.StatusNotFound)
+
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": "image-2.png"}, "t-1"))
+	status(t, response, err, http.StatusNotFound)
+}
+
+// TestMissingStatus answers a job item without a status, or without the
+// attributes of a job, with a 500 carrying the request id of API Gateway.
+func TestMissingStatus(t *testing.T) {
+
+	store, _ := setup(t)
+
+	for _, item := range []map[string]any{
+		{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "OutputKey": "image-1.jpg"},
+		{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": true},
+	} {
+		store.Put(testTable, item)
+		req := request(map[string]string{"object-name": testObject}, "t-1")
+		req.RequestContext.RequestID = "request-1"
+		response, err := lambdaHandler(context.Background(), req)
+		if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+			t.Fatalf("status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+		}
+		var envelope apierror.Envelope
+		json.Unmarshal([]byte(response.Body), &envelope)
+		if envelope.RequestId != "request-1" || envelope.Errors[0].Message != apierror.InternalMessage {
+			t.Errorf("envelope = %+v, want the internal error of request-1", envelope)
+		}
+	}
+}
+
+func TestFails(t *testing.T) {
+
+	store, objects := setup(t)
+	store.Put(testTable, jobItem(job.StatusSucceeded, nil))
+
+	objects.Errors = map[string]error{"PresignGetObject": errors.New("no credentials")}
+	response, err := lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Errorf("presign: status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+
+	store.Errors = map[string]error{"GetItem": errors.New("throttled")}
+	response, err = lambdaHandler(context.Background(), request(map[string]string{"object-name": testObject}, "t-1"))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Errorf("table: status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+
+	response, err = lambdaHandler(context.Background(), request(nil, "t-1"))
+	if !fake.IsErrorEnvelope(response, err, http.StatusBadRequest) {
+		t.Errorf("missing object name: status = %d, err = %v, want a 400 error envelope", response.StatusCode, err)
+	}
+}
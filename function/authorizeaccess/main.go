@@ -4,84 +4,99 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/jobtoken"
+	"cdk_image_transform/internal/tenant"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 var authTableName = os.Getenv("AUTH_TABLE_NAME")
+var jobTokenSecret = os.Getenv("JOB_TOKEN_SECRET_ARN")
+
+var dynamo awsclient.JobStore
+var secrets awsclient.SecretStore
+
+// scopeAdmin marks the routes requiring the API key of an admin tenant.
+const scopeAdmin = "admin"
+
+// routeScopes maps the resources behind the authorizer to the job token scope
+// they require. An empty scope only requires an API key.
+var routeScopes = map[string]string{
+	"/generate-url":                    "",
+	"/transforms":                      "",
+	"/access-object":                   jobtoken.ScopeRead,
+	"/img/{key}":                       jobtoken.ScopeTransform,
+	"/jobs/{id}/reprocess":             jobtoken.ScopeTransform,
+	"/admin/tenants/{tenantId}/limits": scopeAdmin,
+}
 
-var dynamo *dynamodb.Client
+func getHeader(headers map[string]string, name string) string {
 
-func InitConfig() (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO())
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
 }
 
-func InitDynamo(config aws.Config) *dynamodb.Client {
-	return dynamodb.NewFromConfig(config)
-}
+// bearerToken returns the token of an "Authorization: Bearer <token>" header.
+func bearerToken(headers map[string]string) string {
 
-func createKey(Pk, Sk string) (map[string]types.AttributeValue, error) {
-	pk, err := attributevalue.Marshal(Pk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal pk: %v", err)
-	}
-	sk, err := attributevalue.Marshal(Sk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal sk: %v", err)
-	}
-	return map[string]types.AttributeValue{"pk": pk, "sk": sk}, nil
+	token, _ := strings.CutPrefix(getHeader(headers, "Authorization"), "Bearer ")
+	return strings.TrimSpace(token)
 }
 
-func isAuthorized(currentIP, uniqueID string) bool {
+// isAuthorized verifies the job token without any lookup: it must be signed
+// by a key of the keyset, unexpired, issued to the tenant for the object, hold
+// the scope of the route and, when it carries an ip claim, be presented from
+// that address.
+func isAuthorized(keyset *jobtoken.Keyset, token, tenantId, objectName, scope, currentIP string) bool {
 
-	key, err := createKey(uniqueID, "metadata")
+	claims, err := keyset.Verify(token, time.Now())
 	if err != nil {
-		fmt.Printf("failed to create key: %s", err)
+		fmt.Printf("rejected job token: %v\n", err)
 		return false
 	}
-
-	response, err := dynamo.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName:      aws.String(authTableName),
-		Key:            key,
-		ConsistentRead: aws.Bool(true),
-	})
-
-	if err != nil {
-		fmt.Printf("error calling GetItem: %s", err)
+	if claims.Tenant != tenantId {
+		fmt.Printf("the job token of tenant %s was presented by tenant %s\n", claims.Tenant, tenantId)
 		return false
 	}
+	if claims.Subject != objectName {
+		fmt.Printf("the job token of %s was presented for %s\n", claims.Subject, objectName)
+		return false
+	}
+	if !claims.HasScope(scope) {
+		fmt.Printf("the job token of %s lacks the %s scope\n", claims.Subject, scope)
+		return false
+	}
+	if claims.SourceIP != "" && claims.SourceIP != currentIP {
+		fmt.Printf("The token source IP %s does not match current source IP %s\n", claims.SourceIP, currentIP)
+		return false
+	}
+	return true
+}
 
-	if response != nil {
-		if originalIP, ok := response.Item["SourceIP"]; ok {
-
-			originalIPString, ok := originalIP.(*types.AttributeValueMemberS)
-
-			if ok {
-				if originalIPString.Value == currentIP {
-					fmt.Printf("The stored source IP %s matches current source IP %s", originalIPString.Value, currentIP)
-					return true
-				} else {
-					fmt.Printf("The stored source IP %s does not match current source IP %s", originalIPString.Value, currentIP)
-					return false
-				}
-			} else {
-				panic("failed to cast originalIP to *types.AttributeValueMemberS")
-			}
+// stageArn returns the arn matching every method of the stage of methodArn.
+// Policies of the API key only routes are cached per key, they must not be
+// bound to the first method that was called.
+func stageArn(methodArn string) string {
 
-		} else {
-			panic("failed to find source ip inside of item map")
-		}
+	parts := strings.SplitN(methodArn, "/", 3)
+	if len(parts) < 2 {
+		return methodArn
 	}
+	return parts[0] + "/" + parts[1] + "/*"
+}
 
-	fmt.Printf("user attemped to access a no existent item with unique_id:%s", uniqueID)
-	return false
+// adminArn returns the arn matching every admin route of the stage of methodArn.
+func adminArn(methodArn string) string {
+	return stageArn(methodArn) + "/admin/*"
 }
 
 func GeneratePolicy(principalId, effect, resource string) events.APIGatewayCustomAuthorizerResponse {
@@ -104,25 +119,73 @@ func GeneratePolicy(principalId, effect, resource string) events.APIGatewayCusto
 
 func lambdaHandler(ctx context.Context, event events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
 
-	awsConfig, err := InitConfig()
+	scope, ok := routeScopes[event.Resource]
+	if !ok {
+		return GeneratePolicy("user", "Deny", event.MethodArn), nil
+	}
+
+	t, err := tenant.Authenticate(ctx, dynamo, authTableName, getHeader(event.Headers, tenant.APIKeyHeader))
+	if err != nil {
+		fmt.Printf("rejected api key: %v\n", err)
+		return GeneratePolicy("user", "Deny", event.MethodArn), nil
+	}
+
+	if scope == scopeAdmin {
+		if !t.Admin {
+			fmt.Printf("tenant %s isn't an admin\n", t.TenantId)
+			return GeneratePolicy(t.TenantId, "Deny", event.MethodArn), nil
+		}
+		response := GeneratePolicy(t.TenantId, "Allow", adminArn(event.MethodArn))
+		response.Context = map[string]interface{}{tenant.ContextKey: t.TenantId}
+		return response, nil
+	}
+
+	if scope == "" {
+		response := GeneratePolicy(t.TenantId, "Allow", stageArn(event.MethodArn))
+		response.Context = map[string]interface{}{tenant.ContextKey: t.TenantId}
+		return response, nil
+	}
+
+	// API Gateway answers the error with a 500 carrying the request id
+	keyset, err := jobtoken.LoadKeyset(ctx, secrets, jobTokenSecret)
 	if err != nil {
-		panic("failed to load config")
+		fmt.Printf("request %s failed: %v\n", event.RequestContext.RequestID, err)
+		return events.APIGatewayCustomAuthorizerResponse{}, err
 	}
 
-	dynamo = InitDynamo(awsConfig)
+	// /access-object names the object in the query string, /img/{key} and
+	// /jobs/{id}/... in the path
+	objectName, ok := event.QueryStringParameters["object-name"]
+	if !ok {
+		objectName, ok = event.PathParameters["key"]
+	}
+	if !ok {
+		objectName, ok = event.PathParameters["id"]
+	}
 
-	if objectName, ok := event.QueryStringParameters["object-name"]; ok {
+	if ok {
 
-		if isAuthorized(event.RequestContext.Identity.SourceIP, objectName) {
-			return GeneratePolicy("user", "Allow", event.MethodArn), nil
+		if isAuthorized(keyset, bearerToken(event.Headers), t.TenantId, objectName, scope, event.RequestContext.Identity.SourceIP) {
+			response := GeneratePolicy(t.TenantId, "Allow", event.MethodArn)
+			response.Context = map[string]interface{}{tenant.ContextKey: t.TenantId}
+			return response, nil
 		} else {
-			return GeneratePolicy("user", "Deny", event.MethodArn), nil
+			return GeneratePolicy(t.TenantId, "Deny", event.MethodArn), nil
 		}
 	}
 
-	return GeneratePolicy("user", "Deny", event.MethodArn), nil
+	return GeneratePolicy(t.TenantId, "Deny", event.MethodArn), nil
 }
 
 func main() {
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+	secrets = awsclient.NewSecretStore(awsConfig)
+
 	lambda.Start(lambdaHandler)
 }
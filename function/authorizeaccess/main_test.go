@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/jobtoken"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testTable     = "AuthTable"
+	testSecretArn = "keyset"
+	testKeyset    = `{"current": "k1", "k1": "0123456789abcdef0123456789abcdef"}`
+	testMethodArn = "arn:aws:execute-api:us-east-1:000000000000:api/prod/GET/access-object"
+)
+
+// setup points the lambda at fakes holding a tenant, it returns the API key
+// of the tenant.
+func setup(t *testing.T, admin bool) (*fake.DynamoDB, *tenant.Tenant, string) {
+
+	t.Helper()
+	authTableName, jobTokenSecret = testTable, testSecretArn
+	store := fake.NewDynamoDB(testTable)
+	dynamo, secrets = store, fake.Secrets{testSecretArn: testKeyset}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	owner := &tenant.Tenant{Pk: tenant.TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1", Name: "test", Status: tenant.StatusActive, CreatedAt: now, Admin: admin}
+	store.Put(testTable, owner)
+	key, item, err := tenant.NewAPIKey(owner.TenantId, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(testTable, item)
+	return store, owner, key
+}
+
+func issue(t *testing.T, subject, tenantId, scope string) string {
+
+	t.Helper()
+	keyset, err := jobtoken.ParseKeyset([]byte(testKeyset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := keyset.Issue(subject, tenantId, []string{scope}, "", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func request(resource, key, token string, query map[string]string) events.APIGatewayCustomAuthorizerRequestTypeRequest {
+
+	headers := map[string]string{tenant.APIKeyHeader: key}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		MethodArn:             testMethodArn,
+		Resource:              resource,
+		Headers:               headers,
+		QueryStringParameters: query,
+	}
+}
+
+func effect(t *testing.T, response events.APIGatewayCustomAuthorizerResponse, err error) string {
+
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.PolicyDocument.Statement) != 1 {
+		t.Fatalf("policy has %d statements", len(response.PolicyDocument.Statement))
+	}
+	return response.PolicyDocument.Statement[0].Effect
+}
+
+func TestAPIKeyRoute(t *testing.T) {
+
+	_, owner, key := setup(t, false)
+
+	response, err := lambdaHandler(context.Background(), request("/generate-url", key, "", nil))
+	if got := effect(t, response, err); got != "Allow" {
+		t.Fatalf("effect = %s, want Allow", got)
+	}
+	if got := response.PolicyDocument.Statement[0].Resource[0]; got != stageArn(testMethodArn) {
+		t.Errorf("resource = %s, want the stage", got)
+	}
+	if got := response.Context[tenant.ContextKey]; got != owner.TenantId {
+		t.Errorf("tenant = %v, want %s", got, owner.TenantId)
+	}
+}
+
+func TestDeniesInvalidAPIKey(t *testing.T) {
+
+	setup(t, false)
+
+	for _, key := range []string{"", "itk_missing_secret", "not-a-key"} {
+		response, err := lambdaHandler(context.Background(), request("/generate-url", key, "", nil))
+		if got := effect(t, response, err); got != "Deny" {
+			t.Errorf("effect of %q = %s, want Deny", key, got)
+		}
+	}
+}
+
+func TestDeniesUnknownRoute(t *testing.T) {
+
+	_, _, key := setup(t, false)
+
+	response, err := lambdaHandler(context.Background(), request("/unknown", key, "", nil))
+	if got := effect(t, response, err); got != "Deny" {
+		t.Fatalf("effect = %s, want Deny", got)
+	}
+}
+
+func TestAdminRoute(t *testing.T) {
+
+	for _, admin := range []bool{false, true} {
+		_, _, key := setup(t, admin)
+
+		response, err := lambdaHandler(context.Background(), request("/admin/tenants/{tenantId}/limits", key, "", nil))
+		want := "Deny"
+		if admin {
+			want = "Allow"
+		}
+		if got := effect(t, response, err); got != want {
+			t.Errorf("effect for admin %t = %s, want %s", admin, got, want)
+		}
+	}
+}
+
+func TestJobTokenRoute(t *testing.T) {
+
+	_, owner, key := setup(t, false)
+	query := map[string]string{"object-name": "image-1.png"}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"valid", issue(t, "image-1.png", owner.TenantId, jobtoken.ScopeRead), "Allow"},
+		{"missing", "", "Deny"},
+		{"other object", issue(t, "image-2.png", owner.TenantId, jobtoken.ScopeRead), "Deny"},
+		{"other tenant", issue(t, "image-1.png", "t-2", jobtoken.ScopeRead), "Deny"},
+		{"other scope", issue(t, "image-1.png", owner.TenantId, jobtoken.ScopeTransform), "Deny"},
+	}
+	for _, test := range tests {
+		response, err := lambdaHandler(context.Background(), request("/access-object", key, test.token, query))
+		if got := effect(t, response, err); got != test.want {
+			t.Errorf("%s: effect = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDeniesWhenTableFails(t *testing.T) {
+
+	store, _, key := setup(t, false)
+	store.Errors = map[string]error{"GetItem": errors.New("throttled")}
+
+	response, err := lambdaHandler(context.Background(), request("/generate-url", key, "", nil))
+	if got := effect(t, response, err); got != "Deny" {
+		t.Fatalf("effect = %s, want Deny", got)
+	}
+}
+
+// TestSourceIP denies the token bound to another source IP, or presented by a
+// request without one.
+func TestSourceIP(t *testing.T) {
+
+	_, owner, key := setup(t, false)
+	keyset, err := jobtoken.ParseKeyset([]byte(testKeyset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := keyset.Issue("image-1.png", owner.TenantId, []string{jobtoken.ScopeRead}, "203.0.113.7", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sourceIP, want := range map[string]string{"203.0.113.7": "Allow", "198.51.100.1": "Deny", "": "Deny"} {
+		event := request("/access-object", key, token, map[string]string{"object-name": "image-1.png"})
+		event.RequestContext.Identity.SourceIP = sourceIP
+		response, err := lambdaHandler(context.Background(), event)
+		if got := effect(t, response, err); got != want {
+			t.Errorf("source ip %q: effect = %s, want %s", sourceIP, got, want)
+		}
+	}
+}
+
+// TestFailsWhenKeysetFails returns the error, which API Gateway answers with a
+// 500 carrying its request id, rather than deny a valid token.
+func TestFailsWhenKeysetFails(t *testing.T) {
+
+	_, owner, key := setup(t, false)
+	jobTokenSecret = "arn:aws:secretsmanager:us-east-1:000000000000:secret:missing"
+
+	token := issue(t, "image-1.png", owner.TenantId, jobtoken.ScopeRead)
+	response, err := lambdaHandler(context.Background(), request("/access-object", key, token, map[string]string{"object-name": "image-1.png"}))
+	if err == nil || len(response.PolicyDocument.Statement) != 0 {
+		t.Errorf("policy = %+v, err = %v, want an error", response.PolicyDocument, err)
+	}
+}
@@ -6,12 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobevents"
+	"cdk_image_transform/internal/retry"
+	"cdk_image_transform/internal/sequencer"
+	"cdk_image_transform/internal/webhook"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -19,18 +26,16 @@ import (
 
 var authTableName = os.Getenv("AUTH_TABLE_NAME")
 
-var dynamo *dynamodb.Client
-
-func InitConfig() (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO())
-}
+var notifyQueueURL = os.Getenv("NOTIFY_QUEUE_URL")
+var jobEventsTopicArn = os.Getenv("JOB_EVENTS_TOPIC_ARN")
 
-func InitDynamo(config aws.Config) *dynamodb.Client {
-	return dynamodb.NewFromConfig(config)
-}
+var dynamo awsclient.JobStore
+var queue awsclient.Queue
+var topic awsclient.Topic
 
 type S3Object struct {
-	Key string `json:"key"`
+	Key       string `json:"key"`
+	Sequencer string `json:"sequencer"`
 }
 
 type S3Entity struct {
@@ -42,7 +47,8 @@ type Record struct {
 }
 
 type S3Event struct {
-	Records []Record `json:"Records"`
+	Records    []Record `json:"Records"`
+	JobVersion int      `json:"JobVersion,omitempty"`
 }
 
 type StatusValue struct {
@@ -53,26 +59,62 @@ type Item struct {
 	ObjectName string `json:"object-name"`
 }
 
-func createKey(Pk, Sk string) (map[string]types.AttributeValue, error) {
-	pk, err := attributevalue.Marshal(Pk)
+// failJob marks the job of the event failed, keeping the failure recorded by
+// the transform lambda, and returns its item. A job that an earlier delivery
+// of the message already failed is returned as it is, so that its
+// notification is sent again when it was lost. It returns nil when the job is
+// missing, was processed, ended otherwise or was claimed by a more recent
+// event.
+func failJob(ctx context.Context, key, eventSequencer string) (*job.Item, error) {
+
+	// the failure recorded by the transform lambda is kept
+	unknown := failure.Errorf(failure.Unknown, "the job failed without recording a reason").Failure
+	update, transition := job.Transition(job.StatusFailed, time.Now())
+	update = update.Set(expression.Name("Failure"), expression.Name("Failure").IfNotExists(expression.Value(unknown))).
+		Set(expression.Name(sequencer.Attribute), expression.Value(eventSequencer))
+	// a duplicate of an event that was processed doesn't fail the job
+	condition := expression.And(transition, sequencer.Claimable(eventSequencer))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal pk: %v", err)
+		return nil, fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	response, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(authTableName),
+		Key:                                 job.MetadataKey(key),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		UpdateExpression:                    expr.Update(),
+		ReturnValues:                        types.ReturnValueAllNew,
+		ConditionExpression:                 expr.Condition(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		claimedBy, _ := conditionFailed.Item[sequencer.Attribute].(*types.AttributeValueMemberS)
+		if claimedBy == nil || claimedBy.Value != eventSequencer {
+			return nil, nil
+		}
+		item, err := job.Unmarshal(conditionFailed.Item)
+		if err != nil || item.Status != job.StatusFailed {
+			return nil, err
+		}
+		return item, nil
 	}
-	sk, err := attributevalue.Marshal(Sk)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal sk: %v", err)
+		return nil, fmt.Errorf("failed to updated dynamodb item:  %v", err)
 	}
-	return map[string]types.AttributeValue{"pk": pk, "sk": sk}, nil
+
+	return job.Unmarshal(response.Attributes)
 }
 
-func lambdaHandler(ctx context.Context, sqsEvent events.SQSEvent) error {
+// lambdaHandler fails the jobs of the messages the transform lambda gave up
+// on and notifies their failure. Messages whose job couldn't be failed or
+// whose webhook couldn't be enqueued are returned in the batch item failures,
+// and notified on their retry.
+func lambdaHandler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
 
-	awsConfig, err := InitConfig()
-	if err != nil {
-		return fmt.Errorf("failed to load config: %v", err)
-	}
-	dynamo = InitDynamo(awsConfig)
-	var batchDLQErrors []error
+	var batchItemFailures []events.SQSBatchItemFailure
 
 	for _, message := range sqsEvent.Records {
 
@@ -80,48 +122,62 @@ func lambdaHandler(ctx context.Context, sqsEvent events.SQSEvent) error {
 		err := json.Unmarshal([]byte(message.Body), &s3Event)
 
 		if err != nil {
-			batchDLQErrors = append(batchDLQErrors, fmt.Errorf("error unmarshalling message: %v", err))
+			fmt.Printf("dropping %s, error unmarshalling message: %v\n", message.MessageId, err)
 			continue
 		}
 
+		var messageErrors []error
 		for _, record := range s3Event.Records {
 
-			update := expression.Set(expression.Name("Status"), expression.Value("broken"))
-			expr, err := expression.NewBuilder().WithUpdate(update).Build()
+			item, err := failJob(context.TODO(), record.S3.Object.Key, sequencer.Key(s3Event.JobVersion, record.S3.Object.Sequencer))
 			if err != nil {
-
-				batchDLQErrors = append(batchDLQErrors, fmt.Errorf("failed to build expression: %v", err))
+				messageErrors = append(messageErrors, err)
 				continue
 			}
-
-			key, err := createKey(record.S3.Object.Key, "metadata")
-			if err != nil {
-				batchDLQErrors = append(batchDLQErrors, fmt.Errorf("failed to create key: %v", err))
+			if item == nil {
+				fmt.Printf("skipping %s, the job is missing, was processed, ended or was claimed by a more recent event\n", record.S3.Object.Key)
 				continue
 			}
 
-			input := &dynamodb.UpdateItemInput{
-				TableName:                 aws.String(authTableName),
-				Key:                       key,
-				ExpressionAttributeNames:  expr.Names(),
-				ExpressionAttributeValues: expr.Values(),
-				UpdateExpression:          expr.Update(),
-				ReturnValues:              types.ReturnValueUpdatedNew,
-				ConditionExpression:       aws.String("attribute_exists(pk) AND attribute_exists(sk)"),
+			if item.CallbackURL != "" {
+				if err := webhook.Enqueue(context.TODO(), queue, notifyQueueURL, item.Notification()); err != nil {
+					messageErrors = append(messageErrors, err)
+				}
 			}
 
-			_, err = dynamo.UpdateItem(context.TODO(), input)
-			if err != nil {
-
-				batchDLQErrors = append(batchDLQErrors, fmt.Errorf("failed to updated dynamodb item:  %v", err))
-				continue
+			event := jobevents.New(jobevents.ImageJobFailed, jobevents.Detail{
+				JobId:    item.Pk,
+				TenantId: item.TenantId,
+				Status:   string(item.Status),
+				Attempt:  retry.ReceiveCount(message),
+				Failure:  item.Failure,
+			}, time.Now())
+			if err := jobevents.Publish(context.TODO(), topic, jobEventsTopicArn, event); err != nil {
+				fmt.Println(err)
 			}
 		}
+
+		if len(messageErrors) > 0 {
+			fmt.Printf("retrying %s: %v\n", message.MessageId, errors.Join(messageErrors...))
+			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
+		}
 	}
 
-	return errors.Join(batchDLQErrors...)
+	return events.SQSEventResponse{BatchItemFailures: batchItemFailures}, nil
 }
 
 func main() {
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+	queue = awsclient.NewQueue(awsConfig)
+	topic = awsclient.NewTopic(awsConfig)
+
 	lambda.Start(lambdaHandler)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobevents"
+	"cdk_image_transform/internal/sequencer"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testTable  = "AuthTable"
+	testQueue  = "https://sqs.local/NotifyQueue"
+	testTopic  = "arn:aws:sns:us-east-1:000000000000:JobEventsTopic"
+	testObject = "image-1.png"
+)
+
+func setup(t *testing.T) (*fake.DynamoDB, *fake.Queue, *fake.Topic) {
+
+	t.Helper()
+	authTableName, notifyQueueURL, jobEventsTopicArn = testTable, testQueue, testTopic
+	store, sent, published := fake.NewDynamoDB(testTable), &fake.Queue{}, &fake.Topic{}
+	dynamo, queue, topic = store, sent, published
+	store.Put(testTable, map[string]any{
+		"pk":          testObject,
+		"sk":          "metadata",
+		"TenantId":    "t-1",
+		"Status":      "queued",
+		"CallbackURL": "https://example.com/hook",
+	})
+	return store, sent, published
+}
+
+func message(t *testing.T, key, s3Sequencer string) events.SQSEvent {
+
+	body, err := json.Marshal(S3Event{Records: []Record{{S3: S3Entity{Object: S3Object{Key: key, Sequencer: s3Sequencer}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.SQSEvent{Records: []events.SQSMessage{{MessageId: "m-1", Body: string(body)}}}
+}
+
+// run invokes the handler and returns the ids of the failed messages.
+func run(t *testing.T, event events.SQSEvent) []string {
+
+	t.Helper()
+	response, err := lambdaHandler(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for _, failure := range response.BatchItemFailures {
+		failed = append(failed, failure.ItemIdentifier)
+	}
+	return failed
+}
+
+func TestFailsJob(t *testing.T) {
+
+	store, sent, published := setup(t)
+
+	if failed := run(t, message(t, testObject, "0A")); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != job.StatusFailed || item.FailedAt == "" || item.Failure == nil || item.Failure.Type != failure.Unknown {
+		t.Errorf("job = %+v, want failed with an unknown failure", item)
+	}
+	if len(sent.Sent) != 1 {
+		t.Errorf("enqueued %d notifications, want 1", len(sent.Sent))
+	}
+	if len(published.Published) != 1 {
+		t.Fatalf("published %d events, want 1", len(published.Published))
+	}
+	var event jobevents.Event
+	json.Unmarshal([]byte(*published.Published[0].Message), &event)
+	if event.Type != jobevents.ImageJobFailed || event.Detail.JobId != testObject {
+		t.Errorf("event = %+v, want %s of %s", event, jobevents.ImageJobFailed, testObject)
+	}
+}
+
+func TestKeepsRecordedFailure(t *testing.T) {
+
+	store, _, _ := setup(t)
+	recorded := failure.Failure{Type: failure.StorageError, Message: "throttled"}
+	store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "processing", "Failure": recorded})
+
+	if failed := run(t, message(t, testObject, "0A")); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Failure == nil || item.Failure.Type != failure.StorageError {
+		t.Errorf("failure = %+v, want the recorded one", item.Failure)
+	}
+}
+
+func TestSkipsEndedOrMissingJob(t *testing.T) {
+
+	store, sent, published := setup(t)
+	store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "Status": "succeeded", sequencer.ProcessedAttribute: sequencer.Key(1, "0B")})
+	store.Put(testTable, map[string]any{"pk": "image-3.png", "sk": "metadata", "Status": "cancelled"})
+	// failed by a more recent event, which notified it
+	store.Put(testTable, map[string]any{"pk": "image-4.png", "sk": "metadata", "Status": "failed", sequencer.Attribute: sequencer.Key(1, "0B")})
+
+	for _, key := range []string{testObject, "image-2.png", "image-3.png", "image-4.png"} {
+		if failed := run(t, message(t, key, "0A")); len(failed) != 0 {
+			t.Fatalf("%s: failed %v", key, failed)
+		}
+	}
+
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != job.StatusSucceeded {
+		t.Errorf("status = %s, want succeeded", item.Status)
+	}
+	store.Get(testTable, "image-3.png", "metadata", &item)
+	if item.Status != job.StatusCancelled {
+		t.Errorf("status = %s, want cancelled", item.Status)
+	}
+	if len(sent.Sent) != 0 || len(published.Published) != 0 {
+		t.Errorf("notified %d and published %d, want nothing", len(sent.Sent), len(published.Published))
+	}
+}
+
+func TestFails(t *testing.T) {
+
+	// a message that isn't an event never will be
+	setup(t)
+	event := message(t, testObject, "0A")
+	event.Records[0].Body = "{"
+	if failed := run(t, event); len(failed) != 0 {
+		t.Errorf("invalid body: failed %v, want it dropped", failed)
+	}
+
+	store, _, _ := setup(t)
+	store.Errors = map[string]error{"UpdateItem": errors.New("throttled")}
+	if failed := run(t, message(t, testObject, "0A")); len(failed) != 1 || failed[0] != "m-1" {
+		t.Errorf("table: failed %v, want the message", failed)
+	}
+}
+
+func TestNotifiesOnRetry(t *testing.T) {
+
+	// the job fails even when it can't be notified
+	store, sent, published := setup(t)
+	sent.Errors = map[string]error{"SendMessage": errors.New("throttled")}
+	published.Errors = map[string]error{"Publish": errors.New("throttled")}
+	if failed := run(t, message(t, testObject, "0A")); len(failed) != 1 {
+		t.Fatalf("failed %v, want the message", failed)
+	}
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != job.StatusFailed {
+		t.Errorf("status = %s, want failed", item.Status)
+	}
+
+	// the retry finds the job failed by its event and notifies it, events
+	// that can't be published are only logged
+	sent.Errors = nil
+	if failed := run(t, message(t, testObject, "0A")); len(failed) != 0 {
+		t.Fatalf("retry failed %v", failed)
+	}
+	if len(sent.Sent) != 1 || len(published.Published) != 0 {
+		t.Errorf("notified %d and published %d, want 1 and 0", len(sent.Sent), len(published.Published))
+	}
+}
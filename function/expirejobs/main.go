@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/quota"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var authTableName = os.Getenv("AUTH_TABLE_NAME")
+
+var dynamo awsclient.JobStore
+
+// parseUploadExpiry reads the image of a removed job.UploadExpiry.
+func parseUploadExpiry(image map[string]events.DynamoDBAttributeValue) (*job.UploadExpiry, error) {
+
+	expiry := &job.UploadExpiry{}
+	for name, value := range map[string]*string{"pk": &expiry.Pk, "sk": &expiry.Sk, "TenantId": &expiry.TenantId, "ChargedAt": &expiry.ChargedAt} {
+		attribute, ok := image[name]
+		if !ok || attribute.DataType() != events.DataTypeString {
+			return nil, fmt.Errorf("the upload expiry has no %s", name)
+		}
+		*value = attribute.String()
+	}
+
+	expiresAt, ok := image["ExpiresAt"]
+	if !ok || expiresAt.DataType() != events.DataTypeNumber {
+		return nil, fmt.Errorf("the upload expiry of %s has no ExpiresAt", expiry.Pk)
+	}
+	expiry.ExpiresAt, _ = expiresAt.Integer()
+	if megapixels, ok := image["Megapixels"]; ok && megapixels.DataType() == events.DataTypeNumber {
+		expiry.Megapixels, _ = strconv.Atoi(megapixels.Number())
+	}
+	return expiry, nil
+}
+
+// expireJob moves the job of expiry to expired when it is still pending its
+// upload, at the time the upload was due, then gives back the quota charged
+// for it. A failed refund is only logged, the counter of its window may have
+// expired already.
+func expireJob(ctx context.Context, expiry *job.UploadExpiry) error {
+
+	update, transition := job.Transition(job.StatusExpired, time.Unix(expiry.ExpiresAt, 0))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(transition).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(authTableName),
+		Key:                       job.MetadataKey(expiry.Pk),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		fmt.Printf("skipping %s, its upload came or it was removed\n", expiry.Pk)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to expire job %s: %v", expiry.Pk, err)
+	}
+
+	chargedAt, err := time.Parse(time.RFC3339, expiry.ChargedAt)
+	if err == nil {
+		err = quota.RefundJob(ctx, dynamo, authTableName, expiry.TenantId, expiry.Megapixels, chargedAt)
+	}
+	if err != nil {
+		fmt.Printf("failed to refund the expired job %s: %v\n", expiry.Pk, err)
+	}
+	return nil
+}
+
+// lambdaHandler expires the jobs whose job.UploadExpiry was removed by the
+// time to live of the table. The records whose job couldn't be expired are
+// returned in the batch item failures to be retried.
+func lambdaHandler(ctx context.Context, streamEvent events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+
+	var batchItemFailures []events.DynamoDBBatchItemFailure
+	for _, record := range streamEvent.Records {
+
+		// the stream is filtered on these, the other items expire quota counters
+		sk, ok := record.Change.OldImage["sk"]
+		if record.EventName != string(events.DynamoDBOperationTypeRemove) || !ok || sk.DataType() != events.DataTypeString || sk.String() != job.UploadExpirySk {
+			continue
+		}
+		expiry, err := parseUploadExpiry(record.Change.OldImage)
+		if err != nil {
+			fmt.Printf("dropping %s: %v\n", record.EventID, err)
+			continue
+		}
+
+		if err := expireJob(ctx, expiry); err != nil {
+			fmt.Println(err)
+			batchItemFailures = append(batchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+		}
+	}
+
+	return events.DynamoDBEventResponse{BatchItemFailures: batchItemFailures}, nil
+}
+
+func main() {
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to load aws config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+
+	lambda.Start(lambdaHandler)
+}
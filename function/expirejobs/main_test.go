@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/quota"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testTable  = "AuthTable"
+	testObject = "image-1.png"
+)
+
+// setup points the lambda at a fake table holding a job of status charged to
+// t-1, and returns the record of the removal of its upload expiry.
+func setup(t *testing.T, status job.Status) (*fake.DynamoDB, events.DynamoDBEventRecord) {
+
+	t.Helper()
+	authTableName = testTable
+	store := fake.NewDynamoDB(testTable)
+	dynamo = store
+
+	created := time.Now().Add(-job.UploadTimeout)
+	if _, err := quota.ChargeJob(context.Background(), store, testTable, "t-1", quota.DefaultLimits, 4, created); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(testTable, map[string]any{
+		"pk":        testObject,
+		"sk":        "metadata",
+		"TenantId":  "t-1",
+		"Status":    string(status),
+		"CreatedAt": created.UTC().Format(time.RFC3339),
+	})
+
+	expiry := job.NewUploadExpiry(testObject, "t-1", 4, created, created)
+	return store, events.DynamoDBEventRecord{
+		EventID:   "e-1",
+		EventName: string(events.DynamoDBOperationTypeRemove),
+		Change: events.DynamoDBStreamRecord{
+			SequenceNumber: "100",
+			OldImage: map[string]events.DynamoDBAttributeValue{
+				"pk":         events.NewStringAttribute(expiry.Pk),
+				"sk":         events.NewStringAttribute(expiry.Sk),
+				"TenantId":   events.NewStringAttribute(expiry.TenantId),
+				"Megapixels": events.NewNumberAttribute(strconv.Itoa(expiry.Megapixels)),
+				"ChargedAt":  events.NewStringAttribute(expiry.ChargedAt),
+				"ExpiresAt":  events.NewNumberAttribute(strconv.FormatInt(expiry.ExpiresAt, 10)),
+			},
+		},
+	}
+}
+
+// run invokes the handler and returns the sequence numbers of the failed records.
+func run(t *testing.T, records ...events.DynamoDBEventRecord) []string {
+
+	t.Helper()
+	response, err := lambdaHandler(context.Background(), events.DynamoDBEvent{Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for _, failure := range response.BatchItemFailures {
+		failed = append(failed, failure.ItemIdentifier)
+	}
+	return failed
+}
+
+// used returns the jobs and megapixels counted against t-1 when the job was charged.
+func used(t *testing.T, store *fake.DynamoDB) (int, int) {
+
+	t.Helper()
+	usages, err := quota.Current(context.Background(), store, testTable, "t-1", quota.DefaultLimits, time.Now().Add(-job.UploadTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usages[1].Used, usages[2].Used
+}
+
+func TestExpiresPendingJob(t *testing.T) {
+
+	store, record := setup(t, job.StatusPendingUpload)
+
+	if failed := run(t, record); len(failed) != 0 {
+		t.Fatalf("failed = %v, want none", failed)
+	}
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	expiresAt, _ := record.Change.OldImage["ExpiresAt"].Integer()
+	dueAt := time.Unix(expiresAt, 0).UTC().Format(time.RFC3339)
+	if item.Status != job.StatusExpired || item.ExpiredAt != dueAt {
+		t.Errorf("job = %s expired at %q, want expired at %s", item.Status, item.ExpiredAt, dueAt)
+	}
+	if jobs, megapixels := used(t, store); jobs != 0 || megapixels != 0 {
+		t.Errorf("%d jobs and %d megapixels counted, want the job refunded", jobs, megapixels)
+	}
+
+	// a retried record doesn't refund the job twice
+	if failed := run(t, record); len(failed) != 0 {
+		t.Fatalf("failed = %v, want none", failed)
+	}
+	if jobs, _ := used(t, store); jobs != 0 {
+		t.Errorf("%d jobs counted, want 0", jobs)
+	}
+}
+
+func TestKeepsUploadedJob(t *testing.T) {
+
+	store, record := setup(t, job.StatusQueued)
+
+	if failed := run(t, record); len(failed) != 0 {
+		t.Fatalf("failed = %v, want none", failed)
+	}
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != job.StatusQueued {
+		t.Errorf("job = %s, want queued", item.Status)
+	}
+	if jobs, megapixels := used(t, store); jobs != 1 || megapixels != 4 {
+		t.Errorf("%d jobs and %d megapixels counted, want the job still charged", jobs, megapixels)
+	}
+}
+
+func TestIgnoresOtherRemovals(t *testing.T) {
+
+	store, record := setup(t, job.StatusPendingUpload)
+	counter := record
+	counter.Change.OldImage = map[string]events.DynamoDBAttributeValue{
+		"pk":        events.NewStringAttribute("tenant#t-1"),
+		"sk":        events.NewStringAttribute("quota#jobs#2024-01-01"),
+		"ExpiresAt": events.NewNumberAttribute("1"),
+	}
+	inserted := record
+	inserted.EventName = string(events.DynamoDBOperationTypeInsert)
+
+	if failed := run(t, counter, inserted); len(failed) != 0 {
+		t.Fatalf("failed = %v, want none", failed)
+	}
+	var item job.Item
+	store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != job.StatusPendingUpload {
+		t.Errorf("job = %s, want pending_upload", item.Status)
+	}
+}
+
+func TestRetriesWhenTableFails(t *testing.T) {
+
+	store, record := setup(t, job.StatusPendingUpload)
+	store.Errors = map[string]error{"UpdateItem": errors.New("throttled")}
+
+	if failed := run(t, record); len(failed) != 1 || failed[0] != "100" {
+		t.Errorf("failed = %v, want the record", failed)
+	}
+}
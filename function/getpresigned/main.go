@@ -6,16 +6,25 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobtoken"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/transforms"
+
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
 	"github.com/google/uuid"
@@ -23,31 +32,30 @@ import (
 
 var bucketName = os.Getenv("INPUT_BUCKET_NAME")
 var authName = os.Getenv("AUTH_TABLE_NAME")
+var jobTokenSecret = os.Getenv("JOB_TOKEN_SECRET_ARN")
 
-var svc *s3.Client
-var dynamo *dynamodb.Client
-
-type Transform struct {
-	Name   string   `dynamodbav:"Name" json:"Name"`
-	Params []string `dynamodbav:"Params" json:"Params"`
-}
-
-type OutputItem struct {
-	Pk          string      `dynamodbav:"pk" json:"pk"`
-	Sk          string      `dynamodbav:"sk" json:"sk"`
-	SourceIP    string      `dynamodbav:"SourceIP" json:"SourceIP"`
-	Status      string      `dynamodbav:"Status" json:"Status"`
-	ContentType string      `dynamodbav:"ContentType" json:"ContentType"`
-	Transforms  []Transform `dynamodbav:"Transforms" json:"Transforms"`
-}
+var svc awsclient.ObjectStore
+var presigner awsclient.Presigner
+var dynamo awsclient.JobStore
+var secrets awsclient.SecretStore
 
+// InputItem is the body of the POST request. Width and Height optionally
+// declare the dimensions of the upload, bounding the estimated pipeline cost.
+// BindSourceIP restricts the job token to the address of the caller.
+// CallbackURL is notified with a signed webhook once the job is finalized.
 type InputItem struct {
-	ObjectName string      `dynamodbav:"ObjectName"`
-	Transforms []Transform `dynamodbav:"Transforms"`
+	ObjectName   string                 `dynamodbav:"ObjectName"`
+	Width        int                    `dynamodbav:"Width"`
+	Height       int                    `dynamodbav:"Height"`
+	Transforms   []job.Transform        `dynamodbav:"Transforms"`
+	Output       *imaging.OutputOptions `dynamodbav:"Output"`
+	Renditions   []job.Rendition        `dynamodbav:"Renditions"`
+	BindSourceIP bool                   `dynamodbav:"BindSourceIP"`
+	CallbackURL  string                 `dynamodbav:"CallbackURL"`
 }
 
 func getResourceSuffix(resource string) *string {
-	allowedSuffixes := []string{".jpg", ".jpeg", ".png", ".gif"}
+	allowedSuffixes := []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff", ".webp"}
 	for _, suffix := range allowedSuffixes {
 		if strings.HasSuffix(resource, suffix) {
 			return &suffix
@@ -56,19 +64,45 @@ func getResourceSuffix(resource string) *string {
 	return nil
 }
 
-func InitConfig() (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO())
-}
+// outputExtensions returns the extension of the output of the job and of
+// each of its renditions, in the format the transform lambda encodes them.
+func outputExtensions(resourceSuffix string, inputItem *InputItem) (string, []string, error) {
 
-func InitDynamo(config aws.Config) *dynamodb.Client {
-	return dynamodb.NewFromConfig(config)
+	options, err := imaging.ParseOutputOptions(&imaging.Pipeline{ContentType: resourceSuffix, Transforms: job.Steps(inputItem.Transforms), Output: inputItem.Output})
+	if err != nil {
+		return "", nil, err
+	}
+	extensions := make([]string, len(inputItem.Renditions))
+	for i, rendition := range inputItem.Renditions {
+		renditionPipeline := &imaging.Pipeline{
+			ContentType: resourceSuffix,
+			Transforms:  job.Steps(rendition.Transforms),
+			Output:      imaging.MergeOutputOptions(options, rendition.Output),
+		}
+		renditionOptions, err := imaging.ParseOutputOptions(renditionPipeline)
+		if err != nil {
+			return "", nil, fmt.Errorf("rendition %s: %v", rendition.Name, err)
+		}
+		extensions[i] = renditionOptions.Extension()
+	}
+	return options.Extension(), extensions, nil
 }
 
-func InitS3(config aws.Config) *s3.Client {
-	return s3.NewFromConfig(config)
+// jobTokenTTL returns JOB_TOKEN_TTL in seconds, or the default lifetime of a token.
+func jobTokenTTL() time.Duration {
+
+	seconds, err := strconv.Atoi(os.Getenv("JOB_TOKEN_TTL"))
+	if err != nil || seconds <= 0 {
+		return jobtoken.DefaultTTL
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return apierror.Handle(ctx, request, handleRequest)
+}
+
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
 	if request.HTTPMethod != "POST" {
 		return events.APIGatewayProxyResponse{
@@ -77,13 +111,23 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 			fmt.Errorf("invalid http method")
 	}
 
+	tenantId := tenant.FromContext(request.RequestContext.Authorizer)
+	if tenantId == "" {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			fmt.Errorf("missing tenant in the authorizer context")
+	}
+
+	switch request.Resource {
+	case reprocessResource:
+		return reprocessRequest(ctx, request, tenantId)
+	}
+
 	var inputItem InputItem
 	err := json.Unmarshal([]byte(request.Body), &inputItem)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-				StatusCode: http.StatusInternalServerError,
-			},
-			fmt.Errorf("failed to parse request body: %v", err)
+		return validationErrorResponse([]transforms.ValidationError{{Field: "body", Message: err.Error()}})
 	}
 
 	resourceSuffix := getResourceSuffix(inputItem.ObjectName)
@@ -94,22 +138,76 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 			fmt.Errorf("unsupported resource type")
 	}
 
-	awsConfig, err := InitConfig()
+	if errs := ValidateRequest(&inputItem); len(errs) != 0 {
+		return validationErrorResponse(errs)
+	}
+
+	outputExtension, renditionExtensions, err := outputExtensions(*resourceSuffix, &inputItem)
+	if err != nil {
+		return validationErrorResponse([]transforms.ValidationError{{Field: "Output", Message: err.Error()}})
+	}
+
+	t, err := tenant.Get(context.TODO(), dynamo, authName, tenantId)
+	if err == nil && t == nil {
+		err = fmt.Errorf("unknown tenant %s", tenantId)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to get tenant: %v", err)
+	}
+
+	// the webhooks are signed with the secret of the tenant
+	if inputItem.CallbackURL != "" && t.WebhookSecret == "" {
+		return validationErrorResponse([]transforms.ValidationError{{
+			Field:   "CallbackURL",
+			Message: "the tenant has no webhook secret to sign the callbacks",
+		}})
+	}
+
+	// the quotas are checked before anything is presigned or stored
+	chargedAt := time.Now()
+	limited, quotaHeaders, err := chargeQuota(context.TODO(), t, &inputItem, chargedAt)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to check the quotas of %s: %v", tenantId, err)
+	}
+	if limited != nil {
+		return events.APIGatewayProxyResponse{}, limited
+	}
+
+	keyset, err := jobtoken.LoadKeyset(context.TODO(), secrets, jobTokenSecret)
 	if err != nil {
+		refundQuota(context.TODO(), t, &inputItem, chargedAt)
 		return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusInternalServerError,
 			},
-			fmt.Errorf("failed to initialize aws config: %v", err)
+			fmt.Errorf("failed to load job token keyset: %v", err)
 	}
 
-	svc = InitS3(awsConfig)
-	dynamo = InitDynamo(awsConfig)
+	uniqueID := "image-" + uuid.New().String()
+	uniqueObjectName := uniqueID + *resourceSuffix
 
-	uniqueObjectName := "image-" + uuid.New().String() + *resourceSuffix
+	headers := map[string]string{"object-name": uniqueObjectName, "output-name": uniqueID + outputExtension}
+	for name, value := range quotaHeaders {
+		headers[name] = value
+	}
 
-	presignClient := s3.NewPresignClient(svc)
+	if len(inputItem.Renditions) != 0 {
+		names := make([]string, len(inputItem.Renditions))
+		for i := range inputItem.Renditions {
+			rendition := &inputItem.Renditions[i]
+			rendition.OutputKey = uniqueID + "/" + rendition.Name + renditionExtensions[i]
+			names[i] = rendition.Name
+		}
+		delete(headers, "output-name")
+		headers["renditions"] = strings.Join(names, ",")
+	}
 
-	presignedURL, err := presignClient.PresignPutObject(context.TODO(), &s3.PutObjectInput{
+	presignedURL, err := presigner.PresignPutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(uniqueObjectName),
 	}, func(opts *s3.PresignOptions) {
@@ -117,35 +215,75 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 	})
 
 	if err != nil {
+		refundQuota(context.TODO(), t, &inputItem, chargedAt)
 		return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusInternalServerError,
 			},
 			fmt.Errorf("failed to generate presigned url: %v", err) // todo
 	}
 
-	outputItem := OutputItem{
+	// issued before the job is stored, a stored job always has a token
+	boundIP := ""
+	if inputItem.BindSourceIP {
+		boundIP = request.RequestContext.Identity.SourceIP
+	}
+	now, ttl := time.Now(), jobTokenTTL()
+	token, err := keyset.Issue(uniqueObjectName, tenantId, []string{jobtoken.ScopeRead, jobtoken.ScopeTransform}, boundIP, ttl, now)
+	if err != nil {
+		refundQuota(context.TODO(), t, &inputItem, chargedAt)
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to sign job token: %v", err)
+	}
+	headers["job-token"] = token
+	headers["job-token-expires"] = now.Add(ttl).UTC().Format(time.RFC3339)
+
+	created := time.Now()
+	createdAt := created.UTC().Format(time.RFC3339)
+	outputItem := job.Item{
 		Pk:          uniqueObjectName,
-		Sk:          "metadata",
+		Sk:          job.MetadataSk,
+		TenantId:    tenantId,
 		SourceIP:    request.RequestContext.Identity.SourceIP,
-		Status:      "processing",
+		Status:      job.StatusPendingUpload,
 		ContentType: *resourceSuffix,
+		OutputKey:   uniqueID + outputExtension,
+		Width:       inputItem.Width,
+		Height:      inputItem.Height,
 		Transforms:  inputItem.Transforms,
+		Output:      inputItem.Output,
+		Renditions:  inputItem.Renditions,
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+		CallbackURL: inputItem.CallbackURL,
+		JobVersion:  1,
 	}
 
-	av, err := attributevalue.MarshalMap(outputItem)
+	// the job expires unless its upload comes before the expiry is removed
+	var expiryAv map[string]types.AttributeValue
+	av, err := job.Marshal(&outputItem)
+	if err == nil {
+		expiry := job.NewUploadExpiry(uniqueObjectName, tenantId, jobMegapixels(&inputItem), chargedAt, created)
+		expiryAv, err = attributevalue.MarshalMap(expiry)
+	}
 	if err != nil {
+		refundQuota(context.TODO(), t, &inputItem, chargedAt)
 		return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusInternalServerError,
 			},
-			fmt.Errorf("failed to marshal item: %v", err)
+			err
 	}
 
-	_, err = dynamo.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(authName),
-		Item:      av,
+	_, err = dynamo.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{TableName: aws.String(authName), Item: av}},
+			{Put: &types.Put{TableName: aws.String(authName), Item: expiryAv}},
+		},
 	})
 
 	if err != nil {
+		refundQuota(context.TODO(), t, &inputItem, chargedAt)
 		return events.APIGatewayProxyResponse{
 				StatusCode: http.StatusInternalServerError,
 			},
@@ -153,12 +291,25 @@ func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (
 	}
 
 	return events.APIGatewayProxyResponse{
-		Headers:    map[string]string{"object-name": uniqueObjectName},
+		Headers:    headers,
 		Body:       presignedURL.URL,
 		StatusCode: http.StatusOK,
 	}, nil
 }
 
 func main() {
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to initialize aws config: %v\n", err)
+		os.Exit(1)
+	}
+	svc = awsclient.NewObjectStore(awsConfig)
+	presigner = awsclient.NewPresigner(awsConfig)
+	dynamo = awsclient.NewJobStore(awsConfig)
+	secrets = awsclient.NewSecretStore(awsConfig)
+	queue = awsclient.NewQueue(awsConfig)
+	topic = awsclient.NewTopic(awsConfig)
+
 	lambda.Start(lambdaHandler)
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobtoken"
+	"cdk_image_transform/internal/quota"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testTable     = "AuthTable"
+	testBucket    = "input-bucket"
+	testQueue     = "https://sqs.local/BucketUploadQueue"
+	testTopic     = "arn:aws:sns:us-east-1:000000000000:JobEventsTopic"
+	testSecretArn = "keyset"
+	testKeyset    = `{"current": "k1", "k1": "0123456789abcdef0123456789abcdef"}`
+)
+
+// setup points the lambda at fakes holding a tenant with a webhook secret.
+func setup(t *testing.T) (*fake.DynamoDB, *fake.S3, *fake.Queue) {
+
+	t.Helper()
+	bucketName, authName, jobTokenSecret, uploadQueueURL, jobEventsTopicArn = testBucket, testTable, testSecretArn, testQueue, testTopic
+	store, objects, sent := fake.NewDynamoDB(testTable), fake.NewS3(testBucket), &fake.Queue{}
+	dynamo, svc, presigner, queue, topic = store, objects, objects, sent, &fake.Topic{}
+	secrets = fake.Secrets{testSecretArn: testKeyset}
+
+	store.Put(testTable, &tenant.Tenant{Pk: tenant.TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1", Status: tenant.StatusActive, WebhookSecret: "whsec_test"})
+	return store, objects, sent
+}
+
+func request(resource, body string, pathParameters map[string]string) events.APIGatewayProxyRequest {
+
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Resource:       resource,
+		Body:           body,
+		PathParameters: pathParameters,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{tenant.ContextKey: "t-1"},
+			Identity:   events.APIGatewayRequestIdentity{SourceIP: "203.0.113.1"},
+		},
+	}
+}
+
+func TestGeneratesURL(t *testing.T) {
+
+	store, _, _ := setup(t)
+
+	response, err := lambdaHandler(context.Background(), request("/generate-url", `{"ObjectName": "cat.jpeg", "Transforms": [{"Name": "grayscale"}], "Output": {"Format": "png"}}`, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", response.StatusCode, response.Body)
+	}
+
+	objectName := response.Headers["object-name"]
+	if !strings.HasPrefix(objectName, "image-") || !strings.HasSuffix(objectName, ".jpeg") {
+		t.Errorf("object name = %s, want image-<id>.jpeg", objectName)
+	}
+	if want := strings.TrimSuffix(objectName, ".jpeg") + ".png"; response.Headers["output-name"] != want {
+		t.Errorf("output name = %s, want %s", response.Headers["output-name"], want)
+	}
+	if !strings.Contains(response.Body, "/"+testBucket+"/"+objectName+"?") {
+		t.Errorf("url = %s, want an upload url of %s", response.Body, objectName)
+	}
+
+	var item job.Item
+	if !store.Get(testTable, objectName, "metadata", &item) {
+		t.Fatal("the job wasn't stored")
+	}
+	if item.Status != job.StatusPendingUpload || item.TenantId != "t-1" || item.JobVersion != 1 || len(item.Transforms) != 1 {
+		t.Errorf("job = %+v", item)
+	}
+	if item.SchemaVersion != job.SchemaVersion {
+		t.Errorf("schema version = %d, want %d", item.SchemaVersion, job.SchemaVersion)
+	}
+	var expiry job.UploadExpiry
+	if !store.Get(testTable, objectName, job.UploadExpirySk, &expiry) || expiry.TenantId != "t-1" || expiry.Megapixels == 0 {
+		t.Errorf("upload expiry = %+v, want the quota charged to t-1", expiry)
+	}
+	if createdAt, _ := time.Parse(time.RFC3339, item.CreatedAt); expiry.ExpiresAt != createdAt.Add(job.UploadTimeout).Unix() {
+		t.Errorf("upload expires at %d, want an upload timeout after %s", expiry.ExpiresAt, item.CreatedAt)
+	}
+
+	keyset, err := jobtoken.ParseKeyset([]byte(testKeyset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := keyset.Verify(response.Headers["job-token"], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != objectName || claims.Tenant != "t-1" {
+		t.Errorf("claims = %+v, want the job of t-1", claims)
+	}
+}
+
+func TestRejectsInvalidJobs(t *testing.T) {
+
+	setup(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid json", `{"ObjectName": "cat.png",`, http.StatusBadRequest},
+		{"unsupported type", `{"ObjectName": "cat.svg"}`, http.StatusUnsupportedMediaType},
+		{"unknown transform", `{"ObjectName": "cat.png", "Transforms": [{"Name": "sharpen-more"}]}`, http.StatusBadRequest},
+		{"insecure callback", `{"ObjectName": "cat.png", "CallbackURL": "http://example.com/hook"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		response, _ := lambdaHandler(context.Background(), request("/generate-url", test.body, nil))
+		if response.StatusCode != test.want {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, response.StatusCode, test.want, response.Body)
+		}
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+
+	store, _, _ := setup(t)
+	store.Put(testTable, &tenant.Tenant{Pk: tenant.TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1", Status: tenant.StatusActive, Limits: &quota.Limits{JobsPerDay: 1}})
+
+	body := `{"ObjectName": "cat.png", "Width": 100, "Height": 100}`
+	for n, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		response, err := lambdaHandler(context.Background(), request("/generate-url", body, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != want {
+			t.Fatalf("request %d: status = %d, want %d", n, response.StatusCode, want)
+		}
+		// the 429 keeps the quota headers in the error envelope
+		if want == http.StatusTooManyRequests && (!fake.IsErrorEnvelope(response, err, want) || response.Headers["Retry-After"] == "" || response.Headers["X-Quota-Jobs-Remaining"] != "0") {
+			t.Errorf("429 = %v %s, want the error envelope with the quota headers", response.Headers, response.Body)
+		}
+	}
+}
+
+// jobsUsed returns the requests and jobs counted against t-1 today.
+func jobsUsed(t *testing.T, store *fake.DynamoDB) (int, int) {
+
+	t.Helper()
+	usages, err := quota.Current(context.Background(), store, testTable, "t-1", quota.DefaultLimits, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usages[0].Used, usages[1].Used
+}
+
+func TestRefundsFailedJobs(t *testing.T) {
+
+	failures := map[string]func(store *fake.DynamoDB, objects *fake.S3){
+		"TransactWriteItems": func(store *fake.DynamoDB, _ *fake.S3) {
+			store.Errors = map[string]error{"TransactWriteItems": errors.New("throttled")}
+		},
+		"PresignPutObject": func(_ *fake.DynamoDB, objects *fake.S3) {
+			objects.Errors = map[string]error{"PresignPutObject": errors.New("no credentials")}
+		},
+		"keyset": func(*fake.DynamoDB, *fake.S3) { jobTokenSecret = "missing" },
+	}
+	for name, fail := range failures {
+		store, objects, _ := setup(t)
+		fail(store, objects)
+
+		response, err := lambdaHandler(context.Background(), request("/generate-url", `{"ObjectName": "cat.png"}`, nil))
+		if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+			t.Errorf("%s: status = %d, err = %v, want a 500 error envelope", name, response.StatusCode, err)
+		}
+		// the request is counted but not the job that wasn't created
+		if requests, jobs := jobsUsed(t, store); requests != 1 || jobs != 0 {
+			t.Errorf("%s: %d requests and %d jobs counted, want only the request", name, requests, jobs)
+		}
+	}
+}
+
+func TestFails(t *testing.T) {
+
+	for _, operation := range []string{"GetItem", "TransactWriteItems", "UpdateItem"} {
+		store, _, _ := setup(t)
+		store.Errors = map[string]error{operation: errors.New("throttled")}
+
+		response, err := lambdaHandler(context.Background(), request("/generate-url", `{"ObjectName": "cat.png"}`, nil))
+		if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+			t.Errorf("%s: status = %d, err = %v, want a 500 error envelope", operation, response.StatusCode, err)
+		}
+	}
+
+	_, objects, _ := setup(t)
+	objects.Errors = map[string]error{"PresignPutObject": errors.New("no credentials")}
+	response, err := lambdaHandler(context.Background(), request("/generate-url", `{"ObjectName": "cat.png"}`, nil))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Errorf("presign: status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+}
+
+func TestOutputExtensions(t *testing.T) {
+
+	format := func(name string) []job.Transform {
+		return []job.Transform{{Name: "format", Params: []string{name}}}
+	}
+	tests := []struct {
+		suffix     string
+		item       InputItem
+		extension  string
+		renditions []string
+	}{
+		{".jpeg", InputItem{}, ".jpg", nil},
+		{".tif", InputItem{}, ".tiff", nil},
+		// formats that can only be decoded fall back to png
+		{".webp", InputItem{}, ".png", nil},
+		{".png", InputItem{Output: &imaging.OutputOptions{Format: "jpeg"}}, ".jpg", nil},
+		// the format transform wins over the Output block
+		{".png", InputItem{Transforms: format("gif"), Output: &imaging.OutputOptions{Format: "jpeg"}}, ".gif", nil},
+		// the renditions inherit the format of the job unless they set theirs
+		{".png", InputItem{Transforms: format("jpeg"), Renditions: []job.Rendition{
+			{Name: "same"},
+			{Name: "output", Output: &imaging.OutputOptions{Format: "bmp"}},
+			{Name: "transform", Transforms: format("tiff")},
+		}}, ".jpg", []string{".jpg", ".bmp", ".tiff"}},
+	}
+	for _, test := range tests {
+		extension, renditions, err := outputExtensions(test.suffix, &test.item)
+		if err != nil || extension != test.extension || !slices.Equal(renditions, test.renditions) {
+			t.Errorf("%s %+v: extensions = %s, %v, %v, want %s, %v", test.suffix, test.item, extension, renditions, err, test.extension, test.renditions)
+		}
+	}
+
+	if _, _, err := outputExtensions(".png", &InputItem{Output: &imaging.OutputOptions{Format: "webp"}}); err == nil {
+		t.Error("webp output: want an error")
+	}
+}
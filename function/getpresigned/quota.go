@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/quota"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/transforms"
+)
+
+var quotaHeaderNames = map[string]string{
+	quota.Requests:   "X-Quota-Requests",
+	quota.Jobs:       "X-Quota-Jobs",
+	quota.Megapixels: "X-Quota-Megapixels",
+}
+
+// jobMegapixels returns the megapixels charged for the job, of the declared
+// dimensions or of the largest allowed image.
+func jobMegapixels(inputItem *InputItem) int {
+
+	width, height := inputItem.Width, inputItem.Height
+	if width == 0 || height == 0 {
+		width, height = MaxImageWidth, MaxImageHeight
+	}
+	return quota.ImageMegapixels(width, height)
+}
+
+// addQuotaHeaders reports the limit, the remaining quota and the reset time,
+// in unix seconds, of every window checked. Unlimited windows are left out.
+func addQuotaHeaders(headers map[string]string, usages []quota.Usage) {
+
+	for _, usage := range usages {
+		if usage.Limit == quota.Unlimited {
+			continue
+		}
+		name := quotaHeaderNames[usage.Name]
+		headers[name+"-Limit"] = strconv.Itoa(usage.Limit)
+		headers[name+"-Remaining"] = strconv.Itoa(usage.Remaining())
+		headers[name+"-Reset"] = strconv.FormatInt(usage.Reset.Unix(), 10)
+	}
+}
+
+// chargeQuota counts the job against the limits of the tenant at now. It
+// returns the 429 error to answer when a limit is exceeded, or the headers to
+// add to the response otherwise.
+func chargeQuota(ctx context.Context, t *tenant.Tenant, inputItem *InputItem, now time.Time) (*apierror.Error, map[string]string, error) {
+
+	usages, err := quota.ChargeJob(ctx, dynamo, authName, t.TenantId, t.Limits.Effective(), jobMegapixels(inputItem), now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := map[string]string{}
+	addQuotaHeaders(headers, usages)
+
+	exceeded := usages[len(usages)-1]
+	if !exceeded.Exceeded {
+		return nil, headers, nil
+	}
+
+	headers["Retry-After"] = strconv.Itoa(int(exceeded.RetryAfter(now).Seconds()))
+	limited := apierror.New(http.StatusTooManyRequests, transforms.ValidationError{
+		Field:   "Quota",
+		Message: fmt.Sprintf("the %s quota of %d is exceeded", exceeded.Name, exceeded.Limit),
+	})
+	limited.Headers = headers
+	return limited, nil, nil
+}
+
+// refundQuota gives back the job charged at chargedAt by chargeQuota, when it
+// failed to be created. The client gets the error of the failure, so a failed
+// refund is only logged.
+func refundQuota(ctx context.Context, t *tenant.Tenant, inputItem *InputItem, chargedAt time.Time) {
+
+	if err := quota.RefundJob(ctx, dynamo, authName, t.TenantId, jobMegapixels(inputItem), chargedAt); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobevents"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+var uploadQueueURL = os.Getenv("UPLOAD_QUEUE_URL")
+var jobEventsTopicArn = os.Getenv("JOB_EVENTS_TOPIC_ARN")
+
+var queue awsclient.Queue
+var topic awsclient.Topic
+
+// reprocessResource is the route of reprocessRequest.
+const reprocessResource = "/jobs/{id}/reprocess"
+
+// ReprocessItem is the body of a reprocess request, the new pipeline of the
+// job. The callback url of the job is kept when CallbackURL is empty.
+type ReprocessItem struct {
+	Transforms  []job.Transform        `json:"Transforms"`
+	Output      *imaging.OutputOptions `json:"Output"`
+	Renditions  []job.Rendition        `json:"Renditions"`
+	CallbackURL string                 `json:"CallbackURL"`
+}
+
+// ReprocessResponse describes the new version of the job.
+type ReprocessResponse struct {
+	Id         string     `json:"Id"`
+	JobVersion int        `json:"JobVersion"`
+	Status     job.Status `json:"Status"`
+	OutputKey  string     `json:"OutputKey,omitempty"`
+	Renditions []string   `json:"Renditions,omitempty"`
+}
+
+// uploadRecord and uploadEvent are the fields of an S3 event read by the
+// transform lambda.
+type uploadRecord struct {
+	EventTime string `json:"eventTime"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key       string `json:"key"`
+			Size      int    `json:"size"`
+			ETag      string `json:"eTag"`
+			Sequencer string `json:"sequencer"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+type uploadEvent struct {
+	Records    []uploadRecord `json:"Records"`
+	JobVersion int            `json:"JobVersion"`
+}
+
+// versionedOutputKeys returns the output keys of a version of the job. The
+// first version keeps the keys it was created with, the later ones are
+// written under <id>/v<version> so the earlier results stay until they expire.
+func versionedOutputKeys(objectName, resourceSuffix string, version int, inputItem *InputItem) (string, error) {
+
+	outputExtension, renditionExtensions, err := outputExtensions(resourceSuffix, inputItem)
+	if err != nil {
+		return "", err
+	}
+	uniqueID := strings.TrimSuffix(objectName, resourceSuffix)
+	prefix := fmt.Sprintf("%s/v%d", uniqueID, version)
+	for i := range inputItem.Renditions {
+		rendition := &inputItem.Renditions[i]
+		rendition.OutputKey = prefix + "/" + rendition.Name + renditionExtensions[i]
+	}
+	return prefix + outputExtension, nil
+}
+
+// sourceObject returns the ETag and the size of the upload of the job, or an
+// empty ETag when it expired from the input bucket.
+func sourceObject(ctx context.Context, objectName string) (string, int, error) {
+
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectName),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to head the upload: %v", err)
+	}
+	return strings.Trim(aws.ToString(head.ETag), `"`), int(aws.ToInt64(head.ContentLength)), nil
+}
+
+// writeVersion archives the current version of the job under version#<n>
+// and replaces it with next, queued, unless the job changed since current was
+// read or no longer succeeded or failed.
+func writeVersion(ctx context.Context, current map[string]types.AttributeValue, version int, next *job.Item) error {
+
+	archive := make(map[string]types.AttributeValue, len(current))
+	for name, value := range current {
+		archive[name] = value
+	}
+	archive["sk"] = &types.AttributeValueMemberS{Value: job.VersionSk(version)}
+
+	item, err := job.Marshal(next)
+	if err != nil {
+		return err
+	}
+
+	// items created before job versions have no JobVersion
+	unchanged := expression.Name("JobVersion").Equal(expression.Value(version))
+	if version == 1 {
+		unchanged = expression.Or(unchanged, expression.AttributeNotExists(expression.Name("JobVersion")))
+	}
+	condition := expression.And(unchanged, job.StatusIn(job.StatusSucceeded, job.StatusFailed))
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+
+	_, err = dynamo.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(authName),
+				Item:                archive,
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+			{Put: &types.Put{
+				TableName:                 aws.String(authName),
+				Item:                      item,
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			}},
+		},
+	})
+	return err
+}
+
+// enqueueVersion sends the upload of the job to the transform lambda as if it
+// was just uploaded, for the given version of the job.
+func enqueueVersion(ctx context.Context, objectName, eTag string, size, version int, now time.Time) error {
+
+	var record uploadRecord
+	record.EventTime = now.UTC().Format(time.RFC3339)
+	record.S3.Bucket.Name = bucketName
+	record.S3.Object.Key = objectName
+	record.S3.Object.ETag = eTag
+	record.S3.Object.Size = size
+	// the job version orders the events, the sequencer only needs to be
+	// the same for every delivery of the message
+	record.S3.Object.Sequencer = fmt.Sprintf("%X", now.UnixNano())
+
+	body, err := json.Marshal(uploadEvent{Records: []uploadRecord{record}, JobVersion: version})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	_, err = queue.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(uploadQueueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue version %d of %s: %v", version, objectName, err)
+	}
+	return nil
+}
+
+// abandonVersion marks a version that couldn't be enqueued failed, so that
+// it can be reprocessed again.
+func abandonVersion(ctx context.Context, key map[string]types.AttributeValue, version int, cause error) error {
+
+	jobFailure := failure.New(failure.StorageError, cause).Failure
+	update, transition := job.Transition(job.StatusFailed, time.Now())
+	update = update.Set(expression.Name("Failure"), expression.Value(jobFailure))
+	condition := expression.And(transition, expression.Name("JobVersion").Equal(expression.Value(version)))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(authName),
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark version %d failed: %v", version, err)
+	}
+	return nil
+}
+
+// reprocessRequest writes a new version of a succeeded or failed job with the
+// pipeline of the body, and enqueues its upload to run it. The upload must
+// still be in the input bucket.
+func reprocessRequest(ctx context.Context, request events.APIGatewayProxyRequest, tenantId string) (events.APIGatewayProxyResponse, error) {
+
+	objectName := request.PathParameters["id"]
+
+	var reprocessItem ReprocessItem
+	if err := json.Unmarshal([]byte(request.Body), &reprocessItem); err != nil {
+		return validationErrorResponse([]transforms.ValidationError{{Field: "body", Message: err.Error()}})
+	}
+
+	key := job.MetadataKey(objectName)
+	response, err := dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(authName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to get item: %v", err)
+	}
+
+	current, err := job.Unmarshal(response.Item)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			err
+	}
+	// jobs of other tenants are reported as missing
+	if current == nil || current.TenantId != tenantId {
+		return apierror.Respond(http.StatusNotFound, fmt.Sprintf("unknown job %s", objectName))
+	}
+	// only the jobs that ran can be reprocessed
+	if current.Status != job.StatusSucceeded && current.Status != job.StatusFailed {
+		return apierror.Respond(http.StatusConflict, fmt.Sprintf("job %s is %s, only succeeded or failed jobs can be reprocessed", objectName, current.Status))
+	}
+
+	eTag, size, err := sourceObject(ctx, objectName)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			err
+	}
+	if eTag == "" {
+		return apierror.Respond(http.StatusGone, fmt.Sprintf("the upload of %s expired, upload it again", objectName))
+	}
+
+	// the cost is estimated on the actual size of the upload
+	inputItem := InputItem{
+		ObjectName:  objectName,
+		Transforms:  reprocessItem.Transforms,
+		Output:      reprocessItem.Output,
+		Renditions:  reprocessItem.Renditions,
+		CallbackURL: reprocessItem.CallbackURL,
+	}
+	if current.SourceImage != nil {
+		inputItem.Width, inputItem.Height = current.SourceImage.Width, current.SourceImage.Height
+	}
+	if errs := ValidateRequest(&inputItem); len(errs) != 0 {
+		return validationErrorResponse(errs)
+	}
+	if inputItem.CallbackURL == "" {
+		inputItem.CallbackURL = current.CallbackURL
+	}
+
+	version := current.JobVersion
+	next := version + 1
+	outputKey, err := versionedOutputKeys(objectName, current.ContentType, next, &inputItem)
+	if err != nil {
+		return validationErrorResponse([]transforms.ValidationError{{Field: "Output", Message: err.Error()}})
+	}
+
+	t, err := tenant.Get(ctx, dynamo, authName, tenantId)
+	if err == nil && t == nil {
+		err = fmt.Errorf("unknown tenant %s", tenantId)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to get tenant: %v", err)
+	}
+	if inputItem.CallbackURL != "" && t.WebhookSecret == "" {
+		return validationErrorResponse([]transforms.ValidationError{{
+			Field:   "CallbackURL",
+			Message: "the tenant has no webhook secret to sign the callbacks",
+		}})
+	}
+
+	now := time.Now()
+	limited, quotaHeaders, err := chargeQuota(ctx, t, &inputItem, now)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to check the quotas of %s: %v", tenantId, err)
+	}
+	if limited != nil {
+		return events.APIGatewayProxyResponse{}, limited
+	}
+
+	queuedAt := now.UTC().Format(time.RFC3339)
+	nextItem := job.Item{
+		Pk:          current.Pk,
+		Sk:          current.Sk,
+		TenantId:    current.TenantId,
+		SourceIP:    request.RequestContext.Identity.SourceIP,
+		Status:      job.StatusQueued,
+		ContentType: current.ContentType,
+		OutputKey:   outputKey,
+		Width:       inputItem.Width,
+		Height:      inputItem.Height,
+		Transforms:  inputItem.Transforms,
+		Output:      inputItem.Output,
+		Renditions:  inputItem.Renditions,
+		CreatedAt:   current.CreatedAt,
+		UpdatedAt:   queuedAt,
+		QueuedAt:    queuedAt,
+		CallbackURL: inputItem.CallbackURL,
+		JobVersion:  next,
+	}
+
+	if err := writeVersion(ctx, response.Item, version, &nextItem); err != nil {
+		refundQuota(ctx, t, &inputItem, now)
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			return apierror.Respond(http.StatusConflict, fmt.Sprintf("job %s changed while it was reprocessed, try again", objectName))
+		}
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to write version %d of %s: %v", next, objectName, err)
+	}
+	queued := jobevents.New(jobevents.ImageJobQueued, jobevents.Detail{JobId: nextItem.Pk, TenantId: nextItem.TenantId, Status: string(job.StatusQueued)}, now)
+	if err := jobevents.Publish(ctx, topic, jobEventsTopicArn, queued); err != nil {
+		fmt.Println(err)
+	}
+
+	if err := enqueueVersion(ctx, objectName, eTag, size, next, now); err != nil {
+		if abandonErr := abandonVersion(ctx, key, next, err); abandonErr != nil {
+			fmt.Println(abandonErr)
+		}
+		refundQuota(ctx, t, &inputItem, now)
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			err
+	}
+
+	reprocessResponse := ReprocessResponse{Id: objectName, JobVersion: next, Status: nextItem.Status, OutputKey: outputKey}
+	if len(inputItem.Renditions) != 0 {
+		reprocessResponse.OutputKey = ""
+		for _, rendition := range inputItem.Renditions {
+			reprocessResponse.Renditions = append(reprocessResponse.Renditions, rendition.Name)
+		}
+	}
+	accepted, err := apierror.JSON(http.StatusAccepted, reprocessResponse)
+	if err != nil {
+		return accepted, err
+	}
+	for name, value := range quotaHeaders {
+		accepted.Headers[name] = value
+	}
+	return accepted, nil
+}
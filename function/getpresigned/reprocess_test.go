@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobevents"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const testObject = "image-1.png"
+
+// succeededJob stores a succeeded first version of a job and its upload.
+func succeededJob(t *testing.T, store *fake.DynamoDB, objects *fake.S3) {
+
+	t.Helper()
+	store.Put(testTable, &job.Item{
+		Pk:          testObject,
+		Sk:          "metadata",
+		TenantId:    "t-1",
+		Status:      job.StatusSucceeded,
+		ContentType: ".png",
+		OutputKey:   "image-1.png",
+		Transforms:  []job.Transform{{Name: "grayscale"}},
+		JobVersion:  1,
+		SourceImage: &job.ImageInfo{Width: 100, Height: 100},
+	})
+	objects.Put(testBucket, testObject, []byte("upload"), "image/png", nil)
+}
+
+func reprocess(body string) events.APIGatewayProxyRequest {
+	return request(reprocessResource, body, map[string]string{"id": testObject})
+}
+
+func TestReprocess(t *testing.T) {
+
+	store, objects, sent := setup(t)
+	succeededJob(t, store, objects)
+
+	response, err := lambdaHandler(context.Background(), reprocess(`{"Transforms": [{"Name": "invert"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", response.StatusCode, response.Body)
+	}
+	var accepted ReprocessResponse
+	json.Unmarshal([]byte(response.Body), &accepted)
+	if accepted.JobVersion != 2 || accepted.OutputKey != "image-1/v2.png" {
+		t.Errorf("response = %+v, want version 2 under image-1/v2.png", accepted)
+	}
+
+	var current, archived job.Item
+	store.Get(testTable, testObject, "metadata", &current)
+	store.Get(testTable, testObject, "version#1", &archived)
+	if current.JobVersion != 2 || current.Status != job.StatusQueued || current.QueuedAt == "" || current.Transforms[0].Name != "invert" {
+		t.Errorf("current = %+v, want version 2 queued", current)
+	}
+	if archived.JobVersion != 1 || archived.Status != job.StatusSucceeded {
+		t.Errorf("archived = %+v, want version 1 succeeded", archived)
+	}
+
+	if len(sent.Sent) != 1 {
+		t.Fatalf("enqueued %d messages, want 1", len(sent.Sent))
+	}
+	var event uploadEvent
+	json.Unmarshal([]byte(*sent.Sent[0].MessageBody), &event)
+	if event.JobVersion != 2 || len(event.Records) != 1 || event.Records[0].S3.Object.Key != testObject {
+		t.Errorf("event = %+v, want version 2 of %s", event, testObject)
+	}
+
+	published := topic.(*fake.Topic).Published
+	if len(published) != 1 {
+		t.Fatalf("published %d events, want 1", len(published))
+	}
+	var queued jobevents.Event
+	json.Unmarshal([]byte(*published[0].Message), &queued)
+	if queued.Type != jobevents.ImageJobQueued || queued.Detail.JobId != testObject || queued.Detail.Status != string(job.StatusQueued) {
+		t.Errorf("event = %+v, want %s of %s", queued, jobevents.ImageJobQueued, testObject)
+	}
+}
+
+// TestReprocessLegacyJob reprocesses a job written before the schema was
+// versioned, without an OutputKey nor a JobVersion.
+func TestReprocessLegacyJob(t *testing.T) {
+
+	store, objects, _ := setup(t)
+	store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "processed", "ContentType": ".png"})
+	objects.Put(testBucket, testObject, []byte("upload"), "image/png", nil)
+
+	response, err := lambdaHandler(context.Background(), reprocess(`{"Transforms": [{"Name": "invert"}]}`))
+	if err != nil || response.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, err = %v, want 202: %s", response.StatusCode, err, response.Body)
+	}
+
+	var current, archived job.Item
+	store.Get(testTable, testObject, "metadata", &current)
+	store.Get(testTable, testObject, "version#1", &archived)
+	if current.JobVersion != 2 || current.SchemaVersion != job.SchemaVersion || current.OutputKey != "image-1/v2.png" {
+		t.Errorf("current = %+v, want version 2 of the current schema", current)
+	}
+	// the archived version is kept as it was written
+	if archived.Status != "processed" || archived.SchemaVersion != 0 || archived.JobVersion != 0 {
+		t.Errorf("archived = %+v, want the legacy item", archived)
+	}
+}
+
+func TestReprocessConflicts(t *testing.T) {
+
+	store, objects, _ := setup(t)
+	succeededJob(t, store, objects)
+
+	response, _ := lambdaHandler(context.Background(), request(reprocessResource, `{}`, map[string]string{"id": "image-2.png"}))
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing job: status = %d, want 404", response.StatusCode)
+	}
+
+	// the job is queued once reprocessed
+	for n, want := range []int{http.StatusAccepted, http.StatusConflict} {
+		response, _ := lambdaHandler(context.Background(), reprocess(`{"Transforms": [{"Name": "invert"}]}`))
+		if response.StatusCode != want {
+			t.Errorf("request %d: status = %d, want %d", n, response.StatusCode, want)
+		}
+	}
+}
+
+func TestReprocessExpiredUpload(t *testing.T) {
+
+	store, _, _ := setup(t)
+	succeededJob(t, store, fake.NewS3(testBucket))
+
+	response, _ := lambdaHandler(context.Background(), reprocess(`{}`))
+	if response.StatusCode != http.StatusGone {
+		t.Fatalf("status = %d, want 410", response.StatusCode)
+	}
+}
+
+func TestReprocessFails(t *testing.T) {
+
+	store, objects, sent := setup(t)
+	succeededJob(t, store, objects)
+	sent.Errors = map[string]error{"SendMessage": errors.New("throttled")}
+
+	response, err := lambdaHandler(context.Background(), reprocess(`{}`))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Fatalf("status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+	// the version that couldn't be enqueued may be reprocessed again
+	var current job.Item
+	store.Get(testTable, testObject, "metadata", &current)
+	if current.Status != job.StatusFailed || current.JobVersion != 2 {
+		t.Errorf("current = %s version %d, want version 2 failed", current.Status, current.JobVersion)
+	}
+	if requests, jobs := jobsUsed(t, store); requests != 1 || jobs != 0 {
+		t.Errorf("%d requests and %d jobs counted, want only the request", requests, jobs)
+	}
+
+	for _, operation := range []string{"GetItem", "TransactWriteItems"} {
+		store, objects, _ := setup(t)
+		succeededJob(t, store, objects)
+		store.Errors = map[string]error{operation: errors.New("throttled")}
+
+		response, err := lambdaHandler(context.Background(), reprocess(`{}`))
+		if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+			t.Errorf("%s: status = %d, err = %v, want a 500 error envelope", operation, response.StatusCode, err)
+		}
+		store.Errors = nil
+		if _, jobs := jobsUsed(t, store); jobs != 0 {
+			t.Errorf("%s: %d jobs counted, want none", operation, jobs)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/transforms"
+	"cdk_image_transform/internal/webhook"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const MaxImageWidth int = transforms.MaxImageWidth
+const MaxImageHeight int = transforms.MaxImageHeight
+
+// validationErrorResponse answers the 400 listing errs.
+func validationErrorResponse(errs []transforms.ValidationError) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{}, apierror.New(http.StatusBadRequest, errs...)
+}
+
+type outputStep struct {
+	Field string
+	Step  transforms.Step
+}
+
+// outputSteps expresses the Output block as the equivalent encode stage steps
+// so it is validated by the same schema as the Transforms list.
+func outputSteps(output *imaging.OutputOptions) []outputStep {
+
+	var steps []outputStep
+	if output == nil {
+		return steps
+	}
+	if output.Format != "" {
+		steps = append(steps, outputStep{"Output.Format", transforms.Step{Name: "format", Params: []string{output.Format}}})
+	}
+	if output.Quality != 0 {
+		steps = append(steps, outputStep{"Output.Quality", transforms.Step{Name: "quality", Params: []string{strconv.Itoa(output.Quality)}}})
+	}
+	if output.Compression != "" {
+		steps = append(steps, outputStep{"Output.Compression", transforms.Step{Name: "compression", Params: []string{output.Compression}}})
+	}
+	if output.PaletteSize != 0 || output.Quantizer != "" {
+		size := strconv.Itoa(output.PaletteSize)
+		if output.PaletteSize == 0 {
+			size = "256"
+		}
+		params := []string{size}
+		if output.Quantizer != "" {
+			params = append(params, output.Quantizer)
+		}
+		steps = append(steps, outputStep{"Output.Palette", transforms.Step{Name: "palette", Params: params}})
+	}
+	if output.Dither != "" {
+		steps = append(steps, outputStep{"Output.Dither", transforms.Step{Name: "dither", Params: []string{output.Dither}}})
+	}
+	if output.Metadata != "" {
+		steps = append(steps, outputStep{"Output.Metadata", transforms.Step{Name: "metadata", Params: []string{output.Metadata}}})
+	}
+	return steps
+}
+
+// MaxRenditions bounds the number of renditions of a single job.
+const MaxRenditions int = 10
+
+var renditionName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// validatePipeline validates the steps and the Output block of a pipeline,
+// prefixing the field of every error with field.
+func validatePipeline(field string, transformList []job.Transform, output *imaging.OutputOptions) []transforms.ValidationError {
+
+	errs := transforms.Validate(job.Steps(transformList))
+	for i := range errs {
+		errs[i].Field = field
+	}
+
+	for _, output := range outputSteps(output) {
+		if _, err := transforms.Parse(output.Step.Name, output.Step.Params); err != nil {
+			errs = append(errs, transforms.ValidationError{Field: strings.TrimPrefix(field+"."+output.Field, "."), Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// ValidateRequest checks the pipelines, the Output blocks, the declared
+// dimensions and the estimated cost of the job before anything is stored.
+func ValidateRequest(inputItem *InputItem) []transforms.ValidationError {
+
+	steps := job.Steps(inputItem.Transforms)
+	errs := validatePipeline("", inputItem.Transforms, inputItem.Output)
+
+	if len(inputItem.Renditions) > MaxRenditions {
+		errs = append(errs, transforms.ValidationError{Field: "Renditions", Message: fmt.Sprintf("at most %d renditions are allowed", MaxRenditions)})
+	}
+
+	names := map[string]bool{}
+	for i, rendition := range inputItem.Renditions {
+		field := fmt.Sprintf("Renditions[%d]", i)
+		if !renditionName.MatchString(rendition.Name) {
+			errs = append(errs, transforms.ValidationError{Field: field + ".Name", Message: "must be 1 to 32 letters, digits, _ or -"})
+		} else if names[rendition.Name] {
+			errs = append(errs, transforms.ValidationError{Field: field + ".Name", Message: fmt.Sprintf("duplicate rendition %s", rendition.Name)})
+		}
+		names[rendition.Name] = true
+
+		errs = append(errs, validatePipeline(field, rendition.Transforms, rendition.Output)...)
+		for j, step := range rendition.Transforms {
+			if transformer, ok := transforms.Lookup(step.Name); ok && transformer.Spec().Stage == transforms.StageAnimation {
+				index := j
+				errs = append(errs, transforms.ValidationError{Step: &index, Field: field, Name: step.Name, Message: "animation transforms apply to every rendition and must be in the top level Transforms"})
+			}
+		}
+		steps = append(steps, job.Steps(rendition.Transforms)...)
+	}
+
+	if inputItem.CallbackURL != "" {
+		if err := webhook.ValidateURL(inputItem.CallbackURL); err != nil {
+			errs = append(errs, transforms.ValidationError{Field: "CallbackURL", Message: err.Error()})
+		}
+	}
+
+	if inputItem.Width < 0 || inputItem.Width > MaxImageWidth {
+		errs = append(errs, transforms.ValidationError{Field: "Width", Message: fmt.Sprintf("out of range [0, %d]", MaxImageWidth)})
+	}
+	if inputItem.Height < 0 || inputItem.Height > MaxImageHeight {
+		errs = append(errs, transforms.ValidationError{Field: "Height", Message: fmt.Sprintf("out of range [0, %d]", MaxImageHeight)})
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+
+	// without declared dimensions the largest allowed image is assumed
+	width, height := inputItem.Width, inputItem.Height
+	if width == 0 || height == 0 {
+		width, height = MaxImageWidth, MaxImageHeight
+	}
+
+	cost, budget := transforms.Cost(steps, width*height), transforms.PipelineCostBudget()
+	if cost > budget {
+		errs = append(errs, transforms.ValidationError{
+			Field:   "Transforms",
+			Message: fmt.Sprintf("estimated cost of %d megapixel steps exceeds the budget of %d", cost/(1000*1000), budget/(1000*1000)),
+		})
+	}
+	return errs
+}
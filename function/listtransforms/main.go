@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return apierror.Handle(ctx, request, handleRequest)
+}
+
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+	if request.HTTPMethod != "GET" {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusMethodNotAllowed,
+			},
+			fmt.Errorf("invalid http method")
+	}
+
+	body, err := json.Marshal(transforms.Specs())
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to marshal transforms: %v", err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+func main() {
+	lambda.Start(lambdaHandler)
+}
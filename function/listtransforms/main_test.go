@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestListsTransforms(t *testing.T) {
+
+	response, err := lambdaHandler(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", response.StatusCode)
+	}
+	var specs []transforms.Spec
+	if err := json.Unmarshal([]byte(response.Body), &specs); err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != len(transforms.Specs()) {
+		t.Errorf("listed %d transforms, want %d", len(specs), len(transforms.Specs()))
+	}
+}
+
+func TestRejectsOtherMethods(t *testing.T) {
+
+	response, err := lambdaHandler(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "POST"})
+	if !fake.IsErrorEnvelope(response, err, http.StatusMethodNotAllowed) {
+		t.Fatalf("status = %d, err = %v, want a 405 error envelope", response.StatusCode, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/retry"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/webhook"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var authTableName = os.Getenv("AUTH_TABLE_NAME")
+var notifyQueueURL = os.Getenv("NOTIFY_QUEUE_URL")
+
+var dynamo awsclient.JobStore
+var queue awsclient.Queue
+
+// deliveryTimeout bounds a single delivery attempt.
+const deliveryTimeout = 10 * time.Second
+
+// backoff of the failed deliveries, the queue moves them to its dlq after
+// its max receive count.
+var backoff = retry.Backoff{Base: 30 * time.Second, Max: time.Hour}
+
+var client = webhook.NewClient(deliveryTimeout)
+
+// recordAttempt appends the attempt to the Deliveries of the job item.
+func recordAttempt(ctx context.Context, key map[string]types.AttributeValue, attempt webhook.Attempt) error {
+
+	update := expression.Set(expression.Name("Deliveries"), expression.ListAppend(
+		expression.Name("Deliveries").IfNotExists(expression.Value([]webhook.Attempt{})),
+		expression.Value([]webhook.Attempt{attempt}),
+	))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %v", err)
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(authTableName),
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record delivery attempt: %v", err)
+	}
+	return nil
+}
+
+// notify delivers the webhook of a job version once, with the status it was
+// finalized with. It fails when the delivery should be retried.
+func notify(ctx context.Context, message events.SQSMessage) error {
+
+	var notification webhook.Notification
+	if err := json.Unmarshal([]byte(message.Body), &notification); err != nil {
+		fmt.Printf("dropping %s, failed to parse notification: %v\n", message.MessageId, err)
+		return nil
+	}
+
+	key := job.MetadataKey(notification.ObjectName)
+	item, err := job.Get(ctx, dynamo, authTableName, key)
+	if err != nil {
+		return err
+	}
+	if item == nil || item.CallbackURL == "" {
+		fmt.Printf("dropping %s, %s has no callback url\n", message.MessageId, notification.ObjectName)
+		return nil
+	}
+	if notification.JobVersion == 0 {
+		// enqueued before the notifications carried the status of the job
+		notification = item.Notification()
+	}
+	if item.JobVersion != notification.JobVersion {
+		fmt.Printf("dropping %s, %s was reprocessed since version %d\n", message.MessageId, notification.ObjectName, notification.JobVersion)
+		return nil
+	}
+
+	t, err := tenant.Get(ctx, dynamo, authTableName, item.TenantId)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.WebhookSecret == "" {
+		fmt.Printf("dropping %s, tenant %s has no webhook secret\n", message.MessageId, item.TenantId)
+		return nil
+	}
+
+	event := webhook.Event{
+		Version:    webhook.Version,
+		Type:       webhook.JobSucceeded,
+		JobId:      item.Pk,
+		Status:     notification.Status,
+		OccurredAt: notification.OccurredAt,
+		Failure:    notification.Failure,
+	}
+	if notification.Status != string(job.StatusSucceeded) {
+		event.Type = webhook.JobFailed
+	}
+
+	now := time.Now()
+	receiveCount := retry.ReceiveCount(message)
+	attempt := webhook.Attempt{Attempt: receiveCount, At: now.UTC().Format(time.RFC3339)}
+
+	deliveryId := fmt.Sprintf("%s/%d", message.MessageId, receiveCount)
+	attempt.StatusCode, err = webhook.Deliver(ctx, client, item.CallbackURL, t.WebhookSecret, deliveryId, event, now)
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	attempt.Delivered = err == nil
+
+	if recordErr := recordAttempt(ctx, key, attempt); recordErr != nil {
+		fmt.Println(recordErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to deliver the webhook of %s: %v", item.Pk, err)
+	}
+	return nil
+}
+
+// lambdaHandler delivers the webhooks of the notify queue, returning the
+// failed deliveries in the batch item failures to be retried with a backoff.
+func lambdaHandler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+
+	var batchItemFailures []events.SQSBatchItemFailure
+	for _, message := range sqsEvent.Records {
+
+		if err := notify(ctx, message); err != nil {
+			fmt.Println(err)
+			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
+			if err := backoff.DelayMessage(ctx, queue, notifyQueueURL, message); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+
+	return events.SQSEventResponse{
+		BatchItemFailures: batchItemFailures,
+	}, nil
+}
+
+func main() {
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to load aws config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+	queue = awsclient.NewQueue(awsConfig)
+
+	lambda.Start(lambdaHandler)
+}
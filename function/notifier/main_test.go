@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/webhook"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testTable  = "AuthTable"
+	testQueue  = "https://sqs.local/NotifyQueue"
+	testSecret = "whsec_test"
+	testObject = "image-1.png"
+)
+
+// delivery is a request received by the callback.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// setup points the lambda at fakes holding a processed job whose callback
+// answers with status.
+func setup(t *testing.T, status int) (*fake.DynamoDB, *fake.Queue, chan delivery) {
+
+	t.Helper()
+	received := make(chan delivery, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- delivery{header: req.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	authTableName, notifyQueueURL = testTable, testQueue
+	store, sent := fake.NewDynamoDB(testTable), &fake.Queue{}
+	dynamo, queue, client = store, sent, server.Client()
+
+	store.Put(testTable, &tenant.Tenant{Pk: tenant.TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1", Status: tenant.StatusActive, WebhookSecret: testSecret})
+	store.Put(testTable, map[string]any{
+		"pk":          testObject,
+		"sk":          "metadata",
+		"TenantId":    "t-1",
+		"Status":      "succeeded",
+		"UpdatedAt":   "2024-01-01T00:00:00Z",
+		"CallbackURL": server.URL + "/hook",
+	})
+	return store, sent, received
+}
+
+// succeeded is the notification of the first version of the job succeeding.
+var succeeded = webhook.Notification{ObjectName: testObject, JobVersion: 1, Status: "succeeded", OccurredAt: "2024-01-01T00:00:00Z"}
+
+func notification(t *testing.T, n webhook.Notification) events.SQSEvent {
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.SQSEvent{Records: []events.SQSMessage{{
+		MessageId:     "m-1",
+		ReceiptHandle: "r-1",
+		Body:          string(body),
+		Attributes:    map[string]string{"ApproximateReceiveCount": "1"},
+	}}}
+}
+
+func deliveries(t *testing.T, store *fake.DynamoDB) []webhook.Attempt {
+
+	t.Helper()
+	var item struct{ Deliveries []webhook.Attempt }
+	if !store.Get(testTable, testObject, "metadata", &item) {
+		t.Fatal("the job is missing")
+	}
+	return item.Deliveries
+}
+
+func TestDeliversSignedEvent(t *testing.T) {
+
+	store, sent, received := setup(t, http.StatusNoContent)
+
+	response, err := lambdaHandler(context.Background(), notification(t, succeeded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Fatalf("failures = %v, want none", response.BatchItemFailures)
+	}
+
+	d := <-received
+	var event webhook.Event
+	if err := json.Unmarshal(d.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhook.JobSucceeded || event.JobId != testObject || event.Status != "succeeded" || event.Version != "2" {
+		t.Errorf("event = %+v, want version 2 %s of %s", event, webhook.JobSucceeded, testObject)
+	}
+	timestamp, _ := strconv.ParseInt(d.header.Get(webhook.TimestampHeader), 10, 64)
+	if got, want := d.header.Get(webhook.SignatureHeader), webhook.Sign(testSecret, timestamp, d.body); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+
+	attempts := deliveries(t, store)
+	if len(attempts) != 1 || !attempts[0].Delivered || attempts[0].StatusCode != http.StatusNoContent {
+		t.Errorf("deliveries = %+v, want one delivered attempt", attempts)
+	}
+	if len(sent.Visibility) != 0 {
+		t.Errorf("delayed %d messages, want none", len(sent.Visibility))
+	}
+}
+
+func TestRetriesFailedDelivery(t *testing.T) {
+
+	store, sent, _ := setup(t, http.StatusInternalServerError)
+
+	response, err := lambdaHandler(context.Background(), notification(t, succeeded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "m-1" {
+		t.Fatalf("failures = %v, want m-1", response.BatchItemFailures)
+	}
+	if len(sent.Visibility) != 1 {
+		t.Errorf("delayed %d messages, want 1", len(sent.Visibility))
+	}
+	attempts := deliveries(t, store)
+	if len(attempts) != 1 || attempts[0].Delivered || attempts[0].StatusCode != http.StatusInternalServerError {
+		t.Errorf("deliveries = %+v, want one failed attempt", attempts)
+	}
+}
+
+// TestDeliversLegacyStatus notifies a job written with the statuses before
+// the state machine, as the status it stands for, from a notification
+// enqueued before they carried the status of the job.
+func TestDeliversLegacyStatus(t *testing.T) {
+
+	store, _, received := setup(t, http.StatusNoContent)
+	var item map[string]any
+	store.Get(testTable, testObject, "metadata", &item)
+	item["Status"] = "broken"
+	store.Put(testTable, item)
+
+	if _, err := lambdaHandler(context.Background(), notification(t, webhook.Notification{ObjectName: testObject})); err != nil {
+		t.Fatal(err)
+	}
+	var event webhook.Event
+	if err := json.Unmarshal((<-received).body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhook.JobFailed || event.Status != "failed" {
+		t.Errorf("event = %s %s, want %s failed", event.Type, event.Status, webhook.JobFailed)
+	}
+}
+
+// TestDropsReprocessedJob doesn't report the status of the new version of a
+// job reprocessed while its previous notification was retried.
+func TestDropsReprocessedJob(t *testing.T) {
+
+	store, _, received := setup(t, http.StatusNoContent)
+	var item map[string]any
+	store.Get(testTable, testObject, "metadata", &item)
+	item["Status"], item["JobVersion"] = "queued", 2
+	store.Put(testTable, item)
+
+	response, err := lambdaHandler(context.Background(), notification(t, succeeded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Fatalf("failures = %v, want none", response.BatchItemFailures)
+	}
+	select {
+	case <-received:
+		t.Error("the notification of the previous version was delivered")
+	default:
+	}
+}
+
+// TestDeliversFinalStatus signs the status the job was finalized with, not
+// the one of the item when the notification is delivered.
+func TestDeliversFinalStatus(t *testing.T) {
+
+	store, _, received := setup(t, http.StatusNoContent)
+	var item map[string]any
+	store.Get(testTable, testObject, "metadata", &item)
+	item["Status"] = "queued"
+	store.Put(testTable, item)
+
+	failed := webhook.Notification{ObjectName: testObject, JobVersion: 1, Status: "failed", OccurredAt: "2024-01-02T00:00:00Z"}
+	if _, err := lambdaHandler(context.Background(), notification(t, failed)); err != nil {
+		t.Fatal(err)
+	}
+	var event webhook.Event
+	if err := json.Unmarshal((<-received).body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhook.JobFailed || event.Status != "failed" || event.OccurredAt != failed.OccurredAt {
+		t.Errorf("event = %+v, want %s failed at %s", event, webhook.JobFailed, failed.OccurredAt)
+	}
+}
+
+func TestDropsJobWithoutCallback(t *testing.T) {
+
+	store, _, received := setup(t, http.StatusNoContent)
+	store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "succeeded"})
+
+	response, err := lambdaHandler(context.Background(), notification(t, succeeded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Fatalf("failures = %v, want none", response.BatchItemFailures)
+	}
+	select {
+	case <-received:
+		t.Error("the job without a callback url was delivered")
+	default:
+	}
+}
+
+func TestRetriesWhenTableFails(t *testing.T) {
+
+	store, _, _ := setup(t, http.StatusNoContent)
+	store.Errors = map[string]error{"GetItem": errors.New("throttled")}
+
+	response, err := lambdaHandler(context.Background(), notification(t, succeeded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 1 {
+		t.Fatalf("failures = %v, want the message", response.BatchItemFailures)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/quota"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+var authName = os.Getenv("AUTH_TABLE_NAME")
+
+var dynamo awsclient.JobStore
+
+// UsageItem is the usage of one window in the current period.
+type UsageItem struct {
+	Name      string `json:"Name"`
+	Limit     int    `json:"Limit"`
+	Used      int    `json:"Used"`
+	Remaining int    `json:"Remaining"`
+	Reset     string `json:"Reset"`
+}
+
+// LimitsResponse is returned by both methods. Limits holds the overrides of
+// the tenant and Effective the limits actually applied.
+type LimitsResponse struct {
+	TenantId  string        `json:"TenantId"`
+	Limits    *quota.Limits `json:"Limits"`
+	Effective quota.Limits  `json:"Effective"`
+	Usage     []UsageItem   `json:"Usage"`
+}
+
+// describe returns the limits of the tenant with its usage of the current windows.
+func describe(ctx context.Context, t *tenant.Tenant) (*LimitsResponse, error) {
+
+	effective := t.Limits.Effective()
+	usages, err := quota.Current(ctx, dynamo, authName, t.TenantId, effective, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	response := &LimitsResponse{TenantId: t.TenantId, Limits: t.Limits, Effective: effective}
+	for _, usage := range usages {
+		response.Usage = append(response.Usage, UsageItem{
+			Name:      usage.Name,
+			Limit:     usage.Limit,
+			Used:      usage.Used,
+			Remaining: usage.Remaining(),
+			Reset:     usage.Reset.Format(time.RFC3339),
+		})
+	}
+	return response, nil
+}
+
+// lambdaHandler serves GET and PUT /admin/tenants/{tenantId}/limits. The
+// authorizer only lets admin tenants through.
+func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return apierror.Handle(ctx, request, handleRequest)
+}
+
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+	if request.HTTPMethod != "GET" && request.HTTPMethod != "PUT" {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusMethodNotAllowed,
+			},
+			fmt.Errorf("invalid http method")
+	}
+
+	tenantId := request.PathParameters["tenantId"]
+	t, err := tenant.Get(ctx, dynamo, authName, tenantId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			err
+	}
+	if t == nil {
+		return apierror.Respond(http.StatusNotFound, fmt.Sprintf("unknown tenant %s", tenantId))
+	}
+
+	if request.HTTPMethod == "PUT" {
+		var limits quota.Limits
+		if err := json.Unmarshal([]byte(request.Body), &limits); err != nil {
+			return apierror.Respond(http.StatusBadRequest, fmt.Sprintf("invalid limits: %v", err))
+		}
+		if err := limits.Validate(); err != nil {
+			return apierror.Respond(http.StatusBadRequest, err.Error())
+		}
+		if err := tenant.SetLimits(ctx, dynamo, authName, tenantId, limits); err != nil {
+			return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+				},
+				err
+		}
+		t.Limits = &limits
+	}
+
+	response, err := describe(ctx, t)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			err
+	}
+	return apierror.JSON(http.StatusOK, response)
+}
+
+func main() {
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to initialize aws config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+
+	lambda.Start(lambdaHandler)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/quota"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const testTable = "AuthTable"
+
+func setup(t *testing.T) *fake.DynamoDB {
+
+	t.Helper()
+	authName = testTable
+	store := fake.NewDynamoDB(testTable)
+	dynamo = store
+	store.Put(testTable, &tenant.Tenant{Pk: tenant.TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1", Name: "test", Status: tenant.StatusActive})
+	return store
+}
+
+func request(method, tenantId, body string) events.APIGatewayProxyRequest {
+
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:     method,
+		PathParameters: map[string]string{"tenantId": tenantId},
+		Body:           body,
+	}
+}
+
+func TestGetLimits(t *testing.T) {
+
+	setup(t)
+
+	response, err := lambdaHandler(context.Background(), request("GET", "t-1", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", response.StatusCode)
+	}
+	var limits LimitsResponse
+	if err := json.Unmarshal([]byte(response.Body), &limits); err != nil {
+		t.Fatal(err)
+	}
+	if limits.Limits != nil || limits.Effective != quota.DefaultLimits {
+		t.Errorf("limits = %v %v, want the defaults", limits.Limits, limits.Effective)
+	}
+	if len(limits.Usage) != len(quota.Windows) {
+		t.Errorf("usage has %d windows, want %d", len(limits.Usage), len(quota.Windows))
+	}
+}
+
+func TestPutLimits(t *testing.T) {
+
+	store := setup(t)
+
+	response, err := lambdaHandler(context.Background(), request("PUT", "t-1", `{"JobsPerDay": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", response.StatusCode)
+	}
+
+	var stored tenant.Tenant
+	if !store.Get(testTable, tenant.TenantPrefix+"t-1", "metadata", &stored) {
+		t.Fatal("the tenant is missing")
+	}
+	if stored.Limits == nil || stored.Limits.JobsPerDay != 5 {
+		t.Errorf("stored limits = %v, want 5 jobs per day", stored.Limits)
+	}
+}
+
+func TestRejectsInvalidRequests(t *testing.T) {
+
+	setup(t)
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		want    int
+	}{
+		{"unknown tenant", request("GET", "t-2", ""), http.StatusNotFound},
+		{"invalid body", request("PUT", "t-1", "{"), http.StatusBadRequest},
+		{"invalid limit", request("PUT", "t-1", `{"JobsPerDay": -2}`), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		response, err := lambdaHandler(context.Background(), test.request)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response.StatusCode != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, response.StatusCode, test.want)
+		}
+	}
+
+	response, err := lambdaHandler(context.Background(), request("POST", "t-1", ""))
+	if !fake.IsErrorEnvelope(response, err, http.StatusMethodNotAllowed) {
+		t.Errorf("POST: status = %d, want a 405 error envelope", response.StatusCode)
+	}
+}
+
+func TestFailsWhenTableFails(t *testing.T) {
+
+	store := setup(t)
+	store.Errors = map[string]error{"UpdateItem": errors.New("throttled")}
+
+	response, err := lambdaHandler(context.Background(), request("PUT", "t-1", `{"JobsPerDay": 5}`))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Fatalf("status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/sequencer"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Metadata of the outputs, tying them to the event that wrote them so a job
+// interrupted before its item was updated is completed from them.
+const (
+	sequencerMetadata  = "sequencer"
+	sourceETagMetadata = "source-etag"
+	widthMetadata      = "width"
+	heightMetadata     = "height"
+)
+
+// claimLease is how long a claim holds the job against the other deliveries
+// of its event. It is the visibility timeout of the upload queue, as long as
+// the timeout of the function, so an older claim was left by a run that died.
+const claimLease = 300 * time.Second
+
+// errClaimHeld is returned when another delivery of the event is processing
+// the job.
+var errClaimHeld = errors.New("another delivery of the event is processing the job")
+
+func isConditionFailed(err error) bool {
+	var failed *types.ConditionalCheckFailedException
+	return errors.As(err, &failed)
+}
+
+// isSourceReplaced reports whether a GetObject failed because the object was
+// overwritten since the event, whose own event follows.
+func isSourceReplaced(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
+
+// queueJob moves a job that was waiting for its upload, or ended and was
+// uploaded again, to queued. It returns false when the job is left as it is
+// because another event queued it or claimed it first, which claimEvent sorts
+// out.
+func queueJob(ctx context.Context, key map[string]types.AttributeValue, eventSequencer string) (bool, error) {
+
+	update, transition := job.Transition(job.StatusQueued, time.Now())
+	condition := expression.And(transition,
+		job.StatusIn(job.StatusPendingUpload, job.StatusSucceeded, job.StatusFailed),
+		sequencer.Claimable(eventSequencer))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return false, failure.Errorf(failure.StorageError, "failed to build expression: %v", err)
+	}
+
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, failure.Classify(fmt.Errorf("failed to queue the job: %w", err), failure.StorageError)
+	}
+	return true, nil
+}
+
+// claimEvent records the sequencer of the event on the job item and moves the
+// job to processing. It returns false when a more recent event claimed the
+// job, when it was processed already, and the event is a duplicate or out of
+// date, or when the job isn't queued or processing, as it expired or was
+// cancelled. A job processing for the same event is only claimed again once
+// its claim is older than claimLease, errClaimHeld is returned until then.
+func claimEvent(ctx context.Context, key map[string]types.AttributeValue, eventSequencer string) (bool, error) {
+
+	now := time.Now()
+	update, transition := job.Transition(job.StatusProcessing, now)
+	update = update.Set(expression.Name(sequencer.Attribute), expression.Value(eventSequencer))
+	held := expression.And(
+		job.StatusIn(job.StatusProcessing),
+		expression.Name(sequencer.Attribute).Equal(expression.Value(eventSequencer)),
+		expression.Name("ProcessingAt").GreaterThan(expression.Value(now.Add(-claimLease).UTC().Format(time.RFC3339))),
+	)
+	condition := expression.And(transition, sequencer.Claimable(eventSequencer), expression.Not(held))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return false, failure.Errorf(failure.StorageError, "failed to build expression: %v", err)
+	}
+
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(tableName),
+		Key:                                 key,
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		UpdateExpression:                    expr.Update(),
+		ConditionExpression:                 expr.Condition(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		if isClaimHeld(conditionFailed.Item, eventSequencer, now) {
+			return false, errClaimHeld
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, failure.Classify(fmt.Errorf("failed to claim the job: %w", err), failure.StorageError)
+	}
+	return true, nil
+}
+
+// isClaimHeld reports whether the job item is processing for the event of
+// eventSequencer, under a claim younger than claimLease.
+func isClaimHeld(item map[string]types.AttributeValue, eventSequencer string, now time.Time) bool {
+
+	claimedBy, _ := item[sequencer.Attribute].(*types.AttributeValueMemberS)
+	if claimedBy == nil || claimedBy.Value != eventSequencer {
+		return false
+	}
+	current, err := job.Unmarshal(item)
+	if err != nil || current == nil || current.Status != job.StatusProcessing {
+		return false
+	}
+	processingAt, err := time.Parse(time.RFC3339, current.ProcessingAt)
+	return err == nil && now.Add(-claimLease).Before(processingAt)
+}
+
+// outputMetadata returns the metadata written with an output of the event.
+func outputMetadata(eventSequencer, eTag string, info job.ImageInfo) map[string]string {
+
+	return map[string]string{
+		sequencerMetadata:  eventSequencer,
+		sourceETagMetadata: eTag,
+		widthMetadata:      strconv.Itoa(info.Width),
+		heightMetadata:     strconv.Itoa(info.Height),
+	}
+}
+
+// writtenOutputs returns the outputs already written by the event, when all
+// of them are, so that a job that failed to update its item after writing
+// them isn't run again.
+func writtenOutputs(ctx context.Context, keys []string, eventSequencer string) ([]job.ImageInfo, error) {
+
+	infos := make([]job.ImageInfo, len(keys))
+	for i, key := range keys {
+		head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(outputBucketName),
+			Key:    aws.String(key),
+		})
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, failure.Classify(fmt.Errorf("failed to head output: %w", err), failure.StorageError)
+		}
+		if head.Metadata[sequencerMetadata] != eventSequencer {
+			return nil, nil
+		}
+		width, widthErr := strconv.Atoi(head.Metadata[widthMetadata])
+		height, heightErr := strconv.Atoi(head.Metadata[heightMetadata])
+		if widthErr != nil || heightErr != nil {
+			return nil, nil
+		}
+		infos[i] = job.ImageInfo{Width: width, Height: height, Bytes: int(aws.ToInt64(head.ContentLength))}
+	}
+	return infos, nil
+}
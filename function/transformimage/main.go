@@ -7,38 +7,47 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"image/draw"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
-	"io"
 	"os"
-	"strconv"
-
-	"github.com/anthonynsimon/bild/effect"
+	"runtime/debug"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobevents"
+	"cdk_image_transform/internal/retry"
+	"cdk_image_transform/internal/sequencer"
+	"cdk_image_transform/internal/transforms"
+	"cdk_image_transform/internal/webhook"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	_ "golang.org/x/image/webp"
 )
 
 var inputBucketName = os.Getenv("INPUT_BUCKET_NAME")
 var outputBucketName = os.Getenv("OUTPUT_BUCKET_NAME")
 var tableName = os.Getenv("AUTH_TABLE_NAME")
+var uploadQueueURL = os.Getenv("UPLOAD_QUEUE_URL")
+var notifyQueueURL = os.Getenv("NOTIFY_QUEUE_URL")
+var jobEventsTopicArn = os.Getenv("JOB_EVENTS_TOPIC_ARN")
 
-const MaxImageWidth int = 7680
-const MaxImageHeight int = 4320
-const MaxImageSizeBytes int = MaxImageWidth * MaxImageHeight * 4
+const MaxImageWidth int = transforms.MaxImageWidth
+const MaxImageHeight int = transforms.MaxImageHeight
+const MaxImageSizeBytes int = imaging.MaxImageSizeBytes
 
-var svc *s3.Client
-var dynamo *dynamodb.Client
+var svc awsclient.ObjectStore
+var dynamo awsclient.JobStore
+var queue awsclient.Queue
+var topic awsclient.Topic
 
 type S3BucketJson struct {
 	Name string `json:"name"`
@@ -60,34 +69,11 @@ type RecordJson struct {
 	S3        S3Json `json:"s3"`
 }
 
+// Event is the body of the messages of the upload queue: the notification of
+// an upload, or a job version enqueued by /jobs/{id}/reprocess.
 type Event struct {
-	Records []RecordJson `json:"Records"`
-}
-
-type Transform struct {
-	Name   string   `dynamodbav:"Name" json:"Name"`
-	Params []string `dynamodbav:"Params,omitempty" json:"Params,omitempty"`
-}
-
-type InputItem struct {
-	Pk          string      `dynamodbav:"pk" json:"pk"`
-	Sk          string      `dynamodbav:"sk" json:"sk"`
-	SourceIP    string      `dynamodbav:"SourceIP" json:"SourceIP"`
-	Status      string      `dynamodbav:"Status" json:"Status"`
-	ContentType string      `dynamodbav:"ContentType" json:"ContentType"`
-	Transforms  []Transform `dynamodbav:"Transforms" json:"Transforms"`
-}
-
-func createKey(Pk, Sk string) (map[string]types.AttributeValue, error) {
-	pk, err := attributevalue.Marshal(Pk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal pk: %v", err)
-	}
-	sk, err := attributevalue.Marshal(Sk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal sk: %v", err)
-	}
-	return map[string]types.AttributeValue{"pk": pk, "sk": sk}, nil
+	Records    []RecordJson `json:"Records"`
+	JobVersion int          `json:"JobVersion,omitempty"`
 }
 
 type ItemKey struct {
@@ -99,394 +85,397 @@ type ItemStatus struct {
 	Status string `json:"status"`
 }
 
-func InitConfig() (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO())
-}
+// publish sends a job event, a lost event doesn't fail the job.
+func publish(ctx context.Context, eventType string, detail jobevents.Detail) {
 
-func InitDynamo(config aws.Config) *dynamodb.Client {
-	return dynamodb.NewFromConfig(config)
+	if err := jobevents.Publish(ctx, topic, jobEventsTopicArn, jobevents.New(eventType, detail, time.Now())); err != nil {
+		fmt.Println(err)
+	}
 }
 
-func InitS3(config aws.Config) *s3.Client {
-	return s3.NewFromConfig(config)
-}
+// timeoutMargin is kept before the deadline of the function to record the
+// failure of a job that ran out of time.
+const timeoutMargin = 5 * time.Second
 
-func imageToRGBA(src image.Image) *image.RGBA {
+// checkDeadline fails a job whose context expired between two phases, the
+// decoders and transforms can't be interrupted.
+func checkDeadline(ctx context.Context, phase string) error {
 
-	if dst, ok := src.(*image.RGBA); ok {
-		return dst
+	if err := ctx.Err(); err != nil {
+		return failure.Errorf(failure.Timeout, "ran out of time after %s: %v", phase, err)
 	}
-	b := src.Bounds()
-	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
-	return dst
+	return nil
 }
 
-func DilateImage(img image.Image, params []string) (image.Image, error) {
-	if len(params) != 1 {
-		return nil, errors.New("invalid number of parameters")
-	}
-	intensity, err := strconv.ParseFloat(params[0], 64)
+// processObject runs the job of an uploaded object and writes its outputs,
+// attempt counts the receives of its message. Its errors are *failure.Error
+// values, recorded on the job item. Events that are duplicates or were
+// superseded by a more recent upload or version of the job are skipped.
+func processObject(ctx context.Context, record RecordJson, jobVersion, attempt int) error {
+
+	eventSequencer := sequencer.Key(jobVersion, record.S3.Object.Sequencer)
+
+	key := job.MetadataKey(record.S3.Object.Key)
+	item, err := job.Get(ctx, dynamo, tableName, key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse dilate value: %v", err)
+		return failure.Classify(err, failure.StorageError)
+	}
+	if item == nil {
+		return failure.Errorf(failure.StorageError, "item not found: %s", record.S3.Object.Key)
+	}
+	if item.JobVersion > max(jobVersion, 1) {
+		fmt.Printf("skipping %s, the event is about version %d of the job, now at %d\n", record.S3.Object.Key, max(jobVersion, 1), item.JobVersion)
+		return nil
 	}
-	return effect.Dilate(img, intensity), nil
-}
-
-func EdgeDetection(img image.Image, params []string) (image.Image, error) {
 
-	if len(params) != 1 {
-		return nil, errors.New("invalid number of parameters")
+	// the upload of a new job, or a new upload of a job that ended
+	switch item.Status {
+	case job.StatusPendingUpload, job.StatusSucceeded, job.StatusFailed:
+		queued, err := queueJob(ctx, key, eventSequencer)
+		if err != nil {
+			return err
+		}
+		if queued {
+			publish(ctx, jobevents.ImageJobQueued, jobevents.Detail{JobId: item.Pk, TenantId: item.TenantId, Status: string(job.StatusQueued), Attempt: attempt})
+		}
 	}
-	radius, err := strconv.ParseFloat(params[0], 64)
+
+	claimed, err := claimEvent(ctx, key, eventSequencer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse dilate value: %v", err)
+		return err
 	}
-	if radius > 1.0 {
-		radius = 1.0
-	} else if radius < 0.0 {
-		radius = 0.0
+	if !claimed {
+		fmt.Printf("skipping %s, the event %s is a duplicate or out of date, or the job ended\n", record.S3.Object.Key, eventSequencer)
+		return nil
 	}
 
-	return effect.EdgeDetection(img, radius), nil
-}
-
-func Erode(img image.Image, params []string) (image.Image, error) {
+	if record.S3.Object.Size > MaxImageSizeBytes {
+		return failure.Errorf(failure.TooLarge, "image size exceeds maximum allowed size")
+	}
 
-	if len(params) != 1 {
-		return nil, errors.New("invalid number of parameters")
+	// the object the event is about, not a later upload to the same key
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(inputBucketName),
+		Key:    aws.String(record.S3.Object.Key),
+	}
+	if record.S3.Object.ETag != "" {
+		getInput.IfMatch = aws.String(`"` + record.S3.Object.ETag + `"`)
+	}
+	object, err := svc.GetObject(ctx, getInput)
+	if isSourceReplaced(err) {
+		fmt.Printf("skipping %s, the object was replaced since the event %s\n", record.S3.Object.Key, eventSequencer)
+		return nil
 	}
-	erosion, err := strconv.ParseFloat(params[0], 64)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse dilate value: %v", err)
+		return failure.Classify(fmt.Errorf("failed to get object: %w", err), failure.StorageError)
 	}
-	return effect.Erode(img, erosion), nil
-}
-
-func Median(img image.Image, params []string) (image.Image, error) {
+	defer object.Body.Close()
 
-	if len(params) != 1 {
-		return nil, errors.New("invalid number of parameters")
-	}
-	median, err := strconv.ParseFloat(params[0], 64)
+	buffer, err := imaging.ReadAll(object.Body, aws.ToInt64(object.ContentLength))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse median value: %v", err)
+		return failure.Classify(fmt.Errorf("failed to copy image buffer: %w", err), failure.StorageError)
 	}
-	return effect.Median(img, median), nil
-}
 
-func Emboss(img image.Image) image.Image {
+	config, format, err := image.DecodeConfig(bytes.NewReader(buffer))
+	if err != nil {
+		return failure.Errorf(failure.DecodeError, "failed to decode image config: %v", err)
+	}
 
-	return effect.Emboss(img)
-}
+	if config.Width > MaxImageWidth || config.Height > MaxImageHeight {
+		return failure.Errorf(failure.TooLarge, "image dimensions exceed maximum allowed dimensions")
+	}
 
-func Grayscale(img image.Image) image.Image {
+	// the pipeline cost was budgeted against the declared dimensions
+	if (item.Width > 0 && config.Width > item.Width) || (item.Height > 0 && config.Height > item.Height) {
+		return failure.Errorf(failure.TooLarge, "image dimensions exceed the declared dimensions")
+	}
 
-	return effect.Grayscale(img)
-}
+	source := job.ImageInfo{Width: config.Width, Height: config.Height, Bytes: len(buffer)}
 
-func Invert(img image.Image) image.Image {
+	keys := item.OutputKeys()
 
-	return effect.Invert(img)
-}
+	// a previous attempt wrote the outputs but failed to update the item
+	written, err := writtenOutputs(ctx, keys, eventSequencer)
+	if err != nil {
+		return err
+	}
+	if written != nil {
+		fmt.Printf("completing %s from the outputs written by the event %s\n", record.S3.Object.Key, eventSequencer)
+		return completeJob(ctx, key, item, record, eventSequencer, source, keys, written, attempt)
+	}
 
-func Sepia(img image.Image) image.Image {
+	pipeline := item.Pipeline()
+	outputOptions, err := imaging.ParseOutputOptions(pipeline)
+	if err != nil {
+		return failure.Errorf(failure.InvalidParams, "invalid output options: %v", err)
+	}
 
-	return effect.Sepia(img)
-}
+	renditionSteps := make([][]transforms.Step, len(item.Renditions))
+	for i, rendition := range item.Renditions {
+		renditionSteps[i] = job.Steps(rendition.Transforms)
+	}
+	estimate := imaging.EstimateMemory(len(buffer), config, pipeline.Transforms, renditionSteps...)
+	scale, err := estimate.Fit(imaging.MemoryBudget(), imaging.OversizePolicy())
+	if err != nil {
+		return failure.Classify(err, failure.TooLarge)
+	}
+	if scale < 1 {
+		fmt.Printf("downsampling %s by %.2f to fit in memory\n", record.S3.Object.Key, scale)
+	}
 
-func Sharpen(img image.Image) image.Image {
+	animation, err := imaging.Decode(buffer, format, pipeline, scale)
+	buffer = nil // only the decoded frames are needed from here on
+	if err != nil {
+		return failure.Classify(fmt.Errorf("failed to decode image: %w", err), failure.DecodeError)
+	}
+	if err := checkDeadline(ctx, "decoding"); err != nil {
+		return err
+	}
 
-	return effect.Sharpen(img)
-}
+	if err := imaging.TransformAnimation(animation, pipeline); err != nil {
+		return failure.Classify(fmt.Errorf("failed to transform image: %w", err), failure.InvalidParams)
+	}
+	if err := checkDeadline(ctx, "transforming"); err != nil {
+		return err
+	}
 
-func Sobel(img image.Image) image.Image {
+	infos := make([]job.ImageInfo, 0, len(keys))
+	err = RenderOutputs(animation, item, outputOptions, func(output RenderedOutput) error {
+		info := output.Info()
+		_, err := svc.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(outputBucketName),
+			Key:         aws.String(output.Key),
+			Body:        bytes.NewReader(output.Body),
+			ContentType: aws.String(output.ContentType),
+			Metadata:    outputMetadata(eventSequencer, record.S3.Object.ETag, info),
+		})
+		if err != nil {
+			return failure.Classify(fmt.Errorf("failed to put object: %w", err), failure.StorageError)
+		}
+		infos = append(infos, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	return effect.Sobel(img)
+	return completeJob(ctx, key, item, record, eventSequencer, source, keys, infos, attempt)
 }
 
-func TransformImage(img image.Image, item *InputItem) (image.Image, error) {
+// completeJob marks the job succeeded once its outputs are written, unless a
+// more recent event claimed it in the meantime, then notifies it.
+func completeJob(ctx context.Context, key map[string]types.AttributeValue, item *job.Item, record RecordJson, eventSequencer string, source job.ImageInfo, keys []string, infos []job.ImageInfo, attempt int) error {
+
+	update, transition := job.Transition(job.StatusSucceeded, time.Now())
+	update = update.Set(expression.Name("SourceImage"), expression.Value(source)).
+		Set(expression.Name(sequencer.ProcessedAttribute), expression.Value(eventSequencer)).
+		Set(expression.Name(sequencer.ETagAttribute), expression.Value(record.S3.Object.ETag)).
+		Remove(expression.Name("Failure")) // of a previous attempt
+	if len(item.Renditions) == 0 {
+		update = update.Set(expression.Name("OutputImage"), expression.Value(infos[0]))
+	} else {
+		for i, info := range infos {
+			update = update.Set(expression.Name(fmt.Sprintf("Renditions[%d].OutputImage", i)), expression.Value(info))
+		}
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(expression.And(transition, sequencer.Claimed(eventSequencer))).Build()
+	if err != nil {
+		return failure.Errorf(failure.StorageError, "failed to build expression:  %v", err)
+	}
 
-	var err error
-	img = imageToRGBA(img)
+	response, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		fmt.Printf("skipping %s, the event %s was superseded while processing\n", item.Pk, eventSequencer)
+		return nil
+	}
+	if err != nil {
+		return failure.Classify(fmt.Errorf("failed to updated dynamodb item:  %w", err), failure.StorageError)
+	}
 
-	for _, transform := range item.Transforms {
-		switch transform.Name {
-		case "dilate":
-			if img, err = DilateImage(img, transform.Params); err != nil {
-				return nil, fmt.Errorf("failed dilate: %v", err)
-			}
-		case "edgedetection":
-			if img, err = EdgeDetection(img, transform.Params); err != nil {
-				return nil, fmt.Errorf("failed edgedetection: %v", err)
-			}
-		case "erode":
-			if img, err = Erode(img, transform.Params); err != nil {
-				return nil, fmt.Errorf("failed erode: %v", err)
-			}
-		case "median":
-			if img, err = Median(img, transform.Params); err != nil {
-				return nil, fmt.Errorf("failed median: %v", err)
-			}
-		case "emboss":
-			img = Emboss(img)
-		case "grayscale":
-			img = Grayscale(img)
-		case "invert":
-			img = Invert(img)
-		case "sepia":
-			img = Sepia(img)
-		case "sharpen":
-			img = Sharpen(img)
-		case "sobel":
-			img = Sobel(img)
-		default:
-			if transform.Name != "quality" {
-				fmt.Printf("unknown transform: %s\n", transform.Name)
-			}
+	// the job is done, a lost notification doesn't fail it
+	if item.CallbackURL != "" {
+		completed, err := job.Unmarshal(response.Attributes)
+		if err == nil {
+			err = webhook.Enqueue(ctx, queue, notifyQueueURL, completed.Notification())
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	detail := jobevents.Detail{JobId: item.Pk, TenantId: item.TenantId, Status: string(job.StatusSucceeded), Attempt: attempt}
+	for i, info := range infos {
+		output := jobevents.Output{Key: keys[i], Width: info.Width, Height: info.Height, Bytes: info.Bytes}
+		if len(item.Renditions) != 0 {
+			output.Rendition = item.Renditions[i].Name
 		}
+		detail.Outputs = append(detail.Outputs, output)
 	}
-	return img, nil
+	publish(ctx, jobevents.ImageJobSucceeded, detail)
+	return nil
 }
 
-func EncodeImage(img *image.RGBA, destBuffer *bytes.Buffer, inputItem *InputItem) error {
+// recordFailure stores the failure of the job of objectKey on its item, and
+// marks the job failed when the failure is permanent or queued again to be
+// retried, the dlq failing it with this failure once the retries run out. It
+// returns the updated item, or nil when the event of eventSequencer no longer
+// holds the job.
+func recordFailure(ctx context.Context, objectKey, eventSequencer string, jobFailure failure.Failure, permanent bool) (*job.Item, error) {
+
+	status := job.StatusQueued
+	if permanent {
+		status = job.StatusFailed
+	}
+	update, transition := job.Transition(status, time.Now())
+	update = update.Set(expression.Name("Failure"), expression.Value(jobFailure)).
+		Set(expression.Name(sequencer.Attribute), expression.Value(eventSequencer))
+	if !permanent {
+		// the job may have failed after it was queued, before it was claimed
+		transition = expression.Or(transition, job.StatusIn(job.StatusQueued))
+	}
+	condition := expression.And(transition, sequencer.Claimable(eventSequencer))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression: %v", err)
+	}
 
-	switch inputItem.ContentType {
-	case ".jpeg", ".jpg":
-		return jpeg.Encode(destBuffer, img, nil) // nil for default quality. I may add the parameter
-	case ".png":
-		return png.Encode(destBuffer, img)
-	case ".gif":
-		return gif.Encode(destBuffer, img, nil)
-	default:
-		fmt.Printf("unknown content type: %s\n", inputItem.ContentType)
-		panic("shouldn't have reached here")
+	response, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       job.MetadataKey(objectKey),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the failure of %s: %v", objectKey, err)
 	}
+
+	return job.Unmarshal(response.Attributes)
 }
 
+// lambdaHandler processes a batch of upload notifications. Messages failing
+// with a permanent error are dropped once the job is marked failed, messages
+// failing with a transient error are returned in the batch item failures
+// to be retried with a backoff, and end in the dlq after the max receive count.
 func lambdaHandler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
 
-	awsConfig, err := InitConfig()
-	if err != nil {
-		return events.SQSEventResponse{}, fmt.Errorf("failed to load aws config: %v", err)
+	// stop the jobs early enough to record that they ran out of time
+	jobCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		jobCtx, cancel = context.WithDeadline(ctx, deadline.Add(-timeoutMargin))
+		defer cancel()
 	}
 
-	dynamo = InitDynamo(awsConfig)
-	svc = InitS3(awsConfig)
-
 	var batchItemFailures []events.SQSBatchItemFailure
-	var batchItemErrors []error
 
 	for _, message := range sqsEvent.Records {
 		fmt.Printf("The message %s for event source %s = %s \n", message.MessageId, message.EventSource, message.Body)
 
+		// messages that aren't the notification of a single upload never will be
 		var event Event
 		err := json.Unmarshal([]byte(message.Body), &event)
 		if err != nil {
-			return events.SQSEventResponse{}, fmt.Errorf("failed to parse request body: %v", err)
+			fmt.Printf("dropping %s, failed to parse message body: %v\n", message.MessageId, err)
+			continue
 		}
 
 		if len(event.Records) != 1 { // the json of body is an array called records
-
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("event.Record was not equal to one %d", len(event.Records)))
+			fmt.Printf("dropping %s, event.Record was not equal to one %d\n", message.MessageId, len(event.Records))
 			continue
 		}
 
 		record := event.Records[0]
 
 		if record.S3.Bucket.Name != inputBucketName {
-
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("invalid input bucket name"))
-			continue
-		}
-
-		if record.S3.Object.Size > MaxImageSizeBytes {
-
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("image size exceeds maximum allowed size"))
-			continue
-		}
-
-		object, err := svc.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: aws.String(inputBucketName),
-			Key:    aws.String(record.S3.Object.Key),
-		})
-
-		if err != nil {
-
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to get object: %v", err))
-			continue
-		}
-
-		defer object.Body.Close()
-
-		buffer, err := io.ReadAll(object.Body)
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to copy image buffer: %v", err))
-			continue
-		}
-
-		imageReader := bytes.NewReader(buffer)
-		config, _, err := image.DecodeConfig(imageReader)
-
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to decode image config: %v", err))
+			fmt.Printf("dropping %s, invalid input bucket name %s\n", message.MessageId, record.S3.Bucket.Name)
 			continue
 		}
 
-		if config.Width > MaxImageHeight || config.Height > MaxImageHeight {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("image dimensions exceed maximum allowed dimensions"))
+		attempt := retry.ReceiveCount(message)
+		err = processObject(jobCtx, record, event.JobVersion, attempt)
+		if err == nil {
 			continue
 		}
-
-		_, err = imageReader.Seek(0, 0)
-		if err != nil {
+		// the delivery holding the job records its outcome, this one is
+		// retried in case that run dies
+		if errors.Is(err, errClaimHeld) {
+			fmt.Printf("retrying %s, %v\n", message.MessageId, err)
 			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
 				ItemIdentifier: message.MessageId,
 			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to seek to beginning of stream: %v", err))
+			if err := backoff.DelayMessage(ctx, queue, uploadQueueURL, message); err != nil {
+				fmt.Println(err)
+			}
 			continue
 		}
 
-		srcImage, _, err := image.Decode(imageReader)
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to decode image: %v", err))
+		permanent := !isTransient(err)
+		fmt.Printf("job %s failed, permanent %t: %v\n", record.S3.Object.Key, permanent, err)
+
+		// the context of the job may have expired, the margin is left for this
+		jobFailure := failure.Classify(err, failure.Unknown).Failure
+		item, recordErr := recordFailure(ctx, record.S3.Object.Key, sequencer.Key(event.JobVersion, record.S3.Object.Sequencer), jobFailure, permanent)
+		if recordErr != nil {
+			fmt.Println(recordErr)
+			if permanent {
+				// retry rather than lose the failure
+				permanent = false
+			}
+		} else if item == nil {
+			fmt.Printf("dropping %s, the job of %s was processed, ended or claimed by a more recent event\n", message.MessageId, record.S3.Object.Key)
 			continue
 		}
-
-		key, err := createKey(record.S3.Object.Key, "metadata")
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to create key: %v", err))
+		if permanent {
+			if item.CallbackURL != "" {
+				if err := webhook.Enqueue(ctx, queue, notifyQueueURL, item.Notification()); err != nil {
+					fmt.Println(err)
+				}
+			}
+			publish(ctx, jobevents.ImageJobFailed, jobevents.Detail{JobId: item.Pk, TenantId: item.TenantId, Status: string(item.Status), Attempt: attempt, Failure: &jobFailure})
 			continue
 		}
 
-		response, err := dynamo.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String(tableName),
-			Key:       key,
+		batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
+			ItemIdentifier: message.MessageId,
 		})
-
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to get dynamodb item: %v", err))
-			continue
-		}
-
-		var item InputItem
-		err = attributevalue.UnmarshalMap(response.Item, &item)
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to unmarshal dynamodb item: %v", err))
-		}
-		if item.Pk == "" {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("item not found: %v", err))
-		}
-
-		destImage, err := TransformImage(srcImage, &item)
-		if err != nil {
-			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-				ItemIdentifier: message.MessageId,
-			})
-			batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to transform image:  %v", err))
-			continue
-		}
-
-		if dst, ok := destImage.(*image.RGBA); ok {
-
-			var imageBuf bytes.Buffer
-			err = EncodeImage(dst, &imageBuf, &item)
-			if err != nil {
-				batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-					ItemIdentifier: message.MessageId,
-				})
-				batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to encode image: %v", err))
-				continue
-			}
-
-			_, err = svc.PutObject(context.TODO(), &s3.PutObjectInput{
-				Bucket: aws.String(outputBucketName),
-				Key:    aws.String(record.S3.Object.Key),
-				Body:   bytes.NewReader(imageBuf.Bytes()),
-			})
-
-			if err != nil {
-				batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-					ItemIdentifier: message.MessageId,
-				})
-				batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to put object: %v", err))
-				continue
-			}
-
-			update := expression.Set(expression.Name("Status"), expression.Value("processed"))
-			expr, err := expression.NewBuilder().WithUpdate(update).Build()
-			if err != nil {
-				batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-					ItemIdentifier: message.MessageId,
-				})
-				batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to build expression:  %v", err))
-				continue
-			}
-
-			input := &dynamodb.UpdateItemInput{
-				TableName:                 aws.String(tableName),
-				Key:                       key,
-				ExpressionAttributeNames:  expr.Names(),
-				ExpressionAttributeValues: expr.Values(),
-				UpdateExpression:          expr.Update(),
-				ReturnValues:              types.ReturnValueUpdatedNew,
-			}
-
-			_, err = dynamo.UpdateItem(context.TODO(), input)
-			if err != nil {
-				batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{
-					ItemIdentifier: message.MessageId,
-				})
-				batchItemErrors = append(batchItemErrors, fmt.Errorf("failed to updated dynamodb item:  %v", err))
-				continue
-			}
-
-		} else {
-			panic("shouldn't have reached here")
+		if err := backoff.DelayMessage(ctx, queue, uploadQueueURL, message); err != nil {
+			fmt.Println(err)
 		}
 	}
 
+	// an error would fail the whole batch, the failures are reported per message
 	return events.SQSEventResponse{
 		BatchItemFailures: batchItemFailures,
-	}, errors.Join(batchItemErrors...)
+	}, nil
 }
 
 func main() {
+	// make the collector work harder before the function runs out of memory
+	debug.SetMemoryLimit(int64(imaging.MemoryBudget()))
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to load aws config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+	svc = awsclient.NewObjectStore(awsConfig)
+	queue = awsclient.NewQueue(awsConfig)
+	topic = awsclient.NewTopic(awsConfig)
+
 	lambda.Start(lambdaHandler)
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/jobevents"
+	"cdk_image_transform/internal/sequencer"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	testTable        = "AuthTable"
+	testInputBucket  = "input-bucket"
+	testOutputBucket = "output-bucket"
+	testUploadQueue  = "https://sqs.local/BucketUploadQueue"
+	testNotifyQueue  = "https://sqs.local/NotifyQueue"
+	testTopic        = "arn:aws:sns:us-east-1:000000000000:JobEventsTopic"
+	testObject       = "image-1.png"
+)
+
+// harness holds the fakes the lambda runs against and the messages S3
+// notified for the uploads.
+type harness struct {
+	store     *fake.DynamoDB
+	objects   *fake.S3
+	queue     *fake.Queue
+	topic     *fake.Topic
+	uploads   []events.SQSMessage
+	published []string
+}
+
+func setup(t *testing.T) *harness {
+
+	t.Helper()
+	inputBucketName, outputBucketName, tableName = testInputBucket, testOutputBucket, testTable
+	uploadQueueURL, notifyQueueURL, jobEventsTopicArn = testUploadQueue, testNotifyQueue, testTopic
+
+	h := &harness{
+		store:   fake.NewDynamoDB(testTable),
+		objects: fake.NewS3(testInputBucket, testOutputBucket),
+		queue:   &fake.Queue{},
+		topic:   &fake.Topic{},
+	}
+	dynamo, svc, queue, topic = h.store, h.objects, h.queue, h.topic
+
+	h.objects.Notify = func(bucket, key string, o *fake.Object, sequencer string) {
+		if bucket != testInputBucket {
+			return
+		}
+		body, err := fake.S3Notification("us-east-1", bucket, key, o, sequencer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.uploads = append(h.uploads, events.SQSMessage{
+			MessageId:     key + "/" + sequencer,
+			ReceiptHandle: sequencer,
+			Body:          string(body),
+			Attributes:    map[string]string{"ApproximateReceiveCount": "1"},
+		})
+	}
+
+	h.store.Put(testTable, &job.Item{
+		Pk:          testObject,
+		Sk:          "metadata",
+		TenantId:    "t-1",
+		Status:      job.StatusPendingUpload,
+		ContentType: ".png",
+		OutputKey:   "image-1.png",
+		Transforms:  []job.Transform{{Name: "resize", Params: []string{"4", "3"}}},
+		CallbackURL: "https://example.com/hook",
+		JobVersion:  1,
+	})
+	return h
+}
+
+func testImage(t *testing.T) []byte {
+
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for x := 0; x < 8; x++ {
+		img.Set(x, x%6, color.RGBA{G: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// run invokes the lambda with the upload notifications, it returns the ids
+// of the failed messages.
+func (h *harness) run(t *testing.T, messages ...events.SQSMessage) []string {
+
+	t.Helper()
+	response, err := lambdaHandler(context.Background(), events.SQSEvent{Records: messages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for _, failure := range response.BatchItemFailures {
+		failed = append(failed, failure.ItemIdentifier)
+	}
+	return failed
+}
+
+func (h *harness) job(t *testing.T) *job.Item {
+
+	t.Helper()
+	var item job.Item
+	if !h.store.Get(testTable, testObject, "metadata", &item) {
+		t.Fatal("the job is missing")
+	}
+	if item.Failure != nil {
+		t.Logf("failure: %+v", item.Failure)
+	}
+	return &item
+}
+
+// eventTypes returns the types of the events published to the job events topic.
+func (h *harness) eventTypes(t *testing.T) []string {
+
+	t.Helper()
+	var types []string
+	for _, input := range h.topic.Published {
+		var event jobevents.Event
+		if err := json.Unmarshal([]byte(*input.Message), &event); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestProcessesUpload(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+
+	if failed := h.run(t, h.uploads...); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+
+	item := h.job(t)
+	if item.Status != job.StatusSucceeded {
+		t.Fatalf("status = %s, want succeeded", item.Status)
+	}
+	if item.QueuedAt == "" || item.ProcessingAt == "" || item.SucceededAt == "" {
+		t.Errorf("transitions = %v, want queued, processing and succeeded", item.Transitions())
+	}
+	output := h.objects.Object(testOutputBucket, "image-1.png")
+	if output == nil {
+		t.Fatal("the output wasn't written")
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(output.Body))
+	if err != nil || format != "png" || config.Width != 4 || config.Height != 3 {
+		t.Errorf("output is a %dx%d %s (%v), want a 4x3 png", config.Width, config.Height, format, err)
+	}
+	if len(h.queue.Sent) != 1 {
+		t.Errorf("enqueued %d notifications, want 1", len(h.queue.Sent))
+	}
+	if got := h.eventTypes(t); len(got) != 2 || got[0] != jobevents.ImageJobQueued || got[1] != jobevents.ImageJobSucceeded {
+		t.Errorf("published %v, want queued then succeeded", got)
+	}
+
+	// a duplicate delivery of the event is skipped
+	if failed := h.run(t, h.uploads...); len(failed) != 0 {
+		t.Fatalf("duplicate failed %v", failed)
+	}
+	if len(h.topic.Published) != 2 || len(h.queue.Sent) != 1 {
+		t.Errorf("the duplicate published %d events and %d notifications", len(h.topic.Published)-2, len(h.queue.Sent)-1)
+	}
+}
+
+func TestFailsUndecodableUpload(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, []byte("not an image"), "image/png", nil)
+
+	if failed := h.run(t, h.uploads...); len(failed) != 0 {
+		t.Fatalf("failed %v, permanent failures aren't retried", failed)
+	}
+
+	var item struct {
+		Status  string
+		Failure *failure.Failure
+	}
+	h.store.Get(testTable, testObject, "metadata", &item)
+	if item.Status != "failed" || item.Failure == nil || item.Failure.Type != failure.DecodeError {
+		t.Errorf("job = %+v, want failed with a decode error", item)
+	}
+	if got := h.eventTypes(t); len(got) != 2 || got[1] != jobevents.ImageJobFailed {
+		t.Errorf("published %v, want queued then failed", got)
+	}
+	if len(h.queue.Sent) != 1 {
+		t.Errorf("enqueued %d notifications, want 1", len(h.queue.Sent))
+	}
+}
+
+func TestSkipsReplacedUpload(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, []byte("replaced"), "image/png", nil)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+
+	// the event of the first upload finds the second one, whose event follows
+	if failed := h.run(t, h.uploads[0]); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+	if status := h.job(t).Status; status != job.StatusProcessing {
+		t.Fatalf("status = %s, want processing", status)
+	}
+	if failed := h.run(t, h.uploads[1]); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+	if status := h.job(t).Status; status != job.StatusSucceeded {
+		t.Fatalf("status = %s, want succeeded", status)
+	}
+}
+
+func TestSkipsCancelledJob(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	item := h.job(t)
+	item.Status = job.StatusCancelled
+	h.store.Put(testTable, item)
+
+	if failed := h.run(t, h.uploads...); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+	if status := h.job(t).Status; status != job.StatusCancelled {
+		t.Fatalf("status = %s, want cancelled", status)
+	}
+	if h.objects.Object(testOutputBucket, "image-1.png") != nil || len(h.topic.Published) != 0 {
+		t.Errorf("the cancelled job was processed")
+	}
+}
+
+// TestProcessesNewUpload runs a job again when its object is uploaded again
+// after it succeeded.
+func TestProcessesNewUpload(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	if failed := h.run(t, h.uploads[0]); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+	if status := h.job(t).Status; status != job.StatusSucceeded {
+		t.Fatalf("status = %s, want succeeded", status)
+	}
+
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	if failed := h.run(t, h.uploads[1]); len(failed) != 0 {
+		t.Fatalf("failed %v", failed)
+	}
+	if got := h.eventTypes(t); len(got) != 4 || got[3] != jobevents.ImageJobSucceeded {
+		t.Errorf("published %v, want the new upload to succeed", got)
+	}
+}
+
+func TestRetriesStorageFailure(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	h.objects.Errors = map[string]error{"PutObject": &smithy.GenericAPIError{Code: "SlowDown", Message: "throttled"}}
+
+	failed := h.run(t, h.uploads...)
+	if len(failed) != 1 || failed[0] != h.uploads[0].MessageId {
+		t.Fatalf("failed %v, want the upload", failed)
+	}
+	if len(h.queue.Visibility) != 1 {
+		t.Errorf("delayed %d messages, want 1", len(h.queue.Visibility))
+	}
+	var item struct {
+		Status  string
+		Failure *failure.Failure
+	}
+	h.store.Get(testTable, testObject, "metadata", &item)
+	// the job is queued again to be retried
+	if item.Status != "queued" || item.Failure == nil || item.Failure.Type != failure.StorageUnavailable {
+		t.Errorf("job = %+v, want queued with the storage unavailable", item)
+	}
+
+	// the retry succeeds once the storage does
+	h.objects.Errors = nil
+	if failed := h.run(t, h.uploads...); len(failed) != 0 {
+		t.Fatalf("retry failed %v", failed)
+	}
+	if status := h.job(t).Status; status != job.StatusSucceeded {
+		t.Fatalf("status = %s, want succeeded", status)
+	}
+	// the job was queued once, by its upload
+	if got := h.eventTypes(t); len(got) != 2 || got[0] != jobevents.ImageJobQueued || got[1] != jobevents.ImageJobSucceeded {
+		t.Errorf("published %v, want the job queued once", got)
+	}
+}
+
+func TestRetriesWhenTableFails(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	h.store.Errors = map[string]error{"GetItem": &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException", Message: "throttled"}}
+
+	if failed := h.run(t, h.uploads...); len(failed) != 1 {
+		t.Fatalf("failed %v, want the upload", failed)
+	}
+}
+
+func TestFailsRefusedStorageRequest(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	h.objects.Errors = map[string]error{"GetObject": &smithy.GenericAPIError{Code: "AccessDenied", Message: "access denied"}}
+
+	// a refused request fails the same way when retried
+	if failed := h.run(t, h.uploads...); len(failed) != 0 {
+		t.Fatalf("failed %v, want the upload deleted", failed)
+	}
+	if item := h.job(t); item.Status != job.StatusFailed || item.Failure == nil || item.Failure.Type != failure.StorageError {
+		t.Errorf("job = %+v, want failed with a storage error", item)
+	}
+}
+
+func TestClaimsEventOnce(t *testing.T) {
+
+	h := setup(t)
+	h.store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "queued", "JobVersion": 1})
+	key, eventSequencer := job.MetadataKey(testObject), sequencer.Key(1, "0A")
+
+	// two deliveries of the event claim the job at once
+	results := make(chan error, 2)
+	var claims atomic.Int32
+	for i := 0; i < 2; i++ {
+		go func() {
+			claimed, err := claimEvent(context.Background(), key, eventSequencer)
+			if claimed {
+				claims.Add(1)
+			}
+			results <- err
+		}()
+	}
+	var held int
+	for i := 0; i < 2; i++ {
+		if err := <-results; errors.Is(err, errClaimHeld) {
+			held++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if claims.Load() != 1 || held != 1 {
+		t.Fatalf("claimed %d times, held %d, want one claim", claims.Load(), held)
+	}
+
+	// a more recent event takes the job over
+	if claimed, err := claimEvent(context.Background(), key, sequencer.Key(1, "0B")); !claimed || err != nil {
+		t.Errorf("claimed = %t, err = %v, want the job claimed by the new event", claimed, err)
+	}
+
+	// the claim of a run that died is taken once its lease expired
+	expired := time.Now().Add(-claimLease - time.Second).UTC().Format(time.RFC3339)
+	h.store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "processing", "JobVersion": 1, "ProcessingAt": expired, sequencer.Attribute: eventSequencer})
+	if claimed, err := claimEvent(context.Background(), key, eventSequencer); !claimed || err != nil {
+		t.Errorf("claimed = %t, err = %v, want the expired claim taken", claimed, err)
+	}
+}
+
+func TestRetriesHeldClaim(t *testing.T) {
+
+	h := setup(t)
+	h.objects.Put(testInputBucket, testObject, testImage(t), "image/png", nil)
+	var event Event
+	json.Unmarshal([]byte(h.uploads[0].Body), &event)
+	eventSequencer := sequencer.Key(1, event.Records[0].S3.Object.Sequencer)
+
+	// another delivery of the event is running the job
+	processingAt := time.Now().UTC().Format(time.RFC3339)
+	h.store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "processing", "ContentType": ".png", "OutputKey": testObject, "JobVersion": 1, "ProcessingAt": processingAt, sequencer.Attribute: eventSequencer})
+
+	if failed := h.run(t, h.uploads...); len(failed) != 1 {
+		t.Fatalf("failed %v, want the upload retried", failed)
+	}
+	if item := h.job(t); item.Status != job.StatusProcessing || item.Failure != nil {
+		t.Errorf("job = %+v, want it left to the running delivery", item)
+	}
+	if len(h.queue.Visibility) != 1 || len(h.topic.Published) != 0 {
+		t.Errorf("delayed %d messages and published %d events, want 1 and 0", len(h.queue.Visibility), len(h.topic.Published))
+	}
+}
+
+func TestDropsInvalidMessages(t *testing.T) {
+
+	h := setup(t)
+
+	for _, body := range []string{"{", `{"Records": []}`, `{"Records": [{"s3": {"bucket": {"name": "other-bucket"}}}]}`} {
+		if failed := h.run(t, events.SQSMessage{MessageId: "m-1", Body: body}); len(failed) != 0 {
+			t.Errorf("%s: failed %v, want it dropped", body, failed)
+		}
+	}
+}
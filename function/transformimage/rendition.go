@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+)
+
+// RenderedOutput is an encoded image waiting to be written to the output bucket.
+type RenderedOutput struct {
+	Key         string
+	ContentType string
+	Body        []byte
+	Width       int
+	Height      int
+}
+
+// Info returns the dimensions and size recorded on the job item.
+func (o RenderedOutput) Info() job.ImageInfo {
+	return job.ImageInfo{Width: o.Width, Height: o.Height, Bytes: len(o.Body)}
+}
+
+// RenderOutputs encodes the animation, already transformed by the top level
+// pipeline, as the single output of the job or as one output per rendition.
+// Each output is passed to write as soon as it is encoded, so only the copy
+// and the encoded output of one rendition are held at a time.
+func RenderOutputs(animation *imaging.Animation, item *job.Item, options imaging.OutputOptions, write func(RenderedOutput) error) error {
+
+	if len(item.Renditions) == 0 {
+		var imageBuf bytes.Buffer
+		if err := imaging.EncodeAnimation(animation, &imageBuf, options); err != nil {
+			return failure.Errorf(failure.InvalidParams, "failed to encode image: %v", err)
+		}
+		bounds := animation.Bounds()
+		return write(RenderedOutput{Key: item.OutputKey, ContentType: options.ContentType(), Body: imageBuf.Bytes(), Width: bounds.Dx(), Height: bounds.Dy()})
+	}
+
+	for i, rendition := range item.Renditions {
+		renditionPipeline := &imaging.Pipeline{
+			ContentType: item.ContentType,
+			Transforms:  job.Steps(rendition.Transforms),
+			Output:      imaging.MergeOutputOptions(options, rendition.Output),
+		}
+		renditionOptions, err := imaging.ParseOutputOptions(renditionPipeline)
+		if err != nil {
+			return failure.InRendition(failure.Errorf(failure.InvalidParams, "rendition %s: invalid output options: %v", rendition.Name, err), rendition.Name)
+		}
+
+		// the transforms may modify the frames in place, every rendition but
+		// the last one works on a copy of the shared frames
+		renditionAnimation := animation
+		if i < len(item.Renditions)-1 {
+			renditionAnimation = animation.Clone()
+		}
+		if err := imaging.TransformAnimation(renditionAnimation, renditionPipeline); err != nil {
+			return failure.InRendition(failure.Classify(fmt.Errorf("rendition %s: failed to transform image: %w", rendition.Name, err), failure.InvalidParams), rendition.Name)
+		}
+
+		var imageBuf bytes.Buffer
+		if err := imaging.EncodeAnimation(renditionAnimation, &imageBuf, renditionOptions); err != nil {
+			return failure.InRendition(failure.Errorf(failure.InvalidParams, "rendition %s: failed to encode image: %v", rendition.Name, err), rendition.Name)
+		}
+		bounds := renditionAnimation.Bounds()
+		if err := write(RenderedOutput{Key: rendition.OutputKey, ContentType: renditionOptions.ContentType(), Body: imageBuf.Bytes(), Width: bounds.Dx(), Height: bounds.Dy()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
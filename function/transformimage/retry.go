@@ -0,0 +1,17 @@
+package main
+
+import (
+	"time"
+
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/retry"
+)
+
+// backoff of the retried jobs, the queue moves them to the dlq after its max
+// receive count.
+var backoff = retry.Backoff{Base: 30 * time.Second, Max: retry.MaxDelay}
+
+// isTransient reports whether the job should be retried rather than failed.
+func isTransient(err error) bool {
+	return failure.Classify(err, failure.Unknown).Failure.Type.Transient()
+}
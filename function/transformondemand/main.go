@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path"
+	"runtime/debug"
+	"time"
+
+	"cdk_image_transform/internal/apierror"
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/tenant"
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var inputBucketName = os.Getenv("INPUT_BUCKET_NAME")
+var outputBucketName = os.Getenv("OUTPUT_BUCKET_NAME")
+var authTableName = os.Getenv("AUTH_TABLE_NAME")
+
+// maxRenderAttempts bounds the renders of a request whose source object keeps
+// being replaced.
+const maxRenderAttempts = 2
+
+// CachePrefix is the prefix of the cached results in the output bucket.
+const CachePrefix string = "cache/"
+
+var svc awsclient.ObjectStore
+var presigner awsclient.Presigner
+var dynamo awsclient.JobStore
+
+// errorResponse answers errs with statusCode, in the error envelope.
+func errorResponse(statusCode int, errs ...transforms.ValidationError) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{}, apierror.New(statusCode, errs...)
+}
+
+// Source is the object a pipeline runs on.
+type Source struct {
+	Bucket string
+	Key    string
+}
+
+// findSource returns the output of a succeeded job, or the named rendition of
+// it, and the uploaded object when the job hasn't succeeded or source=original.
+func findSource(objectName, source, rendition, tenantId string) (*Source, int, error) {
+
+	item, err := job.Get(context.TODO(), dynamo, authTableName, job.MetadataKey(objectName))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	// objects of other tenants are reported as missing
+	if item == nil || item.TenantId != tenantId {
+		return nil, http.StatusNotFound, fmt.Errorf("unknown object %s", objectName)
+	}
+
+	if rendition != "" {
+		if item.Status != job.StatusSucceeded {
+			return nil, http.StatusConflict, fmt.Errorf("object %s has not succeeded", objectName)
+		}
+		for _, r := range item.Renditions {
+			if r.Name == rendition {
+				return &Source{Bucket: outputBucketName, Key: r.OutputKey}, http.StatusOK, nil
+			}
+		}
+		return nil, http.StatusNotFound, fmt.Errorf("unknown rendition %s", rendition)
+	}
+
+	if source != "original" && item.Status == job.StatusSucceeded && len(item.Renditions) == 0 {
+		return &Source{Bucket: outputBucketName, Key: item.OutputKey}, http.StatusOK, nil
+	}
+	return &Source{Bucket: inputBucketName, Key: item.Pk}, http.StatusOK, nil
+}
+
+// CacheKey returns the key of the cached result of a pipeline. It changes
+// whenever the source object or the canonical pipeline changes.
+func CacheKey(etag, pipeline, extension string) string {
+
+	hash := sha256.Sum256([]byte(etag + "\n" + pipeline))
+	return CachePrefix + hex.EncodeToString(hash[:]) + extension
+}
+
+// errSourceReplaced fails a render whose source object was uploaded again
+// since its head was read, the result would be cached under the old ETag.
+var errSourceReplaced = errors.New("the object was replaced while it was rendered, retry the request")
+
+// isSourceReplaced reports whether a GetObject failed because the object no
+// longer matches its ETag.
+func isSourceReplaced(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
+
+// render runs the pipeline on the version etag of the source object and
+// writes the result to cacheKey.
+func render(source *Source, etag string, pipeline *imaging.Pipeline, options imaging.OutputOptions, cacheKey string) (int, error) {
+
+	object, err := svc.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket:  aws.String(source.Bucket),
+		Key:     aws.String(source.Key),
+		IfMatch: aws.String(etag),
+	})
+	if isSourceReplaced(err) {
+		return http.StatusConflict, errSourceReplaced
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get object: %v", err)
+	}
+	defer object.Body.Close()
+
+	if aws.ToInt64(object.ContentLength) > int64(imaging.MaxImageSizeBytes) {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("image size exceeds maximum allowed size")
+	}
+	buffer, err := imaging.ReadAll(object.Body, aws.ToInt64(object.ContentLength))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to read object: %v", err)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(buffer))
+	if err != nil {
+		return http.StatusUnprocessableEntity, fmt.Errorf("failed to decode image config: %v", err)
+	}
+	if config.Width > transforms.MaxImageWidth || config.Height > transforms.MaxImageHeight {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("image dimensions exceed maximum allowed dimensions")
+	}
+	if cost, budget := transforms.Cost(pipeline.Transforms, config.Width*config.Height), transforms.PipelineCostBudget(); cost > budget {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("estimated cost of %d megapixel steps exceeds the budget of %d", cost/(1000*1000), budget/(1000*1000))
+	}
+
+	scale, err := imaging.EstimateMemory(len(buffer), config, pipeline.Transforms).Fit(imaging.MemoryBudget(), imaging.OversizePolicy())
+	if err != nil {
+		return http.StatusRequestEntityTooLarge, err
+	}
+
+	animation, err := imaging.Decode(buffer, format, pipeline, scale)
+	buffer = nil // only the decoded frames are needed from here on
+	if err != nil {
+		return http.StatusUnprocessableEntity, fmt.Errorf("failed to decode image: %v", err)
+	}
+	if err := imaging.TransformAnimation(animation, pipeline); err != nil {
+		return http.StatusUnprocessableEntity, fmt.Errorf("failed to transform image: %v", err)
+	}
+
+	var imageBuf bytes.Buffer
+	if err := imaging.EncodeAnimation(animation, &imageBuf, options); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to encode image: %v", err)
+	}
+
+	_, err = svc.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(outputBucketName),
+		Key:         aws.String(cacheKey),
+		Body:        bytes.NewReader(imageBuf.Bytes()),
+		ContentType: aws.String(options.ContentType()),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to put object: %v", err)
+	}
+	return http.StatusOK, nil
+}
+
+func redirect(cacheKey, cacheStatus string) (events.APIGatewayProxyResponse, error) {
+
+	presignedURL, err := presigner.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(outputBucketName),
+		Key:    aws.String(cacheKey),
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = time.Duration(60 * int64(time.Second))
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+			},
+			fmt.Errorf("failed to create presigned url: %v", err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusFound,
+		Headers: map[string]string{
+			"Location":      presignedURL.URL,
+			"Cache-Control": "private, max-age=60",
+			"X-Cache":       cacheStatus,
+		},
+	}, nil
+}
+
+func lambdaHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return apierror.Handle(ctx, request, handleRequest)
+}
+
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+	if request.HTTPMethod != "GET" {
+		return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusMethodNotAllowed,
+			},
+			fmt.Errorf("invalid http method")
+	}
+
+	objectName, ok := request.PathParameters["key"]
+	if !ok || objectName == "" {
+		return errorResponse(http.StatusBadRequest, transforms.ValidationError{Field: "key", Message: "missing object key"})
+	}
+
+	steps, err := transforms.ParseCompact(request.QueryStringParameters["ops"])
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, transforms.ValidationError{Field: "ops", Message: err.Error()})
+	}
+	if errs := transforms.Validate(steps); len(errs) != 0 {
+		return errorResponse(http.StatusBadRequest, errs...)
+	}
+	canonical, err := transforms.Compact(steps)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, transforms.ValidationError{Field: "ops", Message: err.Error()})
+	}
+
+	source, statusCode, err := findSource(objectName, request.QueryStringParameters["source"], request.QueryStringParameters["rendition"], tenant.FromContext(request.RequestContext.Authorizer))
+	if err != nil {
+		if statusCode == http.StatusInternalServerError {
+			return events.APIGatewayProxyResponse{StatusCode: statusCode}, err
+		}
+		return errorResponse(statusCode, transforms.ValidationError{Field: "key", Message: err.Error()})
+	}
+
+	pipeline := &imaging.Pipeline{ContentType: path.Ext(source.Key), Transforms: steps}
+	options, err := imaging.ParseOutputOptions(pipeline)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, transforms.ValidationError{Field: "ops", Message: err.Error()})
+	}
+
+	// an object uploaded again while it is rendered is looked up again, its
+	// new ETag changes the cache key
+	for attempt := 1; ; attempt++ {
+		head, err := svc.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(source.Bucket),
+			Key:    aws.String(source.Key),
+		})
+		if err != nil {
+			var notFound *s3types.NotFound
+			if errors.As(err, &notFound) {
+				return errorResponse(http.StatusNotFound, transforms.ValidationError{Field: "key", Message: "the object no longer exists"})
+			}
+			return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+				},
+				fmt.Errorf("failed to head object: %v", err)
+		}
+
+		cacheKey := CacheKey(aws.ToString(head.ETag), canonical, options.Extension())
+
+		_, err = svc.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(outputBucketName),
+			Key:    aws.String(cacheKey),
+		})
+		if err == nil {
+			return redirect(cacheKey, "hit")
+		}
+		var notFound *s3types.NotFound
+		if !errors.As(err, &notFound) {
+			return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+				},
+				fmt.Errorf("failed to head cached object: %v", err)
+		}
+
+		fmt.Printf("rendering %s of %s/%s to %s\n", canonical, source.Bucket, source.Key, cacheKey)
+
+		statusCode, err = render(source, aws.ToString(head.ETag), pipeline, options, cacheKey)
+		if errors.Is(err, errSourceReplaced) && attempt < maxRenderAttempts {
+			continue
+		}
+		if err != nil {
+			if statusCode == http.StatusInternalServerError {
+				return events.APIGatewayProxyResponse{StatusCode: statusCode}, err
+			}
+			return errorResponse(statusCode, transforms.ValidationError{Message: err.Error()})
+		}
+		return redirect(cacheKey, "miss")
+	}
+}
+
+func main() {
+
+	// make the collector work harder before the function runs out of memory
+	debug.SetMemoryLimit(int64(imaging.MemoryBudget()))
+
+	awsConfig, err := awsclient.LoadConfig(context.Background())
+	if err != nil {
+		fmt.Printf("failed to initialize AWS config: %v\n", err)
+		os.Exit(1)
+	}
+	dynamo = awsclient.NewJobStore(awsConfig)
+	svc = awsclient.NewObjectStore(awsConfig)
+	presigner = awsclient.NewPresigner(awsConfig)
+
+	lambda.Start(lambdaHandler)
+}
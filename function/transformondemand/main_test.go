@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/tenant"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	testTable        = "AuthTable"
+	testInputBucket  = "input-bucket"
+	testOutputBucket = "output-bucket"
+	testObject       = "image-1.png"
+)
+
+func testImage(t *testing.T) []byte {
+
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for x := 0; x < 8; x++ {
+		img.Set(x, x%6, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// setup points the lambda at fakes holding an uploaded job.
+func setup(t *testing.T, body []byte) (*fake.DynamoDB, *fake.S3) {
+
+	t.Helper()
+	authTableName, inputBucketName, outputBucketName = testTable, testInputBucket, testOutputBucket
+	store, objects := fake.NewDynamoDB(testTable), fake.NewS3(testInputBucket, testOutputBucket)
+	dynamo, svc, presigner = store, objects, objects
+
+	store.Put(testTable, map[string]any{"pk": testObject, "sk": "metadata", "TenantId": "t-1", "Status": "processing"})
+	objects.Put(testInputBucket, testObject, body, "image/png", nil)
+	return store, objects
+}
+
+func request(key, ops, tenantId string) events.APIGatewayProxyRequest {
+
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		PathParameters:        map[string]string{"key": key},
+		QueryStringParameters: map[string]string{"ops": ops},
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{tenant.ContextKey: tenantId},
+		},
+	}
+}
+
+func TestRendersThenCaches(t *testing.T) {
+
+	_, objects := setup(t, testImage(t))
+
+	for _, want := range []string{"miss", "hit"} {
+		response, err := lambdaHandler(context.Background(), request(testObject, "resize:4x3,grayscale", "t-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusFound || response.Headers["X-Cache"] != want {
+			t.Fatalf("status = %d, cache = %s, want 302 and %s: %s", response.StatusCode, response.Headers["X-Cache"], want, response.Body)
+		}
+		location := response.Headers["Location"]
+		if !strings.Contains(location, "/"+testOutputBucket+"/"+CachePrefix) {
+			t.Fatalf("location = %s, want a cached object", location)
+		}
+		key := strings.SplitN(strings.SplitN(location, "/"+testOutputBucket+"/", 2)[1], "?", 2)[0]
+		cached := objects.Object(testOutputBucket, key)
+		if cached == nil {
+			t.Fatalf("%s wasn't cached", key)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(cached.Body))
+		if err != nil || config.Width != 4 || config.Height != 3 {
+			t.Errorf("cached %dx%d (%v), want 4x3", config.Width, config.Height, err)
+		}
+	}
+}
+
+func TestRejectsInvalidRequests(t *testing.T) {
+
+	setup(t, testImage(t))
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		want    int
+	}{
+		{"missing key", request("", "grayscale", "t-1"), http.StatusBadRequest},
+		{"unknown transform", request(testObject, "sharpen-more", "t-1"), http.StatusBadRequest},
+		{"invalid params", request(testObject, "resize:axb", "t-1"), http.StatusBadRequest},
+		{"other tenant", request(testObject, "grayscale", "t-2"), http.StatusNotFound},
+		{"missing job", request("image-2.png", "grayscale", "t-1"), http.StatusNotFound},
+		{"unprocessed rendition", func() events.APIGatewayProxyRequest {
+			r := request(testObject, "grayscale", "t-1")
+			r.QueryStringParameters["rendition"] = "thumb"
+			return r
+		}(), http.StatusConflict},
+	}
+	for _, test := range tests {
+		response, err := lambdaHandler(context.Background(), test.request)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response.StatusCode != test.want {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, response.StatusCode, test.want, response.Body)
+		}
+	}
+}
+
+func TestUndecodableImage(t *testing.T) {
+
+	setup(t, []byte("not an image"))
+
+	response, err := lambdaHandler(context.Background(), request(testObject, "grayscale", "t-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422", response.StatusCode)
+	}
+}
+
+func TestFails(t *testing.T) {
+
+	for _, operation := range []string{"HeadObject", "GetObject", "PutObject", "PresignGetObject"} {
+		_, objects := setup(t, testImage(t))
+		objects.Errors = map[string]error{operation: errors.New("throttled")}
+
+		response, err := lambdaHandler(context.Background(), request(testObject, "grayscale", "t-1"))
+		if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+			t.Errorf("%s: status = %d, err = %v, want a 500 error envelope", operation, response.StatusCode, err)
+		}
+	}
+
+	store, _ := setup(t, testImage(t))
+	store.Errors = map[string]error{"GetItem": errors.New("throttled")}
+	response, err := lambdaHandler(context.Background(), request(testObject, "grayscale", "t-1"))
+	if !fake.IsErrorEnvelope(response, err, http.StatusInternalServerError) {
+		t.Errorf("GetItem: status = %d, err = %v, want a 500 error envelope", response.StatusCode, err)
+	}
+}
+
+// replacingS3 uploads the source object again after the first replace heads
+// of it, between the head and the get of a render.
+type replacingS3 struct {
+	*fake.S3
+	replace int
+	body    []byte
+}
+
+func (s *replacingS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+
+	head, err := s.S3.HeadObject(ctx, params, optFns...)
+	if aws.ToString(params.Bucket) == testInputBucket && s.replace > 0 {
+		s.replace--
+		s.body = append(s.body, 0)
+		s.Put(testInputBucket, testObject, s.body, "image/png", nil)
+	}
+	return head, err
+}
+
+func TestRendersReplacedSource(t *testing.T) {
+
+	tests := []struct {
+		replace int
+		status  int
+	}{
+		{replace: 1, status: http.StatusFound},
+		{replace: maxRenderAttempts, status: http.StatusConflict},
+	}
+	for _, test := range tests {
+		_, objects := setup(t, testImage(t))
+		replacing := &replacingS3{S3: objects, replace: test.replace, body: testImage(t)}
+		svc = replacing
+
+		response, err := lambdaHandler(context.Background(), request(testObject, "grayscale", "t-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != test.status {
+			t.Fatalf("%d replaces: status = %d, want %d: %s", test.replace, response.StatusCode, test.status, response.Body)
+		}
+		if test.status != http.StatusFound {
+			continue
+		}
+		// the result is cached under the ETag of the object it was rendered from
+		source := objects.Object(testInputBucket, testObject)
+		if cacheKey := CacheKey(source.ETag, "grayscale", ".png"); objects.Object(testOutputBucket, cacheKey) == nil {
+			t.Errorf("%s wasn't cached", cacheKey)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package apierror answers the errors of the API lambdas with the same JSON
+// envelope, so clients handle every failure of the API in one way:
+//
+//	{"errors": [{"message": "unknown object image-1.png"}], "requestId": "<id>"}
+//
+// The request id is the id API Gateway gave the request, it is also returned in
+// the X-Request-Id header and logged with the cause of the internal errors,
+// whose details aren't returned to the client.
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// RequestIdHeader is the header of the error responses carrying the request id.
+const RequestIdHeader = "X-Request-Id"
+
+// InternalMessage is the message of the internal errors.
+const InternalMessage = "internal error, quote the request id when reporting it"
+
+// Envelope is the body of every error response of the API. The validation
+// errors of a pipeline name the step, field, transform and parameter at fault.
+type Envelope struct {
+	Errors    []transforms.ValidationError `json:"errors"`
+	RequestId string                       `json:"requestId"`
+}
+
+// Error is an error answered to the client with its status code, messages and
+// headers, such as the Retry-After of a 429.
+type Error struct {
+	StatusCode int
+	Errors     []transforms.ValidationError
+	Headers    map[string]string
+}
+
+func (e *Error) Error() string {
+
+	if len(e.Errors) == 0 {
+		return http.StatusText(e.StatusCode)
+	}
+	return e.Errors[0].Message
+}
+
+// New returns the error answered with statusCode and errs.
+func New(statusCode int, errs ...transforms.ValidationError) *Error {
+	return &Error{StatusCode: statusCode, Errors: errs}
+}
+
+// Errorf returns the error answered with statusCode and the formatted message.
+func Errorf(statusCode int, format string, args ...any) *Error {
+	return New(statusCode, transforms.ValidationError{Message: fmt.Sprintf(format, args...)})
+}
+
+// JSON answers value with statusCode. A value that can't be marshalled is
+// answered with a 500.
+func JSON(statusCode int, value any) (events.APIGatewayProxyResponse, error) {
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response: %v", err)
+	}
+	return events.APIGatewayProxyResponse{
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+		StatusCode: statusCode,
+	}, nil
+}
+
+// Respond answers message with statusCode, in the envelope.
+func Respond(statusCode int, message string) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{}, Errorf(statusCode, "%s", message)
+}
+
+// Handler is the handler of an API lambda. It returns an *Error for the errors
+// of the client, and any other error or a panic is answered with a 500. The
+// status code of a response returned with another error is kept when it is a
+// 4xx, and the error is its message.
+type Handler func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// Handle runs handler and answers its errors with the envelope. It never
+// returns an error, which API Gateway would answer with a bare 502.
+func Handle(ctx context.Context, request events.APIGatewayProxyRequest, handler Handler) (response events.APIGatewayProxyResponse, err error) {
+
+	requestId := request.RequestContext.RequestID
+	if requestId == "" {
+		requestId = uuid.New().String()
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			response, err = Response(requestId, fmt.Errorf("panic: %v", recovered), 0), nil
+		}
+	}()
+
+	response, err = handler(ctx, request)
+	if err != nil {
+		return Response(requestId, err, response.StatusCode), nil
+	}
+	return response, nil
+}
+
+// Response returns the error response of err to the request of requestId.
+// statusCode is the status the handler answered err with, if any.
+func Response(requestId string, err error, statusCode int) events.APIGatewayProxyResponse {
+
+	envelope := Envelope{RequestId: requestId}
+	headers := map[string]string{}
+
+	var apiErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+		statusCode, envelope.Errors = apiErr.StatusCode, apiErr.Errors
+		for name, value := range apiErr.Headers {
+			headers[name] = value
+		}
+		if len(envelope.Errors) == 0 {
+			envelope.Errors = []transforms.ValidationError{{Message: http.StatusText(statusCode)}}
+		}
+	case statusCode >= 400 && statusCode < 500:
+		envelope.Errors = []transforms.ValidationError{{Message: err.Error()}}
+	default:
+		statusCode = http.StatusInternalServerError
+		envelope.Errors = []transforms.ValidationError{{Message: InternalMessage}}
+	}
+	if statusCode >= 500 {
+		fmt.Printf("request %s failed with %d: %v\n", requestId, statusCode, err)
+	}
+
+	headers["Content-Type"] = "application/json"
+	headers[RequestIdHeader] = requestId
+	body, _ := json.Marshal(envelope) // the envelope only holds strings and ints
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,135 @@
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func handle(t *testing.T, handler Handler) (events.APIGatewayProxyResponse, Envelope) {
+
+	t.Helper()
+	request := events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: "request-1"}}
+	response, err := Handle(context.Background(), request, handler)
+	if err != nil {
+		t.Fatalf("err = %v, want the error answered", err)
+	}
+	var envelope Envelope
+	if response.StatusCode >= 400 {
+		if err := json.Unmarshal([]byte(response.Body), &envelope); err != nil {
+			t.Fatalf("body = %s: %v", response.Body, err)
+		}
+		if envelope.RequestId != "request-1" || response.Headers[RequestIdHeader] != "request-1" {
+			t.Errorf("request id = %q, header %q, want request-1", envelope.RequestId, response.Headers[RequestIdHeader])
+		}
+	}
+	return response, envelope
+}
+
+func TestHandle(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		handler Handler
+		status  int
+		message string
+	}{
+		{
+			name: "client error",
+			handler: func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				return events.APIGatewayProxyResponse{}, Errorf(http.StatusNotFound, "unknown object %s", "image-1.png")
+			},
+			status:  http.StatusNotFound,
+			message: "unknown object image-1.png",
+		},
+		{
+			name: "status of the response",
+			handler: func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusMethodNotAllowed}, errors.New("invalid http method")
+			},
+			status:  http.StatusMethodNotAllowed,
+			message: "invalid http method",
+		},
+		{
+			name: "internal error",
+			handler: func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("secret table name")
+			},
+			status:  http.StatusInternalServerError,
+			message: InternalMessage,
+		},
+		{
+			name: "panic",
+			handler: func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				panic("should be unreachable")
+			},
+			status:  http.StatusInternalServerError,
+			message: InternalMessage,
+		},
+	}
+	for _, test := range tests {
+		response, envelope := handle(t, test.handler)
+		if response.StatusCode != test.status || len(envelope.Errors) != 1 || envelope.Errors[0].Message != test.message {
+			t.Errorf("%s: %d %s, want %d %q", test.name, response.StatusCode, response.Body, test.status, test.message)
+		}
+		// the causes of the internal errors are only logged
+		if strings.Contains(response.Body, "secret") || strings.Contains(response.Body, "unreachable") {
+			t.Errorf("%s: body = %s leaks the cause", test.name, response.Body)
+		}
+	}
+}
+
+func TestHandleKeepsErrorsAndHeaders(t *testing.T) {
+
+	response, envelope := handle(t, func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		limited := New(http.StatusTooManyRequests, transforms.ValidationError{Field: "Quota", Message: "the jobs quota of 10 is exceeded"})
+		limited.Headers = map[string]string{"Retry-After": "60"}
+		return events.APIGatewayProxyResponse{}, limited
+	})
+	if response.StatusCode != http.StatusTooManyRequests || response.Headers["Retry-After"] != "60" {
+		t.Errorf("status = %d, headers = %v, want a 429 to retry after 60s", response.StatusCode, response.Headers)
+	}
+	if len(envelope.Errors) != 1 || envelope.Errors[0].Field != "Quota" {
+		t.Errorf("errors = %+v, want the quota error", envelope.Errors)
+	}
+
+	// the successful responses are left alone
+	response, _ = handle(t, func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "{}"}, nil
+	})
+	if response.StatusCode != http.StatusOK || response.Body != "{}" || response.Headers[RequestIdHeader] != "" {
+		t.Errorf("response = %+v, want it unchanged", response)
+	}
+}
+
+func TestJSON(t *testing.T) {
+
+	response, err := JSON(http.StatusAccepted, map[string]int{"JobVersion": 2})
+	if err != nil || response.StatusCode != http.StatusAccepted || response.Body != `{"JobVersion":2}` || response.Headers["Content-Type"] != "application/json" {
+		t.Errorf("response = %+v, err = %v, want the 202 json body", response, err)
+	}
+
+	response, envelope := handle(t, func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return JSON(http.StatusOK, make(chan int))
+	})
+	if response.StatusCode != http.StatusInternalServerError || envelope.Errors[0].Message != InternalMessage {
+		t.Errorf("unmarshallable value: status = %d, errors = %+v, want an internal error", response.StatusCode, envelope.Errors)
+	}
+}
+
+func TestRespond(t *testing.T) {
+
+	response, envelope := handle(t, func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return Respond(http.StatusNotFound, "unknown object image-1.png")
+	})
+	if response.StatusCode != http.StatusNotFound || len(envelope.Errors) != 1 || envelope.Errors[0].Message != "unknown object image-1.png" {
+		t.Errorf("status = %d, errors = %+v, want the 404 message", response.StatusCode, envelope.Errors)
+	}
+}
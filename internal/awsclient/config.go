@@ -0,0 +1,43 @@
+package awsclient
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// LoadConfig loads the configuration of the clients from the environment of
+// the lambda.
+func LoadConfig(ctx context.Context) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx)
+}
+
+func NewJobStore(config aws.Config) JobStore {
+	return dynamodb.NewFromConfig(config)
+}
+
+func NewObjectStore(config aws.Config) ObjectStore {
+	return s3.NewFromConfig(config)
+}
+
+func NewPresigner(config aws.Config) Presigner {
+	return s3.NewPresignClient(s3.NewFromConfig(config))
+}
+
+func NewQueue(config aws.Config) Queue {
+	return sqs.NewFromConfig(config)
+}
+
+func NewTopic(config aws.Config) Topic {
+	return sns.NewFromConfig(config)
+}
+
+func NewSecretStore(config aws.Config) SecretStore {
+	return secretsmanager.NewFromConfig(config)
+}
@@ -0,0 +1,129 @@
+// Package failure records why a job failed on its item, so the status API
+// can explain a failed job without going through the logs.
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// Type classifies a failure.
+type Type string
+
+const (
+	DecodeError      Type = "decode_error"
+	TooLarge         Type = "too_large"
+	UnknownTransform Type = "unknown_transform"
+	InvalidParams    Type = "invalid_params"
+	// StorageError is a request the storage refused, such as a missing
+	// object or item, a denied access or a failed precondition.
+	StorageError Type = "storage_error"
+	// StorageUnavailable is a throttled request, or one the storage failed
+	// with a 5xx or a timeout.
+	StorageUnavailable Type = "storage_unavailable"
+	Timeout            Type = "timeout"
+	// Unknown is recorded by the dlq for jobs that failed without recording
+	// a reason, such as a function that ran out of memory.
+	Unknown Type = "unknown"
+)
+
+// Transient reports whether a job that failed with a failure of type t may
+// succeed when retried: an unavailable storage or a timeout. The other types
+// depend on the image, the pipeline or the state of the storage, and unknown
+// failures aren't retried blindly.
+func (t Type) Transient() bool {
+	return t == StorageUnavailable || t == Timeout
+}
+
+// Failure is stored under the Failure attribute of the job item. Step is the
+// index of the failing step in the Transforms of the job, or of the rendition
+// when Rendition is set.
+type Failure struct {
+	Type      Type   `dynamodbav:"Type" json:"Type"`
+	Message   string `dynamodbav:"Message" json:"Message"`
+	Step      *int   `dynamodbav:"Step,omitempty" json:"Step,omitempty"`
+	Rendition string `dynamodbav:"Rendition,omitempty" json:"Rendition,omitempty"`
+	At        string `dynamodbav:"At" json:"At"`
+}
+
+// Error is an error carrying the failure to record.
+type Error struct {
+	Failure Failure
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns an error recorded as a failure of type t.
+func New(t Type, err error) *Error {
+	return &Error{Failure: Failure{Type: t, Message: err.Error(), At: time.Now().UTC().Format(time.RFC3339)}, Err: err}
+}
+
+// Errorf formats an error recorded as a failure of type t.
+func Errorf(t Type, format string, args ...any) *Error {
+	return New(t, fmt.Errorf(format, args...))
+}
+
+// InRendition returns err with the failure attributed to the named rendition.
+func InRendition(err *Error, rendition string) *Error {
+	err.Failure.Rendition = rendition
+	return err
+}
+
+// isUnavailable reports whether err is a throttling, 5xx or timeout error of an
+// AWS service, as the retryer of the SDK tells them.
+func isUnavailable(err error) bool {
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err).Bool()
+}
+
+// Classify returns err as a failure. Errors of a step of the pipeline keep its
+// index, and the failure is of type fallback when err tells nothing better.
+func Classify(err error, fallback Type) *Error {
+
+	var failureError *Error
+	if errors.As(err, &failureError) {
+		return failureError
+	}
+
+	t := fallback
+	var paramError *transforms.ParamError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		t = Timeout
+	case isUnavailable(err):
+		t = StorageUnavailable
+	case errors.Is(err, transforms.ErrUnknownTransform):
+		t = UnknownTransform
+	case errors.Is(err, imaging.ErrTooLarge):
+		t = TooLarge
+	case errors.Is(err, imaging.ErrUnknownFormat):
+		t = InvalidParams
+	case errors.As(err, &paramError):
+		t = InvalidParams
+	}
+
+	classified := New(t, err)
+	var stepError *imaging.StepError
+	if errors.As(err, &stepError) {
+		step := stepError.Step
+		classified.Failure.Step = &step
+		if t == fallback {
+			// a step that can't be applied to the image is given bad parameters
+			classified.Failure.Type = InvalidParams
+		}
+	}
+	return classified
+}
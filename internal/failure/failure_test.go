@@ -0,0 +1,65 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/transforms"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// responseError returns the error of a storage request answered with status.
+func responseError(status int, code string) error {
+
+	return &smithy.OperationError{ServiceID: "S3", OperationName: "GetObject", Err: &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}}, Err: &smithy.GenericAPIError{Code: code}},
+	}}
+}
+
+func TestClassify(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  error
+		want Type
+	}{
+		{"throttled", responseError(http.StatusServiceUnavailable, "SlowDown"), StorageUnavailable},
+		{"throttled table", &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"}, StorageUnavailable},
+		{"internal error", responseError(http.StatusInternalServerError, "InternalError"), StorageUnavailable},
+		{"request timeout", responseError(http.StatusBadRequest, "RequestTimeout"), StorageUnavailable},
+		{"deadline", fmt.Errorf("failed to get object: %w", context.DeadlineExceeded), Timeout},
+		{"no such key", responseError(http.StatusNotFound, "NoSuchKey"), StorageError},
+		{"access denied", responseError(http.StatusForbidden, "AccessDenied"), StorageError},
+		{"precondition", responseError(http.StatusPreconditionFailed, "PreconditionFailed"), StorageError},
+		{"conditional check", &smithy.GenericAPIError{Code: "ConditionalCheckFailedException"}, StorageError},
+		{"unknown transform", fmt.Errorf("%w: blur", transforms.ErrUnknownTransform), UnknownTransform},
+		{"too large", imaging.ErrTooLarge, TooLarge},
+		{"param", &transforms.ParamError{Param: "width", Value: "-1", Err: errors.New("invalid")}, InvalidParams},
+	}
+	for _, test := range tests {
+		classified := Classify(fmt.Errorf("failed: %w", test.err), StorageError)
+		if classified.Failure.Type != test.want {
+			t.Errorf("%s: type = %s, want %s", test.name, classified.Failure.Type, test.want)
+		}
+		if transient := test.want == StorageUnavailable || test.want == Timeout; classified.Failure.Type.Transient() != transient {
+			t.Errorf("%s: transient = %t, want %t", test.name, !transient, transient)
+		}
+	}
+
+	// unknown failures aren't retried
+	if classified := Classify(errors.New("out of memory"), Unknown); classified.Failure.Type != Unknown || classified.Failure.Type.Transient() {
+		t.Errorf("failure = %+v, want a permanent unknown failure", classified.Failure)
+	}
+	// a classified error keeps its failure
+	recorded := Errorf(StorageError, "item not found: image-1.png")
+	if classified := Classify(fmt.Errorf("failed: %w", recorded), Unknown); classified != recorded {
+		t.Errorf("failure = %+v, want the recorded one", classified.Failure)
+	}
+}
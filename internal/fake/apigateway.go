@@ -0,0 +1,20 @@
+package fake
+
+import (
+	"encoding/json"
+
+	"cdk_image_transform/internal/apierror"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// IsErrorEnvelope reports whether the response of a lambda behind the API
+// answers want with the error envelope, carrying the request id in its body
+// and header.
+func IsErrorEnvelope(response events.APIGatewayProxyResponse, err error, want int) bool {
+
+	var envelope apierror.Envelope
+	return err == nil && response.StatusCode == want &&
+		json.Unmarshal([]byte(response.Body), &envelope) == nil && len(envelope.Errors) != 0 &&
+		envelope.RequestId != "" && response.Headers[apierror.RequestIdHeader] == envelope.RequestId
+}
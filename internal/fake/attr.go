@@ -0,0 +1,280 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// attr is an attribute value in the wire format of the DynamoDB API. Exactly
+// one field is set, M and L are set when they aren't nil even when empty.
+type attr struct {
+	S    *string
+	N    *string
+	B    []byte
+	BOOL *bool
+	NULL *bool
+	M    map[string]*attr
+	L    []*attr
+	SS   []string
+	NS   []string
+	BS   [][]byte
+}
+
+type item map[string]*attr
+
+// wireAttr marshals the fields of attr, with omitempty for every field but M
+// and L, which are handled by MarshalJSON.
+type wireAttr struct {
+	S    *string  `json:"S,omitempty"`
+	N    *string  `json:"N,omitempty"`
+	B    []byte   `json:"B,omitempty"`
+	BOOL *bool    `json:"BOOL,omitempty"`
+	NULL *bool    `json:"NULL,omitempty"`
+	SS   []string `json:"SS,omitempty"`
+	NS   []string `json:"NS,omitempty"`
+	BS   [][]byte `json:"BS,omitempty"`
+}
+
+func (a *attr) MarshalJSON() ([]byte, error) {
+
+	switch {
+	case a.M != nil:
+		return json.Marshal(map[string]map[string]*attr{"M": a.M})
+	case a.L != nil:
+		return json.Marshal(map[string][]*attr{"L": a.L})
+	}
+	return json.Marshal(wireAttr{S: a.S, N: a.N, B: a.B, BOOL: a.BOOL, NULL: a.NULL, SS: a.SS, NS: a.NS, BS: a.BS})
+}
+
+func (a *attr) UnmarshalJSON(data []byte) error {
+
+	var wire struct {
+		wireAttr
+		M map[string]*attr `json:"M"`
+		L []*attr          `json:"L"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	*a = attr{S: wire.S, N: wire.N, B: wire.B, BOOL: wire.BOOL, NULL: wire.NULL, M: wire.M, L: wire.L, SS: wire.SS, NS: wire.NS, BS: wire.BS}
+	if a.typeName() == "" {
+		return errors.New("attribute value without a type")
+	}
+	return nil
+}
+
+func stringAttr(s string) *attr {
+	return &attr{S: &s}
+}
+
+func numberAttr(n *big.Rat) *attr {
+
+	s := n.FloatString(0)
+	if !n.IsInt() {
+		s = n.FloatString(20)
+		s = string(bytes.TrimRight([]byte(s), "0"))
+	}
+	return &attr{N: &s}
+}
+
+// typeName returns the type of the value as named by attribute_type.
+func (a *attr) typeName() string {
+
+	switch {
+	case a.S != nil:
+		return "S"
+	case a.N != nil:
+		return "N"
+	case a.B != nil:
+		return "B"
+	case a.BOOL != nil:
+		return "BOOL"
+	case a.NULL != nil:
+		return "NULL"
+	case a.M != nil:
+		return "M"
+	case a.L != nil:
+		return "L"
+	case a.SS != nil:
+		return "SS"
+	case a.NS != nil:
+		return "NS"
+	case a.BS != nil:
+		return "BS"
+	}
+	return ""
+}
+
+func (a *attr) number() (*big.Rat, bool) {
+
+	if a == nil || a.N == nil {
+		return nil, false
+	}
+	return new(big.Rat).SetString(*a.N)
+}
+
+func (a *attr) clone() *attr {
+
+	if a == nil {
+		return nil
+	}
+	c := *a
+	if a.M != nil {
+		c.M = make(map[string]*attr, len(a.M))
+		for name, value := range a.M {
+			c.M[name] = value.clone()
+		}
+	}
+	if a.L != nil {
+		c.L = make([]*attr, len(a.L))
+		for i, value := range a.L {
+			c.L[i] = value.clone()
+		}
+	}
+	c.B = slices.Clone(a.B)
+	c.SS, c.NS, c.BS = slices.Clone(a.SS), slices.Clone(a.NS), slices.Clone(a.BS)
+	return &c
+}
+
+func (i item) clone() item {
+
+	if i == nil {
+		return nil
+	}
+	c := make(item, len(i))
+	for name, value := range i {
+		c[name] = value.clone()
+	}
+	return c
+}
+
+// equal compares two values of any type, numbers by their value.
+func equal(a, b *attr) bool {
+
+	if a == nil || b == nil || a.typeName() != b.typeName() {
+		return false
+	}
+	if x, ok := a.number(); ok {
+		y, _ := b.number()
+		return y != nil && x.Cmp(y) == 0
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+// compare orders two strings, numbers or binaries of the same type.
+func compare(a, b *attr) (int, bool) {
+
+	if a == nil || b == nil || a.typeName() != b.typeName() {
+		return 0, false
+	}
+	switch {
+	case a.S != nil:
+		return bytes.Compare([]byte(*a.S), []byte(*b.S)), true
+	case a.N != nil:
+		x, okX := a.number()
+		y, okY := b.number()
+		if !okX || !okY {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case a.B != nil:
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+// fromSDK converts a value of the SDK, nil stays nil.
+func fromSDK(v types.AttributeValue) *attr {
+
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return stringAttr(v.Value)
+	case *types.AttributeValueMemberN:
+		n := v.Value
+		return &attr{N: &n}
+	case *types.AttributeValueMemberB:
+		return &attr{B: slices.Clone(v.Value)}
+	case *types.AttributeValueMemberBOOL:
+		b := v.Value
+		return &attr{BOOL: &b}
+	case *types.AttributeValueMemberNULL:
+		b := v.Value
+		return &attr{NULL: &b}
+	case *types.AttributeValueMemberM:
+		return &attr{M: fromSDKItem(v.Value)}
+	case *types.AttributeValueMemberL:
+		l := make([]*attr, len(v.Value))
+		for i, element := range v.Value {
+			l[i] = fromSDK(element)
+		}
+		return &attr{L: l}
+	case *types.AttributeValueMemberSS:
+		return &attr{SS: slices.Clone(v.Value)}
+	case *types.AttributeValueMemberNS:
+		return &attr{NS: slices.Clone(v.Value)}
+	case *types.AttributeValueMemberBS:
+		return &attr{BS: slices.Clone(v.Value)}
+	}
+	return nil
+}
+
+func fromSDKItem(values map[string]types.AttributeValue) item {
+
+	if values == nil {
+		return nil
+	}
+	i := make(item, len(values))
+	for name, value := range values {
+		i[name] = fromSDK(value)
+	}
+	return i
+}
+
+// toSDK converts a value to the SDK.
+func (a *attr) toSDK() types.AttributeValue {
+
+	switch {
+	case a.S != nil:
+		return &types.AttributeValueMemberS{Value: *a.S}
+	case a.N != nil:
+		return &types.AttributeValueMemberN{Value: *a.N}
+	case a.B != nil:
+		return &types.AttributeValueMemberB{Value: slices.Clone(a.B)}
+	case a.BOOL != nil:
+		return &types.AttributeValueMemberBOOL{Value: *a.BOOL}
+	case a.NULL != nil:
+		return &types.AttributeValueMemberNULL{Value: *a.NULL}
+	case a.M != nil:
+		return &types.AttributeValueMemberM{Value: item(a.M).toSDK()}
+	case a.L != nil:
+		l := make([]types.AttributeValue, len(a.L))
+		for i, element := range a.L {
+			l[i] = element.toSDK()
+		}
+		return &types.AttributeValueMemberL{Value: l}
+	case a.SS != nil:
+		return &types.AttributeValueMemberSS{Value: slices.Clone(a.SS)}
+	case a.NS != nil:
+		return &types.AttributeValueMemberNS{Value: slices.Clone(a.NS)}
+	}
+	return &types.AttributeValueMemberBS{Value: slices.Clone(a.BS)}
+}
+
+func (i item) toSDK() map[string]types.AttributeValue {
+
+	if i == nil {
+		return nil
+	}
+	values := make(map[string]types.AttributeValue, len(i))
+	for name, value := range i {
+		values[name] = value.toSDK()
+	}
+	return values
+}
@@ -0,0 +1,551 @@
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// DynamoDB holds tables keyed by pk and sk, as the auth table is. It
+// implements awsclient.JobStore, and serves the JSON protocol of the DynamoDB
+// API for the lambdas of the local harness.
+type DynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string]item
+
+	// Errors fails the operations named by its keys, such as "PutItem", with
+	// their error
+	Errors map[string]error
+}
+
+func NewDynamoDB(tableNames ...string) *DynamoDB {
+
+	store := &DynamoDB{tables: map[string]map[string]item{}}
+	for _, name := range tableNames {
+		store.tables[name] = map[string]item{}
+	}
+	return store
+}
+
+// dynamoError is an error of the DynamoDB API, Item is the item failing a
+// condition when ReturnValuesOnConditionCheckFailure is ALL_OLD.
+type dynamoError struct {
+	Type                string               `json:"__type"`
+	Message             string               `json:"message"`
+	Item                item                 `json:"Item,omitempty"`
+	CancellationReasons []cancellationReason `json:"CancellationReasons,omitempty"`
+}
+
+type cancellationReason struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message,omitempty"`
+	Item    item   `json:"Item,omitempty"`
+}
+
+func (e *dynamoError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+func validationError(format string, args ...any) *dynamoError {
+	return &dynamoError{Type: "ValidationException", Message: fmt.Sprintf(format, args...)}
+}
+
+func conditionFailed(old item, returnOld bool) *dynamoError {
+
+	e := &dynamoError{Type: "ConditionalCheckFailedException", Message: "The conditional request failed"}
+	if returnOld {
+		e.Item = old
+	}
+	return e
+}
+
+// writeRequest is the union of the fields of PutItem, UpdateItem, DeleteItem
+// and the items of TransactWriteItems.
+type writeRequest struct {
+	TableName                           string
+	Key                                 item
+	Item                                item
+	UpdateExpression                    string
+	ConditionExpression                 string
+	ExpressionAttributeNames            map[string]string
+	ExpressionAttributeValues           map[string]*attr
+	ReturnValues                        string
+	ReturnValuesOnConditionCheckFailure string
+}
+
+type getRequest struct {
+	TableName string
+	Key       item
+}
+
+type transactItem struct {
+	Put            *writeRequest
+	Update         *writeRequest
+	Delete         *writeRequest
+	ConditionCheck *writeRequest
+}
+
+type transactRequest struct {
+	TransactItems []transactItem
+}
+
+func keyOf(i item) (string, error) {
+
+	pk, sk := i["pk"], i["sk"]
+	if pk == nil || pk.S == nil || sk == nil || sk.S == nil {
+		return "", validationError("The provided key element does not match the schema")
+	}
+	return *pk.S + "\x00" + *sk.S, nil
+}
+
+func (s *DynamoDB) table(name string) (map[string]item, error) {
+
+	table, ok := s.tables[name]
+	if !ok {
+		return nil, &dynamoError{Type: "ResourceNotFoundException", Message: "Requested resource not found: " + name}
+	}
+	return table, nil
+}
+
+// prepare checks the condition of a write and returns the item to store, nil
+// for a delete, along with its key and the item it replaces.
+func (s *DynamoDB) prepare(kind string, r *writeRequest) (key string, old, updated item, err error) {
+
+	table, err := s.table(r.TableName)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	keyItem := r.Key
+	if kind == "Put" {
+		keyItem = r.Item
+	}
+	if key, err = keyOf(keyItem); err != nil {
+		return "", nil, nil, err
+	}
+	old = table[key]
+
+	used := map[string]bool{}
+	if r.ConditionExpression != "" {
+		c, err := parseConditionExpression(r.ConditionExpression, r.ExpressionAttributeNames, r.ExpressionAttributeValues, used)
+		if err != nil {
+			return "", nil, nil, validationError("Invalid ConditionExpression: %v", err)
+		}
+		ok, err := c.test(old)
+		if err != nil {
+			return "", nil, nil, validationError("Invalid ConditionExpression: %v", err)
+		}
+		if !ok {
+			return "", nil, nil, conditionFailed(old, r.ReturnValuesOnConditionCheckFailure == "ALL_OLD")
+		}
+	}
+
+	switch kind {
+	case "Put":
+		updated = r.Item.clone()
+	case "Update":
+		actions, err := parseUpdateExpression(r.UpdateExpression, r.ExpressionAttributeNames, r.ExpressionAttributeValues, used)
+		if err != nil {
+			return "", nil, nil, validationError("Invalid UpdateExpression: %v", err)
+		}
+		base := old
+		if base == nil {
+			base = item{"pk": r.Key["pk"], "sk": r.Key["sk"]}
+		}
+		if updated, err = apply(base, actions); err != nil {
+			return "", nil, nil, validationError("Invalid UpdateExpression: %v", err)
+		}
+	case "ConditionCheck":
+		updated = old
+	}
+
+	for name := range r.ExpressionAttributeNames {
+		if !used[name] {
+			return "", nil, nil, validationError("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", name)
+		}
+	}
+	for name := range r.ExpressionAttributeValues {
+		if !used[name] {
+			return "", nil, nil, validationError("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", name)
+		}
+	}
+	return key, old, updated, nil
+}
+
+func (s *DynamoDB) store(tableName, key string, updated item) {
+
+	if updated == nil {
+		delete(s.tables[tableName], key)
+		return
+	}
+	s.tables[tableName][key] = updated
+}
+
+// returnValues picks the attributes to return from a write.
+func returnValues(mode string, old, updated item, r *writeRequest) item {
+
+	switch mode {
+	case "ALL_OLD":
+		return old.clone()
+	case "ALL_NEW":
+		return updated.clone()
+	case "UPDATED_OLD", "UPDATED_NEW":
+		source := updated
+		if mode == "UPDATED_OLD" {
+			source = old
+		}
+		actions, _ := parseUpdateExpression(r.UpdateExpression, r.ExpressionAttributeNames, r.ExpressionAttributeValues, map[string]bool{})
+		result := item{}
+		for _, a := range actions {
+			name := a.path[0].name
+			if value, ok := source[name]; ok {
+				result[name] = value.clone()
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func (s *DynamoDB) getItem(r *getRequest) (item, error) {
+
+	table, err := s.table(r.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyOf(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	return table[key].clone(), nil
+}
+
+// write runs a PutItem, UpdateItem or DeleteItem and returns the attributes
+// asked for by ReturnValues.
+func (s *DynamoDB) write(kind string, r *writeRequest) (item, error) {
+
+	key, old, updated, err := s.prepare(kind, r)
+	if err != nil {
+		return nil, err
+	}
+	s.store(r.TableName, key, updated)
+	return returnValues(r.ReturnValues, old, updated, r), nil
+}
+
+// transactWriteItems applies every write or none of them.
+func (s *DynamoDB) transactWriteItems(r *transactRequest) error {
+
+	type write struct {
+		table, key string
+		updated    item
+	}
+	var writes []write
+	reasons := make([]cancellationReason, len(r.TransactItems))
+	cancelled := false
+	seen := map[string]bool{}
+
+	for n, transactItem := range r.TransactItems {
+		kind, request := "Put", transactItem.Put
+		switch {
+		case transactItem.Update != nil:
+			kind, request = "Update", transactItem.Update
+		case transactItem.Delete != nil:
+			kind, request = "Delete", transactItem.Delete
+		case transactItem.ConditionCheck != nil:
+			kind, request = "ConditionCheck", transactItem.ConditionCheck
+		}
+		if request == nil {
+			return validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+		}
+
+		key, _, updated, err := s.prepare(kind, request)
+		if err != nil {
+			e, ok := err.(*dynamoError)
+			if !ok || e.Type != "ConditionalCheckFailedException" {
+				return err
+			}
+			reasons[n] = cancellationReason{Code: "ConditionalCheckFailed", Message: e.Message, Item: e.Item}
+			cancelled = true
+			continue
+		}
+		if seen[request.TableName+key] {
+			return validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[request.TableName+key] = true
+		reasons[n] = cancellationReason{Code: "None"}
+		if kind != "ConditionCheck" {
+			writes = append(writes, write{request.TableName, key, updated})
+		}
+	}
+
+	if cancelled {
+		codes := make([]string, len(reasons))
+		for n, reason := range reasons {
+			codes[n] = reason.Code
+		}
+		return &dynamoError{
+			Type:                "TransactionCanceledException",
+			Message:             "Transaction cancelled, please refer cancellation reasons for specific reasons [" + strings.Join(codes, ", ") + "]",
+			CancellationReasons: reasons,
+		}
+	}
+	for _, w := range writes {
+		s.store(w.table, w.key, w.updated)
+	}
+	return nil
+}
+
+// ServeHTTP answers the JSON 1.0 protocol of the DynamoDB API.
+func (s *DynamoDB) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	operation := strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result any
+	switch operation {
+	case "GetItem":
+		var r getRequest
+		if err = json.Unmarshal(body, &r); err == nil {
+			var i item
+			i, err = s.getItem(&r)
+			result = struct {
+				Item item `json:"Item,omitempty"`
+			}{i}
+		}
+	case "PutItem", "UpdateItem", "DeleteItem":
+		var r writeRequest
+		if err = json.Unmarshal(body, &r); err == nil {
+			var attributes item
+			attributes, err = s.write(strings.TrimSuffix(operation, "Item"), &r)
+			result = struct {
+				Attributes item `json:"Attributes,omitempty"`
+			}{attributes}
+		}
+	case "TransactWriteItems":
+		var r transactRequest
+		if err = json.Unmarshal(body, &r); err == nil {
+			err, result = s.transactWriteItems(&r), struct{}{}
+		}
+	default:
+		err = &dynamoError{Type: "UnknownOperationException", Message: "unsupported operation " + operation}
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		e, ok := err.(*dynamoError)
+		if !ok {
+			e = &dynamoError{Type: "SerializationException", Message: err.Error()}
+		}
+		e.Type = "com.amazonaws.dynamodb.v20120810#" + e.Type
+		status, result = http.StatusBadRequest, e
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the SDK checks the checksum of every response
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Header().Set("X-Amz-Crc32", strconv.FormatUint(uint64(crc32.ChecksumIEEE(response)), 10))
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// sdkError converts an error to the error the SDK would return for it.
+func sdkError(err error) error {
+
+	e, ok := err.(*dynamoError)
+	if !ok {
+		return err
+	}
+	switch e.Type {
+	case "ConditionalCheckFailedException":
+		return &types.ConditionalCheckFailedException{Message: aws.String(e.Message), Item: e.Item.toSDK()}
+	case "TransactionCanceledException":
+		reasons := make([]types.CancellationReason, len(e.CancellationReasons))
+		for n, reason := range e.CancellationReasons {
+			reasons[n] = types.CancellationReason{Code: aws.String(reason.Code), Item: reason.Item.toSDK()}
+			if reason.Message != "" {
+				reasons[n].Message = aws.String(reason.Message)
+			}
+		}
+		return &types.TransactionCanceledException{Message: aws.String(e.Message), CancellationReasons: reasons}
+	case "ResourceNotFoundException":
+		return &types.ResourceNotFoundException{Message: aws.String(e.Message)}
+	}
+	return &smithy.GenericAPIError{Code: e.Type, Message: e.Message}
+}
+
+// call runs an operation with the lock held, unless Errors fails it.
+func (s *DynamoDB) call(operation string, run func() error) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Errors[operation]; err != nil {
+		return err
+	}
+	return sdkError(run())
+}
+
+func (s *DynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+
+	output := &dynamodb.GetItemOutput{}
+	err := s.call("GetItem", func() error {
+		i, err := s.getItem(&getRequest{TableName: aws.ToString(params.TableName), Key: fromSDKItem(params.Key)})
+		output.Item = i.toSDK()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *DynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+
+	output := &dynamodb.PutItemOutput{}
+	err := s.call("PutItem", func() error {
+		attributes, err := s.write("Put", &writeRequest{
+			TableName:                           aws.ToString(params.TableName),
+			Item:                                fromSDKItem(params.Item),
+			ConditionExpression:                 aws.ToString(params.ConditionExpression),
+			ExpressionAttributeNames:            params.ExpressionAttributeNames,
+			ExpressionAttributeValues:           fromSDKItem(params.ExpressionAttributeValues),
+			ReturnValues:                        string(params.ReturnValues),
+			ReturnValuesOnConditionCheckFailure: string(params.ReturnValuesOnConditionCheckFailure),
+		})
+		output.Attributes = attributes.toSDK()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *DynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+
+	output := &dynamodb.UpdateItemOutput{}
+	err := s.call("UpdateItem", func() error {
+		attributes, err := s.write("Update", &writeRequest{
+			TableName:                           aws.ToString(params.TableName),
+			Key:                                 fromSDKItem(params.Key),
+			UpdateExpression:                    aws.ToString(params.UpdateExpression),
+			ConditionExpression:                 aws.ToString(params.ConditionExpression),
+			ExpressionAttributeNames:            params.ExpressionAttributeNames,
+			ExpressionAttributeValues:           fromSDKItem(params.ExpressionAttributeValues),
+			ReturnValues:                        string(params.ReturnValues),
+			ReturnValuesOnConditionCheckFailure: string(params.ReturnValuesOnConditionCheckFailure),
+		})
+		output.Attributes = attributes.toSDK()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *DynamoDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+
+	request := &transactRequest{}
+	for _, i := range params.TransactItems {
+		var t transactItem
+		switch {
+		case i.Put != nil:
+			t.Put = &writeRequest{
+				TableName:                           aws.ToString(i.Put.TableName),
+				Item:                                fromSDKItem(i.Put.Item),
+				ConditionExpression:                 aws.ToString(i.Put.ConditionExpression),
+				ExpressionAttributeNames:            i.Put.ExpressionAttributeNames,
+				ExpressionAttributeValues:           fromSDKItem(i.Put.ExpressionAttributeValues),
+				ReturnValuesOnConditionCheckFailure: string(i.Put.ReturnValuesOnConditionCheckFailure),
+			}
+		case i.Update != nil:
+			t.Update = &writeRequest{
+				TableName:                           aws.ToString(i.Update.TableName),
+				Key:                                 fromSDKItem(i.Update.Key),
+				UpdateExpression:                    aws.ToString(i.Update.UpdateExpression),
+				ConditionExpression:                 aws.ToString(i.Update.ConditionExpression),
+				ExpressionAttributeNames:            i.Update.ExpressionAttributeNames,
+				ExpressionAttributeValues:           fromSDKItem(i.Update.ExpressionAttributeValues),
+				ReturnValuesOnConditionCheckFailure: string(i.Update.ReturnValuesOnConditionCheckFailure),
+			}
+		case i.Delete != nil:
+			t.Delete = &writeRequest{
+				TableName:                           aws.ToString(i.Delete.TableName),
+				Key:                                 fromSDKItem(i.Delete.Key),
+				ConditionExpression:                 aws.ToString(i.Delete.ConditionExpression),
+				ExpressionAttributeNames:            i.Delete.ExpressionAttributeNames,
+				ExpressionAttributeValues:           fromSDKItem(i.Delete.ExpressionAttributeValues),
+				ReturnValuesOnConditionCheckFailure: string(i.Delete.ReturnValuesOnConditionCheckFailure),
+			}
+		case i.ConditionCheck != nil:
+			t.ConditionCheck = &writeRequest{
+				TableName:                           aws.ToString(i.ConditionCheck.TableName),
+				Key:                                 fromSDKItem(i.ConditionCheck.Key),
+				ConditionExpression:                 aws.ToString(i.ConditionCheck.ConditionExpression),
+				ExpressionAttributeNames:            i.ConditionCheck.ExpressionAttributeNames,
+				ExpressionAttributeValues:           fromSDKItem(i.ConditionCheck.ExpressionAttributeValues),
+				ReturnValuesOnConditionCheckFailure: string(i.ConditionCheck.ReturnValuesOnConditionCheckFailure),
+			}
+		}
+		request.TransactItems = append(request.TransactItems, t)
+	}
+
+	err := s.call("TransactWriteItems", func() error {
+		return s.transactWriteItems(request)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// Put stores v, marshalled with attributevalue, in a table without any
+// condition.
+func (s *DynamoDB) Put(tableName string, v any) {
+
+	values, err := attributevalue.MarshalMap(v)
+	if err != nil {
+		panic("fake: " + err.Error())
+	}
+	if _, err := s.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: values}); err != nil {
+		panic("fake: " + err.Error())
+	}
+}
+
+// Get unmarshals the item of a table into out, it returns false when the item
+// is missing.
+func (s *DynamoDB) Get(tableName, pk, sk string, out any) bool {
+
+	s.mu.Lock()
+	i := s.tables[tableName][pk+"\x00"+sk]
+	s.mu.Unlock()
+	if i == nil {
+		return false
+	}
+	if err := attributevalue.UnmarshalMap(i.toSDK(), out); err != nil {
+		panic("fake: " + err.Error())
+	}
+	return true
+}
@@ -0,0 +1,851 @@
+package fake
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The condition and update expressions of the DynamoDB API, enough of them
+// for the expressions built by the lambdas and the expression package.
+
+type token struct {
+	kind string // "name", "value", "ident", "number" or the punctuation itself
+	text string
+}
+
+func tokenize(expr string) ([]token, error) {
+
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '#' || c == ':' || unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || expr[j] == '_') {
+				j++
+			}
+			kind := "ident"
+			if c == '#' {
+				kind = "name"
+			} else if c == ':' {
+				kind = "value"
+			}
+			tokens = append(tokens, token{kind, expr[i:j]})
+			i = j
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(expr) && unicode.IsDigit(rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, token{"number", expr[i:j]})
+			i = j
+		case strings.HasPrefix(expr[i:], "<>") || strings.HasPrefix(expr[i:], "<=") || strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, token{expr[i : i+2], expr[i : i+2]})
+			i += 2
+		case strings.ContainsRune("()[],.=<>+-", c):
+			tokens = append(tokens, token{string(c), string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("invalid character %q in expression", c)
+		}
+	}
+	return tokens, nil
+}
+
+// pathElement is a name, or an index when name is empty.
+type pathElement struct {
+	name  string
+	index int
+}
+
+type attrPath []pathElement
+
+func (p attrPath) String() string {
+
+	var b strings.Builder
+	for i, element := range p {
+		if element.name == "" {
+			fmt.Fprintf(&b, "[%d]", element.index)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(element.name)
+	}
+	return b.String()
+}
+
+// operand evaluates to a value of the item, nil when it is missing.
+type operand interface {
+	eval(i item) (*attr, error)
+}
+
+type pathOperand struct{ path attrPath }
+type valueOperand struct{ value *attr }
+type sizeOperand struct{ path attrPath }
+type ifNotExistsOperand struct {
+	path     attrPath
+	fallback operand
+}
+type listAppendOperand struct{ a, b operand }
+type arithmeticOperand struct {
+	op   string
+	a, b operand
+}
+
+// condition evaluates to a boolean on the item.
+type condition interface {
+	test(i item) (bool, error)
+}
+
+type logical struct {
+	op   string
+	a, b condition
+}
+type not struct{ c condition }
+type comparison struct {
+	op   string
+	a, b operand
+}
+type between struct{ a, low, high operand }
+type in struct {
+	a      operand
+	values []operand
+}
+type functionCondition struct {
+	name string
+	path attrPath
+	arg  operand
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	names  map[string]string
+	values map[string]*attr
+	used   map[string]bool
+}
+
+func newParser(expr string, names map[string]string, values map[string]*attr, used map[string]bool) (*parser, error) {
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens, names: names, values: values, used: used}, nil
+}
+
+func (p *parser) peek() token {
+
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{}
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == "ident" && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(kind string) (token, error) {
+
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("syntax error: expected %q, found %q", kind, t.text)
+	}
+	return t, nil
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) parsePath() (attrPath, error) {
+
+	var result attrPath
+	for {
+		t := p.next()
+		var name string
+		switch t.kind {
+		case "name":
+			resolved, ok := p.names[t.text]
+			if !ok {
+				return nil, fmt.Errorf("undefined expression attribute name %s", t.text)
+			}
+			p.used[t.text] = true
+			name = resolved
+		case "ident":
+			name = t.text
+		default:
+			return nil, fmt.Errorf("syntax error: expected an attribute name, found %q", t.text)
+		}
+		result = append(result, pathElement{name: name})
+
+		for p.peek().kind == "[" {
+			p.next()
+			index, err := p.expect("number")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n, _ := strconv.Atoi(index.text)
+			result = append(result, pathElement{index: n})
+		}
+		if p.peek().kind != "." {
+			return result, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseOperand() (operand, error) {
+
+	t := p.peek()
+	switch {
+	case t.kind == "value":
+		p.next()
+		value, ok := p.values[t.text]
+		if !ok {
+			return nil, fmt.Errorf("undefined expression attribute value %s", t.text)
+		}
+		p.used[t.text] = true
+		return valueOperand{value}, nil
+	case t.kind == "ident" && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == "(":
+		p.next()
+		p.next()
+		var result operand
+		switch strings.ToLower(t.text) {
+		case "size":
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			result = sizeOperand{target}
+		case "if_not_exists":
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+			fallback, err := p.parseSetValue()
+			if err != nil {
+				return nil, err
+			}
+			result = ifNotExistsOperand{target, fallback}
+		case "list_append":
+			a, err := p.parseSetValue()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseSetValue()
+			if err != nil {
+				return nil, err
+			}
+			result = listAppendOperand{a, b}
+		default:
+			return nil, fmt.Errorf("unsupported function %s", t.text)
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	target, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{target}, nil
+}
+
+// parseSetValue parses the right-hand side of a SET action.
+func (p *parser) parseSetValue() (operand, error) {
+
+	a, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peek().kind; op == "+" || op == "-" {
+		p.next()
+		b, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return arithmeticOperand{op, a, b}, nil
+	}
+	return a, nil
+}
+
+func (p *parser) parseCondition() (condition, error) {
+
+	a, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("OR") {
+		p.next()
+		b, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		a = logical{"OR", a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+
+	a, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("AND") {
+		p.next()
+		b, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		a = logical{"AND", a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+
+	if p.peekKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+var conditionFunctions = []string{"attribute_exists", "attribute_not_exists", "attribute_type", "begins_with", "contains"}
+
+func (p *parser) parsePrimary() (condition, error) {
+
+	t := p.peek()
+	if t.kind == "(" {
+		p.next()
+		c, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	if t.kind == "ident" && slices.Contains(conditionFunctions, strings.ToLower(t.text)) {
+		p.next()
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		f := functionCondition{name: strings.ToLower(t.text), path: target}
+		if f.name != "attribute_exists" && f.name != "attribute_not_exists" {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if f.arg, err = p.parseOperand(); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	a, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); {
+	case op.kind == "=" || op.kind == "<>" || op.kind == "<" || op.kind == "<=" || op.kind == ">" || op.kind == ">=":
+		p.next()
+		b, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return comparison{op.kind, a, b}, nil
+	case p.peekKeyword("BETWEEN"):
+		p.next()
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekKeyword("AND") {
+			return nil, fmt.Errorf("syntax error: expected AND in BETWEEN")
+		}
+		p.next()
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return between{a, low, high}, nil
+	case p.peekKeyword("IN"):
+		p.next()
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var values []operand
+		for {
+			value, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			if p.peek().kind != "," {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return in{a, values}, nil
+	default:
+		return nil, fmt.Errorf("syntax error: expected a comparison, found %q", op.text)
+	}
+}
+
+// lookup returns the value at the path, nil when it is missing.
+func (i item) lookup(target attrPath) *attr {
+
+	value := i[target[0].name]
+	for _, element := range target[1:] {
+		if value == nil {
+			return nil
+		}
+		if element.name == "" {
+			if value.L == nil || element.index >= len(value.L) {
+				return nil
+			}
+			value = value.L[element.index]
+		} else {
+			if value.M == nil {
+				return nil
+			}
+			value = value.M[element.name]
+		}
+	}
+	return value
+}
+
+func (o pathOperand) eval(i item) (*attr, error) {
+	return i.lookup(o.path), nil
+}
+
+func (o valueOperand) eval(item) (*attr, error) {
+	return o.value, nil
+}
+
+func (o sizeOperand) eval(i item) (*attr, error) {
+
+	value := i.lookup(o.path)
+	if value == nil {
+		return nil, nil
+	}
+	var size int
+	switch {
+	case value.S != nil:
+		size = len(*value.S)
+	case value.B != nil:
+		size = len(value.B)
+	case value.M != nil:
+		size = len(value.M)
+	case value.L != nil:
+		size = len(value.L)
+	case value.SS != nil:
+		size = len(value.SS)
+	case value.NS != nil:
+		size = len(value.NS)
+	case value.BS != nil:
+		size = len(value.BS)
+	default:
+		return nil, fmt.Errorf("size() of a %s", value.typeName())
+	}
+	return numberAttr(big.NewRat(int64(size), 1)), nil
+}
+
+func (o ifNotExistsOperand) eval(i item) (*attr, error) {
+
+	if value := i.lookup(o.path); value != nil {
+		return value, nil
+	}
+	return o.fallback.eval(i)
+}
+
+func (o listAppendOperand) eval(i item) (*attr, error) {
+
+	a, err := o.a.eval(i)
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.b.eval(i)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil || a.L == nil || b.L == nil {
+		return nil, fmt.Errorf("list_append of values that aren't lists")
+	}
+	return &attr{L: append(slices.Clone(a.L), b.L...)}, nil
+}
+
+func (o arithmeticOperand) eval(i item) (*attr, error) {
+
+	a, err := o.a.eval(i)
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.b.eval(i)
+	if err != nil {
+		return nil, err
+	}
+	x, okX := a.number()
+	y, okY := b.number()
+	if !okX || !okY {
+		return nil, fmt.Errorf("an operand of %s isn't a number", o.op)
+	}
+	if o.op == "-" {
+		return numberAttr(new(big.Rat).Sub(x, y)), nil
+	}
+	return numberAttr(new(big.Rat).Add(x, y)), nil
+}
+
+func (c logical) test(i item) (bool, error) {
+
+	a, err := c.a.test(i)
+	if err != nil {
+		return false, err
+	}
+	if c.op == "AND" && !a || c.op == "OR" && a {
+		return a, nil
+	}
+	return c.b.test(i)
+}
+
+func (c not) test(i item) (bool, error) {
+	result, err := c.c.test(i)
+	return !result, err
+}
+
+func (c comparison) test(i item) (bool, error) {
+
+	a, err := c.a.eval(i)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.b.eval(i)
+	if err != nil {
+		return false, err
+	}
+	switch c.op {
+	case "=":
+		return equal(a, b), nil
+	case "<>":
+		return a != nil && b != nil && !equal(a, b), nil
+	}
+	order, ok := compare(a, b)
+	if !ok {
+		return false, nil
+	}
+	switch c.op {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	}
+	return order >= 0, nil
+}
+
+func (c between) test(i item) (bool, error) {
+
+	a, err := c.a.eval(i)
+	if err != nil {
+		return false, err
+	}
+	low, err := c.low.eval(i)
+	if err != nil {
+		return false, err
+	}
+	high, err := c.high.eval(i)
+	if err != nil {
+		return false, err
+	}
+	lowOrder, okLow := compare(a, low)
+	highOrder, okHigh := compare(a, high)
+	return okLow && okHigh && lowOrder >= 0 && highOrder <= 0, nil
+}
+
+func (c in) test(i item) (bool, error) {
+
+	a, err := c.a.eval(i)
+	if err != nil {
+		return false, err
+	}
+	for _, operand := range c.values {
+		value, err := operand.eval(i)
+		if err != nil {
+			return false, err
+		}
+		if equal(a, value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c functionCondition) test(i item) (bool, error) {
+
+	value := i.lookup(c.path)
+	switch c.name {
+	case "attribute_exists":
+		return value != nil, nil
+	case "attribute_not_exists":
+		return value == nil, nil
+	}
+
+	arg, err := c.arg.eval(i)
+	if err != nil || value == nil || arg == nil {
+		return false, err
+	}
+	switch c.name {
+	case "attribute_type":
+		return arg.S != nil && value.typeName() == *arg.S, nil
+	case "begins_with":
+		if value.S != nil && arg.S != nil {
+			return strings.HasPrefix(*value.S, *arg.S), nil
+		}
+		return false, nil
+	}
+	// contains
+	switch {
+	case value.S != nil && arg.S != nil:
+		return strings.Contains(*value.S, *arg.S), nil
+	case value.SS != nil && arg.S != nil:
+		return slices.Contains(value.SS, *arg.S), nil
+	case value.NS != nil && arg.N != nil:
+		return slices.ContainsFunc(value.NS, func(n string) bool { return equal(&attr{N: &n}, arg) }), nil
+	case value.L != nil:
+		return slices.ContainsFunc(value.L, func(element *attr) bool { return equal(element, arg) }), nil
+	}
+	return false, nil
+}
+
+// parseConditionExpression parses a whole condition expression.
+func parseConditionExpression(expr string, names map[string]string, values map[string]*attr, used map[string]bool) (condition, error) {
+
+	p, err := newParser(expr, names, values, used)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("syntax error: unexpected %q", p.peek().text)
+	}
+	return c, nil
+}
+
+// action is a single action of an update expression.
+type action struct {
+	clause string // SET, REMOVE, ADD or DELETE
+	path   attrPath
+	value  operand
+}
+
+func parseUpdateExpression(expr string, names map[string]string, values map[string]*attr, used map[string]bool) ([]action, error) {
+
+	p, err := newParser(expr, names, values, used)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []action
+	for !p.done() {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != "ident" || !slices.Contains([]string{"SET", "REMOVE", "ADD", "DELETE"}, clause) {
+			return nil, fmt.Errorf("syntax error: expected SET, REMOVE, ADD or DELETE, found %q", t.text)
+		}
+		for {
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			a := action{clause: clause, path: target}
+			switch clause {
+			case "SET":
+				if _, err := p.expect("="); err != nil {
+					return nil, err
+				}
+				a.value, err = p.parseSetValue()
+			case "ADD", "DELETE":
+				a.value, err = p.parseOperand()
+			}
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, a)
+			if p.peek().kind != "," {
+				break
+			}
+			p.next()
+		}
+	}
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("empty update expression")
+	}
+	return actions, nil
+}
+
+// set stores value at the path, whose parent must exist.
+func (i item) set(target attrPath, value *attr) error {
+
+	if len(target) == 1 {
+		i[target[0].name] = value
+		return nil
+	}
+	parent := i.lookup(target[:len(target)-1])
+	last := target[len(target)-1]
+	switch {
+	case parent == nil:
+		return fmt.Errorf("the document path %s is invalid for update", target)
+	case last.name != "" && parent.M != nil:
+		parent.M[last.name] = value
+	case last.name == "" && parent.L != nil:
+		if last.index < len(parent.L) {
+			parent.L[last.index] = value
+		} else {
+			parent.L = append(parent.L, value)
+		}
+	default:
+		return fmt.Errorf("the document path %s is invalid for update", target)
+	}
+	return nil
+}
+
+func (i item) remove(target attrPath) {
+
+	if len(target) == 1 {
+		delete(i, target[0].name)
+		return
+	}
+	parent := i.lookup(target[:len(target)-1])
+	last := target[len(target)-1]
+	switch {
+	case parent == nil:
+	case last.name != "" && parent.M != nil:
+		delete(parent.M, last.name)
+	case last.name == "" && parent.L != nil && last.index < len(parent.L):
+		parent.L = slices.Delete(parent.L, last.index, last.index+1)
+	}
+}
+
+// apply runs the actions on a copy of old, the operands being evaluated on
+// old as DynamoDB does.
+func apply(old item, actions []action) (item, error) {
+
+	updated := old.clone()
+	for _, a := range actions {
+		var value *attr
+		if a.value != nil {
+			var err error
+			if value, err = a.value.eval(old); err != nil {
+				return nil, err
+			}
+			if value == nil {
+				return nil, fmt.Errorf("the value of %s refers to a missing attribute", a.path)
+			}
+			value = value.clone()
+		}
+
+		switch a.clause {
+		case "SET":
+			if err := updated.set(a.path, value); err != nil {
+				return nil, err
+			}
+		case "REMOVE":
+			updated.remove(a.path)
+		case "ADD":
+			current := updated.lookup(a.path)
+			switch {
+			case current == nil:
+				if err := updated.set(a.path, value); err != nil {
+					return nil, err
+				}
+			case current.N != nil:
+				x, _ := current.number()
+				y, ok := value.number()
+				if !ok {
+					return nil, fmt.Errorf("ADD of a %s to a number", value.typeName())
+				}
+				*current = *numberAttr(new(big.Rat).Add(x, y))
+			case current.SS != nil && value.SS != nil:
+				for _, s := range value.SS {
+					if !slices.Contains(current.SS, s) {
+						current.SS = append(current.SS, s)
+					}
+				}
+			case current.NS != nil && value.NS != nil:
+				for _, n := range value.NS {
+					if !slices.Contains(current.NS, n) {
+						current.NS = append(current.NS, n)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("ADD of a %s to a %s", value.typeName(), current.typeName())
+			}
+		case "DELETE":
+			current := updated.lookup(a.path)
+			if current == nil {
+				continue
+			}
+			switch {
+			case current.SS != nil && value.SS != nil:
+				current.SS = slices.DeleteFunc(current.SS, func(s string) bool { return slices.Contains(value.SS, s) })
+			case current.NS != nil && value.NS != nil:
+				current.NS = slices.DeleteFunc(current.NS, func(n string) bool { return slices.Contains(value.NS, n) })
+			default:
+				return nil, fmt.Errorf("DELETE of a %s from a %s", value.typeName(), current.typeName())
+			}
+			if len(current.SS) == 0 && len(current.NS) == 0 && len(current.BS) == 0 {
+				updated.remove(a.path)
+			}
+		}
+	}
+	return updated, nil
+}
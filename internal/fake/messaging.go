@@ -0,0 +1,80 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Queue records the messages sent to the queues and the changes of the
+// visibility of their messages. It implements awsclient.Queue.
+type Queue struct {
+	// Errors fails the operations named by its keys with their errors.
+	Errors map[string]error
+
+	mu         sync.Mutex
+	Sent       []*sqs.SendMessageInput
+	Visibility []*sqs.ChangeMessageVisibilityInput
+}
+
+func (q *Queue) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.Errors["SendMessage"]; err != nil {
+		return nil, err
+	}
+	q.Sent = append(q.Sent, params)
+	return &sqs.SendMessageOutput{MessageId: aws.String(fmt.Sprintf("message-%d", len(q.Sent)))}, nil
+}
+
+func (q *Queue) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.Errors["ChangeMessageVisibility"]; err != nil {
+		return nil, err
+	}
+	q.Visibility = append(q.Visibility, params)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// Topic records the messages published to the topics. It implements
+// awsclient.Topic.
+type Topic struct {
+	// Errors fails the operations named by its keys with their errors.
+	Errors map[string]error
+
+	mu        sync.Mutex
+	Published []*sns.PublishInput
+}
+
+func (t *Topic) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.Errors["Publish"]; err != nil {
+		return nil, err
+	}
+	t.Published = append(t.Published, params)
+	return &sns.PublishOutput{MessageId: aws.String(fmt.Sprintf("message-%d", len(t.Published)))}, nil
+}
+
+// Secrets holds the values of the secrets by their ids. It implements
+// awsclient.SecretStore.
+type Secrets map[string]string
+
+func (s Secrets) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+
+	value, ok := s[aws.ToString(params.SecretId)]
+	if !ok {
+		return nil, &smtypes.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+	}
+	return &secretsmanager.GetSecretValueOutput{ARN: params.SecretId, SecretString: aws.String(value)}, nil
+}
@@ -0,0 +1,374 @@
+package fake
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Object is an object of a bucket.
+type Object struct {
+	Body         []byte
+	ETag         string // quoted, as in the ETag header
+	ContentType  string
+	Metadata     map[string]string
+	LastModified time.Time
+}
+
+// S3 holds the buckets, addressed path-style as the SDK does for an endpoint
+// that is an IP address. It implements awsclient.ObjectStore and
+// awsclient.Presigner, and serves the REST API of S3.
+type S3 struct {
+	// Errors fails the operations named by its keys with their errors.
+	Errors map[string]error
+
+	// Notify is called with every object created in a bucket, as S3 notifies
+	// the upload topic.
+	Notify func(bucket, key string, o *Object, sequencer string)
+
+	// Endpoint prefixes the presigned urls.
+	Endpoint string
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*Object
+
+	// sequencer orders the notifications, as the sequencer of S3 events
+	sequencer uint64
+}
+
+func NewS3(bucketNames ...string) *S3 {
+
+	store := &S3{Endpoint: "https://s3.local", buckets: map[string]map[string]*Object{}}
+	for _, name := range bucketNames {
+		store.buckets[name] = map[string]*Object{}
+	}
+	return store
+}
+
+// newObject returns an object with its ETag computed from its body.
+func newObject(body []byte, contentType string, metadata map[string]string) *Object {
+
+	sum := md5.Sum(body)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return &Object{
+		Body:         body,
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		ContentType:  contentType,
+		Metadata:     metadata,
+		LastModified: time.Now().UTC(),
+	}
+}
+
+// put stores an object and notifies it, it returns false when the bucket is
+// missing.
+func (s *S3) put(bucketName, key string, o *Object) bool {
+
+	s.mu.Lock()
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	bucket[key] = o
+	s.sequencer++
+	sequencer := fmt.Sprintf("%016X", s.sequencer)
+	s.mu.Unlock()
+
+	if s.Notify != nil {
+		s.Notify(bucketName, key, o, sequencer)
+	}
+	return true
+}
+
+// get returns an object, nil when it or its bucket is missing.
+func (s *S3) get(bucketName, key string) *Object {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[bucketName][key]
+}
+
+// Put stores an object, as an upload does.
+func (s *S3) Put(bucket, key string, body []byte, contentType string, metadata map[string]string) *Object {
+
+	o := newObject(body, contentType, metadata)
+	if !s.put(bucket, key, o) {
+		panic("fake: no bucket " + bucket)
+	}
+	return o
+}
+
+// Object returns an object, nil when it is missing.
+func (s *S3) Object(bucket, key string) *Object {
+
+	return s.get(bucket, key)
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, status int, code, message string) {
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if req.Method != http.MethodHead {
+		xml.NewEncoder(w).Encode(s3Error{Code: code, Message: message})
+	}
+}
+
+// readChunked decodes a body sent with the aws-chunked content encoding.
+func readChunked(body io.Reader) ([]byte, error) {
+
+	reader := bufio.NewReader(body)
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk header: %v", err)
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size: %v", err)
+		}
+		if size == 0 {
+			return data.Bytes(), nil // the trailers aren't checked
+		}
+		if _, err := io.CopyN(&data, reader, size); err != nil {
+			return nil, err
+		}
+		reader.ReadString('\n')
+	}
+}
+
+func (s *S3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	_, ok := s.buckets[bucketName]
+	s.mu.Unlock()
+	if !ok {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if key == "" {
+		writeS3Error(w, req, http.StatusNotImplemented, "NotImplemented", "bucket operations aren't supported")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var body []byte
+		var err error
+		if strings.Contains(req.Header.Get("Content-Encoding"), "aws-chunked") {
+			body, err = readChunked(req.Body)
+		} else {
+			body, err = io.ReadAll(req.Body)
+		}
+		if err != nil {
+			writeS3Error(w, req, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+
+		o := newObject(body, req.Header.Get("Content-Type"), nil)
+		for name, values := range req.Header {
+			if metaName, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+				o.Metadata[metaName] = values[0]
+			}
+		}
+
+		s.put(bucketName, key, o)
+		w.Header().Set("ETag", o.ETag)
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet, http.MethodHead:
+		o := s.get(bucketName, key)
+		if o == nil {
+			writeS3Error(w, req, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if match := req.Header.Get("If-Match"); match != "" && match != "*" && match != o.ETag {
+			writeS3Error(w, req, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+
+		header := w.Header()
+		header.Set("ETag", o.ETag)
+		header.Set("Last-Modified", o.LastModified.Format(http.TimeFormat))
+		header.Set("Content-Length", strconv.Itoa(len(o.Body)))
+		if o.ContentType != "" {
+			header.Set("Content-Type", o.ContentType)
+		}
+		for name, value := range o.Metadata {
+			header.Set("X-Amz-Meta-"+name, value)
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(o.Body)
+		}
+
+	default:
+		writeS3Error(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// S3Notification returns the ObjectCreated:Put event of an object, as S3
+// publishes it to the upload topic.
+func S3Notification(region, bucket, key string, o *Object, sequencer string) ([]byte, error) {
+
+	type m = map[string]any
+	return json.Marshal(m{
+		"Records": []m{{
+			"eventVersion": "2.1",
+			"eventSource":  "aws:s3",
+			"awsRegion":    region,
+			"eventTime":    o.LastModified.Format("2006-01-02T15:04:05.000Z"),
+			"eventName":    "ObjectCreated:Put",
+			"s3": m{
+				"s3SchemaVersion": "1.0",
+				"bucket":          m{"name": bucket, "arn": "arn:aws:s3:::" + bucket},
+				"object": m{
+					"key":       strings.ReplaceAll(url.QueryEscape(key), "%2F", "/"),
+					"size":      len(o.Body),
+					"eTag":      strings.Trim(o.ETag, `"`),
+					"sequencer": sequencer,
+				},
+			},
+		}},
+	})
+}
+
+// call checks Errors for an operation.
+func (s *S3) call(operation string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Errors[operation]
+}
+
+// lookup returns an object for the SDK, failing as S3 does when it is missing
+// or doesn't match ifMatch.
+func (s *S3) lookup(bucket, key, ifMatch *string, missing error) (*Object, error) {
+
+	o := s.get(aws.ToString(bucket), aws.ToString(key))
+	if o == nil {
+		return nil, missing
+	}
+	if match := aws.ToString(ifMatch); match != "" && match != "*" && match != o.ETag {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	return o, nil
+}
+
+func (s *S3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+
+	if err := s.call("GetObject"); err != nil {
+		return nil, err
+	}
+	o, err := s.lookup(params.Bucket, params.Key, params.IfMatch, &s3types.NoSuchKey{Message: aws.String("The specified key does not exist.")})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(o.Body)),
+		ContentLength: aws.Int64(int64(len(o.Body))),
+		ContentType:   aws.String(o.ContentType),
+		ETag:          aws.String(o.ETag),
+		LastModified:  aws.Time(o.LastModified),
+		Metadata:      o.Metadata,
+	}, nil
+}
+
+func (s *S3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+
+	if err := s.call("HeadObject"); err != nil {
+		return nil, err
+	}
+	o, err := s.lookup(params.Bucket, params.Key, params.IfMatch, &s3types.NotFound{})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.Body))),
+		ContentType:   aws.String(o.ContentType),
+		ETag:          aws.String(o.ETag),
+		LastModified:  aws.Time(o.LastModified),
+		Metadata:      o.Metadata,
+	}, nil
+}
+
+func (s *S3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+
+	if err := s.call("PutObject"); err != nil {
+		return nil, err
+	}
+	var body []byte
+	if params.Body != nil {
+		var err error
+		if body, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+	metadata := map[string]string{}
+	for name, value := range params.Metadata {
+		metadata[strings.ToLower(name)] = value
+	}
+	o := newObject(body, aws.ToString(params.ContentType), metadata)
+	if !s.put(aws.ToString(params.Bucket), aws.ToString(params.Key), o) {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchBucket", Message: "The specified bucket does not exist"}
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(o.ETag)}, nil
+}
+
+// presign returns the url of an object, signed by nothing but its expiry.
+func (s *S3) presign(method string, bucket, key *string, optFns []func(*s3.PresignOptions)) *v4.PresignedHTTPRequest {
+
+	options := s3.PresignOptions{Expires: 15 * time.Minute}
+	for _, f := range optFns {
+		f(&options)
+	}
+	return &v4.PresignedHTTPRequest{
+		URL:          fmt.Sprintf("%s/%s/%s?X-Amz-Expires=%d", s.Endpoint, aws.ToString(bucket), aws.ToString(key), int(options.Expires.Seconds())),
+		Method:       method,
+		SignedHeader: http.Header{},
+	}
+}
+
+func (s *S3) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+
+	if err := s.call("PresignGetObject"); err != nil {
+		return nil, err
+	}
+	return s.presign(http.MethodGet, params.Bucket, params.Key, optFns), nil
+}
+
+func (s *S3) PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+
+	if err := s.call("PresignPutObject"); err != nil {
+		return nil, err
+	}
+	return s.presign(http.MethodPut, params.Bucket, params.Key, optFns), nil
+}
@@ -0,0 +1,301 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"slices"
+
+	"cdk_image_transform/internal/transforms"
+
+	"github.com/anthonynsimon/bild/transform"
+)
+
+// MaxAnimationSizeBytes bounds the decoded size of all the frames kept from an
+// animation, the same way MaxImageSizeBytes bounds a still image.
+const MaxAnimationSizeBytes int = MaxImageSizeBytes
+
+// Animation is a decoded image as a list of full frames. Still images are an
+// animation with a single frame.
+type Animation struct {
+	Frames    []*image.RGBA
+	Delays    []int // in 100ths of a second
+	LoopCount int
+	Palettes  []color.Palette // the palette of each source frame, only set for gif inputs
+	Metadata  *Metadata       // only set for jpeg inputs
+}
+
+// DecodeStill decodes a single frame, downsampled by scale when it is below 1.
+func DecodeStill(r io.Reader, scale float64) (*Animation, error) {
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Animation{Frames: []*image.RGBA{Downsample(ImageToRGBA(img), scale)}, Delays: []int{0}}, nil
+}
+
+// Downsample returns img shrunk by scale, or img itself when scale isn't below 1.
+func Downsample(img *image.RGBA, scale float64) *image.RGBA {
+
+	if scale <= 0 || scale >= 1 {
+		return img
+	}
+	width := max(1, int(float64(img.Bounds().Dx())*scale))
+	height := max(1, int(float64(img.Bounds().Dy())*scale))
+	return transform.Resize(img, width, height, transform.Linear)
+}
+
+// selectFrames applies the animation stage steps to the frame indices and
+// delays, before any frame is rendered.
+func selectFrames(delays []int, pipeline *Pipeline) ([]int, []int, error) {
+
+	indices := make([]int, len(delays))
+	for i := range indices {
+		indices[i] = i
+	}
+	delays = append([]int(nil), delays...)
+
+	for i, step := range pipeline.Transforms {
+		transformer, ok := transforms.Lookup(step.Name)
+		if !ok || transformer.Spec().Stage != transforms.StageAnimation {
+			continue
+		}
+		args, err := transforms.Parse(step.Name, step.Params)
+		if err != nil {
+			return nil, nil, &StepError{Step: i, Name: step.Name, Err: err}
+		}
+
+		switch step.Name {
+		case "frame":
+			index := args.Int("index")
+			if index >= len(indices) {
+				return nil, nil, &StepError{Step: i, Name: step.Name, Err: fmt.Errorf("index %d out of range, the animation has %d frames", index, len(indices))}
+			}
+			indices, delays = indices[index:index+1], []int{0}
+		case "dropframes":
+			keep := args.Int("step")
+			var keptIndices, keptDelays []int
+			for i := range indices {
+				if i%keep == 0 {
+					keptIndices = append(keptIndices, indices[i])
+					keptDelays = append(keptDelays, 0)
+				}
+				keptDelays[len(keptDelays)-1] += delays[i]
+			}
+			indices, delays = keptIndices, keptDelays
+		case "fps":
+			delay := max(1, int(100/args.Float("fps")+0.5))
+			for i := range delays {
+				delays[i] = delay
+			}
+		}
+	}
+	return indices, delays, nil
+}
+
+// DecodeAnimation decodes every frame of a gif and composites them onto full
+// canvases, honoring the disposal method of each frame. Only the frames kept
+// by the animation stage steps of the pipeline are rendered, downsampled by
+// scale when it is below 1.
+func DecodeAnimation(r io.Reader, pipeline *Pipeline, scale float64) (*Animation, error) {
+
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("gif has no frames")
+	}
+
+	indices, delays, err := selectFrames(g.Delay, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	if len(indices)*bounds.Dx()*bounds.Dy()*4 > MaxAnimationSizeBytes {
+		return nil, fmt.Errorf("%w: %d frames of %dx%d exceed the maximum allowed size", ErrTooLarge, len(indices), bounds.Dx(), bounds.Dy())
+	}
+	// the kept frames are held next to the working memory of a single frame
+	frameWidth, frameHeight := bounds.Dx(), bounds.Dy()
+	if scale > 0 && scale < 1 {
+		frameWidth, frameHeight = max(1, int(float64(frameWidth)*scale)), max(1, int(float64(frameHeight)*scale))
+	}
+	if kept, budget := len(indices)*frameWidth*frameHeight*4, MemoryBudget()/2; kept > budget {
+		return nil, fmt.Errorf("%w: %d frames of %dx%d need %d MB, only %d MB are available", ErrTooLarge, len(indices), frameWidth, frameHeight, kept>>20, budget>>20)
+	}
+
+	keep := map[int]int{}
+	for position, index := range indices {
+		keep[index] = position
+	}
+
+	animation := &Animation{
+		Frames:    make([]*image.RGBA, len(indices)),
+		Delays:    delays,
+		LoopCount: g.LoopCount,
+		Palettes:  make([]color.Palette, len(indices)),
+	}
+
+	canvas := image.NewRGBA(bounds)
+	var previous *image.RGBA
+
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			if previous == nil {
+				previous = image.NewRGBA(bounds)
+			}
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if position, ok := keep[i]; ok {
+			animation.Palettes[position] = frame.Palette
+			if scale > 0 && scale < 1 {
+				animation.Frames[position] = Downsample(canvas, scale)
+			} else {
+				animation.Frames[position] = cloneRGBA(canvas)
+			}
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			// swap the buffers, the current canvas is overwritten on the next save
+			canvas, previous = previous, canvas
+		}
+	}
+	return animation, nil
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// TransformAnimation runs the image stage of the pipeline on every frame,
+// the frames may be modified in place.
+func TransformAnimation(animation *Animation, pipeline *Pipeline) error {
+
+	for i, frame := range animation.Frames {
+		destImage, err := TransformImage(frame, pipeline.Transforms)
+		if err != nil {
+			return err
+		}
+		animation.Frames[i] = destImage
+	}
+	return nil
+}
+
+// Bounds returns the bounds of the first frame, every frame has the same size.
+func (a *Animation) Bounds() image.Rectangle {
+
+	if len(a.Frames) == 0 {
+		return image.Rectangle{}
+	}
+	return a.Frames[0].Bounds()
+}
+
+// Clone returns a copy of the animation whose frames can be modified
+// without affecting a.
+func (a *Animation) Clone() *Animation {
+
+	clone := *a
+	clone.Frames = make([]*image.RGBA, len(a.Frames))
+	for i, frame := range a.Frames {
+		clone.Frames[i] = cloneRGBA(frame)
+	}
+	return &clone
+}
+
+// EncodeAnimation writes every frame when the output is a gif, other formats
+// only keep the first frame.
+func EncodeAnimation(animation *Animation, destBuffer *bytes.Buffer, options OutputOptions) error {
+
+	if len(animation.Frames) == 1 || options.Format != "gif" {
+		return EncodeImage(animation.Frames[0], destBuffer, options, animation.Metadata)
+	}
+
+	gifOptions := options.gifOptions()
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, len(animation.Frames)),
+		Delay:     animation.Delays,
+		Disposal:  make([]byte, len(animation.Frames)),
+		LoopCount: animation.LoopCount,
+	}
+
+	for i, frame := range animation.Frames {
+		var source color.Palette
+		if i < len(animation.Palettes) {
+			source = animation.Palettes[i]
+		}
+		framePalette := encodingPalette(source, frame, gifOptions)
+		paletted := image.NewPaletted(frame.Bounds(), framePalette)
+		gifOptions.Drawer.Draw(paletted, frame.Bounds(), frame, frame.Bounds().Min)
+
+		g.Image[i] = paletted
+		g.Disposal[i] = gif.DisposalNone
+	}
+	return gif.EncodeAll(destBuffer, g)
+}
+
+// encodingPalette returns the palette frame is encoded with. Without a
+// quantizer the frame keeps the palette of its source frame, which is only
+// reduced when it has more colors than the palette size. A transparent entry
+// is kept for the transparent pixels of the frame.
+func encodingPalette(source color.Palette, frame *image.RGBA, options *gif.Options) color.Palette {
+
+	transparent := hasTransparency(frame)
+	if options.Quantizer == nil && source != nil && len(source) <= options.NumColors {
+		if transparent && len(source) < 256 && !slices.ContainsFunc(source, isTransparent) {
+			return append(source[:len(source):len(source)], color.RGBA{})
+		}
+		return source
+	}
+
+	quantizer := options.Quantizer
+	if quantizer == nil {
+		quantizer = medianCutQuantizer{}
+		if source == nil {
+			quantizer = paletteQuantizer(palette.Plan9)
+		}
+	}
+	reduced := make(color.Palette, 0, options.NumColors)
+	if transparent {
+		reduced = append(reduced, color.RGBA{})
+	}
+	return quantizer.Quantize(reduced, frame)
+}
+
+func hasTransparency(img *image.RGBA) bool {
+
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func isTransparent(c color.Color) bool {
+
+	_, _, _, a := c.RGBA()
+	return a == 0
+}
@@ -0,0 +1,100 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"slices"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{R: 0xff, A: 0xff}
+	green = color.RGBA{G: 0xff, A: 0xff}
+	blue  = color.RGBA{B: 0xff, A: 0xff}
+)
+
+// transparentGif encodes two frames whose left half is transparent and right
+// half is red then blue.
+func transparentGif(t *testing.T) []byte {
+
+	t.Helper()
+	framePalette := color.Palette{color.RGBA{}, red, green, blue}
+	g := &gif.GIF{Delay: []int{10, 10}, Disposal: []byte{gif.DisposalBackground, gif.DisposalBackground}}
+	for _, index := range []uint8{1, 3} {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 4), framePalette)
+		for y := 0; y < 4; y++ {
+			for x := 4; x < 8; x++ {
+				frame.SetColorIndex(x, y, index)
+			}
+		}
+		g.Image = append(g.Image, frame)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func reencode(t *testing.T, options OutputOptions) *gif.GIF {
+
+	t.Helper()
+	animation, err := DecodeAnimation(bytes.NewReader(transparentGif(t)), &Pipeline{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeAnimation(animation, &buf, options); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 {
+		t.Fatalf("%d frames, want 2", len(g.Image))
+	}
+	return g
+}
+
+func TestEncodeAnimationKeepsPalettes(t *testing.T) {
+
+	// the source palette and its transparent index are kept
+	g := reencode(t, OutputOptions{Format: "gif"})
+	for i, want := range []color.RGBA{red, blue} {
+		frame := g.Image[i]
+		if !slices.Contains(frame.Palette, color.Color(want)) || len(frame.Palette) > 4 {
+			t.Errorf("frame %d palette = %v, want the source palette", i, frame.Palette)
+		}
+		if _, _, _, a := frame.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("frame %d left half alpha = %d, want transparent", i, a)
+		}
+		if got := color.RGBAModel.Convert(frame.At(7, 3)); got != want {
+			t.Errorf("frame %d right half = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestEncodeAnimationReducesPalettes(t *testing.T) {
+
+	tests := []OutputOptions{
+		{Format: "gif", PaletteSize: 2},
+		{Format: "gif", PaletteSize: 2, Quantizer: "mediancut"},
+		{Format: "gif", PaletteSize: 16, Quantizer: "plan9"},
+	}
+	for _, options := range tests {
+		g := reencode(t, options)
+		for i, frame := range g.Image {
+			if len(frame.Palette) > options.PaletteSize {
+				t.Errorf("%+v: frame %d has %d colors, want at most %d", options, i, len(frame.Palette), options.PaletteSize)
+			}
+			// the transparent pixels keep a transparent entry
+			if _, _, _, a := frame.At(0, 0).RGBA(); a != 0 {
+				t.Errorf("%+v: frame %d left half alpha = %d, want transparent", options, i, a)
+			}
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"sort"
+)
+
+// Metadata is what is kept from the APP segments of a jpeg input.
+type Metadata struct {
+	Orientation int
+	Copyright   string
+	Exif        []byte // the TIFF structure following the "Exif\0\0" header
+	ICC         []byte // the reassembled ICC profile
+
+	orientationOffset int          // offset of the orientation value inside Exif, 0 when absent
+	pixelDimensions   [2]exifValue // PixelXDimension and PixelYDimension of the Exif IFD
+	byteOrder         binary.ByteOrder
+}
+
+// exifValue locates the value of a short or long entry inside Exif, its
+// offset is 0 when the entry is absent.
+type exifValue struct {
+	offset int
+	kind   uint16
+}
+
+const (
+	exifOrientationTag     = 0x0112
+	exifCopyrightTag       = 0x8298
+	exifIFDTag             = 0x8769
+	exifPixelXDimensionTag = 0xa002
+	exifPixelYDimensionTag = 0xa003
+
+	exifTypeASCII = 2
+	exifTypeShort = 3
+	exifTypeLong  = 4
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// maxSegmentPayload is the largest payload of a jpeg APP segment.
+const maxSegmentPayload = 0xffff - 2
+
+// ParseJPEGMetadata reads the EXIF and ICC segments located before the
+// image data of a jpeg. It returns a Metadata with an orientation of 1 when
+// the jpeg has no EXIF.
+func ParseJPEGMetadata(data []byte) (*Metadata, error) {
+
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("missing jpeg start of image marker")
+	}
+
+	metadata := &Metadata{Orientation: 1}
+	iccChunks := map[int][]byte{}
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xff {
+			return nil, errors.New("invalid jpeg marker")
+		}
+		marker := data[offset+1]
+		if marker == 0xff { // fill byte
+			offset++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 { // start of scan or end of image
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return nil, errors.New("truncated jpeg segment")
+		}
+		payload := data[offset+4 : offset+2+length]
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, exifHeader) && metadata.Exif == nil:
+			// copied so the input can be released once it is decoded
+			metadata.Exif = append([]byte(nil), payload[len(exifHeader):]...)
+			if err := metadata.parseExif(); err != nil {
+				return nil, err
+			}
+		case marker == 0xe2 && bytes.HasPrefix(payload, iccHeader) && len(payload) > len(iccHeader)+2:
+			sequence := int(payload[len(iccHeader)])
+			iccChunks[sequence] = payload[len(iccHeader)+2:]
+		}
+		offset += 2 + length
+	}
+
+	if len(iccChunks) != 0 {
+		sequences := make([]int, 0, len(iccChunks))
+		for sequence := range iccChunks {
+			sequences = append(sequences, sequence)
+		}
+		sort.Ints(sequences)
+		for _, sequence := range sequences {
+			metadata.ICC = append(metadata.ICC, iccChunks[sequence]...)
+		}
+	}
+	return metadata, nil
+}
+
+// parseExif reads the orientation and copyright entries of IFD0, and locates
+// the pixel dimensions in the Exif IFD it points to.
+func (m *Metadata) parseExif() error {
+
+	tiff := m.Exif
+	if len(tiff) < 8 {
+		return errors.New("truncated exif header")
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		m.byteOrder = binary.LittleEndian
+	case "MM":
+		m.byteOrder = binary.BigEndian
+	default:
+		return errors.New("invalid exif byte order")
+	}
+
+	exifIFD := 0
+	err := m.readIFD(int(m.byteOrder.Uint32(tiff[4:])), func(entry int, tag, kind uint16, count int) {
+		switch {
+		case tag == exifOrientationTag && kind == exifTypeShort:
+			orientation := int(m.byteOrder.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				m.Orientation = orientation
+				m.orientationOffset = entry + 8
+			}
+		case tag == exifCopyrightTag && kind == exifTypeASCII:
+			value := entry + 8
+			if count > 4 {
+				value = int(m.byteOrder.Uint32(tiff[entry+8:]))
+			}
+			if count >= 0 && value+count <= len(tiff) {
+				m.Copyright = string(bytes.TrimRight(tiff[value:value+count], "\x00"))
+			}
+		case tag == exifIFDTag && kind == exifTypeLong:
+			exifIFD = int(m.byteOrder.Uint32(tiff[entry+8:]))
+		}
+	})
+	if err != nil || exifIFD == 0 {
+		return err
+	}
+
+	// a broken Exif IFD only loses the pixel dimensions, it is kept as is
+	var pixelDimensions [2]exifValue
+	err = m.readIFD(exifIFD, func(entry int, tag, kind uint16, count int) {
+		if (tag == exifPixelXDimensionTag || tag == exifPixelYDimensionTag) && (kind == exifTypeShort || kind == exifTypeLong) && count == 1 {
+			pixelDimensions[tag-exifPixelXDimensionTag] = exifValue{offset: entry + 8, kind: kind}
+		}
+	})
+	if err == nil {
+		m.pixelDimensions = pixelDimensions
+	}
+	return nil
+}
+
+// readIFD calls visit with the offset, tag, type and count of every entry of
+// the IFD at offset ifd.
+func (m *Metadata) readIFD(ifd int, visit func(entry int, tag, kind uint16, count int)) error {
+
+	tiff := m.Exif
+	if ifd+2 > len(tiff) {
+		return errors.New("invalid exif ifd offset")
+	}
+	entries := int(m.byteOrder.Uint16(tiff[ifd:]))
+
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return errors.New("truncated exif ifd")
+		}
+		visit(entry, m.byteOrder.Uint16(tiff[entry:]), m.byteOrder.Uint16(tiff[entry+2:]), int(m.byteOrder.Uint32(tiff[entry+4:])))
+	}
+	return nil
+}
+
+// AutoOrient returns img rotated and flipped so that it displays upright for
+// the given EXIF orientation.
+func AutoOrient(img *image.RGBA, orientation int) *image.RGBA {
+
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			src := img.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[src:src+4])
+		}
+	}
+	return dst
+}
+
+// forPolicy returns the EXIF and ICC profile to write for a metadata policy
+// into an image of size. The image has been auto oriented so a kept
+// orientation is reset to 1, and the kept pixel dimensions are those of the
+// output since the pipeline may have resized or rotated it.
+func (m *Metadata) forPolicy(policy string, size image.Point) (exif []byte, icc []byte) {
+
+	switch policy {
+	case "all":
+		if m.Exif != nil {
+			exif = append([]byte(nil), m.Exif...)
+			if m.orientationOffset != 0 {
+				m.byteOrder.PutUint16(exif[m.orientationOffset:], 1)
+			}
+			for i, dimension := range []int{size.X, size.Y} {
+				switch value := m.pixelDimensions[i]; {
+				case value.offset == 0:
+				case value.kind == exifTypeLong:
+					m.byteOrder.PutUint32(exif[value.offset:], uint32(dimension))
+				case dimension <= 0xffff:
+					m.byteOrder.PutUint16(exif[value.offset:], uint16(dimension))
+				}
+			}
+		}
+		return exif, m.ICC
+	case "copyright":
+		if m.Copyright != "" {
+			exif = buildCopyrightExif(m.Copyright)
+		}
+		return exif, m.ICC
+	}
+	return nil, nil
+}
+
+// buildCopyrightExif returns a big endian TIFF structure whose IFD0 only holds the copyright.
+func buildCopyrightExif(copyright string) []byte {
+
+	value := append([]byte(copyright), 0)
+	tiff := make([]byte, 8+2+12+4)
+	copy(tiff, "MM\x00\x2a")
+	binary.BigEndian.PutUint32(tiff[4:], 8)
+	binary.BigEndian.PutUint16(tiff[8:], 1)
+	binary.BigEndian.PutUint16(tiff[10:], exifCopyrightTag)
+	binary.BigEndian.PutUint16(tiff[12:], exifTypeASCII)
+	binary.BigEndian.PutUint32(tiff[14:], uint32(len(value)))
+	if len(value) <= 4 {
+		copy(tiff[18:], value)
+		return tiff
+	}
+	binary.BigEndian.PutUint32(tiff[18:], uint32(len(tiff)))
+	return append(tiff, value...)
+}
+
+func writeJPEGSegment(dst *bytes.Buffer, marker byte, parts ...[]byte) {
+
+	length := 2
+	for _, part := range parts {
+		length += len(part)
+	}
+	dst.Write([]byte{0xff, marker, byte(length >> 8), byte(length)})
+	for _, part := range parts {
+		dst.Write(part)
+	}
+}
+
+// embedJPEGMetadata copies an encoded jpeg into dst with APP1 and APP2
+// segments holding exif and icc inserted after the start of image marker.
+func embedJPEGMetadata(dst *bytes.Buffer, encoded []byte, exif, icc []byte) {
+
+	dst.Write(encoded[:2])
+	if exif != nil && len(exifHeader)+len(exif) <= maxSegmentPayload {
+		writeJPEGSegment(dst, 0xe1, exifHeader, exif)
+	}
+
+	chunkSize := maxSegmentPayload - len(iccHeader) - 2
+	chunks := (len(icc) + chunkSize - 1) / chunkSize
+	if chunks <= 255 {
+		for i := 0; i < chunks; i++ {
+			chunk := icc[i*chunkSize : min(len(icc), (i+1)*chunkSize)]
+			writeJPEGSegment(dst, 0xe2, iccHeader, []byte{byte(i + 1), byte(chunks)}, chunk)
+		}
+	}
+	dst.Write(encoded[2:])
+}
+
+func writePNGChunk(dst *bytes.Buffer, kind string, data []byte) {
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], kind)
+	dst.Write(header[:])
+	dst.Write(data)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	binary.Write(dst, binary.BigEndian, crc.Sum32())
+}
+
+// pngHeaderSize is the size of the png signature followed by the IHDR chunk.
+const pngHeaderSize = 8 + 8 + 13 + 4
+
+// embedPNGMetadata copies an encoded png into dst with iCCP and eXIf chunks
+// inserted after the IHDR chunk.
+func embedPNGMetadata(dst *bytes.Buffer, encoded []byte, exif, icc []byte) error {
+
+	dst.Write(encoded[:pngHeaderSize])
+	if icc != nil {
+		var profile bytes.Buffer
+		profile.WriteString("ICC Profile\x00\x00") // name and compression method
+		writer := zlib.NewWriter(&profile)
+		if _, err := writer.Write(icc); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		writePNGChunk(dst, "iCCP", profile.Bytes())
+	}
+	if exif != nil {
+		writePNGChunk(dst, "eXIf", exif)
+	}
+	dst.Write(encoded[pngHeaderSize:])
+	return nil
+}
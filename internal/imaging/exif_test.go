@@ -0,0 +1,98 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// orientedExif returns a big endian TIFF structure with an orientation of 6
+// and a 400x300 long and short pixel dimension in its Exif IFD.
+func orientedExif() []byte {
+
+	tiff := []byte("MM\x00\x2a")
+	tiff = binary.BigEndian.AppendUint32(tiff, 8)
+	entry := func(tag, kind uint16, value uint32) {
+		tiff = binary.BigEndian.AppendUint16(tiff, tag)
+		tiff = binary.BigEndian.AppendUint16(tiff, kind)
+		tiff = binary.BigEndian.AppendUint32(tiff, 1)
+		if kind == exifTypeShort {
+			value <<= 16
+		}
+		tiff = binary.BigEndian.AppendUint32(tiff, value)
+	}
+
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	entry(exifOrientationTag, exifTypeShort, 6)
+	entry(exifIFDTag, exifTypeLong, 8+2+2*12+4)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	entry(exifPixelXDimensionTag, exifTypeLong, 400)
+	entry(exifPixelYDimensionTag, exifTypeShort, 300)
+	return binary.BigEndian.AppendUint32(tiff, 0)
+}
+
+func TestMetadataPolicyAll(t *testing.T) {
+
+	var encoded, data bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 4, 3)), nil); err != nil {
+		t.Fatal(err)
+	}
+	embedJPEGMetadata(&data, encoded.Bytes(), orientedExif(), nil)
+
+	metadata, err := ParseJPEGMetadata(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Orientation != 6 {
+		t.Fatalf("orientation = %d, want 6", metadata.Orientation)
+	}
+
+	// the output was rotated upright and resized by the pipeline
+	exif, _ := metadata.forPolicy("all", image.Pt(150, 200))
+	written := &Metadata{Exif: exif}
+	if err := written.parseExif(); err != nil {
+		t.Fatal(err)
+	}
+	width := written.byteOrder.Uint32(exif[written.pixelDimensions[0].offset:])
+	height := written.byteOrder.Uint16(exif[written.pixelDimensions[1].offset:])
+	if written.Orientation != 1 || width != 150 || height != 200 {
+		t.Errorf("orientation %d, %dx%d, want 1, 150x200", written.Orientation, width, height)
+	}
+	if !bytes.Equal(metadata.Exif, orientedExif()) {
+		t.Error("the exif of the input was modified")
+	}
+
+	if exif, _ := metadata.forPolicy("strip", image.Pt(150, 200)); exif != nil {
+		t.Errorf("strip kept %d bytes of exif", len(exif))
+	}
+}
+
+func TestMetadataDoesNotKeepInput(t *testing.T) {
+
+	var encoded, data bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 4, 3)), nil); err != nil {
+		t.Fatal(err)
+	}
+	embedJPEGMetadata(&data, encoded.Bytes(), orientedExif(), []byte("profile"))
+
+	input := data.Bytes()
+	metadata, err := ParseJPEGMetadata(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a kept segment sharing the input's backing array would keep it alive
+	for i := range input {
+		input[i] = 0
+	}
+	if !bytes.Equal(metadata.Exif, orientedExif()) {
+		t.Error("the exif shares the backing array of the input")
+	}
+	if string(metadata.ICC) != "profile" {
+		t.Error("the icc profile shares the backing array of the input")
+	}
+}
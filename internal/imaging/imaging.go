@@ -0,0 +1,164 @@
+// Package imaging decodes, transforms and encodes images. It runs the steps of
+// a pipeline declared in internal/transforms and is shared by the lambdas that
+// process uploads and the ones that transform images on request.
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+
+	"cdk_image_transform/internal/transforms"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const MaxImageSizeBytes int = transforms.MaxImageWidth * transforms.MaxImageHeight * 4
+
+// Pipeline is the part of a job needed to process its image. ContentType is
+// the suffix of the uploaded object, it picks the output format when none was requested.
+type Pipeline struct {
+	ContentType string
+	Transforms  []transforms.Step
+	Output      *OutputOptions
+}
+
+func ImageToRGBA(src image.Image) *image.RGBA {
+
+	if dst, ok := src.(*image.RGBA); ok {
+		return dst
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// Decode decodes every frame of a gif, or the single frame of any other
+// format, downsampled by scale when it is below 1. JPEG inputs are auto
+// oriented and keep their metadata. data isn't referenced once Decode returns.
+func Decode(data []byte, format string, pipeline *Pipeline, scale float64) (*Animation, error) {
+
+	var animation *Animation
+	var err error
+	if format == "gif" {
+		animation, err = DecodeAnimation(bytes.NewReader(data), pipeline, scale)
+	} else {
+		animation, err = DecodeStill(bytes.NewReader(data), scale)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "jpeg" {
+		// broken metadata shouldn't fail a job whose image decoded fine
+		metadata, err := ParseJPEGMetadata(data)
+		if err != nil {
+			fmt.Printf("ignoring jpeg metadata: %v\n", err)
+		} else {
+			animation.Frames[0] = AutoOrient(animation.Frames[0], metadata.Orientation)
+			animation.Metadata = metadata
+		}
+	}
+	return animation, nil
+}
+
+// StepError is the failure of the step at index Step of a pipeline.
+type StepError struct {
+	Step int
+	Name string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("failed %s: %v", e.Name, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// TransformImage runs the image stage steps on img, failing on unknown steps.
+// Consecutive pointwise steps are fused into a single pass over stripes of
+// rows that modifies the image in place, so img is modified when it is an
+// *image.RGBA. Other steps allocate their output and drop their input.
+func TransformImage(img image.Image, steps []transforms.Step) (*image.RGBA, error) {
+
+	dst := ImageToRGBA(img)
+	var points []transforms.PointFunc
+
+	for i, step := range steps {
+		transformer, ok := transforms.Lookup(step.Name)
+		if !ok {
+			return nil, &StepError{Step: i, Name: step.Name, Err: transforms.ErrUnknownTransform}
+		}
+		if transformer.Spec().Stage != transforms.StageImage {
+			continue
+		}
+
+		args, err := transforms.Parse(step.Name, step.Params)
+		if err != nil {
+			return nil, &StepError{Step: i, Name: step.Name, Err: err}
+		}
+		if pointwise, ok := transformer.(transforms.Pointwise); ok {
+			points = append(points, pointwise.Point(args))
+			continue
+		}
+
+		transforms.ApplyPoints(dst, points...)
+		points = points[:0]
+
+		out, err := transformer.Apply(dst, args)
+		if err != nil {
+			return nil, &StepError{Step: i, Name: step.Name, Err: err}
+		}
+		dst = ImageToRGBA(out)
+	}
+	transforms.ApplyPoints(dst, points...)
+	return dst, nil
+}
+
+// EncodeImage encodes img in the requested format. The metadata kept by the
+// metadata policy is embedded in jpeg and png outputs, metadata may be nil.
+func EncodeImage(img *image.RGBA, destBuffer *bytes.Buffer, options OutputOptions, metadata *Metadata) error {
+
+	var exif, icc []byte
+	if metadata != nil {
+		exif, icc = metadata.forPolicy(options.Metadata, img.Bounds().Size())
+	}
+
+	switch options.Format {
+	case "jpeg":
+		if exif == nil && icc == nil {
+			return jpeg.Encode(destBuffer, img, options.jpegOptions())
+		}
+		var encoded bytes.Buffer
+		if err := jpeg.Encode(&encoded, img, options.jpegOptions()); err != nil {
+			return err
+		}
+		embedJPEGMetadata(destBuffer, encoded.Bytes(), exif, icc)
+		return nil
+	case "png":
+		if exif == nil && icc == nil {
+			return options.pngEncoder().Encode(destBuffer, img)
+		}
+		var encoded bytes.Buffer
+		if err := options.pngEncoder().Encode(&encoded, img); err != nil {
+			return err
+		}
+		return embedPNGMetadata(destBuffer, encoded.Bytes(), exif, icc)
+	case "gif":
+		return gif.Encode(destBuffer, img, options.gifOptions())
+	case "bmp":
+		return bmp.Encode(destBuffer, img)
+	case "tiff":
+		return tiff.Encode(destBuffer, img, options.tiffOptions())
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownFormat, options.Format)
+	}
+}
@@ -0,0 +1,20 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestEncodeImageUnknownFormat(t *testing.T) {
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	var buf bytes.Buffer
+	if err := EncodeImage(img, &buf, OutputOptions{Format: "webp"}, nil); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("err = %v, want %v", err, ErrUnknownFormat)
+	}
+	if err := EncodeImage(img, &buf, OutputOptions{Format: "png"}, nil); err != nil || buf.Len() == 0 {
+		t.Fatalf("png: %d bytes, err = %v, want the encoded image", buf.Len(), err)
+	}
+}
@@ -0,0 +1,189 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"cdk_image_transform/internal/transforms"
+)
+
+// memoryOverheadBytes is what the runtime, the sdk clients and the encoders
+// use next to the images, it isn't part of the estimate.
+const memoryOverheadBytes int = 48 << 20
+
+// Values of OVERSIZE_POLICY, deciding what happens to a job whose estimate
+// exceeds the memory of the function.
+const (
+	OversizeReject     = "reject"
+	OversizeDownsample = "downsample"
+)
+
+// ErrTooLarge is wrapped by the errors of images that can't be processed in
+// the memory of the function.
+var ErrTooLarge = errors.New("image too large")
+
+// MemoryBudget returns the bytes available to the images of a job, from the
+// memory configured for the function. It is unbounded outside of lambda.
+func MemoryBudget() int {
+
+	size, err := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+	if err != nil || size <= 0 {
+		return math.MaxInt
+	}
+	return max(0, size<<20-memoryOverheadBytes)
+}
+
+// OversizePolicy returns OVERSIZE_POLICY, rejecting by default.
+func OversizePolicy() string {
+
+	if os.Getenv("OVERSIZE_POLICY") == OversizeDownsample {
+		return OversizeDownsample
+	}
+	return OversizeReject
+}
+
+// ReadAll reads r into a buffer allocated once when size is known, instead of
+// growing it the way io.ReadAll does.
+func ReadAll(r io.Reader, size int64) ([]byte, error) {
+
+	if size <= 0 {
+		return io.ReadAll(r)
+	}
+	buffer := make([]byte, size)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// MemoryEstimate is the peak memory, in bytes, of the two phases of a job.
+// The raw bytes and the decoder output are released before the transform
+// phase, which holds the frames and the input and output of one step, and
+// the copy and encoded output of the rendition being rendered.
+type MemoryEstimate struct {
+	Decode    int
+	Transform int
+}
+
+// bytesPerPixel returns the size of a pixel in the image returned by the decoder.
+func bytesPerPixel(model color.Model) int {
+
+	switch model {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel, color.NYCbCrAModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// stepSize returns the dimensions of the output of a step.
+func stepSize(step transforms.Step, width, height int) (int, int) {
+
+	args, err := transforms.Parse(step.Name, step.Params)
+	if err != nil {
+		return width, height
+	}
+
+	switch step.Name {
+	case "resize":
+		w, h := args.Int("width"), args.Int("height")
+		switch {
+		case w == 0:
+			w = max(1, width*h/max(1, height))
+		case h == 0:
+			h = max(1, height*w/max(1, width))
+		case args.String("fit") == "contain":
+			scale := math.Min(float64(w)/float64(width), float64(h)/float64(height))
+			w, h = int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+		}
+		return w, h
+	case "crop":
+		return min(width, args.Int("width")), min(height, args.Int("height"))
+	case "rotate":
+		radians := args.Float("degrees") * math.Pi / 180
+		sin, cos := math.Abs(math.Sin(radians)), math.Abs(math.Cos(radians))
+		return int(math.Ceil(float64(width)*cos + float64(height)*sin)), int(math.Ceil(float64(width)*sin + float64(height)*cos))
+	}
+	return width, height
+}
+
+// pipelinePeak returns the largest number of pixels held at once by the steps
+// run on a width x height image, and the size of their output.
+func pipelinePeak(steps []transforms.Step, width, height int) (int, int, int) {
+
+	peak := width * height
+	for _, step := range steps {
+		transformer, ok := transforms.Lookup(step.Name)
+		if !ok || transformer.Spec().Stage != transforms.StageImage {
+			continue
+		}
+		if _, ok := transformer.(transforms.Pointwise); ok {
+			continue // runs in place
+		}
+		w, h := stepSize(step, width, height)
+		peak = max(peak, width*height+w*h)
+		width, height = w, h
+	}
+	return peak, width, height
+}
+
+// EstimateMemory estimates the peak memory of a still image, or of each frame
+// of an animation, from the size of the encoded image and its header. The
+// renditions are rendered one at a time from a copy of the output of steps,
+// which is kept until the last one is written.
+func EstimateMemory(encodedSize int, config image.Config, steps []transforms.Step, renditions ...[]transforms.Step) MemoryEstimate {
+
+	pixels := config.Width * config.Height
+	decoded := pixels * bytesPerPixel(config.ColorModel)
+	if config.ColorModel == color.RGBAModel {
+		decoded = 0 // already RGBA, it isn't copied
+	}
+
+	estimate := MemoryEstimate{Decode: encodedSize + decoded + pixels*4}
+
+	peak, width, height := pipelinePeak(steps, config.Width, config.Height)
+	if len(renditions) == 0 {
+		// the encoder buffer is at most the size of the uncompressed output
+		estimate.Transform = peak*4 + width*height*4
+		return estimate
+	}
+
+	estimate.Transform = peak * 4
+	for _, renditionSteps := range renditions {
+		renditionPeak, renditionWidth, renditionHeight := pipelinePeak(renditionSteps, width, height)
+		estimate.Transform = max(estimate.Transform, width*height*4+renditionPeak*4+renditionWidth*renditionHeight*4)
+	}
+	return estimate
+}
+
+// Fit returns the scale an image must be downsampled by, right after
+// decoding, for the job to fit in budget. It is 1 when the job already fits.
+// Jobs whose decode phase doesn't fit are always rejected.
+func (e MemoryEstimate) Fit(budget int, policy string) (float64, error) {
+
+	if e.Decode > budget {
+		return 0, fmt.Errorf("%w: decoding needs an estimated %d MB, only %d MB are available", ErrTooLarge, e.Decode>>20, budget>>20)
+	}
+	if e.Transform <= budget {
+		return 1, nil
+	}
+	if policy != OversizeDownsample {
+		return 0, fmt.Errorf("%w: the pipeline needs an estimated %d MB, only %d MB are available", ErrTooLarge, e.Transform>>20, budget>>20)
+	}
+	// the memory of the transform phase grows with the square of the scale
+	return math.Sqrt(float64(budget)/float64(e.Transform)) * 0.95, nil
+}
@@ -0,0 +1,55 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	"cdk_image_transform/internal/transforms"
+)
+
+func TestEstimateMemory(t *testing.T) {
+
+	config := image.Config{ColorModel: color.YCbCrModel, Width: 1000, Height: 1000}
+	resize := func(width, height string) transforms.Step {
+		return transforms.Step{Name: "resize", Params: []string{width, height, "fill"}}
+	}
+	const frame = 1000 * 1000 * 4
+
+	tests := []struct {
+		name       string
+		steps      []transforms.Step
+		renditions [][]transforms.Step
+		decode     int
+		transform  int
+	}{
+		{"still", nil, nil, 100 + 3*frame/4 + frame, 2 * frame},
+		// pointwise steps run in place
+		{"pointwise", []transforms.Step{{Name: "grayscale"}, {Name: "invert"}}, nil, 100 + 3*frame/4 + frame, 2 * frame},
+		{"upscale", []transforms.Step{resize("2000", "2000")}, nil, 100 + 3*frame/4 + frame, 5*frame + 4*frame},
+		{"downscale", []transforms.Step{resize("500", "500")}, nil, 100 + 3*frame/4 + frame, frame + frame/4 + frame/4},
+		// the shared frame, a copy and the encoded output of the largest rendition
+		{"renditions", nil, [][]transforms.Step{nil, {resize("500", "500")}}, 100 + 3*frame/4 + frame, 3 * frame},
+		{"upscaled rendition", nil, [][]transforms.Step{nil, {resize("2000", "2000")}}, 100 + 3*frame/4 + frame, frame + 5*frame + 4*frame},
+	}
+	for _, test := range tests {
+		estimate := EstimateMemory(100, config, test.steps, test.renditions...)
+		if estimate.Decode != test.decode || estimate.Transform != test.transform {
+			t.Errorf("%s: estimate = %+v, want %d and %d", test.name, estimate, test.decode, test.transform)
+		}
+	}
+
+	// ten renditions can't fit where the still image does
+	renditions := make([][]transforms.Step, 10)
+	still, rendered := EstimateMemory(100, config, nil), EstimateMemory(100, config, nil, renditions...)
+	if _, err := still.Fit(2*frame, OversizeReject); err != nil {
+		t.Errorf("still: %v", err)
+	}
+	if _, err := rendered.Fit(2*frame, OversizeReject); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("renditions: err = %v, want ErrTooLarge", err)
+	}
+	if scale, err := rendered.Fit(2*frame, OversizeDownsample); err != nil || scale >= 1 {
+		t.Errorf("renditions: scale = %.2f, err = %v, want them downsampled", scale, err)
+	}
+}
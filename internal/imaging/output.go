@@ -0,0 +1,294 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"sort"
+
+	"cdk_image_transform/internal/transforms"
+
+	"golang.org/x/image/tiff"
+)
+
+// OutputOptions configures the encoder for the output image. It can be supplied
+// as the Output block of the job or through encoder transforms such as
+// "quality" in the Transforms list, the latter taking precedence.
+type OutputOptions struct {
+	Format      string `dynamodbav:"Format,omitempty" json:"Format,omitempty"`
+	Quality     int    `dynamodbav:"Quality,omitempty" json:"Quality,omitempty"`
+	Compression string `dynamodbav:"Compression,omitempty" json:"Compression,omitempty"`
+	PaletteSize int    `dynamodbav:"PaletteSize,omitempty" json:"PaletteSize,omitempty"`
+	Quantizer   string `dynamodbav:"Quantizer,omitempty" json:"Quantizer,omitempty"`
+	Dither      string `dynamodbav:"Dither,omitempty" json:"Dither,omitempty"`
+	Metadata    string `dynamodbav:"Metadata,omitempty" json:"Metadata,omitempty"`
+}
+
+// ErrUnknownFormat is wrapped by the errors of the output formats that can't
+// be encoded.
+var ErrUnknownFormat = errors.New("unknown output format")
+
+// formatExtensions maps the supported output formats to the extension of the output key.
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"bmp":  ".bmp",
+	"tiff": ".tiff",
+}
+
+var formatContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+}
+
+// defaultFormat returns the output format used when none was requested,
+// formats that can only be decoded fall back to png.
+func defaultFormat(suffix string) string {
+
+	switch suffix {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".gif":
+		return "gif"
+	case ".bmp":
+		return "bmp"
+	case ".tif", ".tiff":
+		return "tiff"
+	default:
+		return "png"
+	}
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// ParseOutputOptions merges the Output block of the pipeline with the encode stage
+// transforms in its Transforms list and validates the result.
+func ParseOutputOptions(pipeline *Pipeline) (OutputOptions, error) {
+
+	var options OutputOptions
+	if pipeline.Output != nil {
+		options = *pipeline.Output
+	}
+
+	for _, step := range pipeline.Transforms {
+		transformer, ok := transforms.Lookup(step.Name)
+		if !ok || transformer.Spec().Stage != transforms.StageEncode {
+			continue
+		}
+		args, err := transforms.Parse(step.Name, step.Params)
+		if err != nil {
+			return options, fmt.Errorf("%s: %v", step.Name, err)
+		}
+		switch step.Name {
+		case "format":
+			options.Format = args.String("format")
+		case "quality":
+			options.Quality = args.Int("quality")
+		case "compression":
+			options.Compression = args.String("level")
+		case "palette":
+			options.PaletteSize = args.Int("size")
+			if args.Has("quantizer") {
+				options.Quantizer = args.String("quantizer")
+			}
+		case "dither":
+			options.Dither = args.String("mode")
+		case "metadata":
+			options.Metadata = args.String("policy")
+		}
+	}
+
+	if options.Format == "" {
+		options.Format = defaultFormat(pipeline.ContentType)
+	}
+	return options, options.Validate()
+}
+
+// MergeOutputOptions returns base with the fields set in override replaced,
+// the options of a rendition over those of its job.
+func MergeOutputOptions(base OutputOptions, override *OutputOptions) *OutputOptions {
+
+	if override == nil {
+		return &base
+	}
+	if override.Format != "" {
+		base.Format = override.Format
+	}
+	if override.Quality != 0 {
+		base.Quality = override.Quality
+	}
+	if override.Compression != "" {
+		base.Compression = override.Compression
+	}
+	if override.PaletteSize != 0 {
+		base.PaletteSize = override.PaletteSize
+	}
+	if override.Quantizer != "" {
+		base.Quantizer = override.Quantizer
+	}
+	if override.Dither != "" {
+		base.Dither = override.Dither
+	}
+	if override.Metadata != "" {
+		base.Metadata = override.Metadata
+	}
+	return &base
+}
+
+func (o OutputOptions) Validate() error {
+
+	if _, ok := formatExtensions[o.Format]; !ok {
+		return fmt.Errorf("unsupported output format: %s", o.Format)
+	}
+	if o.Quality != 0 && (o.Quality < 1 || o.Quality > 100) {
+		return fmt.Errorf("quality %d out of range [1, 100]", o.Quality)
+	}
+	if _, ok := pngCompressionLevels[o.Compression]; o.Compression != "" && !ok {
+		return fmt.Errorf("unknown compression level: %s", o.Compression)
+	}
+	if o.PaletteSize != 0 && (o.PaletteSize < 2 || o.PaletteSize > 256) {
+		return fmt.Errorf("palette size %d out of range [2, 256]", o.PaletteSize)
+	}
+	if o.Quantizer != "" && !slices.Contains(transforms.Quantizers, o.Quantizer) {
+		return fmt.Errorf("unknown quantizer: %s", o.Quantizer)
+	}
+	if o.Dither != "" && !slices.Contains(transforms.DitherModes, o.Dither) {
+		return fmt.Errorf("unknown dither mode: %s", o.Dither)
+	}
+	if o.Metadata != "" && !slices.Contains(transforms.MetadataPolicies, o.Metadata) {
+		return fmt.Errorf("unknown metadata policy: %s", o.Metadata)
+	}
+	return nil
+}
+
+func (o OutputOptions) ContentType() string {
+
+	return formatContentTypes[o.Format]
+}
+
+// Extension returns the extension of an object holding the output.
+func (o OutputOptions) Extension() string {
+
+	return formatExtensions[o.Format]
+}
+
+func (o OutputOptions) jpegOptions() *jpeg.Options {
+
+	if o.Quality == 0 {
+		return nil
+	}
+	return &jpeg.Options{Quality: o.Quality}
+}
+
+func (o OutputOptions) pngEncoder() *png.Encoder {
+
+	return &png.Encoder{CompressionLevel: pngCompressionLevels[o.Compression]}
+}
+
+func (o OutputOptions) gifOptions() *gif.Options {
+
+	options := &gif.Options{NumColors: 256, Drawer: draw.FloydSteinberg}
+	if o.PaletteSize != 0 {
+		options.NumColors = o.PaletteSize
+	}
+	if o.Dither == "none" {
+		options.Drawer = draw.Src
+	}
+	switch o.Quantizer {
+	case "plan9":
+		options.Quantizer = paletteQuantizer(palette.Plan9)
+	case "websafe":
+		options.Quantizer = paletteQuantizer(palette.WebSafe)
+	case "mediancut":
+		options.Quantizer = medianCutQuantizer{}
+	}
+	return options
+}
+
+func (o OutputOptions) tiffOptions() *tiff.Options {
+
+	if o.Compression == "none" {
+		return &tiff.Options{Compression: tiff.Uncompressed}
+	}
+	return &tiff.Options{Compression: tiff.Deflate}
+}
+
+// paletteQuantizer returns a fixed palette truncated to the requested size.
+type paletteQuantizer color.Palette
+
+func (q paletteQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+
+	return append(p, q[:min(len(q), cap(p)-len(p))]...)
+}
+
+// medianCutQuantizer builds an adaptive palette by repeatedly splitting the box
+// of sampled colors with the widest channel range at its median.
+type medianCutQuantizer struct{}
+
+const maxQuantizerSamples = 1 << 16
+
+func (medianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+
+	bounds := m.Bounds()
+	step := max(1, bounds.Dx()*bounds.Dy()/maxQuantizerSamples)
+
+	samples := make([][3]uint8, 0, min(bounds.Dx()*bounds.Dy(), maxQuantizerSamples)+1)
+	for i := 0; i < bounds.Dx()*bounds.Dy(); i += step {
+		r, g, b, _ := m.At(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx()).RGBA()
+		samples = append(samples, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+	}
+	if len(samples) == 0 {
+		return p
+	}
+
+	boxes := [][][3]uint8{samples}
+	for len(boxes) < cap(p)-len(p) {
+		widest, channel, spread := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				lo, hi := uint8(255), uint8(0)
+				for _, s := range box {
+					lo, hi = min(lo, s[c]), max(hi, s[c])
+				}
+				if int(hi-lo) > spread {
+					widest, channel, spread = i, c, int(hi-lo)
+				}
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		box := boxes[widest]
+		sort.Slice(box, func(i, j int) bool { return box[i][channel] < box[j][channel] })
+		boxes = append(boxes, box[len(box)/2:])
+		boxes[widest] = box[:len(box)/2]
+	}
+
+	for _, box := range boxes {
+		var r, g, b int
+		for _, s := range box {
+			r, g, b = r+int(s[0]), g+int(s[1]), b+int(s[2])
+		}
+		p = append(p, color.RGBA{R: uint8(r / len(box)), G: uint8(g / len(box)), B: uint8(b / len(box)), A: 0xff})
+	}
+	return p
+}
@@ -0,0 +1,49 @@
+package job
+
+import (
+	"time"
+)
+
+// UploadExpirySk is the sort key of the item expiring a job whose upload
+// never came. The time to live of the table removes it UploadTimeout after the
+// job was created, and the expirejobs lambda expires the job from the stream
+// of the removal when it is still pending its upload.
+const UploadExpirySk = "upload-expiry"
+
+// UploadExpiry is the item expiring a job, stored next to its job item. It
+// records the quota charged for the job, given back when the job expires.
+// ExpiresAt is the time to live attribute of the table, in unix seconds.
+type UploadExpiry struct {
+	Pk         string `dynamodbav:"pk"`
+	Sk         string `dynamodbav:"sk"`
+	TenantId   string `dynamodbav:"TenantId"`
+	Megapixels int    `dynamodbav:"Megapixels"`
+	ChargedAt  string `dynamodbav:"ChargedAt"`
+	ExpiresAt  int64  `dynamodbav:"ExpiresAt"`
+}
+
+// NewUploadExpiry returns the item expiring the job of objectName created at
+// createdAt, whose megapixels were charged to the tenant at chargedAt.
+func NewUploadExpiry(objectName, tenantId string, megapixels int, chargedAt, createdAt time.Time) *UploadExpiry {
+
+	return &UploadExpiry{
+		Pk:         objectName,
+		Sk:         UploadExpirySk,
+		TenantId:   tenantId,
+		Megapixels: megapixels,
+		ChargedAt:  chargedAt.UTC().Format(time.RFC3339),
+		ExpiresAt:  createdAt.Add(UploadTimeout).Unix(),
+	}
+}
+
+// UploadExpired reports whether the job is pending an upload that is overdue
+// at now. The job is only stored expired once its UploadExpiry is removed,
+// which the time to live of the table may delay.
+func (item *Item) UploadExpired(now time.Time) bool {
+
+	if item.Status != StatusPendingUpload {
+		return false
+	}
+	createdAt, err := time.Parse(time.RFC3339, item.CreatedAt)
+	return err == nil && now.Sub(createdAt) >= UploadTimeout
+}
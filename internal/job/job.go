@@ -0,0 +1,161 @@
+// Package job owns the job items of the auth table: their schema, their
+// statuses and their keys. getpresigned writes the items, the transform, dlq,
+// notifier and expirejobs lambdas update them and accessobject reads them.
+package job
+
+import (
+	"fmt"
+
+	"cdk_image_transform/internal/failure"
+	"cdk_image_transform/internal/imaging"
+	"cdk_image_transform/internal/transforms"
+	"cdk_image_transform/internal/webhook"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MetadataSk is the sort key of the current version of a job, the earlier
+// versions are archived under VersionSk.
+const MetadataSk = "metadata"
+
+// VersionSk returns the sort key of an archived version of a job.
+func VersionSk(jobVersion int) string {
+	return fmt.Sprintf("version#%d", jobVersion)
+}
+
+// Key returns the key of an item of the auth table.
+func Key(pk, sk string) map[string]types.AttributeValue {
+
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: pk},
+		"sk": &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+// MetadataKey returns the key of the current version of the job of objectName.
+func MetadataKey(objectName string) map[string]types.AttributeValue {
+	return Key(objectName, MetadataSk)
+}
+
+type Transform struct {
+	Name   string   `dynamodbav:"Name" json:"Name"`
+	Params []string `dynamodbav:"Params,omitempty" json:"Params,omitempty"`
+}
+
+// Steps returns the transforms as the steps run by the imaging pipeline.
+func Steps(transformList []Transform) []transforms.Step {
+
+	steps := make([]transforms.Step, len(transformList))
+	for i, transform := range transformList {
+		steps[i] = transforms.Step(transform)
+	}
+	return steps
+}
+
+// ImageInfo is the size of the source or of an output, recorded by the transform lambda.
+type ImageInfo struct {
+	Width  int `dynamodbav:"Width" json:"Width"`
+	Height int `dynamodbav:"Height" json:"Height"`
+	Bytes  int `dynamodbav:"Bytes" json:"Bytes"`
+}
+
+// Rendition is an additional output of the job stored under OutputKey. Its
+// pipeline runs after the top level Transforms, and its Output block overrides
+// the top level one.
+type Rendition struct {
+	Name        string                 `dynamodbav:"Name" json:"Name"`
+	Transforms  []Transform            `dynamodbav:"Transforms" json:"Transforms"`
+	Output      *imaging.OutputOptions `dynamodbav:"Output,omitempty" json:"Output,omitempty"`
+	OutputKey   string                 `dynamodbav:"OutputKey" json:"-"`
+	OutputImage *ImageInfo             `dynamodbav:"OutputImage,omitempty" json:"-"`
+}
+
+// Item is a version of a job. The current version is stored under MetadataSk
+// and the earlier ones under VersionSk. SchemaVersion is the version of the
+// schema the item was written with, items of older schemas are migrated when
+// they are read. The <Status>At attributes record when the job last entered
+// each status, CreatedAt being the time it was created pending its upload.
+// The sequencers ordering the events of the job are only accessed through
+// expressions, see package sequencer.
+type Item struct {
+	Pk            string                 `dynamodbav:"pk"`
+	Sk            string                 `dynamodbav:"sk"`
+	SchemaVersion int                    `dynamodbav:"SchemaVersion"`
+	TenantId      string                 `dynamodbav:"TenantId"`
+	SourceIP      string                 `dynamodbav:"SourceIP"`
+	Status        Status                 `dynamodbav:"Status"`
+	ContentType   string                 `dynamodbav:"ContentType"`
+	OutputKey     string                 `dynamodbav:"OutputKey"`
+	Width         int                    `dynamodbav:"Width,omitempty"`
+	Height        int                    `dynamodbav:"Height,omitempty"`
+	Transforms    []Transform            `dynamodbav:"Transforms"`
+	Output        *imaging.OutputOptions `dynamodbav:"Output,omitempty"`
+	Renditions    []Rendition            `dynamodbav:"Renditions,omitempty"`
+	CreatedAt     string                 `dynamodbav:"CreatedAt"`
+	UpdatedAt     string                 `dynamodbav:"UpdatedAt"`
+	QueuedAt      string                 `dynamodbav:"QueuedAt,omitempty"`
+	ProcessingAt  string                 `dynamodbav:"ProcessingAt,omitempty"`
+	SucceededAt   string                 `dynamodbav:"SucceededAt,omitempty"`
+	FailedAt      string                 `dynamodbav:"FailedAt,omitempty"`
+	ExpiredAt     string                 `dynamodbav:"ExpiredAt,omitempty"`
+	CancelledAt   string                 `dynamodbav:"CancelledAt,omitempty"`
+	CallbackURL   string                 `dynamodbav:"CallbackURL,omitempty"`
+	JobVersion    int                    `dynamodbav:"JobVersion"`
+	SourceImage   *ImageInfo             `dynamodbav:"SourceImage,omitempty"`
+	OutputImage   *ImageInfo             `dynamodbav:"OutputImage,omitempty"`
+	Failure       *failure.Failure       `dynamodbav:"Failure,omitempty"`
+	Deliveries    []webhook.Attempt      `dynamodbav:"Deliveries,omitempty"`
+}
+
+// Transitions returns when the job last entered each of the statuses it went
+// through.
+func (item *Item) Transitions() map[Status]string {
+
+	timestamps := map[Status]string{}
+	for status, at := range map[Status]string{
+		StatusPendingUpload: item.CreatedAt,
+		StatusQueued:        item.QueuedAt,
+		StatusProcessing:    item.ProcessingAt,
+		StatusSucceeded:     item.SucceededAt,
+		StatusFailed:        item.FailedAt,
+		StatusExpired:       item.ExpiredAt,
+		StatusCancelled:     item.CancelledAt,
+	} {
+		if at != "" {
+			timestamps[status] = at
+		}
+	}
+	return timestamps
+}
+
+// Notification returns the notification of the webhook of the finalized item.
+func (item *Item) Notification() webhook.Notification {
+
+	return webhook.Notification{
+		ObjectName: item.Pk,
+		JobVersion: item.JobVersion,
+		Status:     string(item.Status),
+		OccurredAt: item.UpdatedAt,
+		Failure:    item.Failure,
+	}
+}
+
+// Pipeline returns the top level pipeline of the job.
+func (item *Item) Pipeline() *imaging.Pipeline {
+
+	return &imaging.Pipeline{ContentType: item.ContentType, Transforms: Steps(item.Transforms), Output: item.Output}
+}
+
+// OutputKeys returns the keys the job writes its outputs to, one per rendition
+// or the OutputKey of the job without renditions.
+func (item *Item) OutputKeys() []string {
+
+	if len(item.Renditions) == 0 {
+		return []string{item.OutputKey}
+	}
+	keys := make([]string, len(item.Renditions))
+	for i, rendition := range item.Renditions {
+		keys[i] = rendition.OutputKey
+	}
+	return keys
+}
@@ -0,0 +1,90 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"cdk_image_transform/internal/awsclient"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SchemaVersion is the version of the schema of the items written by Marshal.
+// Items written before the schema was versioned have no SchemaVersion and are
+// of version 0.
+const SchemaVersion = 2
+
+// migrations upgrade an item from the schema version of its index to the next.
+// The items are only migrated in memory, they keep their schema version until
+// they are written again.
+var migrations = []func(item *Item){
+	// 0 -> 1: items written before format conversion have no OutputKey and
+	// wrote their output under the key of the upload, items written before
+	// job versions have no JobVersion.
+	func(item *Item) {
+		if item.OutputKey == "" {
+			item.OutputKey = item.Pk
+		}
+		if item.JobVersion == 0 {
+			item.JobVersion = 1
+		}
+	},
+	// 1 -> 2: the statuses of the state machine replace processed and broken.
+	// The items keep the values they were written with, see StatusIn.
+	func(item *Item) {
+		for status, legacy := range legacyStatuses {
+			if slices.Contains(legacy, item.Status) {
+				item.Status = status
+			}
+		}
+	},
+}
+
+// Unmarshal returns the job item of the attributes read from the table,
+// migrated to the current schema. It returns nil when the item is missing.
+func Unmarshal(attributes map[string]types.AttributeValue) (*Item, error) {
+
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	var item Item
+	if err := attributevalue.UnmarshalMap(attributes, &item); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal job item: %v", err)
+	}
+	if item.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("job item %s has schema version %d, newer than %d", item.Pk, item.SchemaVersion, SchemaVersion)
+	}
+	for ; item.SchemaVersion < SchemaVersion; item.SchemaVersion++ {
+		migrations[item.SchemaVersion](&item)
+	}
+	return &item, nil
+}
+
+// Marshal returns the attributes of the job item, written with the current schema.
+func Marshal(item *Item) (map[string]types.AttributeValue, error) {
+
+	item.SchemaVersion = SchemaVersion
+	attributes, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal job item: %v", err)
+	}
+	return attributes, nil
+}
+
+// Get reads the job item under key, it returns nil when the item is missing.
+func Get(ctx context.Context, dynamo awsclient.JobStore, tableName string, key map[string]types.AttributeValue) (*Item, error) {
+
+	response, err := dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item: %w", err)
+	}
+	return Unmarshal(response.Item)
+}
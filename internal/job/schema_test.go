@@ -0,0 +1,49 @@
+package job
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+func TestUnmarshalMigrates(t *testing.T) {
+
+	// written before the schema was versioned, format conversion and job versions
+	legacy, err := attributevalue.MarshalMap(map[string]any{"pk": "image-1.png", "sk": MetadataSk, "Status": "processed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := Unmarshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.SchemaVersion != SchemaVersion || item.OutputKey != "image-1.png" || item.JobVersion != 1 || item.Status != StatusSucceeded {
+		t.Errorf("item = %+v, want the output under the upload key, version 1 and succeeded", item)
+	}
+
+	current, err := Marshal(&Item{Pk: "image-2.png", Sk: MetadataSk, Status: StatusQueued, OutputKey: "image-2.jpg", JobVersion: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err = Unmarshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.SchemaVersion != SchemaVersion || item.OutputKey != "image-2.jpg" || item.JobVersion != 3 || item.Status != StatusQueued {
+		t.Errorf("item = %+v, want it unchanged", item)
+	}
+}
+
+func TestUnmarshalRejectsNewerSchema(t *testing.T) {
+
+	newer, err := attributevalue.MarshalMap(map[string]any{"pk": "image-1.png", "SchemaVersion": SchemaVersion + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(newer); err == nil {
+		t.Error("want an error for an item of a newer schema")
+	}
+	if item, err := Unmarshal(nil); item != nil || err != nil {
+		t.Errorf("missing item = %+v, %v, want nil", item, err)
+	}
+}
@@ -0,0 +1,106 @@
+package job
+
+import (
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// Status is the state of a job. A job waits for its upload in
+// StatusPendingUpload, is StatusQueued once its upload or a new version of it
+// is enqueued and StatusProcessing while the transform lambda runs it. It ends
+// StatusSucceeded or StatusFailed, and is queued again to retry or reprocess
+// it. A job whose upload never came ends StatusExpired, and a job cancelled
+// before it ran StatusCancelled, which no lambda does yet.
+type Status string
+
+const (
+	StatusPendingUpload Status = "pending_upload"
+	StatusQueued        Status = "queued"
+	StatusProcessing    Status = "processing"
+	StatusSucceeded     Status = "succeeded"
+	StatusFailed        Status = "failed"
+	StatusExpired       Status = "expired"
+	StatusCancelled     Status = "cancelled"
+)
+
+// Statuses lists every status of a job.
+var Statuses = []Status{StatusPendingUpload, StatusQueued, StatusProcessing, StatusSucceeded, StatusFailed, StatusExpired, StatusCancelled}
+
+// transitions lists the statuses a job may move to from each status. A job
+// stays processing when a newer event of its upload claims it, and goes back
+// to queued when a transient failure is retried, when its object is uploaded
+// again or when it is reprocessed.
+var transitions = map[Status][]Status{
+	StatusPendingUpload: {StatusQueued, StatusExpired, StatusCancelled},
+	StatusQueued:        {StatusProcessing, StatusFailed, StatusCancelled},
+	StatusProcessing:    {StatusProcessing, StatusQueued, StatusSucceeded, StatusFailed},
+	StatusSucceeded:     {StatusQueued},
+	StatusFailed:        {StatusQueued},
+}
+
+// timestampAttributes are the attributes recording when the job last entered
+// each status.
+var timestampAttributes = map[Status]string{
+	StatusPendingUpload: "CreatedAt",
+	StatusQueued:        "QueuedAt",
+	StatusProcessing:    "ProcessingAt",
+	StatusSucceeded:     "SucceededAt",
+	StatusFailed:        "FailedAt",
+	StatusExpired:       "ExpiredAt",
+	StatusCancelled:     "CancelledAt",
+}
+
+// legacyStatuses are the values stored for a status by the items of schema
+// versions before 2. Their processing status is the current one.
+var legacyStatuses = map[Status][]Status{
+	StatusSucceeded: {"processed"},
+	StatusFailed:    {"broken"},
+}
+
+// UploadTimeout is how long a job waits for its upload before it expires,
+// well past the lifetime of the presigned upload url.
+const UploadTimeout = time.Hour
+
+// CanTransition reports whether a job may move from status from to status to.
+func CanTransition(from, to Status) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// StatusIn is the condition that the stored status of the job is one of
+// statuses, or a value stored for them by an older schema version. Without
+// statuses it is the condition that the job doesn't exist yet.
+func StatusIn(statuses ...Status) expression.ConditionBuilder {
+
+	if len(statuses) == 0 {
+		return expression.AttributeNotExists(expression.Name("pk"))
+	}
+	var values []expression.OperandBuilder
+	for _, status := range statuses {
+		values = append(values, expression.Value(status))
+		for _, legacy := range legacyStatuses[status] {
+			values = append(values, expression.Value(legacy))
+		}
+	}
+	return expression.Name("Status").In(values[0], values[1:]...)
+}
+
+// Transition returns the update moving a job to status to at the given time,
+// which is recorded as UpdatedAt and in the timestamp of the status, and the
+// condition that the stored status may move to it. The callers narrow the
+// condition when only some of the legal transitions apply.
+func Transition(to Status, at time.Time) (expression.UpdateBuilder, expression.ConditionBuilder) {
+
+	var from []Status
+	for _, status := range Statuses {
+		if CanTransition(status, to) {
+			from = append(from, status)
+		}
+	}
+	timestamp := at.UTC().Format(time.RFC3339)
+	update := expression.Set(expression.Name("Status"), expression.Value(to)).
+		Set(expression.Name("UpdatedAt"), expression.Value(timestamp)).
+		Set(expression.Name(timestampAttributes[to]), expression.Value(timestamp))
+	return update, StatusIn(from...)
+}
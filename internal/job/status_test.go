@@ -0,0 +1,99 @@
+package job
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+func TestCanTransition(t *testing.T) {
+
+	tests := []struct {
+		from, to Status
+		want     bool
+	}{
+		{StatusPendingUpload, StatusQueued, true},
+		{StatusPendingUpload, StatusExpired, true},
+		{StatusPendingUpload, StatusProcessing, false},
+		{StatusQueued, StatusProcessing, true},
+		{StatusQueued, StatusCancelled, true},
+		{StatusProcessing, StatusSucceeded, true},
+		{StatusProcessing, StatusCancelled, false},
+		{StatusSucceeded, StatusQueued, true},
+		{StatusSucceeded, StatusFailed, false},
+		{StatusExpired, StatusQueued, false},
+		{StatusCancelled, StatusQueued, false},
+	}
+	for _, test := range tests {
+		if got := CanTransition(test.from, test.to); got != test.want {
+			t.Errorf("CanTransition(%s, %s) = %t, want %t", test.from, test.to, got, test.want)
+		}
+	}
+
+	// every status is reachable and has a timestamp
+	for _, status := range Statuses {
+		if timestampAttributes[status] == "" {
+			t.Errorf("%s has no timestamp attribute", status)
+		}
+		if status == StatusPendingUpload {
+			continue
+		}
+		reachable := slices.ContainsFunc(Statuses, func(from Status) bool { return CanTransition(from, status) })
+		if !reachable {
+			t.Errorf("%s is unreachable", status)
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	update, condition := Transition(StatusSucceeded, at)
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(condition).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values []string
+	for _, value := range expr.Values() {
+		var s string
+		if err := attributevalue.Unmarshal(value, &s); err == nil {
+			values = append(values, s)
+		}
+	}
+	// set to succeeded at the time, from processing or its legacy value
+	for _, want := range []string{"succeeded", "2024-05-01T10:00:00Z", "processing"} {
+		if !slices.Contains(values, want) {
+			t.Errorf("values = %v, want %s", values, want)
+		}
+	}
+	names := expr.Names()
+	var attributes []string
+	for _, name := range names {
+		attributes = append(attributes, name)
+	}
+	if !slices.Contains(attributes, "SucceededAt") || !slices.Contains(attributes, "UpdatedAt") {
+		t.Errorf("attributes = %v, want SucceededAt and UpdatedAt", attributes)
+	}
+
+	_, condition = Transition(StatusQueued, at)
+	if expr, err = expression.NewBuilder().WithCondition(condition).Build(); err != nil {
+		t.Fatal(err)
+	}
+	values = nil
+	for _, value := range expr.Values() {
+		var s string
+		if err := attributevalue.Unmarshal(value, &s); err == nil {
+			values = append(values, s)
+		}
+	}
+	// the items of schema 1 store processed and broken
+	for _, want := range []string{"pending_upload", "processing", "succeeded", "processed", "failed", "broken"} {
+		if !slices.Contains(values, want) {
+			t.Errorf("queued from %v, want %s", values, want)
+		}
+	}
+}
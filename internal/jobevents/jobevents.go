@@ -0,0 +1,117 @@
+// Package jobevents publishes the lifecycle events of the jobs to the job
+// events topic, so other services react to them without reading the auth
+// table. Consumers subscribe with a filter policy on the message attributes.
+package jobevents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/failure"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/google/uuid"
+)
+
+// Version of the Event schema. Fields may be added within a version, it is
+// bumped when a field is removed or changes meaning. Version 2 reports the
+// statuses of the job state machine, see package job.
+const Version = "2"
+
+// Source of every event.
+const Source = "image-transform"
+
+// Types of Event.
+const (
+	// ImageJobQueued is emitted when the job is queued, by the upload of its
+	// image or when it is reprocessed.
+	ImageJobQueued = "ImageJobQueued"
+	// ImageJobSucceeded is emitted once the outputs are written.
+	ImageJobSucceeded = "ImageJobSucceeded"
+	// ImageJobFailed is emitted when the job is marked failed.
+	ImageJobFailed = "ImageJobFailed"
+)
+
+// Message attributes of every event, to filter the subscriptions on.
+const (
+	TypeAttribute    = "type"
+	VersionAttribute = "version"
+	TenantAttribute  = "tenantId"
+)
+
+// Output is an object written by a job.
+type Output struct {
+	Key       string `json:"key"`
+	Rendition string `json:"rendition,omitempty"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Bytes     int    `json:"bytes"`
+}
+
+// Detail describes the job, fields that don't apply to the type of the
+// event are left out.
+type Detail struct {
+	JobId    string           `json:"jobId"`
+	TenantId string           `json:"tenantId"`
+	Status   string           `json:"status"`
+	Attempt  int              `json:"attempt,omitempty"`
+	Outputs  []Output         `json:"outputs,omitempty"`
+	Failure  *failure.Failure `json:"failure,omitempty"`
+}
+
+// Event is the body of the messages of the job events topic.
+type Event struct {
+	Version string `json:"version"`
+	Id      string `json:"id"`
+	Type    string `json:"type"`
+	Source  string `json:"source"`
+	Time    string `json:"time"`
+	Detail  Detail `json:"detail"`
+}
+
+// New returns an event of the given type about a job.
+func New(eventType string, detail Detail, now time.Time) Event {
+	return Event{
+		Version: Version,
+		Id:      uuid.New().String(),
+		Type:    eventType,
+		Source:  Source,
+		Time:    now.UTC().Format(time.RFC3339Nano),
+		Detail:  detail,
+	}
+}
+
+func stringAttribute(value string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+}
+
+// Publish sends the event to the topic. Nothing is sent when topicArn is
+// empty, so the lambdas still run without the topic.
+func Publish(ctx context.Context, topic awsclient.Topic, topicArn string, event Event) error {
+
+	if topicArn == "" {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	_, err = topic.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicArn),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			TypeAttribute:    stringAttribute(event.Type),
+			VersionAttribute: stringAttribute(event.Version),
+			TenantAttribute:  stringAttribute(event.Detail.TenantId),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s of %s: %v", event.Type, event.Detail.JobId, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Package jobtoken issues and verifies the tokens granting access to a job.
+// Tokens are JWTs signed with HMAC-SHA256, bound to the object key of the job,
+// an expiry and a list of scopes, so they can be verified without a lookup.
+package jobtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes of a token. ScopeRead allows /access-object and ScopeTransform allows /img.
+const (
+	ScopeRead      = "read"
+	ScopeTransform = "transform"
+)
+
+// DefaultTTL matches the lifetime of the objects in the buckets.
+const DefaultTTL time.Duration = 24 * time.Hour
+
+// leeway tolerates clock skew between the lambdas.
+const leeway time.Duration = 30 * time.Second
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrUnknownKey = errors.New("token signed with an unknown key")
+	ErrSignature  = errors.New("invalid token signature")
+	ErrExpired    = errors.New("token expired")
+)
+
+// Claims is the payload of a token. SourceIP is only set when the job was
+// created with the IP check, the token is then only valid from that address.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Tenant    string   `json:"tid"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	Scopes    []string `json:"scope"`
+	SourceIP  string   `json:"ip,omitempty"`
+}
+
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+func (k *Keyset) sign(kid, signingInput string) []byte {
+	mac := hmac.New(sha256.New, k.keys[kid])
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// Sign returns a token holding claims signed with the current key.
+func (k *Keyset) Sign(claims Claims) (string, error) {
+
+	headerJSON, err := json.Marshal(header{Algorithm: "HS256", Type: "JWT", KeyID: k.current})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+	return signingInput + "." + encoding.EncodeToString(k.sign(k.current, signingInput)), nil
+}
+
+// Issue signs a token for the object of a tenant with the given scopes, valid for ttl.
+func (k *Keyset) Issue(subject, tenant string, scopes []string, sourceIP string, ttl time.Duration, now time.Time) (string, error) {
+
+	return k.Sign(Claims{
+		Subject:   subject,
+		Tenant:    tenant,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Scopes:    scopes,
+		SourceIP:  sourceIP,
+	})
+}
+
+// Verify checks the signature of a token against any key of the keyset, so
+// tokens signed before a rotation stay valid while their key is kept, and
+// returns its claims when it hasn't expired.
+func (k *Keyset) Verify(token string, now time.Time) (*Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := json.Unmarshal(headerJSON, &h); err != nil || h.Algorithm != "HS256" {
+		return nil, ErrMalformed
+	}
+	if _, ok := k.keys[h.KeyID]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, h.KeyID)
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(signature, k.sign(h.KeyID, parts[0]+"."+parts[1])) {
+		return nil, ErrSignature
+	}
+
+	claimsJSON, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
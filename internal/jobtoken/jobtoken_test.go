@@ -0,0 +1,150 @@
+package jobtoken
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	key1 = "k1-0123456789abcdef0123456789abcdef"
+	key2 = "k2-0123456789abcdef0123456789abcdef"
+)
+
+func keyset(t *testing.T, entries map[string]string) *Keyset {
+
+	t.Helper()
+	data, _ := json.Marshal(entries)
+	keyset, err := ParseKeyset(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyset
+}
+
+var issuedAt = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func issue(t *testing.T, k *Keyset) string {
+
+	t.Helper()
+	token, err := k.Issue("image-1.png", "t-1", []string{ScopeRead}, "203.0.113.7", time.Hour, issuedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// encodePart returns v as a base64url encoded JSON part of a token.
+func encodePart(v any) string {
+
+	data, _ := json.Marshal(v)
+	return encoding.EncodeToString(data)
+}
+
+func TestVerify(t *testing.T) {
+
+	k := keyset(t, map[string]string{"current": "k1", "k1": key1})
+	claims, err := k.Verify(issue(t, k), issuedAt.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{Subject: "image-1.png", Tenant: "t-1", IssuedAt: issuedAt.Unix(), ExpiresAt: issuedAt.Add(time.Hour).Unix(), Scopes: []string{ScopeRead}, SourceIP: "203.0.113.7"}
+	if claims.Subject != want.Subject || claims.Tenant != want.Tenant || claims.IssuedAt != want.IssuedAt || claims.ExpiresAt != want.ExpiresAt || claims.SourceIP != want.SourceIP {
+		t.Errorf("claims = %+v, want %+v", claims, want)
+	}
+	if !claims.HasScope(ScopeRead) || claims.HasScope(ScopeTransform) {
+		t.Errorf("scopes = %v, want only read", claims.Scopes)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+
+	k := keyset(t, map[string]string{"current": "k1", "k1": key1})
+	token := issue(t, k)
+	parts := strings.Split(token, ".")
+	now := issuedAt.Add(time.Minute)
+
+	// the claims of another object, under the signature of the token
+	forged := encodePart(Claims{Subject: "image-2.png", Tenant: "t-1", ExpiresAt: issuedAt.Add(time.Hour).Unix(), Scopes: []string{ScopeRead}})
+	signature := []byte(parts[2])
+	signature[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"tampered claims", parts[0] + "." + forged + "." + parts[2], ErrSignature},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + string(signature), ErrSignature},
+		{"missing signature", parts[0] + "." + parts[1] + ".", ErrSignature},
+		{"alg none", encodePart(header{Algorithm: "none", Type: "JWT", KeyID: "k1"}) + "." + parts[1] + ".", ErrMalformed},
+		{"alg RS256", encodePart(header{Algorithm: "RS256", Type: "JWT", KeyID: "k1"}) + "." + parts[1] + "." + parts[2], ErrMalformed},
+		{"unknown kid", encodePart(header{Algorithm: "HS256", Type: "JWT", KeyID: "k9"}) + "." + parts[1] + "." + parts[2], ErrUnknownKey},
+		{"two parts", parts[0] + "." + parts[1], ErrMalformed},
+		{"invalid header", "e30x." + parts[1] + "." + parts[2], ErrMalformed},
+		{"empty", "", ErrMalformed},
+	}
+	for _, test := range tests {
+		if claims, err := k.Verify(test.token, now); !errors.Is(err, test.want) {
+			t.Errorf("%s: claims = %+v, err = %v, want %v", test.name, claims, err, test.want)
+		}
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+
+	k := keyset(t, map[string]string{"current": "k1", "k1": key1})
+	token := issue(t, k)
+	expiresAt := issuedAt.Add(time.Hour)
+
+	tests := []struct {
+		now  time.Time
+		want error
+	}{
+		{expiresAt.Add(-time.Second), nil},
+		// the leeway tolerates the clock skew of the lambdas
+		{expiresAt.Add(leeway), nil},
+		{expiresAt.Add(leeway + time.Second), ErrExpired},
+		{expiresAt.Add(DefaultTTL), ErrExpired},
+	}
+	for _, test := range tests {
+		if _, err := k.Verify(token, test.now); !errors.Is(err, test.want) {
+			t.Errorf("at %s: err = %v, want %v", test.now.Sub(expiresAt), err, test.want)
+		}
+	}
+}
+
+func TestVerifyRotatedKeyset(t *testing.T) {
+
+	old := issue(t, keyset(t, map[string]string{"current": "k1", "k1": key1}))
+	now := issuedAt.Add(time.Minute)
+
+	// the old key verifies the tokens it signed until it is removed
+	rotated := keyset(t, map[string]string{"current": "k2", "k1": key1, "k2": key2})
+	if _, err := rotated.Verify(old, now); err != nil {
+		t.Errorf("old token: %v", err)
+	}
+	token := issue(t, rotated)
+	headerJSON, _ := encoding.DecodeString(strings.Split(token, ".")[0])
+	var h header
+	json.Unmarshal(headerJSON, &h)
+	if h.KeyID != "k2" || h.Algorithm != "HS256" {
+		t.Errorf("header = %+v, want signed with k2", h)
+	}
+
+	retired := keyset(t, map[string]string{"current": "k2", "k2": key2})
+	if _, err := retired.Verify(old, now); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("old token: err = %v, want %v", err, ErrUnknownKey)
+	}
+	if _, err := retired.Verify(token, now); err != nil {
+		t.Errorf("new token: %v", err)
+	}
+
+	// a key id reused for another secret doesn't verify the old tokens
+	replaced := keyset(t, map[string]string{"current": "k1", "k1": key2})
+	if _, err := replaced.Verify(old, now); !errors.Is(err, ErrSignature) {
+		t.Errorf("old token: err = %v, want %v", err, ErrSignature)
+	}
+}
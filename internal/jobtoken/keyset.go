@@ -0,0 +1,85 @@
+package jobtoken
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// minKeySize is the smallest HMAC key accepted, the size of the hash.
+const minKeySize int = 32
+
+// Keyset holds the signing keys by id. New tokens are signed with the current
+// key and tokens signed with any key of the set are accepted.
+type Keyset struct {
+	current string
+	keys    map[string][]byte
+}
+
+// ParseKeyset parses a keyset stored as a JSON object mapping key ids to
+// secrets, with a "current" entry naming the signing key:
+//
+//	{"current": "k2", "k1": "<secret>", "k2": "<secret>"}
+func ParseKeyset(data []byte) (*Keyset, error) {
+
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid keyset: %v", err)
+	}
+
+	keyset := &Keyset{current: entries["current"], keys: map[string][]byte{}}
+	delete(entries, "current")
+	for kid, secret := range entries {
+		if len(secret) < minKeySize {
+			return nil, fmt.Errorf("invalid keyset: key %s is shorter than %d bytes", kid, minKeySize)
+		}
+		keyset.keys[kid] = []byte(secret)
+	}
+	if _, ok := keyset.keys[keyset.current]; !ok {
+		return nil, fmt.Errorf("invalid keyset: current key %q is missing", keyset.current)
+	}
+	return keyset, nil
+}
+
+// cacheTTL bounds how long a rotation takes to reach a warm lambda.
+const cacheTTL time.Duration = 5 * time.Minute
+
+var cache struct {
+	sync.Mutex
+	secretID  string
+	keyset    *Keyset
+	fetchedAt time.Time
+}
+
+// LoadKeyset returns the keyset stored in the secret, cached per secret for a few
+// minutes between the invocations of a lambda.
+func LoadKeyset(ctx context.Context, client awsclient.SecretStore, secretID string) (*Keyset, error) {
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.keyset != nil && cache.secretID == secretID && time.Since(cache.fetchedAt) < cacheTTL {
+		return cache.keyset, nil
+	}
+
+	secret, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keyset secret: %v", err)
+	}
+
+	keyset, err := ParseKeyset([]byte(aws.ToString(secret.SecretString)))
+	if err != nil {
+		return nil, err
+	}
+	cache.secretID, cache.keyset, cache.fetchedAt = secretID, keyset, time.Now()
+	return keyset, nil
+}
@@ -0,0 +1,72 @@
+package jobtoken
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+)
+
+func TestParseKeyset(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", `k1`},
+		{"not strings", `{"current": "k1", "k1": 1}`},
+		{"short key", `{"current": "k1", "k1": "0123456789"}`},
+		{"missing current", `{"current": "k2", "k1": "` + key1 + `"}`},
+		{"no current", `{"k1": "` + key1 + `"}`},
+		{"empty", `{}`},
+	}
+	for _, test := range tests {
+		if _, err := ParseKeyset([]byte(test.data)); err == nil {
+			t.Errorf("%s: want an error", test.name)
+		}
+	}
+
+	k, err := ParseKeyset([]byte(`{"current": "k2", "k1": "` + key1 + `", "k2": "` + key2 + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.current != "k2" || len(k.keys) != 2 {
+		t.Errorf("keyset = %s with %d keys, want k2 of 2", k.current, len(k.keys))
+	}
+}
+
+func TestLoadKeyset(t *testing.T) {
+
+	secrets := fake.Secrets{
+		"keyset-1": `{"current": "k1", "k1": "` + key1 + `"}`,
+		"keyset-2": `{"current": "k2", "k2": "` + key2 + `"}`,
+		"invalid":  `{"current": "k1"}`,
+	}
+	ctx := context.Background()
+
+	first, err := LoadKeyset(ctx, secrets, "keyset-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keyset is cached per secret, a rotation shows once the cache expires
+	secrets["keyset-1"] = `{"current": "k2", "k2": "` + key2 + `"}`
+	if cached, err := LoadKeyset(ctx, secrets, "keyset-1"); err != nil || cached != first {
+		t.Errorf("keyset = %+v, %v, want the cached one", cached, err)
+	}
+	other, err := LoadKeyset(ctx, secrets, "keyset-2")
+	if err != nil || other.current != "k2" {
+		t.Errorf("keyset = %+v, %v, want the keyset of the other secret", other, err)
+	}
+
+	cache.fetchedAt = time.Now().Add(-cacheTTL)
+	if rotated, err := LoadKeyset(ctx, secrets, "keyset-2"); err != nil || rotated == other {
+		t.Errorf("keyset = %+v, %v, want it fetched again", rotated, err)
+	}
+
+	for _, secretID := range []string{"missing", "invalid"} {
+		if keyset, err := LoadKeyset(ctx, secrets, secretID); err == nil {
+			t.Errorf("%s: keyset = %+v, want an error", secretID, keyset)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Package quota limits the requests, jobs and megapixels of a tenant with
+// atomic counters stored in the auth table, one item per tenant and window.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// UsagePrefix starts the partition key of the counters of a tenant.
+const UsagePrefix = "usage#"
+
+// Unlimited disables a limit. A zero limit falls back to the default.
+const Unlimited = -1
+
+// Limits of a tenant, stored on its tenant item.
+type Limits struct {
+	RequestsPerMinute  int `dynamodbav:"RequestsPerMinute,omitempty" json:"RequestsPerMinute,omitempty"`
+	JobsPerDay         int `dynamodbav:"JobsPerDay,omitempty" json:"JobsPerDay,omitempty"`
+	MegapixelsPerMonth int `dynamodbav:"MegapixelsPerMonth,omitempty" json:"MegapixelsPerMonth,omitempty"`
+}
+
+// DefaultLimits apply to tenants without limits of their own.
+var DefaultLimits = Limits{
+	RequestsPerMinute:  60,
+	JobsPerDay:         1000,
+	MegapixelsPerMonth: 10000,
+}
+
+func orDefault(limit, fallback int) int {
+	if limit == 0 {
+		return fallback
+	}
+	return limit
+}
+
+// Effective returns the limits with the unset ones replaced by DefaultLimits.
+func (l *Limits) Effective() Limits {
+
+	if l == nil {
+		return DefaultLimits
+	}
+	return Limits{
+		RequestsPerMinute:  orDefault(l.RequestsPerMinute, DefaultLimits.RequestsPerMinute),
+		JobsPerDay:         orDefault(l.JobsPerDay, DefaultLimits.JobsPerDay),
+		MegapixelsPerMonth: orDefault(l.MegapixelsPerMonth, DefaultLimits.MegapixelsPerMonth),
+	}
+}
+
+// Validate rejects limits other than positive values, zero and Unlimited.
+func (l Limits) Validate() error {
+
+	for name, limit := range map[string]int{
+		"RequestsPerMinute":  l.RequestsPerMinute,
+		"JobsPerDay":         l.JobsPerDay,
+		"MegapixelsPerMonth": l.MegapixelsPerMonth,
+	} {
+		if limit < Unlimited {
+			return fmt.Errorf("invalid %s %d: must be positive, 0 for the default or %d for unlimited", name, limit, Unlimited)
+		}
+	}
+	return nil
+}
+
+// Names of the windows, they start the sort key of their counters.
+const (
+	Requests   = "requests"
+	Jobs       = "jobs"
+	Megapixels = "megapixels"
+)
+
+// Windows lists the windows in the order they are checked.
+var Windows = []string{Requests, Jobs, Megapixels}
+
+// Of returns the limit of the named window.
+func (l Limits) Of(name string) int {
+
+	switch name {
+	case Requests:
+		return l.RequestsPerMinute
+	case Jobs:
+		return l.JobsPerDay
+	default:
+		return l.MegapixelsPerMonth
+	}
+}
+
+// window returns the sort key of the counter of the window containing now
+// and the time the window ends.
+func window(name string, now time.Time) (string, time.Time) {
+
+	now = now.UTC()
+	switch name {
+	case Requests:
+		start := now.Truncate(time.Minute)
+		return name + "#" + start.Format("2006-01-02T15:04"), start.Add(time.Minute)
+	case Jobs:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return name + "#" + start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+	default:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return name + "#" + start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+}
+
+// Usage is the state of one window after a request was counted.
+type Usage struct {
+	Name     string
+	Limit    int
+	Used     int
+	Reset    time.Time
+	Exceeded bool
+}
+
+// Remaining returns what is left of the window, or -1 when it is unlimited.
+func (u Usage) Remaining() int {
+
+	if u.Limit == Unlimited {
+		return Unlimited
+	}
+	return max(u.Limit-u.Used, 0)
+}
+
+// RetryAfter returns the time until the window resets.
+func (u Usage) RetryAfter(now time.Time) time.Duration {
+	return max(u.Reset.Sub(now), time.Second).Round(time.Second)
+}
+
+func counterKey(tenantId, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: UsagePrefix + tenantId},
+		"sk": &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+func number(value int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(value, 10)}
+}
+
+func readCount(item map[string]types.AttributeValue) int {
+
+	count, ok := item["Count"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	used, _ := strconv.Atoi(count.Value)
+	return used
+}
+
+// readCounter returns the count of the counter of sk, 0 when it doesn't exist.
+func readCounter(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId, sk string) (int, error) {
+
+	response, err := dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       counterKey(tenantId, sk),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return readCount(response.Item), nil
+}
+
+// consume atomically adds amount to the counter of the window, unless it
+// would go over limit. The counters expire with the TTL of the table a day
+// after their window ends.
+func consume(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId, name string, limit, amount int, now time.Time) (Usage, error) {
+
+	sk, reset := window(name, now)
+	usage := Usage{Name: name, Limit: limit, Reset: reset}
+
+	// the condition below lets the first charge of a window through, whatever its amount
+	if limit != Unlimited && amount > limit {
+		used, err := readCounter(ctx, dynamo, tableName, tenantId, sk)
+		if err != nil {
+			return usage, fmt.Errorf("failed to get the %s counter of %s: %v", name, tenantId, err)
+		}
+		usage.Used, usage.Exceeded = used, true
+		return usage, nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(tableName),
+		Key:                                 counterKey(tenantId, sk),
+		UpdateExpression:                    aws.String("ADD #count :amount SET #expires = if_not_exists(#expires, :expires)"),
+		ExpressionAttributeNames:            map[string]string{"#count": "Count", "#expires": "ExpiresAt"},
+		ExpressionAttributeValues:           map[string]types.AttributeValue{":amount": number(int64(amount)), ":expires": number(reset.Add(24 * time.Hour).Unix())},
+		ReturnValues:                        types.ReturnValueUpdatedNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+	if limit != Unlimited {
+		input.ConditionExpression = aws.String("attribute_not_exists(#count) OR #count <= :max")
+		input.ExpressionAttributeValues[":max"] = number(int64(limit - amount))
+	}
+
+	response, err := dynamo.UpdateItem(ctx, input)
+	if err != nil {
+		var failed *types.ConditionalCheckFailedException
+		if errors.As(err, &failed) {
+			usage.Used = readCount(failed.Item)
+			usage.Exceeded = true
+			return usage, nil
+		}
+		return usage, fmt.Errorf("failed to update the %s counter of %s: %v", name, tenantId, err)
+	}
+	usage.Used = readCount(response.Attributes)
+	return usage, nil
+}
+
+// refund gives back amount to the counter of the window containing now.
+func refund(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId, name string, amount int, now time.Time) error {
+
+	sk, _ := window(name, now)
+	_, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       counterKey(tenantId, sk),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		UpdateExpression:          aws.String("ADD #count :amount"),
+		ExpressionAttributeNames:  map[string]string{"#count": "Count"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":amount": number(int64(-amount))},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to refund the %s counter of %s: %v", name, tenantId, err)
+	}
+	return nil
+}
+
+// RefundJob gives back a job of megapixels counted by ChargeJob at chargedAt,
+// when it couldn't be created after all. The request stays counted.
+func RefundJob(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId string, megapixels int, chargedAt time.Time) error {
+
+	return errors.Join(
+		refund(ctx, dynamo, tableName, tenantId, Jobs, 1, chargedAt),
+		refund(ctx, dynamo, tableName, tenantId, Megapixels, megapixels, chargedAt),
+	)
+}
+
+// ImageMegapixels returns the megapixels charged for an image, rounded up.
+func ImageMegapixels(width, height int) int {
+	return (width*height + 999999) / 1000000
+}
+
+// ChargeJob counts a request creating a job of megapixels against the limits.
+// It returns the usage of every window checked so far, the last one being the
+// exceeded window if any. A job rejected by a later window isn't counted.
+func ChargeJob(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId string, limits Limits, megapixels int, now time.Time) ([]Usage, error) {
+
+	var usages []Usage
+	amounts := map[string]int{Requests: 1, Jobs: 1, Megapixels: megapixels}
+
+	for _, name := range Windows {
+		usage, err := consume(ctx, dynamo, tableName, tenantId, name, limits.Of(name), amounts[name], now)
+		if err != nil {
+			return usages, err
+		}
+		usages = append(usages, usage)
+		if usage.Exceeded {
+			// the request was made, but the job wasn't
+			if name == Megapixels {
+				err = refund(ctx, dynamo, tableName, tenantId, Jobs, 1, now)
+			}
+			return usages, err
+		}
+	}
+	return usages, nil
+}
+
+// Current returns the usage of every window containing now without counting anything.
+func Current(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId string, limits Limits, now time.Time) ([]Usage, error) {
+
+	var usages []Usage
+	for _, name := range Windows {
+		limit := limits.Of(name)
+		sk, reset := window(name, now)
+		used, err := readCounter(ctx, dynamo, tableName, tenantId, sk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the %s counter of %s: %v", name, tenantId, err)
+		}
+		usages = append(usages, Usage{Name: name, Limit: limit, Used: used, Reset: reset})
+	}
+	return usages, nil
+}
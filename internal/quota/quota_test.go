@@ -0,0 +1,183 @@
+package quota
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+)
+
+const testTable = "auth"
+
+func TestWindow(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		sk    string
+		reset time.Time
+	}{
+		{Requests, time.Date(2024, 5, 1, 10, 7, 59, 0, time.UTC), "requests#2024-05-01T10:07", time.Date(2024, 5, 1, 10, 8, 0, 0, time.UTC)},
+		{Jobs, time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC), "jobs#2024-05-01", time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+		{Megapixels, time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), "megapixels#2024-02", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Megapixels, time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), "megapixels#2024-12", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// the windows are in UTC whatever the zone of now
+		{Jobs, time.Date(2024, 5, 1, 20, 0, 0, 0, time.FixedZone("UTC-5", -5*3600)), "jobs#2024-05-02", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		sk, reset := window(test.name, test.now)
+		if sk != test.sk || !reset.Equal(test.reset) {
+			t.Errorf("window(%s, %s) = %s, %s, want %s, %s", test.name, test.now, sk, reset, test.sk, test.reset)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+
+	now := time.Date(2024, 5, 1, 10, 7, 30, 400, time.UTC)
+	tests := []struct {
+		usage      Usage
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{Usage{Limit: 10, Used: 3, Reset: now.Add(90 * time.Second)}, 7, 90 * time.Second},
+		{Usage{Limit: 10, Used: 12, Reset: now.Add(-time.Minute)}, 0, time.Second},
+		{Usage{Limit: Unlimited, Used: 12, Reset: now.Add(time.Hour)}, Unlimited, time.Hour},
+	}
+	for _, test := range tests {
+		if remaining, retryAfter := test.usage.Remaining(), test.usage.RetryAfter(now); remaining != test.remaining || retryAfter != test.retryAfter {
+			t.Errorf("%+v: remaining %d, retry after %s, want %d, %s", test.usage, remaining, retryAfter, test.remaining, test.retryAfter)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+
+	var unset *Limits
+	if unset.Effective() != DefaultLimits {
+		t.Errorf("effective = %+v, want the defaults", unset.Effective())
+	}
+	limits := &Limits{RequestsPerMinute: Unlimited, JobsPerDay: 5}
+	if effective := limits.Effective(); effective != (Limits{RequestsPerMinute: Unlimited, JobsPerDay: 5, MegapixelsPerMonth: DefaultLimits.MegapixelsPerMonth}) {
+		t.Errorf("effective = %+v, want the megapixels defaulted", effective)
+	}
+
+	if err := limits.Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (Limits{JobsPerDay: -2}).Validate(); err == nil {
+		t.Error("want an error for a negative limit")
+	}
+}
+
+func charge(t *testing.T, store *fake.DynamoDB, limits Limits, megapixels int, now time.Time) []Usage {
+
+	t.Helper()
+	usages, err := ChargeJob(context.Background(), store, testTable, "t-1", limits, megapixels, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usages
+}
+
+func used(t *testing.T, store *fake.DynamoDB, limits Limits, now time.Time) [3]int {
+
+	t.Helper()
+	usages, err := Current(context.Background(), store, testTable, "t-1", limits, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [3]int{usages[0].Used, usages[1].Used, usages[2].Used}
+}
+
+func TestChargeJob(t *testing.T) {
+
+	store := fake.NewDynamoDB(testTable)
+	limits := Limits{RequestsPerMinute: 3, JobsPerDay: 2, MegapixelsPerMonth: 10}
+	now := time.Date(2024, 5, 1, 10, 7, 0, 0, time.UTC)
+
+	usages := charge(t, store, limits, 4, now)
+	if len(usages) != 3 || usages[2].Exceeded || usages[2].Remaining() != 6 {
+		t.Fatalf("usages = %+v, want 6 megapixels left", usages)
+	}
+
+	// the megapixels are exceeded, the job is given back but not the request
+	usages = charge(t, store, limits, 7, now)
+	if last := usages[len(usages)-1]; last.Name != Megapixels || !last.Exceeded || last.Used != 4 {
+		t.Errorf("usages = %+v, want the megapixels exceeded", usages)
+	}
+	if got := used(t, store, limits, now); got != [3]int{2, 1, 4} {
+		t.Errorf("used = %v, want 2 requests, 1 job, 4 megapixels", got)
+	}
+
+	charge(t, store, limits, 6, now)
+	usages = charge(t, store, limits, 1, now)
+	if last := usages[len(usages)-1]; last.Name != Requests || !last.Exceeded {
+		t.Errorf("usages = %+v, want the requests exceeded", usages)
+	}
+
+	// the next minute only resets the requests
+	usages = charge(t, store, limits, 1, now.Add(time.Minute))
+	if last := usages[len(usages)-1]; last.Name != Jobs || !last.Exceeded || last.Remaining() != 0 {
+		t.Errorf("usages = %+v, want the jobs exceeded", usages)
+	}
+	if got := used(t, store, limits, now); got != [3]int{3, 2, 10} {
+		t.Errorf("used = %v, want 3 requests, 2 jobs, 10 megapixels", got)
+	}
+}
+
+func TestChargeJobLargerThanLimit(t *testing.T) {
+
+	store := fake.NewDynamoDB(testTable)
+	limits := Limits{RequestsPerMinute: 10, JobsPerDay: 10, MegapixelsPerMonth: 10}
+	now := time.Date(2024, 5, 1, 10, 7, 0, 0, time.UTC)
+
+	// the first charge of the window can't exceed the limit either
+	usages := charge(t, store, limits, 11, now)
+	if last := usages[len(usages)-1]; last.Name != Megapixels || !last.Exceeded || last.Used != 0 || last.Remaining() != 10 {
+		t.Errorf("usages = %+v, want the megapixels exceeded", usages)
+	}
+	if got := used(t, store, limits, now); got != [3]int{1, 0, 0} {
+		t.Errorf("used = %v, want only the request counted", got)
+	}
+
+	charge(t, store, limits, 10, now)
+	if got := used(t, store, limits, now); got != [3]int{2, 1, 10} {
+		t.Errorf("used = %v, want the job of the limit counted", got)
+	}
+
+	// unlimited windows count without a bound
+	unlimited := Limits{RequestsPerMinute: Unlimited, JobsPerDay: Unlimited, MegapixelsPerMonth: Unlimited}
+	usages = charge(t, store, unlimited, 1000, now)
+	if last := usages[len(usages)-1]; last.Exceeded || last.Used != 1010 || last.Remaining() != Unlimited {
+		t.Errorf("usages = %+v, want 1010 unlimited megapixels", usages)
+	}
+}
+
+func TestRefundJob(t *testing.T) {
+
+	store := fake.NewDynamoDB(testTable)
+	limits := Limits{RequestsPerMinute: 10, JobsPerDay: 10, MegapixelsPerMonth: 100}
+	chargedAt := time.Date(2024, 5, 31, 23, 59, 59, 0, time.UTC)
+
+	charge(t, store, limits, 40, chargedAt)
+	charge(t, store, limits, 30, chargedAt)
+	if err := RefundJob(context.Background(), store, testTable, "t-1", 30, chargedAt); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(t, store, limits, chargedAt); got != [3]int{2, 1, 40} {
+		t.Errorf("used = %v, want the second job given back", got)
+	}
+
+	// a refund goes to the window of the charge, even once it ended
+	if err := RefundJob(context.Background(), store, testTable, "t-1", 40, chargedAt); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(t, store, limits, chargedAt); got != [3]int{2, 0, 0} {
+		t.Errorf("used = %v, want both jobs given back", got)
+	}
+	if err := RefundJob(context.Background(), store, testTable, "t-1", 1, chargedAt.Add(time.Second)); err == nil {
+		t.Error("want an error for a window without counters")
+	}
+}
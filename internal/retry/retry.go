@@ -0,0 +1,66 @@
+// Package retry delays the messages of an SQS queue that a lambda returns in
+// its batch item failures, so they are retried with an exponential backoff
+// rather than once the visibility timeout of the queue expires.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// MaxDelay is the maximum visibility timeout of SQS.
+const MaxDelay = 12 * time.Hour
+
+// Backoff doubles from Base on every receive of a message, up to Max.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// ReceiveCount returns how many times the message was received, at least 1.
+func ReceiveCount(message events.SQSMessage) int {
+
+	receiveCount, err := strconv.Atoi(message.Attributes["ApproximateReceiveCount"])
+	if err != nil || receiveCount < 1 {
+		return 1
+	}
+	return receiveCount
+}
+
+// Delay returns the backoff before the next receive of a message received
+// receiveCount times.
+func (b Backoff) Delay(receiveCount int) time.Duration {
+
+	limit := min(b.Max, MaxDelay)
+	delay := b.Base
+	for i := 1; i < receiveCount && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// DelayMessage hides the message until its backoff has elapsed.
+func (b Backoff) DelayMessage(ctx context.Context, queue awsclient.Queue, queueURL string, message events.SQSMessage) error {
+
+	receiveCount := ReceiveCount(message)
+	delay := b.Delay(receiveCount)
+
+	_, err := queue.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     aws.String(message.ReceiptHandle),
+		VisibilityTimeout: int32(delay.Seconds()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delay the retry of %s: %v", message.MessageId, err)
+	}
+	fmt.Printf("retrying %s in %s, receive %d\n", message.MessageId, delay, receiveCount)
+	return nil
+}
@@ -0,0 +1,74 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cdk_image_transform/internal/fake"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestDelay(t *testing.T) {
+
+	tests := []struct {
+		backoff      Backoff
+		receiveCount int
+		want         time.Duration
+	}{
+		{Backoff{Base: 30 * time.Second, Max: time.Hour}, 1, 30 * time.Second},
+		{Backoff{Base: 30 * time.Second, Max: time.Hour}, 4, 4 * time.Minute},
+		{Backoff{Base: 30 * time.Second, Max: time.Hour}, 8, time.Hour},
+		// the cap holds for counts that would overflow the doubling
+		{Backoff{Base: 30 * time.Second, Max: time.Hour}, 1000, time.Hour},
+		{Backoff{Base: time.Hour, Max: 24 * time.Hour}, 10, MaxDelay},
+		{Backoff{Base: 2 * time.Hour, Max: time.Hour}, 1, time.Hour},
+	}
+	for _, test := range tests {
+		if delay := test.backoff.Delay(test.receiveCount); delay != test.want {
+			t.Errorf("%+v receive %d: delay = %s, want %s", test.backoff, test.receiveCount, delay, test.want)
+		}
+	}
+}
+
+func TestReceiveCount(t *testing.T) {
+
+	tests := []struct {
+		count string
+		want  int
+	}{
+		{"3", 3},
+		{"1", 1},
+		{"0", 1},
+		{"", 1},
+		{"many", 1},
+	}
+	for _, test := range tests {
+		message := events.SQSMessage{Attributes: map[string]string{"ApproximateReceiveCount": test.count}}
+		if count := ReceiveCount(message); count != test.want {
+			t.Errorf("ReceiveCount(%q) = %d, want %d", test.count, count, test.want)
+		}
+	}
+}
+
+func TestDelayMessage(t *testing.T) {
+
+	queue := &fake.Queue{}
+	backoff := Backoff{Base: 30 * time.Second, Max: time.Hour}
+	message := events.SQSMessage{MessageId: "m-1", ReceiptHandle: "r-1", Attributes: map[string]string{"ApproximateReceiveCount": "3"}}
+
+	if err := backoff.DelayMessage(context.Background(), queue, "uploads", message); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.Visibility) != 1 || aws.ToString(queue.Visibility[0].ReceiptHandle) != "r-1" || queue.Visibility[0].VisibilityTimeout != 120 {
+		t.Errorf("visibility = %+v, want r-1 hidden for 120 seconds", queue.Visibility)
+	}
+
+	queue.Errors = map[string]error{"ChangeMessageVisibility": errors.New("throttled")}
+	if err := backoff.DelayMessage(context.Background(), queue, "uploads", message); err == nil {
+		t.Error("want the error of the queue")
+	}
+}
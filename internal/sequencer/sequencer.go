@@ -0,0 +1,75 @@
+// Package sequencer orders the S3 events of an object, so a job is processed
+// once per upload however many times its event is delivered.
+package sequencer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// Attributes of the job item. Attribute holds the sequencer of the latest
+// event that claimed the job, ProcessedAttribute the sequencer of the event
+// whose outputs are written.
+const (
+	Attribute          = "Sequencer"
+	ProcessedAttribute = "ProcessedSequencer"
+	ETagAttribute      = "SourceETag"
+)
+
+// width is the length the sequencers are padded to. S3 only guarantees the
+// order of the sequencers of an object when they have the same length.
+const width = 32
+
+// Normalize pads a sequencer with zeros so that the sequencers of an object
+// are ordered as strings, which is how DynamoDB compares them.
+func Normalize(sequencer string) string {
+
+	sequencer = strings.ToUpper(sequencer)
+	if len(sequencer) >= width {
+		return sequencer
+	}
+	return strings.Repeat("0", width-len(sequencer)) + sequencer
+}
+
+// Key returns the key ordering the events of a job: the events of a later
+// version of the job, enqueued when it is reprocessed, come after the events
+// of the upload whatever their sequencer.
+func Key(jobVersion int, sequencer string) string {
+	return fmt.Sprintf("%08X", max(jobVersion, 1)) + Normalize(sequencer)
+}
+
+// NotProcessed is the condition that no event as recent as sequencer was
+// processed.
+func NotProcessed(sequencer string) expression.ConditionBuilder {
+
+	return expression.Or(
+		expression.AttributeNotExists(expression.Name(ProcessedAttribute)),
+		expression.Name(ProcessedAttribute).LessThan(expression.Value(sequencer)),
+	)
+}
+
+// Claimable is the condition that the event of sequencer may process the
+// job: no more recent event claimed it and it wasn't processed already.
+func Claimable(sequencer string) expression.ConditionBuilder {
+
+	return expression.And(
+		expression.AttributeExists(expression.Name("pk")),
+		expression.Or(
+			expression.AttributeNotExists(expression.Name(Attribute)),
+			expression.Name(Attribute).LessThanEqual(expression.Value(sequencer)),
+		),
+		NotProcessed(sequencer),
+	)
+}
+
+// Claimed is the condition that the event of sequencer still holds the job
+// and may write its outcome.
+func Claimed(sequencer string) expression.ConditionBuilder {
+
+	return expression.And(
+		expression.Name(Attribute).Equal(expression.Value(sequencer)),
+		NotProcessed(sequencer),
+	)
+}
@@ -0,0 +1,49 @@
+package sequencer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+
+	tests := []struct {
+		sequencer string
+		want      string
+	}{
+		{"0A", strings.Repeat("0", 30) + "0A"},
+		{"0055aed6dcd90281e5", strings.Repeat("0", 14) + "0055AED6DCD90281E5"},
+		{strings.Repeat("f", 40), strings.Repeat("F", 40)},
+	}
+	for _, test := range tests {
+		if got := Normalize(test.sequencer); got != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.sequencer, got, test.want)
+		}
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+
+	// each key is ordered after the previous one
+	keys := []string{
+		Key(1, "0A"),
+		// a longer sequencer of the same object comes later once padded
+		Key(1, "0B"),
+		Key(1, "0055AED6DCD90281E5"),
+		Key(1, "0055aed6dcd90281e6"),
+		// a later version comes after every event of the upload
+		Key(2, "01"),
+		Key(2, "0A"),
+		Key(10, "00"),
+		Key(16, "00"),
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Errorf("%s >= %s, want it ordered before", keys[i-1], keys[i])
+		}
+	}
+	// the version 0 of the jobs written before versions is the first one
+	if Key(0, "0A") != Key(1, "0A") {
+		t.Errorf("Key(0) = %s, want Key(1) = %s", Key(0, "0A"), Key(1, "0A"))
+	}
+}
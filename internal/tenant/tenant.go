@@ -0,0 +1,282 @@
+// Package tenant stores the tenants of the API and their API keys in the auth
+// table, next to the job items, and authenticates requests with those keys.
+package tenant
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/job"
+	"cdk_image_transform/internal/quota"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Partition key prefixes, job items are keyed by their object name which
+// always starts with "image-".
+const (
+	TenantPrefix = "tenant#"
+	APIKeyPrefix = "apikey#"
+)
+
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// APIKeyHeader is the header carrying the API key of a request.
+const APIKeyHeader = "X-Api-Key"
+
+// apiKeyPrefix starts every API key so leaked keys are easy to search for.
+const apiKeyPrefix = "itk"
+
+var (
+	ErrInvalidKey = errors.New("invalid api key")
+	ErrDisabled   = errors.New("api key or tenant disabled")
+)
+
+// Tenant is the owner of API keys and jobs. Admin tenants may manage the
+// limits of every tenant, Limits overrides the default quotas. WebhookSecret
+// signs the completion webhooks of its jobs.
+type Tenant struct {
+	Pk        string        `dynamodbav:"pk" json:"-"`
+	Sk        string        `dynamodbav:"sk" json:"-"`
+	TenantId  string        `dynamodbav:"TenantId" json:"TenantId"`
+	Name      string        `dynamodbav:"Name" json:"Name"`
+	Status    string        `dynamodbav:"Status" json:"Status"`
+	CreatedAt string        `dynamodbav:"CreatedAt" json:"CreatedAt"`
+	Admin     bool          `dynamodbav:"Admin,omitempty" json:"Admin,omitempty"`
+	Limits    *quota.Limits `dynamodbav:"Limits,omitempty" json:"Limits,omitempty"`
+
+	WebhookSecret string `dynamodbav:"WebhookSecret,omitempty" json:"-"`
+}
+
+// APIKey is stored under its public id, only the hash of its secret is kept.
+type APIKey struct {
+	Pk        string `dynamodbav:"pk"`
+	Sk        string `dynamodbav:"sk"`
+	KeyId     string `dynamodbav:"KeyId"`
+	TenantId  string `dynamodbav:"TenantId"`
+	Hash      string `dynamodbav:"Hash"`
+	Status    string `dynamodbav:"Status"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func NewTenantId() (string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	return "t-" + id, nil
+}
+
+// NewWebhookSecret returns a secret to sign the webhooks of a tenant, of the
+// form whsec_<secret>.
+func NewWebhookSecret() (string, error) {
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + secret, nil
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewAPIKey returns a new key of the tenant, of the form itk_<id>_<secret>,
+// and the item to store for it. The key itself is never stored.
+func NewAPIKey(tenantId, createdAt string) (string, *APIKey, error) {
+
+	keyId, err := randomHex(6)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", nil, err
+	}
+	item := &APIKey{
+		Pk:        APIKeyPrefix + keyId,
+		Sk:        job.MetadataSk,
+		KeyId:     keyId,
+		TenantId:  tenantId,
+		Hash:      hashSecret(secret),
+		Status:    StatusActive,
+		CreatedAt: createdAt,
+	}
+	return apiKeyPrefix + "_" + keyId + "_" + secret, item, nil
+}
+
+func parseAPIKey(key string) (keyId, secret string, err error) {
+
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", ErrInvalidKey
+	}
+	return parts[1], parts[2], nil
+}
+
+// getItem reads the metadata item of pk into out and reports whether it exists.
+func getItem(ctx context.Context, dynamo awsclient.JobStore, tableName, pk string, out any) (bool, error) {
+
+	response, err := dynamo.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       job.MetadataKey(pk),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get item: %v", err)
+	}
+	if len(response.Item) == 0 {
+		return false, nil
+	}
+	if err := attributevalue.UnmarshalMap(response.Item, out); err != nil {
+		return false, fmt.Errorf("failed to unmarshal item: %v", err)
+	}
+	return true, nil
+}
+
+func Get(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId string) (*Tenant, error) {
+
+	var tenant Tenant
+	found, err := getItem(ctx, dynamo, tableName, TenantPrefix+tenantId, &tenant)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+// Authenticate returns the tenant owning key. It fails with ErrInvalidKey for
+// unknown keys and ErrDisabled when the key or its tenant was disabled.
+func Authenticate(ctx context.Context, dynamo awsclient.JobStore, tableName, key string) (*Tenant, error) {
+
+	keyId, secret, err := parseAPIKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiKey APIKey
+	found, err := getItem(ctx, dynamo, tableName, APIKeyPrefix+keyId, &apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found || subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidKey
+	}
+	if apiKey.Status != StatusActive {
+		return nil, ErrDisabled
+	}
+
+	tenant, err := Get(ctx, dynamo, tableName, apiKey.TenantId)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil || tenant.Status != StatusActive {
+		return nil, ErrDisabled
+	}
+	return tenant, nil
+}
+
+// ContextKey is the key of the tenant id in the context returned by the authorizer.
+const ContextKey = "tenantId"
+
+// FromContext returns the tenant id the authorizer put in the request
+// context, or an empty string.
+func FromContext(authorizer map[string]interface{}) string {
+
+	tenantId, _ := authorizer[ContextKey].(string)
+	return tenantId
+}
+
+// Put stores a Tenant or an APIKey, failing if an item with its key exists.
+func Put(ctx context.Context, dynamo awsclient.JobStore, tableName string, item any) error {
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %v", err)
+	}
+	_, err = dynamo.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put item: %v", err)
+	}
+	return nil
+}
+
+// SetStatus enables or disables an existing tenant or API key.
+func SetStatus(ctx context.Context, dynamo awsclient.JobStore, tableName, pk, status string) error {
+
+	_, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       job.MetadataKey(pk),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		UpdateExpression:          aws.String("SET #status = :status"),
+		ExpressionAttributeNames:  map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":status": &types.AttributeValueMemberS{Value: status}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", pk, err)
+	}
+	return nil
+}
+
+// SetLimits replaces the limits of an existing tenant.
+func SetLimits(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId string, limits quota.Limits) error {
+
+	av, err := attributevalue.Marshal(limits)
+	if err != nil {
+		return fmt.Errorf("failed to marshal limits: %v", err)
+	}
+	_, err = dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       job.MetadataKey(TenantPrefix + tenantId),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		UpdateExpression:          aws.String("SET #limits = :limits"),
+		ExpressionAttributeNames:  map[string]string{"#limits": "Limits"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":limits": av},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the limits of %s: %v", tenantId, err)
+	}
+	return nil
+}
+
+// SetWebhookSecret replaces the webhook secret of an existing tenant.
+func SetWebhookSecret(ctx context.Context, dynamo awsclient.JobStore, tableName, tenantId, secret string) error {
+
+	_, err := dynamo.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       job.MetadataKey(TenantPrefix + tenantId),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		UpdateExpression:          aws.String("SET #secret = :secret"),
+		ExpressionAttributeNames:  map[string]string{"#secret": "WebhookSecret"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":secret": &types.AttributeValueMemberS{Value: secret}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the webhook secret of %s: %v", tenantId, err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cdk_image_transform/internal/fake"
+	"cdk_image_transform/internal/quota"
+)
+
+const testTable = "auth"
+
+func TestParseAPIKey(t *testing.T) {
+
+	tests := []struct {
+		key           string
+		keyId, secret string
+	}{
+		{"itk_abc_def", "abc", "def"},
+		{"itk_abc", "", ""},
+		{"itk__def", "", ""},
+		{"itk_abc_", "", ""},
+		{"xyz_abc_def", "", ""},
+		{"itk_abc_def_ghi", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		keyId, secret, err := parseAPIKey(test.key)
+		if keyId != test.keyId || secret != test.secret || (err == nil) != (test.keyId != "") {
+			t.Errorf("parseAPIKey(%q) = %q, %q, %v, want %q, %q", test.key, keyId, secret, err, test.keyId, test.secret)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("parseAPIKey(%q) err = %v, want %v", test.key, err, ErrInvalidKey)
+		}
+	}
+}
+
+// setup stores an active tenant t-1 and returns one of its API keys.
+func setup(t *testing.T) (*fake.DynamoDB, string, *APIKey) {
+
+	t.Helper()
+	store := fake.NewDynamoDB(testTable)
+	ctx := context.Background()
+	tenant := &Tenant{Pk: TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1", Name: "one", Status: StatusActive, Limits: &quota.Limits{JobsPerDay: 5}}
+	if err := Put(ctx, store, testTable, tenant); err != nil {
+		t.Fatal(err)
+	}
+	key, item, err := NewAPIKey("t-1", "2024-05-01T10:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(ctx, store, testTable, item); err != nil {
+		t.Fatal(err)
+	}
+	return store, key, item
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	store, key, item := setup(t)
+	ctx := context.Background()
+
+	if !strings.HasPrefix(key, "itk_"+item.KeyId+"_") || strings.Contains(item.Hash, strings.Split(key, "_")[2]) {
+		t.Errorf("key = %q, hash = %q, want the key id and only the hash of the secret stored", key, item.Hash)
+	}
+
+	tenant, err := Authenticate(ctx, store, testTable, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant.TenantId != "t-1" || tenant.Limits == nil || tenant.Limits.JobsPerDay != 5 {
+		t.Errorf("tenant = %+v, want t-1 with its limits", tenant)
+	}
+
+	// a secret of the same length differing in its last character
+	wrong := key[:len(key)-1] + "0"
+	if strings.HasSuffix(key, "0") {
+		wrong = key[:len(key)-1] + "1"
+	}
+	tests := []struct {
+		name string
+		key  string
+		want error
+	}{
+		{"wrong secret", wrong, ErrInvalidKey},
+		{"unknown key", "itk_000000000000_" + strings.Split(key, "_")[2], ErrInvalidKey},
+		{"malformed", "Bearer " + key, ErrInvalidKey},
+	}
+	for _, test := range tests {
+		if tenant, err := Authenticate(ctx, store, testTable, test.key); !errors.Is(err, test.want) {
+			t.Errorf("%s: tenant = %+v, err = %v, want %v", test.name, tenant, err, test.want)
+		}
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+
+	ctx := context.Background()
+	for _, pk := range []string{APIKeyPrefix, TenantPrefix + "t-1"} {
+		store, key, item := setup(t)
+		if pk == APIKeyPrefix {
+			pk = item.Pk
+		}
+		if err := SetStatus(ctx, store, testTable, pk, StatusDisabled); err != nil {
+			t.Fatal(err)
+		}
+		if tenant, err := Authenticate(ctx, store, testTable, key); !errors.Is(err, ErrDisabled) {
+			t.Errorf("%s disabled: tenant = %+v, err = %v, want %v", pk, tenant, err, ErrDisabled)
+		}
+
+		if err := SetStatus(ctx, store, testTable, pk, StatusActive); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Authenticate(ctx, store, testTable, key); err != nil {
+			t.Errorf("%s enabled again: %v", pk, err)
+		}
+	}
+
+	store, _, _ := setup(t)
+	store.Errors = map[string]error{"GetItem": errors.New("throttled")}
+	if _, err := Authenticate(ctx, store, testTable, "itk_abc_def"); err == nil || errors.Is(err, ErrInvalidKey) {
+		t.Errorf("err = %v, want the error of the store", err)
+	}
+}
+
+func TestUpdates(t *testing.T) {
+
+	store, _, _ := setup(t)
+	ctx := context.Background()
+
+	// items are never overwritten and only existing ones are updated
+	if err := Put(ctx, store, testTable, &Tenant{Pk: TenantPrefix + "t-1", Sk: "metadata", TenantId: "t-1"}); err == nil {
+		t.Error("put t-1 twice, want an error")
+	}
+	if err := SetStatus(ctx, store, testTable, TenantPrefix+"t-2", StatusDisabled); err == nil {
+		t.Error("disabled t-2, want an error")
+	}
+	if err := SetLimits(ctx, store, testTable, "t-2", quota.Limits{}); err == nil {
+		t.Error("limited t-2, want an error")
+	}
+
+	if err := SetLimits(ctx, store, testTable, "t-1", quota.Limits{JobsPerDay: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWebhookSecret(ctx, store, testTable, "t-1", "whsec_1"); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := Get(ctx, store, testTable, "t-1")
+	if err != nil || tenant.Limits.JobsPerDay != 7 || tenant.WebhookSecret != "whsec_1" || tenant.Name != "one" {
+		t.Errorf("tenant = %+v, %v, want t-1 updated", tenant, err)
+	}
+
+	if tenant, err := Get(ctx, store, testTable, "t-2"); tenant != nil || err != nil {
+		t.Errorf("t-2 = %+v, %v, want nil", tenant, err)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+
+	if id := FromContext(map[string]interface{}{ContextKey: "t-1"}); id != "t-1" {
+		t.Errorf("id = %q, want t-1", id)
+	}
+	for _, authorizer := range []map[string]interface{}{nil, {}, {ContextKey: 1}} {
+		if id := FromContext(authorizer); id != "" {
+			t.Errorf("FromContext(%v) = %q, want none", authorizer, id)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package transforms
+
+func animationSpec(name, description string, params ...Param) Spec {
+	return Spec{Name: name, Description: description, Stage: StageAnimation, Params: params}
+}
+
+func init() {
+	Register(New(animationSpec("frame", "Extracts a single frame of an animation.",
+		Param{Name: "index", Type: ParamInt}.Range(0, 9999),
+	), nil, nil))
+
+	Register(New(animationSpec("dropframes", "Keeps one frame out of every step, the dropped delays are added to the kept frames.",
+		Param{Name: "step", Type: ParamInt}.Range(2, 100),
+	), nil, nil))
+
+	Register(New(animationSpec("fps", "Sets the frame rate of an animation.",
+		Param{Name: "fps", Type: ParamFloat}.Range(1, 50),
+	), nil, nil))
+}
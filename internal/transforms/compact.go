@@ -0,0 +1,84 @@
+package transforms
+
+import (
+	"fmt"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxCompactSteps bounds the number of steps of a pipeline given in compact form.
+const MaxCompactSteps int = 32
+
+var dimensions = regexp.MustCompile(`^(\d+)x(\d+)$`)
+
+// ParseCompact parses the compact form of a pipeline used in urls, e.g.
+// "resize:300x200,grayscale,quality:80". Steps are separated by commas and
+// the parameters of a step by colons, a WxH parameter stands for two parameters.
+func ParseCompact(ops string) ([]Step, error) {
+
+	if ops == "" {
+		return nil, nil
+	}
+	parts := strings.Split(ops, ",")
+	if len(parts) > MaxCompactSteps {
+		return nil, fmt.Errorf("at most %d steps are allowed", MaxCompactSteps)
+	}
+
+	steps := make([]Step, len(parts))
+	for i, part := range parts {
+		fields := strings.Split(part, ":")
+		if fields[0] == "" {
+			return nil, fmt.Errorf("step %d has no name", i)
+		}
+		step := Step{Name: fields[0]}
+		for _, field := range fields[1:] {
+			if match := dimensions.FindStringSubmatch(field); match != nil {
+				step.Params = append(step.Params, match[1], match[2])
+			} else {
+				step.Params = append(step.Params, field)
+			}
+		}
+		steps[i] = step
+	}
+	return steps, nil
+}
+
+// Compact returns the canonical compact form of a valid pipeline. Defaults are
+// filled in and values are normalized, so equivalent pipelines give the same string.
+func (r *Registry) Compact(steps []Step) (string, error) {
+
+	parts := make([]string, len(steps))
+	for i, step := range steps {
+		args, err := r.Parse(step.Name, step.Params)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", step.Name, err)
+		}
+		fields := []string{step.Name}
+		for _, param := range r.transformers[step.Name].Spec().Params {
+			if !args.Has(param.Name) {
+				break
+			}
+			fields = append(fields, formatArg(args[param.Name]))
+		}
+		parts[i] = strings.Join(fields, ":")
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func formatArg(value any) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case color.RGBA:
+		return fmt.Sprintf("#%02x%02x%02x%02x", v.R, v.G, v.B, v.A)
+	}
+	return fmt.Sprint(value)
+}
+
+func Compact(steps []Step) (string, error) {
+	return defaultRegistry.Compact(steps)
+}
@@ -0,0 +1,75 @@
+package transforms
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCompact(t *testing.T) {
+
+	tests := []struct {
+		ops  string
+		want []Step
+	}{
+		{"", nil},
+		{"grayscale", []Step{{Name: "grayscale"}}},
+		{"resize:300x200,grayscale,quality:80", []Step{
+			{Name: "resize", Params: []string{"300", "200"}},
+			{Name: "grayscale"},
+			{Name: "quality", Params: []string{"80"}},
+		}},
+		{"crop:10x20:5:6", []Step{{Name: "crop", Params: []string{"10", "20", "5", "6"}}}},
+		{"rotate:90:#ffffff", []Step{{Name: "rotate", Params: []string{"90", "#ffffff"}}}},
+	}
+	for _, test := range tests {
+		got, err := ParseCompact(test.ops)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseCompact(%q) = %+v, %v, want %+v", test.ops, got, err, test.want)
+		}
+	}
+
+	for _, ops := range []string{",grayscale", "resize:1x1,:2", strings.Repeat("grayscale,", MaxCompactSteps) + "grayscale"} {
+		if _, err := ParseCompact(ops); err == nil {
+			t.Errorf("ParseCompact(%q) want an error", ops)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+
+	tests := []struct {
+		ops  string
+		want string
+	}{
+		{"resize:300x200", "resize:300:200:contain:lanczos"},
+		{"resize:300:200:contain:lanczos", "resize:300:200:contain:lanczos"},
+		{"resize:300x200::box", "resize:300:200:contain:box"},
+		{"crop:10x20", "crop:10:20:center"},
+		{"crop:10x20:5:6", "crop:10:20:5:6"},
+		{"rotate:90.0", "rotate:90:#00000000"},
+		{"rotate:-45.5:#FF8000", "rotate:-45.5:#ff8000ff"},
+		{"grayscale,quality:080", "grayscale,quality:80"},
+	}
+	for _, test := range tests {
+		steps, err := ParseCompact(test.ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Compact(steps)
+		if err != nil || got != test.want {
+			t.Errorf("Compact(%q) = %q, %v, want %q", test.ops, got, err, test.want)
+			continue
+		}
+
+		// the canonical form is a fixed point
+		steps, _ = ParseCompact(got)
+		if again, err := Compact(steps); err != nil || again != got {
+			t.Errorf("Compact(%q) = %q, %v, want it unchanged", got, again, err)
+		}
+	}
+
+	if _, err := Compact([]Step{{Name: "resize", Params: []string{"a", "1"}}}); err == nil {
+		t.Error("want an error for an invalid pipeline")
+	}
+}
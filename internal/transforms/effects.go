@@ -0,0 +1,77 @@
+package transforms
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/anthonynsimon/bild/effect"
+)
+
+var radius = Param{Name: "radius", Type: ParamFloat}.Range(0, 25)
+
+func effectSpec(name, description string, params ...Param) Spec {
+	return Spec{Name: name, Description: description, Params: params}
+}
+
+// simpleEffect adapts a bild effect without parameters.
+func simpleEffect(fn func(image.Image) *image.RGBA) ApplyFunc {
+	return func(img image.Image, _ Args) (image.Image, error) {
+		return fn(img), nil
+	}
+}
+
+// pointEffect adapts a pixel mapping without parameters.
+func pointEffect(fn PointFunc) func(Args) PointFunc {
+	return func(Args) PointFunc {
+		return fn
+	}
+}
+
+// grayscale, invert and sepia match the bild effects pixel for pixel.
+func grayscale(c color.RGBA) color.RGBA {
+	k := uint8(0.3*float64(c.R) + 0.6*float64(c.G) + 0.1*float64(c.B) + 0.5)
+	return color.RGBA{R: k, G: k, B: k, A: c.A}
+}
+
+func invert(c color.RGBA) color.RGBA {
+	return color.RGBA{R: 255 - c.R, G: 255 - c.G, B: 255 - c.B, A: c.A}
+}
+
+func sepia(c color.RGBA) color.RGBA {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	return color.RGBA{
+		R: clampUint8(r*0.393 + g*0.769 + b*0.189 + 0.5),
+		G: clampUint8(r*0.349 + g*0.686 + b*0.168 + 0.5),
+		B: clampUint8(r*0.272 + g*0.534 + b*0.131 + 0.5),
+		A: c.A,
+	}
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+func init() {
+	Register(New(effectSpec("dilate", "Dilates bright areas of the image.", radius), func(img image.Image, args Args) (image.Image, error) {
+		return effect.Dilate(img, args.Float("radius")), nil
+	}, nil))
+
+	Register(New(effectSpec("edgedetection", "Highlights edges with the given radius.", Param{Name: "radius", Type: ParamFloat}.Range(0, 1)), func(img image.Image, args Args) (image.Image, error) {
+		return effect.EdgeDetection(img, args.Float("radius")), nil
+	}, nil))
+
+	Register(New(effectSpec("erode", "Erodes bright areas of the image.", radius), func(img image.Image, args Args) (image.Image, error) {
+		return effect.Erode(img, args.Float("radius")), nil
+	}, nil))
+
+	Register(New(effectSpec("median", "Applies a median filter, reducing noise.", radius), func(img image.Image, args Args) (image.Image, error) {
+		return effect.Median(img, args.Float("radius")), nil
+	}, nil))
+
+	Register(New(effectSpec("emboss", "Applies an emboss filter."), simpleEffect(effect.Emboss), nil))
+	Register(NewPointwise(effectSpec("grayscale", "Converts the image to grayscale."), pointEffect(grayscale), nil))
+	Register(NewPointwise(effectSpec("invert", "Inverts the colors of the image."), pointEffect(invert), nil))
+	Register(NewPointwise(effectSpec("sepia", "Applies a sepia tone."), pointEffect(sepia), nil))
+	Register(New(effectSpec("sharpen", "Sharpens the image."), simpleEffect(effect.Sharpen), nil))
+	Register(New(effectSpec("sobel", "Applies the sobel edge operator."), simpleEffect(effect.Sobel), nil))
+}
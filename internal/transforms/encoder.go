@@ -0,0 +1,43 @@
+package transforms
+
+// Values accepted by the encode stage operations. They are exported so the
+// Output block of a job can be validated against the same lists.
+var (
+	Formats      = []string{"jpeg", "png", "gif", "bmp", "tiff"}
+	Compressions = []string{"default", "none", "fast", "best"}
+	Quantizers   = []string{"plan9", "websafe", "mediancut"}
+	DitherModes  = []string{"floydsteinberg", "none"}
+	// MetadataPolicies strip every tag, keep the copyright and ICC profile or keep everything.
+	MetadataPolicies = []string{"strip", "copyright", "all"}
+)
+
+func encoderSpec(name, description string, params ...Param) Spec {
+	return Spec{Name: name, Description: description, Stage: StageEncode, Params: params}
+}
+
+func init() {
+	Register(New(encoderSpec("format", "Sets the output format.",
+		Param{Name: "format", Type: ParamEnum, Choices: Formats},
+	), nil, nil))
+
+	Register(New(encoderSpec("quality", "Sets the jpeg quality.",
+		Param{Name: "quality", Type: ParamInt}.Range(1, 100),
+	), nil, nil))
+
+	Register(New(encoderSpec("compression", "Sets the png compression level.",
+		Param{Name: "level", Type: ParamEnum, Choices: Compressions},
+	), nil, nil))
+
+	Register(New(encoderSpec("palette", "Sets the gif palette size and quantizer.",
+		Param{Name: "size", Type: ParamInt}.Range(2, 256),
+		Param{Name: "quantizer", Type: ParamEnum, Choices: Quantizers, Optional: true},
+	), nil, nil))
+
+	Register(New(encoderSpec("metadata", "Sets which jpeg metadata is kept in jpeg and png outputs.",
+		Param{Name: "policy", Type: ParamEnum, Choices: MetadataPolicies},
+	), nil, nil))
+
+	Register(New(encoderSpec("dither", "Sets the gif dithering mode.",
+		Param{Name: "mode", Type: ParamEnum, Choices: DitherModes},
+	), nil, nil))
+}
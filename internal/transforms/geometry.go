@@ -0,0 +1,168 @@
+package transforms
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"strings"
+
+	"github.com/anthonynsimon/bild/transform"
+)
+
+var resampleFilters = map[string]transform.ResampleFilter{
+	"nearest":    transform.NearestNeighbor,
+	"box":        transform.Box,
+	"linear":     transform.Linear,
+	"gaussian":   transform.Gaussian,
+	"mitchell":   transform.MitchellNetravali,
+	"catmullrom": transform.CatmullRom,
+	"lanczos":    transform.Lanczos,
+}
+
+var Gravities = []string{"center", "north", "south", "east", "west", "northeast", "northwest", "southeast", "southwest"}
+
+var width = Param{Name: "width", Type: ParamInt}.Range(0, float64(MaxImageWidth))
+var height = Param{Name: "height", Type: ParamInt}.Range(0, float64(MaxImageHeight))
+
+// gravityRect returns a width x height rectangle anchored inside bounds.
+func gravityRect(bounds image.Rectangle, width, height int, gravity string) image.Rectangle {
+	x := bounds.Min.X + (bounds.Dx()-width)/2
+	y := bounds.Min.Y + (bounds.Dy()-height)/2
+
+	if strings.Contains(gravity, "north") {
+		y = bounds.Min.Y
+	} else if strings.Contains(gravity, "south") {
+		y = bounds.Max.Y - height
+	}
+	if strings.Contains(gravity, "west") {
+		x = bounds.Min.X
+	} else if strings.Contains(gravity, "east") {
+		x = bounds.Max.X - width
+	}
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// cropRect copies rect out of img into a new image whose bounds start at the origin.
+func cropRect(img image.Image, rect image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+func resize(img image.Image, args Args) (image.Image, error) {
+	width, height := args.Int("width"), args.Int("height")
+	fit := args.String("fit")
+	filter := resampleFilters[args.String("filter")]
+
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	if width == 0 {
+		width = max(1, srcWidth*height/srcHeight)
+		fit = "fill"
+	} else if height == 0 {
+		height = max(1, srcHeight*width/srcWidth)
+		fit = "fill"
+	}
+
+	scaleX := float64(width) / float64(srcWidth)
+	scaleY := float64(height) / float64(srcHeight)
+
+	switch fit {
+	case "contain":
+		scale := min(scaleX, scaleY)
+		return transform.Resize(img, max(1, int(float64(srcWidth)*scale+0.5)), max(1, int(float64(srcHeight)*scale+0.5)), filter), nil
+	case "cover":
+		scale := max(scaleX, scaleY)
+		scaledWidth := max(width, int(float64(srcWidth)*scale+0.5))
+		scaledHeight := max(height, int(float64(srcHeight)*scale+0.5))
+		scaled := transform.Resize(img, scaledWidth, scaledHeight, filter)
+		return cropRect(scaled, gravityRect(scaled.Bounds(), width, height, "center")), nil
+	}
+	return transform.Resize(img, width, height, filter), nil
+}
+
+func crop(img image.Image, args Args) (image.Image, error) {
+	width, height := args.Int("width"), args.Int("height")
+	bounds := img.Bounds()
+
+	var rect image.Rectangle
+	if gravity := args.String("position"); gravity != "" {
+		rect = gravityRect(bounds, width, height, gravity)
+	} else {
+		x, y := args.Int("position"), args.Int("y")
+		rect = image.Rect(x, y, x+width, y+height).Add(bounds.Min)
+	}
+
+	rect = rect.Intersect(bounds)
+	if rect.Empty() {
+		return nil, errors.New("crop rectangle is outside of the image")
+	}
+	return cropRect(img, rect), nil
+}
+
+func rotate(img image.Image, args Args) (image.Image, error) {
+	background := args.Color("background")
+
+	rotated := transform.Rotate(img, args.Float("degrees"), &transform.RotationOptions{ResizeBounds: true})
+	if background.A == 0 {
+		return rotated, nil
+	}
+
+	dst := image.NewRGBA(rotated.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), rotated, rotated.Bounds().Min, draw.Over)
+	return dst, nil
+}
+
+func init() {
+	Register(New(Spec{
+		Name:        "resize",
+		Description: "Resizes the image. Either width or height may be 0 to keep the aspect ratio.",
+		Params: []Param{
+			width,
+			height,
+			{Name: "fit", Type: ParamEnum, Choices: []string{"contain", "cover", "fill"}, Default: "contain"},
+			{Name: "filter", Type: ParamEnum, Choices: []string{"nearest", "box", "linear", "gaussian", "mitchell", "catmullrom", "lanczos"}, Default: "lanczos"},
+		},
+	}, resize, func(args Args) error {
+		if args.Int("width") == 0 && args.Int("height") == 0 {
+			return errors.New("width and height can't both be 0")
+		}
+		return nil
+	}))
+
+	Register(New(Spec{
+		Name:        "crop",
+		Description: "Crops the image to width x height, placed by gravity or at the x, y offset.",
+		Params: []Param{
+			width,
+			height,
+			Param{Name: "position", Type: ParamPosition, Description: "gravity or x offset", Choices: Gravities, Default: "center"}.Range(0, float64(MaxImageWidth)),
+			Param{Name: "y", Type: ParamInt, Description: "y offset, required with an x offset", Optional: true}.Range(0, float64(MaxImageHeight)),
+		},
+	}, crop, func(args Args) error {
+		if args.Int("width") == 0 || args.Int("height") == 0 {
+			return errors.New("crop width and height must be greater than 0")
+		}
+		if _, isOffset := args["position"].(int); isOffset != args.Has("y") {
+			return errors.New("crop takes either a gravity or both x and y")
+		}
+		return nil
+	}))
+
+	Register(New(Spec{
+		Name:        "rotate",
+		Description: "Rotates the image clockwise, growing the bounds to fit and filling the corners with the background.",
+		Params: []Param{
+			Param{Name: "degrees", Type: ParamFloat}.Range(-360, 360),
+			{Name: "background", Type: ParamColor, Default: "transparent"},
+		},
+	}, rotate, nil))
+
+	Register(New(Spec{Name: "flipH", Description: "Flips the image horizontally."}, func(img image.Image, _ Args) (image.Image, error) {
+		return transform.FlipH(img), nil
+	}, nil))
+
+	Register(New(Spec{Name: "flipV", Description: "Flips the image vertically."}, func(img image.Image, _ Args) (image.Image, error) {
+		return transform.FlipV(img), nil
+	}, nil))
+}
@@ -0,0 +1,124 @@
+package transforms
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradient returns an image whose pixels hold their own coordinates.
+func gradient(width, height int) *image.RGBA {
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 0xff})
+		}
+	}
+	return img
+}
+
+func apply(t *testing.T, img image.Image, name string, params ...string) image.Image {
+
+	t.Helper()
+	args, err := Parse(name, params)
+	if err != nil {
+		t.Fatalf("%s %q: %v", name, params, err)
+	}
+	transformer, _ := Lookup(name)
+	out, err := transformer.Apply(img, args)
+	if err != nil {
+		t.Fatalf("%s %q: %v", name, params, err)
+	}
+	return out
+}
+
+func TestResize(t *testing.T) {
+
+	tests := []struct {
+		params        []string
+		width, height int
+	}{
+		{[]string{"50", "50"}, 50, 25},
+		{[]string{"50", "50", "contain"}, 50, 25},
+		{[]string{"50", "50", "cover"}, 50, 50},
+		{[]string{"50", "50", "fill"}, 50, 50},
+		{[]string{"400", "100", "contain", "nearest"}, 200, 100},
+		// a 0 side keeps the aspect ratio whatever the fit
+		{[]string{"0", "25"}, 50, 25},
+		{[]string{"20", "0", "cover"}, 20, 10},
+	}
+	for _, test := range tests {
+		bounds := apply(t, gradient(100, 50), "resize", test.params...).Bounds()
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("resize %q = %dx%d, want %dx%d", test.params, bounds.Dx(), bounds.Dy(), test.width, test.height)
+		}
+	}
+}
+
+func TestCrop(t *testing.T) {
+
+	tests := []struct {
+		params []string
+		origin image.Point
+	}{
+		{[]string{"10", "20"}, image.Pt(45, 15)},
+		{[]string{"10", "20", "center"}, image.Pt(45, 15)},
+		{[]string{"10", "20", "north"}, image.Pt(45, 0)},
+		{[]string{"10", "20", "south"}, image.Pt(45, 30)},
+		{[]string{"10", "20", "east"}, image.Pt(90, 15)},
+		{[]string{"10", "20", "west"}, image.Pt(0, 15)},
+		{[]string{"10", "20", "northeast"}, image.Pt(90, 0)},
+		{[]string{"10", "20", "northwest"}, image.Pt(0, 0)},
+		{[]string{"10", "20", "southeast"}, image.Pt(90, 30)},
+		{[]string{"10", "20", "southwest"}, image.Pt(0, 30)},
+		{[]string{"10", "20", "7", "3"}, image.Pt(7, 3)},
+	}
+	for _, test := range tests {
+		out := apply(t, gradient(100, 50), "crop", test.params...)
+		if out.Bounds() != image.Rect(0, 0, 10, 20) {
+			t.Errorf("crop %q bounds = %v, want 10x20 at the origin", test.params, out.Bounds())
+		}
+		r, g, _, _ := out.At(0, 0).RGBA()
+		if origin := image.Pt(int(r>>8), int(g>>8)); origin != test.origin {
+			t.Errorf("crop %q starts at %v, want %v", test.params, origin, test.origin)
+		}
+	}
+
+	// an offset crop is clipped to the image
+	out := apply(t, gradient(100, 50), "crop", "30", "30", "90", "40")
+	if out.Bounds() != image.Rect(0, 0, 10, 10) {
+		t.Errorf("bounds = %v, want the 10x10 corner", out.Bounds())
+	}
+
+	args, _ := Parse("crop", []string{"10", "10", "200", "0"})
+	transformer, _ := Lookup("crop")
+	if _, err := transformer.Apply(gradient(100, 50), args); err == nil {
+		t.Error("want an error for a crop outside of the image")
+	}
+}
+
+func TestRotate(t *testing.T) {
+
+	// the bounds grow to fit, the corners are transparent or the background
+	transparent := apply(t, gradient(40, 20), "rotate", "45")
+	if bounds := transparent.Bounds(); bounds.Dx() <= 40 || bounds.Dy() <= 20 {
+		t.Errorf("bounds = %v, want them grown", bounds)
+	}
+	if _, _, _, a := transparent.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("corner alpha = %d, want transparent", a)
+	}
+
+	filled := apply(t, gradient(40, 20), "rotate", "45", "#ff0000")
+	if corner := color.RGBAModel.Convert(filled.At(0, 0)); corner != (color.RGBA{R: 0xff, A: 0xff}) {
+		t.Errorf("corner = %v, want the red background", corner)
+	}
+	if filled.Bounds() != transparent.Bounds() {
+		t.Errorf("bounds = %v, want %v", filled.Bounds(), transparent.Bounds())
+	}
+
+	quarter := apply(t, gradient(40, 20), "rotate", "90").Bounds()
+	if quarter.Dx() < 20 || quarter.Dx() > 21 || quarter.Dy() < 40 || quarter.Dy() > 41 {
+		t.Errorf("bounds = %v, want about 20x40", quarter)
+	}
+}
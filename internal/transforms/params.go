@@ -0,0 +1,144 @@
+package transforms
+
+import (
+	"fmt"
+	"image/color"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type ParamType string
+
+const (
+	ParamInt   ParamType = "int"
+	ParamFloat ParamType = "float"
+	ParamEnum  ParamType = "enum"
+	// ParamColor accepts "transparent" or a hex color of the form #rrggbb or #rrggbbaa.
+	ParamColor ParamType = "color"
+	// ParamPosition accepts either an int or one of Choices.
+	ParamPosition ParamType = "position"
+)
+
+// Param is a positional parameter of an operation. A param is optional when
+// it is marked so or has a default, all of them must come after the required ones.
+type Param struct {
+	Name        string    `json:"name"`
+	Type        ParamType `json:"type"`
+	Description string    `json:"description,omitempty"`
+	Min         *float64  `json:"min,omitempty"`
+	Max         *float64  `json:"max,omitempty"`
+	Choices     []string  `json:"choices,omitempty"`
+	Default     string    `json:"default,omitempty"`
+	Optional    bool      `json:"optional,omitempty"`
+}
+
+// Range returns a copy of p bounded to [min, max].
+func (p Param) Range(min, max float64) Param {
+	p.Min, p.Max = &min, &max
+	return p
+}
+
+type ParamError struct {
+	Param string
+	Value string
+	Err   error
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %v", e.Param, e.Value, e.Err)
+}
+
+func (e *ParamError) Unwrap() error {
+	return e.Err
+}
+
+func (p Param) checkRange(value float64) error {
+	if p.Min == nil || p.Max == nil {
+		return nil
+	}
+	if value < *p.Min || value > *p.Max {
+		return fmt.Errorf("out of range [%v, %v]", *p.Min, *p.Max)
+	}
+	return nil
+}
+
+func (p Param) parse(value string) (any, error) {
+	switch p.Type {
+	case ParamInt:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("not an integer")
+		}
+		return v, p.checkRange(float64(v))
+	case ParamFloat:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("not a number")
+		}
+		return v, p.checkRange(v)
+	case ParamEnum:
+		if !slices.Contains(p.Choices, value) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(p.Choices, ", "))
+		}
+		return value, nil
+	case ParamColor:
+		return parseColor(value)
+	case ParamPosition:
+		if slices.Contains(p.Choices, value) {
+			return value, nil
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer or one of %s", strings.Join(p.Choices, ", "))
+		}
+		return v, p.checkRange(float64(v))
+	}
+	return nil, fmt.Errorf("unknown parameter type %s", p.Type)
+}
+
+func parseColor(value string) (color.RGBA, error) {
+	if value == "transparent" {
+		return color.RGBA{}, nil
+	}
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("not a color")
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	rgba, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("not a color")
+	}
+	return color.RGBA{R: uint8(rgba >> 24), G: uint8(rgba >> 16), B: uint8(rgba >> 8), A: uint8(rgba)}, nil
+}
+
+// Args holds the parsed parameters of an operation keyed by param name.
+type Args map[string]any
+
+func (a Args) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+func (a Args) Int(name string) int {
+	v, _ := a[name].(int)
+	return v
+}
+
+func (a Args) Float(name string) float64 {
+	v, _ := a[name].(float64)
+	return v
+}
+
+func (a Args) String(name string) string {
+	v, _ := a[name].(string)
+	return v
+}
+
+func (a Args) Color(name string) color.RGBA {
+	v, _ := a[name].(color.RGBA)
+	return v
+}
@@ -0,0 +1,88 @@
+package transforms
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"runtime"
+	"sync"
+)
+
+// PointFunc maps a single pixel.
+type PointFunc func(c color.RGBA) color.RGBA
+
+// Pointwise is implemented by operations whose output pixel only depends on
+// the same input pixel. They can run in place on any stripe of an image, and
+// consecutive ones can be fused into a single pass.
+type Pointwise interface {
+	Point(args Args) PointFunc
+}
+
+type pointwiseTransformer struct {
+	transformer
+	point func(args Args) PointFunc
+}
+
+// NewPointwise builds a Transformer from a function returning the pixel
+// mapping of the operation. check may be nil.
+func NewPointwise(spec Spec, point func(args Args) PointFunc, check CheckFunc) Transformer {
+	t := &pointwiseTransformer{point: point}
+	t.transformer = transformer{spec: spec, check: check}
+	t.apply = func(img image.Image, args Args) (image.Image, error) {
+		// Apply must leave img untouched, the executor calls Point to work in place
+		dst := image.NewRGBA(img.Bounds())
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+		ApplyPoints(dst, t.Point(args))
+		return dst, nil
+	}
+	if t.spec.Stage == "" {
+		t.spec.Stage = StageImage
+	}
+	return t
+}
+
+func (t *pointwiseTransformer) Point(args Args) PointFunc {
+	return t.point(args)
+}
+
+// StripeRows is the number of rows processed at once by ApplyPoints.
+const StripeRows int = 64
+
+// ApplyPoints runs the pixel mappings, in order, on img in place. The rows are
+// split into stripes shared by a worker per CPU so that every pixel is read
+// and written once whatever the number of mappings.
+func ApplyPoints(img *image.RGBA, points ...PointFunc) {
+
+	if len(points) == 0 || img.Bounds().Empty() {
+		return
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	stripes := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range stripes {
+				for y := start; y < min(start+StripeRows, height); y++ {
+					row := img.Pix[y*img.Stride : y*img.Stride+width*4]
+					for x := 0; x < len(row); x += 4 {
+						c := color.RGBA{R: row[x], G: row[x+1], B: row[x+2], A: row[x+3]}
+						for _, point := range points {
+							c = point(c)
+						}
+						row[x], row[x+1], row[x+2], row[x+3] = c.R, c.G, c.B, c.A
+					}
+				}
+			}
+		}()
+	}
+
+	for start := 0; start < height; start += StripeRows {
+		stripes <- start
+	}
+	close(stripes)
+	wg.Wait()
+}
@@ -0,0 +1,188 @@
+// Package transforms holds the registry of operations that can appear in the
+// Transforms list of a job. Each operation declares its parameter schema so the
+// same registry can validate a pipeline, execute it and describe it to clients.
+package transforms
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+)
+
+const MaxImageWidth int = 7680
+const MaxImageHeight int = 4320
+
+// Stage tells when an operation runs. Animation operations select and time
+// the frames of an animated image, image operations modify each decoded frame
+// and encode operations only configure the encoder.
+type Stage string
+
+const (
+	StageAnimation Stage = "animation"
+	StageImage     Stage = "image"
+	StageEncode    Stage = "encode"
+)
+
+// Spec describes an operation and its positional parameters.
+type Spec struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Stage       Stage   `json:"stage"`
+	Params      []Param `json:"params"`
+}
+
+type Transformer interface {
+	Spec() Spec
+	Apply(img image.Image, args Args) (image.Image, error)
+}
+
+// Checker is implemented by transformers whose parameters depend on each
+// other and can't be validated one at a time.
+type Checker interface {
+	Check(args Args) error
+}
+
+var ErrUnknownTransform = errors.New("unknown transform")
+
+type ApplyFunc func(img image.Image, args Args) (image.Image, error)
+
+type CheckFunc func(args Args) error
+
+type transformer struct {
+	spec  Spec
+	apply ApplyFunc
+	check CheckFunc
+}
+
+// New builds a Transformer from a spec and the function that executes it.
+// check may be nil. Animation and encode stage operations don't need an apply function.
+func New(spec Spec, apply ApplyFunc, check CheckFunc) Transformer {
+	if spec.Stage == "" {
+		spec.Stage = StageImage
+	}
+	return &transformer{spec: spec, apply: apply, check: check}
+}
+
+func (t *transformer) Spec() Spec {
+	return t.spec
+}
+
+func (t *transformer) Apply(img image.Image, args Args) (image.Image, error) {
+	if t.apply == nil {
+		return img, nil
+	}
+	return t.apply(img, args)
+}
+
+func (t *transformer) Check(args Args) error {
+	if t.check == nil {
+		return nil
+	}
+	return t.check(args)
+}
+
+type Registry struct {
+	transformers map[string]Transformer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{transformers: map[string]Transformer{}}
+}
+
+// Register adds t to the registry, registering the same name twice is a programming error.
+func (r *Registry) Register(t Transformer) {
+	name := t.Spec().Name
+	if _, ok := r.transformers[name]; ok {
+		panic(fmt.Sprintf("transform %s registered twice", name))
+	}
+	r.transformers[name] = t
+}
+
+func (r *Registry) Lookup(name string) (Transformer, bool) {
+	t, ok := r.transformers[name]
+	return t, ok
+}
+
+// Specs returns the specs of every registered operation sorted by name.
+func (r *Registry) Specs() []Spec {
+	specs := make([]Spec, 0, len(r.transformers))
+	for _, t := range r.transformers {
+		specs = append(specs, t.Spec())
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+// Parse validates params against the schema of the named operation and
+// returns the typed arguments, with defaults filled in.
+func (r *Registry) Parse(name string, params []string) (Args, error) {
+	t, ok := r.transformers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransform, name)
+	}
+	spec := t.Spec()
+
+	required := 0
+	for _, param := range spec.Params {
+		if !param.Optional && param.Default == "" {
+			required++
+		}
+	}
+	if len(params) < required || len(params) > len(spec.Params) {
+		if required == len(spec.Params) {
+			return nil, fmt.Errorf("expected %d parameters, got %d", required, len(params))
+		}
+		return nil, fmt.Errorf("expected %d to %d parameters, got %d", required, len(spec.Params), len(params))
+	}
+
+	args := Args{}
+	for i, param := range spec.Params {
+		// an empty param is omitted, it takes its default
+		value := param.Default
+		if i < len(params) && params[i] != "" {
+			value = params[i]
+		}
+		if value == "" {
+			if i < required {
+				return nil, &ParamError{Param: param.Name, Value: value, Err: errors.New("required")}
+			}
+			continue
+		}
+		parsed, err := param.parse(value)
+		if err != nil {
+			return nil, &ParamError{Param: param.Name, Value: value, Err: err}
+		}
+		args[param.Name] = parsed
+	}
+
+	if checker, ok := t.(Checker); ok {
+		if err := checker.Check(args); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+var defaultRegistry = NewRegistry()
+
+// Default returns the registry holding the built-in operations.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+func Register(t Transformer) {
+	defaultRegistry.Register(t)
+}
+
+func Lookup(name string) (Transformer, bool) {
+	return defaultRegistry.Lookup(name)
+}
+
+func Parse(name string, params []string) (Args, error) {
+	return defaultRegistry.Parse(name, params)
+}
+
+func Specs() []Spec {
+	return defaultRegistry.Specs()
+}
@@ -0,0 +1,122 @@
+package transforms
+
+import (
+	"errors"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		params []string
+		want   Args
+	}{
+		{"resize", []string{"300", "200"}, Args{"width": 300, "height": 200, "fit": "contain", "filter": "lanczos"}},
+		{"resize", []string{"300", "0", "cover", "nearest"}, Args{"width": 300, "height": 0, "fit": "cover", "filter": "nearest"}},
+		// an empty param takes its default
+		{"resize", []string{"300", "200", "", "box"}, Args{"width": 300, "height": 200, "fit": "contain", "filter": "box"}},
+		{"crop", []string{"10", "20"}, Args{"width": 10, "height": 20, "position": "center"}},
+		{"crop", []string{"10", "20", "southwest"}, Args{"width": 10, "height": 20, "position": "southwest"}},
+		{"crop", []string{"10", "20", "5", "6"}, Args{"width": 10, "height": 20, "position": 5, "y": 6}},
+		{"crop", []string{"10", "20", "", ""}, Args{"width": 10, "height": 20, "position": "center"}},
+		{"rotate", []string{"90"}, Args{"degrees": 90.0, "background": color.RGBA{}}},
+		{"rotate", []string{"-45.5", "#ff8000"}, Args{"degrees": -45.5, "background": color.RGBA{R: 0xff, G: 0x80, A: 0xff}}},
+		{"rotate", []string{"10", "#00000080"}, Args{"degrees": 10.0, "background": color.RGBA{A: 0x80}}},
+		{"palette", []string{"16"}, Args{"size": 16}},
+		{"grayscale", nil, Args{}},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.name, test.params)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.name, test.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q = %v, want %v", test.name, test.params, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		params []string
+		param  string
+	}{
+		{"resize", []string{"a", "200"}, "width"},
+		{"resize", []string{"7681", "200"}, "width"},
+		{"resize", []string{"-1", "200"}, "width"},
+		{"resize", []string{"300", "4321"}, "height"},
+		{"resize", []string{"300", "200", "stretch"}, "fit"},
+		{"resize", []string{"", "200"}, "width"},
+		{"crop", []string{"10", "20", "middle"}, "position"},
+		{"crop", []string{"10", "20", "7681", "0"}, "position"},
+		{"rotate", []string{"361"}, "degrees"},
+		{"rotate", []string{"x"}, "degrees"},
+		{"rotate", []string{"90", "red"}, "background"},
+		{"rotate", []string{"90", "#ff00"}, "background"},
+		{"rotate", []string{"90", "#gggggg"}, "background"},
+		{"quality", []string{"0"}, "quality"},
+		{"palette", []string{"16", "octree"}, "quantizer"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.name, test.params)
+		var paramError *ParamError
+		if !errors.As(err, &paramError) || paramError.Param != test.param {
+			t.Errorf("%s %q: err = %v, want an invalid %s", test.name, test.params, err, test.param)
+		}
+	}
+}
+
+func TestParseChecks(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		params []string
+	}{
+		{"blur", nil},
+		{"resize", []string{"300"}},
+		{"resize", []string{"300", "200", "cover", "lanczos", "extra"}},
+		{"resize", []string{"0", "0"}},
+		{"crop", []string{"0", "20"}},
+		// an x offset needs a y offset, a gravity doesn't take one
+		{"crop", []string{"10", "20", "5"}},
+		{"crop", []string{"10", "20", "north", "5"}},
+		{"grayscale", []string{"1"}},
+	}
+	for _, test := range tests {
+		if args, err := Parse(test.name, test.params); err == nil {
+			t.Errorf("%s %q = %v, want an error", test.name, test.params, args)
+		}
+	}
+
+	if _, err := Parse("blur", nil); !errors.Is(err, ErrUnknownTransform) {
+		t.Errorf("err = %v, want ErrUnknownTransform", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+
+	registry := NewRegistry()
+	registry.Register(New(Spec{Name: "b"}, nil, nil))
+	registry.Register(New(Spec{Name: "a", Stage: StageEncode}, nil, nil))
+
+	specs := registry.Specs()
+	if len(specs) != 2 || specs[0].Name != "a" || specs[1].Name != "b" {
+		t.Fatalf("specs = %+v, want a and b", specs)
+	}
+	if specs[1].Stage != StageImage {
+		t.Errorf("stage = %s, want image by default", specs[1].Stage)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a twice didn't panic")
+		}
+	}()
+	registry.Register(New(Spec{Name: "a"}, nil, nil))
+}
@@ -0,0 +1,80 @@
+package transforms
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// Step is one entry of a Transforms list. The Transform structs of the lambdas
+// share its fields so they can be converted with Step(transform).
+type Step struct {
+	Name   string
+	Params []string
+}
+
+// ValidationError describes why a step of a pipeline, or a field of the
+// request, was rejected.
+type ValidationError struct {
+	Step    *int   `json:"step,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// Validate parses every step of the pipeline and returns one error per invalid step.
+func (r *Registry) Validate(steps []Step) []ValidationError {
+	var errs []ValidationError
+	for i, step := range steps {
+		if _, err := r.Parse(step.Name, step.Params); err != nil {
+			index := i
+			validationError := ValidationError{Step: &index, Name: step.Name, Message: err.Error()}
+			var paramError *ParamError
+			if errors.As(err, &paramError) {
+				validationError.Param = paramError.Param
+			}
+			errs = append(errs, validationError)
+		}
+	}
+	return errs
+}
+
+// Cost estimates the work of a pipeline as the number of image stage steps
+// times the number of pixels of the source image.
+func (r *Registry) Cost(steps []Step, pixels int) int {
+	cost := 0
+	for _, step := range steps {
+		if t, ok := r.transformers[step.Name]; ok && t.Spec().Stage == StageImage {
+			cost += pixels
+		}
+	}
+	return cost
+}
+
+func Validate(steps []Step) []ValidationError {
+	return defaultRegistry.Validate(steps)
+}
+
+func Cost(steps []Step, pixels int) int {
+	return defaultRegistry.Cost(steps, pixels)
+}
+
+// DefaultPipelineCostBudget is the budget, in megapixel steps, used when
+// PIPELINE_COST_BUDGET isn't set. It allows 12 steps on the largest image.
+const DefaultPipelineCostBudget int = 400
+
+// PipelineCostBudget returns the maximum Cost of a pipeline in pixels, shared
+// by the lambdas validating pipelines so an accepted upload can be transformed.
+func PipelineCostBudget() int {
+
+	budget, err := strconv.Atoi(os.Getenv("PIPELINE_COST_BUDGET"))
+	if err != nil || budget <= 0 {
+		budget = DefaultPipelineCostBudget
+	}
+	return budget * 1000 * 1000
+}
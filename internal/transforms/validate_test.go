@@ -0,0 +1,72 @@
+package transforms
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+
+	errs := Validate([]Step{
+		{Name: "resize", Params: []string{"a", "200"}},
+		{Name: "grayscale"},
+		{Name: "blur"},
+		{Name: "resize", Params: []string{"0", "0"}},
+	})
+	if len(errs) != 3 {
+		t.Fatalf("errors = %+v, want 3", errs)
+	}
+
+	want := []struct {
+		step        int
+		name, param string
+	}{
+		{0, "resize", "width"},
+		{2, "blur", ""},
+		{3, "resize", ""},
+	}
+	for i, err := range errs {
+		if err.Step == nil || *err.Step != want[i].step || err.Name != want[i].name || err.Param != want[i].param || err.Message == "" {
+			t.Errorf("error %d = %+v, want step %d %s %q", i, err, want[i].step, want[i].name, want[i].param)
+		}
+	}
+
+	if errs := Validate([]Step{{Name: "grayscale"}, {Name: "quality", Params: []string{"80"}}}); errs != nil {
+		t.Errorf("errors = %+v, want none", errs)
+	}
+}
+
+func TestCost(t *testing.T) {
+
+	tests := []struct {
+		steps []Step
+		want  int
+	}{
+		{nil, 0},
+		{[]Step{{Name: "grayscale"}, {Name: "resize", Params: []string{"10", "10"}}}, 2000},
+		// animation and encode steps are free, unknown ones are left to Validate
+		{[]Step{{Name: "fps", Params: []string{"10"}}, {Name: "quality", Params: []string{"80"}}, {Name: "blur"}}, 0},
+		{[]Step{{Name: "sepia"}, {Name: "format", Params: []string{"png"}}}, 1000},
+	}
+	for _, test := range tests {
+		if got := Cost(test.steps, 1000); got != test.want {
+			t.Errorf("Cost(%+v) = %d, want %d", test.steps, got, test.want)
+		}
+	}
+}
+
+func TestPipelineCostBudget(t *testing.T) {
+
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", DefaultPipelineCostBudget * 1000 * 1000},
+		{"50", 50 * 1000 * 1000},
+		{"-1", DefaultPipelineCostBudget * 1000 * 1000},
+		{"lots", DefaultPipelineCostBudget * 1000 * 1000},
+	}
+	for _, test := range tests {
+		t.Setenv("PIPELINE_COST_BUDGET", test.env)
+		if got := PipelineCostBudget(); got != test.want {
+			t.Errorf("PIPELINE_COST_BUDGET=%q: budget = %d, want %d", test.env, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package webhook notifies the callback url of a job once it is finalized.
+// The transform and dlq lambdas enqueue a Notification, the notifier lambda
+// posts the signed Event and retries it through its queue.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cdk_image_transform/internal/awsclient"
+	"cdk_image_transform/internal/failure"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Headers of a delivery. The signature is computed over
+// "<timestamp>.<body>" with the webhook secret of the tenant.
+const (
+	IdHeader        = "X-Webhook-Id"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// Version of the Event schema, bumped on incompatible changes. Version 2
+// reports the statuses of the job state machine, succeeded and failed.
+const Version = "2"
+
+// Types of Event.
+const (
+	JobSucceeded = "job.succeeded"
+	JobFailed    = "job.failed"
+)
+
+// MaxURLLength bounds the length of a callback url.
+const MaxURLLength = 2048
+
+var ErrPrivateAddress = errors.New("callback urls can't target private addresses")
+
+// Notification is the message of the notify queue. It carries the final
+// status of the job version it notifies, the job item may have been
+// reprocessed by the time it is delivered.
+type Notification struct {
+	ObjectName string           `json:"ObjectName"`
+	JobVersion int              `json:"JobVersion"`
+	Status     string           `json:"Status"`
+	OccurredAt string           `json:"OccurredAt"`
+	Failure    *failure.Failure `json:"Failure,omitempty"`
+}
+
+// Event is the body posted to the callback url.
+type Event struct {
+	Version    string           `json:"Version"`
+	Type       string           `json:"Type"`
+	JobId      string           `json:"JobId"`
+	Status     string           `json:"Status"`
+	OccurredAt string           `json:"OccurredAt"`
+	Failure    *failure.Failure `json:"Failure,omitempty"`
+}
+
+// Attempt is a delivery attempt, appended to the Deliveries of the job item.
+type Attempt struct {
+	Attempt    int    `dynamodbav:"Attempt" json:"Attempt"`
+	At         string `dynamodbav:"At" json:"At"`
+	StatusCode int    `dynamodbav:"StatusCode,omitempty" json:"StatusCode,omitempty"`
+	Error      string `dynamodbav:"Error,omitempty" json:"Error,omitempty"`
+	Delivered  bool   `dynamodbav:"Delivered" json:"Delivered"`
+}
+
+// Enqueue asks the notifier to deliver the webhook of a finalized job.
+func Enqueue(ctx context.Context, queue awsclient.Queue, queueURL string, notification Notification) error {
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %v", err)
+	}
+	_, err = queue.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue the notification of %s: %v", notification.ObjectName, err)
+	}
+	return nil
+}
+
+// Sign returns the signature of a body sent at timestamp, in unix seconds.
+func Sign(secret string, timestamp int64, body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func isPublic(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// ValidateURL checks a callback url is an absolute https url without
+// credentials. Hosts resolving to private addresses are refused on delivery.
+func ValidateURL(raw string) error {
+
+	if len(raw) > MaxURLLength {
+		return fmt.Errorf("longer than %d characters", MaxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return errors.New("must be an absolute https url")
+	}
+	if u.User != nil {
+		return errors.New("must not contain credentials")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublic(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// NewClient returns a client that only connects to public addresses and
+// doesn't follow redirects.
+func NewClient(timeout time.Duration) *http.Client {
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Deliver posts the signed event to the callback url. A response other than
+// 2xx is an error, the status code is returned when there was a response.
+func Deliver(ctx context.Context, client *http.Client, callbackURL, secret, deliveryId string, event Event, now time.Time) (int, error) {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(IdHeader, deliveryId)
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("callback answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}